@@ -19,11 +19,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/cloud-provider/app"
 	"k8s.io/cloud-provider/app/config"
@@ -66,39 +69,99 @@ func main() {
 	command := app.NewCloudControllerManagerCommand(opts, cloudInitializer, controllerInitializers, names.CCMControllerAliases(), fss, wait.NeverStop)
 
 	command.Flags().BoolVar(&provider.OutSideCluster, "OutSideCluster", false, "Start Controller outside of cluster")
+	command.AddCommand(newUninstallCleanupCommand())
 
-	// Set static flags for which we know the values.
-	command.Flags().VisitAll(func(fl *pflag.Flag) {
-		var err error
-		switch fl.Name {
-		case "allow-untagged-cloud",
-			// Untagged clouds must be enabled explicitly as they were once marked
-			// deprecated. See
-			// https://github.com/kubernetes/cloud-provider/issues/12 for an ongoing
-			// discussion on whether that is to be changed or not.
-			"authentication-skip-lookup":
-			// Prevent reaching out to an authentication-related ConfigMap that
-			// we do not need, and thus do not intend to create RBAC permissions
-			// for. See also
-			// https://github.com/digitalocean/digitalocean-cloud-controller-manager/issues/217
-			// and https://github.com/kubernetes/cloud-provider/issues/29.
-			err = fl.Value.Set("true")
-		case "cloud-provider":
-			// Specify the name we register our own cloud provider implementation
-			// for.
-			err = fl.Value.Set(provider.ProviderName)
-		}
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to set flag %q: %s\n", fl.Name, err)
+	// Set static flags for which we know the values, once the command line is parsed so they can't be overridden.
+	runE := command.RunE
+	command.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := forceFlags(cmd.Flags()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
-	})
+		return runE(cmd, args)
+	}
 
 	if err := command.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
+// newUninstallCleanupCommand returns the uninstall-cleanup command, it removes the finalizer of the services implemented
+// by kube-vip-cloud-provider so they can still be deleted once it is uninstalled
+func newUninstallCleanupCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "uninstall-cleanup",
+		Short: "Remove the load balancer finalizer from the services implemented by kube-vip-cloud-provider",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			restConfig, err := provider.NewRestConfig()
+			if err != nil {
+				return err
+			}
+			kubeClient, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			}
+			labelKey := os.Getenv(provider.ImplementationLabelKeyEnvKey)
+			if len(labelKey) == 0 {
+				labelKey = provider.ImplementationLabelKey
+			}
+
+			cleaned, err := provider.UninstallCleanup(cmd.Context(), kubeClient, labelKey)
+			for _, svc := range cleaned {
+				fmt.Fprintf(cmd.OutOrStdout(), "removed finalizer from service %s\n", svc)
+			}
+			return err
+		},
+	}
+	command.Flags().BoolVar(&provider.OutSideCluster, "OutSideCluster", false, "Use the local kubeConfig instead of the in-cluster config")
+	return command
+}
+
+// forcedFlags returns the flags kube-vip-cloud-provider always sets, with their values
+func forcedFlags() map[string]string {
+	return map[string]string{
+		// Untagged clouds must be enabled explicitly as they were once marked
+		// deprecated. See
+		// https://github.com/kubernetes/cloud-provider/issues/12 for an ongoing
+		// discussion on whether that is to be changed or not.
+		"allow-untagged-cloud": "true",
+		// Prevent reaching out to an authentication-related ConfigMap that
+		// we do not need, and thus do not intend to create RBAC permissions
+		// for. See also
+		// https://github.com/digitalocean/digitalocean-cloud-controller-manager/issues/217
+		// and https://github.com/kubernetes/cloud-provider/issues/29.
+		"authentication-skip-lookup": "true",
+		// Specify the name we register our own cloud provider implementation
+		// for.
+		"cloud-provider": provider.ProviderName,
+	}
+}
+
+// forceFlags sets the forced flags, a different value given on the command line is overridden with a warning
+func forceFlags(flags *pflag.FlagSet) error {
+	forced := forcedFlags()
+	names := make([]string, 0, len(forced))
+	for name := range forced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fl := flags.Lookup(name)
+		if fl == nil {
+			continue
+		}
+		if fl.Changed && fl.Value.String() != forced[name] {
+			klog.Warningf("flag --%s=%s is overridden with %s, kube-vip-cloud-provider always sets it", name, fl.Value.String(), forced[name])
+		}
+		if err := fl.Value.Set(forced[name]); err != nil {
+			return fmt.Errorf("failed to set flag %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
 // only enable service controller
 func controllerInitializers() map[string]app.ControllerInitFuncConstructor {
 	return map[string]app.ControllerInitFuncConstructor{
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog"
+)
+
+func TestForceFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expectedLog string
+	}{
+		{
+			name: "flags not set by the user are forced silently",
+		},
+		{
+			name:        "flag set by the user is overridden with a warning",
+			args:        []string{"--cloud-provider=aws"},
+			expectedLog: "flag --cloud-provider=aws is overridden with " + provider.ProviderName,
+		},
+		{
+			name: "flag set by the user to the forced value isn't reported",
+			args: []string{"--allow-untagged-cloud=true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			cloudProvider := flags.String("cloud-provider", "", "")
+			allowUntagged := flags.Bool("allow-untagged-cloud", false, "")
+			skipLookup := flags.Bool("authentication-skip-lookup", false, "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			buf, restore := captureKlog(t)
+			err := forceFlags(flags)
+			restore()
+			if err != nil {
+				t.Fatalf("forceFlags() error: %v", err)
+			}
+
+			assert.Equal(t, provider.ProviderName, *cloudProvider)
+			assert.True(t, *allowUntagged)
+			assert.True(t, *skipLookup)
+			if len(tt.expectedLog) > 0 {
+				assert.Contains(t, buf.String(), tt.expectedLog)
+			} else {
+				assert.NotContains(t, buf.String(), "is overridden")
+			}
+		})
+	}
+}
+
+// captureKlog redirects klog to a buffer until the returned func is called
+func captureKlog(t *testing.T) (*bytes.Buffer, func()) {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	for name, value := range map[string]string{"logtostderr": "false", "alsologtostderr": "false"} {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatalf("failed to set klog flag %s: %v", name, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	klog.SetOutput(buf)
+	return buf, func() {
+		klog.Flush()
+		_ = fs.Set("logtostderr", "true")
+	}
+}
@@ -0,0 +1,185 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// AddressEnvKey environment key for the address the admin endpoint listens on, e.g. :8090.
+// The admin endpoint is disabled unless it's set.
+const AddressEnvKey = "KUBEVIP_ADMIN_ADDRESS"
+
+// TokenEnvKey environment key for the bearer token required by the endpoints changing the state of the provider, e.g.
+// POST /manager/reset, or revealing its pools, e.g. GET /config. Without it, they are only served to clients on the
+// loopback address.
+const TokenEnvKey = "KUBEVIP_ADMIN_TOKEN"
+
+// ConfigFunc returns the effective configuration of the provider
+type ConfigFunc func(ctx context.Context) (interface{}, error)
+
+// Status is the summary of the pools and of the services managed by the provider, rendered on the /status page
+type Status struct {
+	// ConfigMap is the <namespace>/<name> of the pool ConfigMap
+	ConfigMap string
+	// Services is the number of services managed by the provider
+	Services int
+	Pools    []PoolStatus
+}
+
+// PoolStatus is the capacity and the usage of a pool of the ConfigMap
+type PoolStatus struct {
+	// Key is the cidr, range or allowlist key of the pool
+	Key  string
+	Pool string
+	Size string
+	Used int
+	Free string
+	// Services are the services with an address of the pool, as <namespace>/<name> <IPs>
+	Services []string
+}
+
+// StatusFunc returns the status of the pools from the live state
+type StatusFunc func(ctx context.Context) (*Status, error)
+
+var statusTemplate = template.Must(template.New("status").Parse(`kube-vip-cloud-provider status
+
+configMap: {{.ConfigMap}}
+managed services: {{.Services}}
+{{range .Pools}}
+pool {{.Key}} [{{.Pool}}]: {{.Size}} addresses, {{.Used}} used, {{.Free}} free
+{{- range .Services}}
+  {{.}}
+{{- end}}
+{{end}}`))
+
+// NewHandler returns the handler serving the admin endpoint, the /config path is only served if effectiveConfig is set
+// and the /status path if status is set. POST /manager/reset, and the paths revealing the pools, e.g. from a Secret,
+// require the token if it is set, a loopback client otherwise.
+func NewHandler(token string, effectiveConfig ConfigFunc, status StatusFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /manager", authorized(token, listManager))
+	mux.HandleFunc("POST /manager/reset", authorized(token, resetManager))
+	mux.HandleFunc("GET /releases", listReleases)
+	if effectiveConfig != nil {
+		mux.HandleFunc("GET /config", authorized(token, getConfig(effectiveConfig)))
+	}
+	if status != nil {
+		mux.HandleFunc("GET /status", authorized(token, getStatus(status)))
+	}
+	// the metrics are also served in the OpenMetrics format, which carries the exemplars of kubevip_allocations_total
+	mux.Handle("GET /metrics", promhttp.HandlerFor(legacyregistry.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	return mux
+}
+
+// Start serves the admin endpoint on the address in the background
+func Start(address, token string, effectiveConfig ConfigFunc, status StatusFunc) {
+	if len(token) == 0 {
+		klog.Infof("%s isn't set, the admin endpoint only serves POST /manager/reset, /manager, /config and /status to the loopback address", TokenEnvKey)
+	}
+	server := &http.Server{
+		Addr:              address,
+		Handler:           NewHandler(token, effectiveConfig, status),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		klog.Infof("starting admin endpoint on [%s]", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("admin endpoint stopped: %v", err)
+		}
+	}()
+}
+
+// authorized only calls next for a request with the bearer token, or from a loopback client if the token isn't set
+func authorized(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(token) == 0 {
+			if !loopbackClient(r) {
+				http.Error(w, "only served on the loopback address unless "+TokenEnvKey+" is set", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loopbackClient returns true if the request comes from the loopback address
+func loopbackClient(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// listManager returns the pools cached by the address manager
+func listManager(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ipam.ListManager())
+}
+
+// resetManager clears the address manager so the next sync rebuilds it from the ConfigMap and live services
+func resetManager(w http.ResponseWriter, _ *http.Request) {
+	ipam.ResetManager()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listReleases returns the releases kept by the release registry, the most recent first
+func listReleases(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, ipam.RecentReleases())
+}
+
+// getConfig returns the effective configuration of the provider
+func getConfig(effectiveConfig ConfigFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := effectiveConfig(r.Context())
+		if err != nil {
+			klog.Errorf("unable to resolve the effective configuration: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, cfg)
+	}
+}
+
+// getStatus renders the status of the pools as text
+func getStatus(status StatusFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, err := status(r.Context())
+		if err != nil {
+			klog.Errorf("unable to resolve the status of the pools: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := statusTemplate.Execute(w, st); err != nil {
+			klog.Errorf("unable to write admin response: %v", err)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("unable to write admin response: %v", err)
+	}
+}
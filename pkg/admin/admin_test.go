@@ -0,0 +1,219 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func TestManagerReset(t *testing.T) {
+	server := httptest.NewServer(NewHandler("", nil, nil))
+	defer server.Close()
+	defer ipam.ResetManager()
+
+	inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ipam.FindAvailableHostFromCidr("admin", "192.168.0.200/30", inUse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.0.200", addr)
+
+	listManager := func() []ipam.ManagerEntry {
+		resp, err := http.Get(server.URL + "/manager")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var entries []ipam.ManagerEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	assert.Equal(t, []ipam.ManagerEntry{{
+		Namespace: "admin",
+		Cidr:      "192.168.0.200/30",
+		Pool:      []string{"192.168.0.200-192.168.0.203"},
+	}}, listManager())
+
+	// reset only accepts POST
+	resp, err := http.Get(server.URL + "/manager/reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/manager/reset", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, listManager())
+
+	// the pool is rebuilt on the next allocation
+	addr, err = ipam.FindAvailableHostFromCidr("admin", "192.168.0.200/30", inUse, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.0.200", addr)
+	assert.Len(t, listManager(), 1)
+}
+
+func TestManagerResetAuthorization(t *testing.T) {
+	defer ipam.ResetManager()
+
+	tests := []struct {
+		name          string
+		token         string
+		remoteAddr    string
+		authorization string
+		want          int
+	}{
+		{name: "loopback client without a token", remoteAddr: "127.0.0.1:40000", want: http.StatusNoContent},
+		{name: "IPv6 loopback client without a token", remoteAddr: "[::1]:40000", want: http.StatusNoContent},
+		{name: "remote client without a token", remoteAddr: "192.0.2.10:40000", want: http.StatusForbidden},
+		{name: "remote client with the token", token: "secret", remoteAddr: "192.0.2.10:40000", authorization: "Bearer secret", want: http.StatusNoContent},
+		{name: "wrong token", token: "secret", remoteAddr: "127.0.0.1:40000", authorization: "Bearer other", want: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", remoteAddr: "127.0.0.1:40000", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/manager/reset", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if len(tt.authorization) > 0 {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			NewHandler(tt.token, nil, nil).ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestReadAuthorization(t *testing.T) {
+	effectiveConfig := func(context.Context) (interface{}, error) { return map[string]string{}, nil }
+	status := func(context.Context) (*Status, error) { return &Status{}, nil }
+
+	tests := []struct {
+		path       string
+		token      string
+		remoteAddr string
+		want       int
+	}{
+		// the paths revealing the pools are authorized as POST /manager/reset
+		{path: "/manager", remoteAddr: "192.0.2.10:40000", want: http.StatusForbidden},
+		{path: "/config", remoteAddr: "192.0.2.10:40000", want: http.StatusForbidden},
+		{path: "/status", remoteAddr: "192.0.2.10:40000", want: http.StatusForbidden},
+		{path: "/config", remoteAddr: "127.0.0.1:40000", want: http.StatusOK},
+		{path: "/config", token: "secret", remoteAddr: "127.0.0.1:40000", want: http.StatusUnauthorized},
+		// the other read-only paths aren't
+		{path: "/releases", remoteAddr: "192.0.2.10:40000", want: http.StatusOK},
+		{path: "/metrics", token: "secret", remoteAddr: "192.0.2.10:40000", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+" from "+tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			NewHandler(tt.token, effectiveConfig, status).ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestReleases(t *testing.T) {
+	server := httptest.NewServer(NewHandler("", nil, nil))
+	defer server.Close()
+	defer ipam.ResetReleases()
+
+	released := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ipam.RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, "team-a", "", released)
+	ipam.RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, "team-b", "", released.Add(time.Minute))
+
+	resp, err := http.Get(server.URL + "/releases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var releases []ipam.ReleaseEntry
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []ipam.ReleaseEntry{
+		{Address: "10.0.0.2", Namespace: "team-b", ReleasedAt: released.Add(time.Minute)},
+		{Address: "10.0.0.1", Namespace: "team-a", ReleasedAt: released},
+	}, releases)
+}
+
+func TestMetricsExemplar(t *testing.T) {
+	server := httptest.NewServer(NewHandler("", nil, nil))
+	defer server.Close()
+
+	ipam.RecordAllocation("admin", "ingress", ipam.AllocationOutcomeAllocated, true)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(body), `kubevip_allocations_total{namespace="admin",outcome="allocated"} 1.0 # {service="admin/ingress"} 1.0`)
+}
+
+func TestStatus(t *testing.T) {
+	server := httptest.NewServer(NewHandler("", nil, func(context.Context) (*Status, error) {
+		return &Status{
+			ConfigMap: "kube-system/kubevip",
+			Services:  2,
+			Pools: []PoolStatus{
+				{Key: "cidr-global", Pool: "10.0.0.0/30", Size: "4", Used: 2, Free: "2", Services: []string{"test/a 10.0.0.1", "test/b 10.0.0.2"}},
+				{Key: "range-team", Pool: "10.1.0.1-10.1.0.10", Size: "10", Used: 0, Free: "10"},
+			},
+		}, nil
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(body), "managed services: 2")
+	assert.Contains(t, string(body), "pool cidr-global [10.0.0.0/30]: 4 addresses, 2 used, 2 free\n  test/a 10.0.0.1\n  test/b 10.0.0.2\n")
+	assert.Contains(t, string(body), "pool range-team [10.1.0.1-10.1.0.10]: 10 addresses, 0 used, 10 free\n")
+}
@@ -1,9 +1,20 @@
 package config
 
-import v1 "k8s.io/api/core/v1"
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
 
 const (
 	// ConfigMapSearchOrderKey is the key in the ConfigMap that defines whether IPs are allocated from the beginning or from the end.
+	// It can be overridden per namespace with search-order-<namespace>.
 	ConfigMapSearchOrderKey = "search-order"
 
 	// ConfigMapSkipStartIPsKey is the key in the ConfigMap that has the IPs to skip at the start and end of the CIDR
@@ -11,27 +22,176 @@ const (
 
 	// ConfigMapServiceInterfacePrefix is prefix of the key in the ConfigMap for specifying the service interface for that namespace
 	ConfigMapServiceInterfacePrefix = "interface"
+
+	// ConfigMapKeyDelimiterEnvKey environment key for setting the delimiter between the config name and the namespace in the ConfigMap keys
+	ConfigMapKeyDelimiterEnvKey = "KUBEVIP_CONFIG_KEY_DELIMITER"
+
+	// DefaultNamespaceKeyDelimiter is the default delimiter between the config name and the namespace, e.g. cidr-<namespace>
+	DefaultNamespaceKeyDelimiter = "-"
+
+	// GlobalKeywordEnvKey environment key for the keyword of the global keys, e.g. cidr-all with all, a namespace
+	// named global then gets its own keys, e.g. cidr-global
+	GlobalKeywordEnvKey = "KUBEVIP_GLOBAL_KEYWORD"
+
+	// DefaultGlobalKeyword is the default keyword of the global keys, e.g. cidr-global
+	DefaultGlobalKeyword = "global"
+
+	// ClusterNameEnvKey environment key for the name of the cluster, the keys scoped to the cluster, e.g. cidr-<cluster>-<namespace>
+	// or cidr-<cluster>-global, take precedence over the unscoped ones so one ConfigMap can serve several clusters
+	ClusterNameEnvKey = "KUBEVIP_CLUSTER_NAME"
 )
 
+// NamespaceKeyDelimiter is the delimiter between the config name and the namespace in the ConfigMap keys.
+// With a delimiter other than "-", a namespace named global no longer shadows the global config.
+var NamespaceKeyDelimiter = DefaultNamespaceKeyDelimiter
+
+var keyDelimiterRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// SetNamespaceKeyDelimiter validates and sets the delimiter used to build namespace keys
+func SetNamespaceKeyDelimiter(delimiter string) error {
+	if !keyDelimiterRegexp.MatchString(delimiter) {
+		return fmt.Errorf("invalid ConfigMap key delimiter '%s', only alphanumeric characters, '-', '_' or '.' are allowed", delimiter)
+	}
+	NamespaceKeyDelimiter = delimiter
+	return nil
+}
+
+// GlobalKeyword is the keyword of the global keys, e.g. cidr-<keyword>
+var GlobalKeyword = DefaultGlobalKeyword
+
+// SetGlobalKeyword validates and sets the keyword used to build global keys
+func SetGlobalKeyword(keyword string) error {
+	if !keyDelimiterRegexp.MatchString(keyword) {
+		return fmt.Errorf("invalid global keyword '%s', only alphanumeric characters, '-', '_' or '.' are allowed", keyword)
+	}
+	GlobalKeyword = keyword
+	return nil
+}
+
+// ClusterName is the name of the cluster the cluster-scoped keys are looked up for, empty if they aren't
+var ClusterName string
+
+// SetClusterName validates and sets the name of the cluster used to build cluster-scoped keys
+func SetClusterName(name string) error {
+	if !keyDelimiterRegexp.MatchString(name) {
+		return fmt.Errorf("invalid cluster name '%s', only alphanumeric characters, '-', '_' or '.' are allowed", name)
+	}
+	ClusterName = name
+	return nil
+}
+
+// ClusterScopedName returns the config name scoped to the cluster, e.g. cidr-<cluster>, the namespace
+// and global keys of the scoped name are built as for any config name
+func ClusterScopedName(name string) string {
+	return name + "-" + ClusterName
+}
+
+// NamespaceKey returns the ConfigMap key of the config name for the namespace
+func NamespaceKey(name, namespace string) string {
+	return name + NamespaceKeyDelimiter + namespace
+}
+
+// GlobalKey returns the ConfigMap key of the global config name
+func GlobalKey(name string) string {
+	return name + "-" + GlobalKeyword
+}
+
 // KubevipLBConfig defines the configuration for the kube-vip load balancer in the kubevip configMap
 // TODO: move all config into here so that it can be easily accessed and processed
 type KubevipLBConfig struct {
 	ReturnIPInDescOrder bool
 	SkipEndIPsInCIDR    bool
+	// UsableRange restricts the addresses allocated from a cidr pool to this range, the cidr still
+	// defines the network and broadcast addresses
+	UsableRange string
+	// ProbeBeforeAssign skips the addresses that already answer on the network
+	ProbeBeforeAssign bool
+	// ProbedAddresses are the probe results of the allocation, true if the address answers on the network, the
+	// addresses not probed yet are probed with the pools unlocked
+	ProbedAddresses map[netip.Addr]bool
+	// EmptyPoolDHCP assigns DHCP (0.0.0.0) to services in namespaces without a pool instead of failing
+	EmptyPoolDHCP bool
+	// PreferredIPs are tried in order, if free and in the pool, before scanning the pool
+	PreferredIPs []string
+	// ReclaimableIPs were released by a previous service of the same namespace/name, they are tried in order, if free
+	// and in the pool, before the preferred IPs and regardless of the release cooldowns
+	ReclaimableIPs []string
+	// KeepEndIPs allocates the IPv4 addresses ending in .0 and .255, which are otherwise skipped, e.g. for allowlist pools
+	KeepEndIPs bool
+	// Debug logs the allocation decision trace at the default verbosity, e.g. for a service under investigation
+	Debug bool
+	// DefaultIPFamilyPolicy applies to the services without spec.ipFamilyPolicy, single stack if nil
+	DefaultIPFamilyPolicy *v1.IPFamilyPolicy
+	// Namespace is the namespace of the service the addresses are allocated to
+	Namespace string
+	// ReleaseCooldown keeps the released addresses from being allocated again during that time
+	ReleaseCooldown time.Duration
+	// CrossNamespaceCooldown keeps the addresses released by a namespace from being allocated to another one during that time
+	CrossNamespaceCooldown time.Duration
+	// AllocationStride only allocates every AllocationStride-th address of the pool ranges, leaving the addresses in
+	// between free, e.g. for future contiguous pairs, every address if 0 or 1
+	AllocationStride int
+	// RejectReservedRanges skips the addresses of the well-known reserved ranges, e.g. multicast or loopback, which are
+	// otherwise allocated with a warning
+	RejectReservedRanges bool
+	// ExcludedIPs are ranges never allocated from the pool, on top of the end IPs skipped with SkipEndIPsInCIDR
+	ExcludedIPs string
+	// DowngradeRequireDualStack allocates a single IP to a RequireDualStack service that can't be dual-stack, because
+	// the cluster or its pool only has one IP family, instead of failing
+	DowngradeRequireDualStack bool
 }
 
-// GetKubevipLBConfig returns the KubevipLBConfig from the ConfigMap
-func GetKubevipLBConfig(cm *v1.ConfigMap) *KubevipLBConfig {
+// GetKubevipLBConfig returns the KubevipLBConfig from the ConfigMap for the given namespace,
+// namespace specific keys take precedence over the global ones
+func GetKubevipLBConfig(cm *v1.ConfigMap, namespace string) *KubevipLBConfig {
 	c := &KubevipLBConfig{}
-	if searchOrder, ok := cm.Data[ConfigMapSearchOrderKey]; ok {
+	if searchOrder, ok := getWithNamespace(cm, ConfigMapSearchOrderKey, namespace); ok {
 		if searchOrder == "desc" {
 			c.ReturnIPInDescOrder = true
 		}
 	}
-	if skip, ok := cm.Data[ConfigMapSkipEndIPsKey]; ok {
+	if skip, _, ok := Lookup(cm, ConfigMapSkipEndIPsKey, ConfigMapSkipEndIPsKey); ok {
 		if skip == "true" {
 			c.SkipEndIPsInCIDR = true
 		}
 	}
 	return c
 }
+
+// getWithNamespace looks up <key>-<namespace> first and falls back to <key>
+func getWithNamespace(cm *v1.ConfigMap, key, namespace string) (string, bool) {
+	if len(namespace) > 0 {
+		if value, _, ok := Lookup(cm, key, NamespaceKey(key, namespace)); ok {
+			return value, true
+		}
+	}
+	value, _, ok := Lookup(cm, key, key)
+	return value, ok
+}
+
+// Lookup returns the value of the key in the ConfigMap, the key being the config name followed by a suffix,
+// e.g. -global or -<namespace>. If the key doesn't exist, a key only differing by the case of the config name
+// (Search-Order-global for search-order-global) is used with a warning, the suffix must match exactly.
+func Lookup(cm *v1.ConfigMap, name, key string) (value, matchedKey string, ok bool) {
+	if value, ok := cm.Data[key]; ok {
+		return value, key, true
+	}
+	if !strings.HasPrefix(key, name) {
+		return "", key, false
+	}
+
+	suffix := key[len(name):]
+	var candidates []string
+	for k := range cm.Data {
+		if len(k) == len(key) && strings.HasSuffix(k, suffix) && strings.EqualFold(k[:len(name)], name) {
+			candidates = append(candidates, k)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", key, false
+	}
+
+	sort.Strings(candidates)
+	klog.Warningf("config key [%s] matched [%s] ignoring case, config names are lowercase, rename it to [%s]", candidates[0], key, key)
+	return cm.Data[candidates[0]], candidates[0], true
+}
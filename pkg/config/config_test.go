@@ -0,0 +1,214 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func TestGetKubevipLBConfig(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"search-order":         "desc",
+			"search-order-ascns":   "asc",
+			"search-order-descns":  "desc",
+			"skip-end-ips-in-cidr": "true",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		cm        *v1.ConfigMap
+		namespace string
+		want      *KubevipLBConfig
+	}{
+		{
+			name:      "namespace overrides global search order with asc",
+			cm:        cm,
+			namespace: "ascns",
+			want:      &KubevipLBConfig{ReturnIPInDescOrder: false, SkipEndIPsInCIDR: true},
+		},
+		{
+			name:      "namespace overrides global search order with desc",
+			cm:        cm,
+			namespace: "descns",
+			want:      &KubevipLBConfig{ReturnIPInDescOrder: true, SkipEndIPsInCIDR: true},
+		},
+		{
+			name:      "namespace without override falls back to global search order",
+			cm:        cm,
+			namespace: "other",
+			want:      &KubevipLBConfig{ReturnIPInDescOrder: true, SkipEndIPsInCIDR: true},
+		},
+		{
+			name: "namespace override without global search order",
+			cm: &v1.ConfigMap{
+				Data: map[string]string{
+					"search-order-descns": "desc",
+				},
+			},
+			namespace: "descns",
+			want:      &KubevipLBConfig{ReturnIPInDescOrder: true},
+		},
+		{
+			name: "mixed case search order",
+			cm: &v1.ConfigMap{
+				Data: map[string]string{
+					"Search-Order": "desc",
+				},
+			},
+			namespace: "other",
+			want:      &KubevipLBConfig{ReturnIPInDescOrder: true},
+		},
+		{
+			name:      "empty configmap",
+			cm:        &v1.ConfigMap{},
+			namespace: "descns",
+			want:      &KubevipLBConfig{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualValues(t, tt.want, GetKubevipLBConfig(tt.cm, tt.namespace))
+		})
+	}
+}
+
+func TestSetNamespaceKeyDelimiter(t *testing.T) {
+	defer func() { NamespaceKeyDelimiter = DefaultNamespaceKeyDelimiter }()
+
+	for _, delimiter := range []string{".", "_", ".ns."} {
+		assert.NoError(t, SetNamespaceKeyDelimiter(delimiter))
+		assert.Equal(t, "cidr"+delimiter+"global", NamespaceKey("cidr", "global"))
+		assert.Equal(t, "cidr-global", GlobalKey("cidr"))
+	}
+
+	for _, delimiter := range []string{"/", ":", " "} {
+		assert.Error(t, SetNamespaceKeyDelimiter(delimiter))
+	}
+}
+
+func TestSetClusterName(t *testing.T) {
+	defer func() { ClusterName = "" }()
+
+	assert.NoError(t, SetClusterName("east"))
+	assert.Equal(t, "cidr-east-system", NamespaceKey(ClusterScopedName("cidr"), "system"))
+	assert.Equal(t, "cidr-east-global", GlobalKey(ClusterScopedName("cidr")))
+
+	for _, name := range []string{"east/1", "east west", ""} {
+		assert.Error(t, SetClusterName(name))
+	}
+}
+
+func TestSetGlobalKeyword(t *testing.T) {
+	defer func() { GlobalKeyword = DefaultGlobalKeyword }()
+
+	assert.NoError(t, SetGlobalKeyword("_all"))
+	assert.Equal(t, "cidr-_all", GlobalKey("cidr"))
+	assert.Equal(t, "cidr-global", NamespaceKey("cidr", "global"))
+
+	for _, keyword := range []string{"all/1", "all ns", ""} {
+		assert.Error(t, SetGlobalKeyword(keyword))
+	}
+}
+
+func TestLookupGlobalKey(t *testing.T) {
+	defer func() { GlobalKeyword = DefaultGlobalKeyword }()
+	cm := &v1.ConfigMap{Data: map[string]string{"cidr-global": "10.0.0.0/24", "range-_all": "10.0.2.1-10.0.2.10"}}
+
+	value, key, ok := Lookup(cm, "cidr", GlobalKey("cidr"))
+	assert.True(t, ok)
+	assert.Equal(t, "cidr-global", key)
+	assert.Equal(t, "10.0.0.0/24", value)
+
+	assert.NoError(t, SetGlobalKeyword("_all"))
+	// cidr-global is then the key of the namespace global only
+	_, key, ok = Lookup(cm, "cidr", GlobalKey("cidr"))
+	assert.False(t, ok)
+	assert.Equal(t, "cidr-_all", key)
+	value, key, ok = Lookup(cm, "range", GlobalKey("range"))
+	assert.True(t, ok)
+	assert.Equal(t, "range-_all", key)
+	assert.Equal(t, "10.0.2.1-10.0.2.10", value)
+}
+
+func TestLookup(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"search-order-global": "asc",
+			"Search-Order-descns": "desc",
+			"ALLOW-SHARE-global":  "true",
+			"cidr-Prod":           "10.0.0.0/24",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		configName  string
+		key         string
+		wantValue   string
+		wantKey     string
+		wantOk      bool
+		wantWarning bool
+	}{
+		{
+			name:       "exact key",
+			configName: "search-order",
+			key:        "search-order-global",
+			wantValue:  "asc",
+			wantKey:    "search-order-global",
+			wantOk:     true,
+		},
+		{
+			name:        "mixed case config name",
+			configName:  "search-order",
+			key:         "search-order-descns",
+			wantValue:   "desc",
+			wantKey:     "Search-Order-descns",
+			wantOk:      true,
+			wantWarning: true,
+		},
+		{
+			name:        "uppercase config name",
+			configName:  "allow-share",
+			key:         "allow-share-global",
+			wantValue:   "true",
+			wantKey:     "ALLOW-SHARE-global",
+			wantOk:      true,
+			wantWarning: true,
+		},
+		{
+			name:       "namespace is case sensitive",
+			configName: "cidr",
+			key:        "cidr-prod",
+			wantKey:    "cidr-prod",
+		},
+		{
+			name:       "missing key",
+			configName: "range",
+			key:        "range-global",
+			wantKey:    "range-global",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, restore := tu.CaptureKlog(t, "0")
+			value, key, ok := Lookup(cm, tt.configName, tt.key)
+			restore()
+
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantValue, value)
+			assert.Equal(t, tt.wantKey, key)
+			if tt.wantWarning {
+				assert.Contains(t, buf.String(), "config key ["+tt.wantKey+"] matched ["+tt.key+"] ignoring case")
+			} else {
+				assert.NotContains(t, buf.String(), "ignoring case")
+			}
+		})
+	}
+}
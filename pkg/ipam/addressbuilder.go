@@ -1,16 +1,68 @@
 package ipam
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"math/big"
 	"net/netip"
 	"strings"
+	"sync"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
 	"go4.org/netipx"
+	"k8s.io/klog"
 )
 
-// parseCidr - Builds an IPSet constructed from the cidrs
+// maxParsedPools bounds the number of parsed pools kept in the cache
+const maxParsedPools = 128
+
+// parsedPools caches the IPSets parsed from pool strings keyed by the hash of the pool,
+// so large pools shared by several namespaces are only parsed once. IPSets are immutable
+// so they can be shared safely.
+var (
+	parsedPoolsLock sync.Mutex
+	parsedPools     = map[[sha256.Size]byte]*netipx.IPSet{}
+)
+
+// parseCached returns the cached IPSet of the pool or parses and caches it, failed parses aren't cached
+func parseCached(kind, pool string, parse func(string) (*netipx.IPSet, error)) (*netipx.IPSet, error) {
+	key := sha256.Sum256([]byte(kind + ":" + pool))
+
+	parsedPoolsLock.Lock()
+	set, ok := parsedPools[key]
+	parsedPoolsLock.Unlock()
+	if ok {
+		return set, nil
+	}
+
+	set, err := parse(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedPoolsLock.Lock()
+	defer parsedPoolsLock.Unlock()
+	if len(parsedPools) >= maxParsedPools {
+		clear(parsedPools)
+	}
+	parsedPools[key] = set
+	return set, nil
+}
+
+// resetParsedPools drops all the cached IPSets
+func resetParsedPools() {
+	parsedPoolsLock.Lock()
+	defer parsedPoolsLock.Unlock()
+	clear(parsedPools)
+}
+
+// parseCidrs - Returns the IPSet constructed from the cidrs, using the cache if possible
 func parseCidrs(cidr string) (*netipx.IPSet, error) {
+	return parseCached("cidr", cidr, buildCidrs)
+}
+
+// buildCidrs - Builds an IPSet constructed from the cidrs
+func buildCidrs(cidr string) (*netipx.IPSet, error) {
 	// Split the ipranges (comma separated)
 	cidrs := strings.Split(cidr, ",")
 	if len(cidrs) == 0 {
@@ -20,7 +72,8 @@ func parseCidrs(cidr string) (*netipx.IPSet, error) {
 	builder := &netipx.IPSetBuilder{}
 
 	for x := range cidrs {
-		prefix, err := netip.ParsePrefix(cidrs[x])
+		cidr, _ := splitEntryMetadata(cidrs[x])
+		prefix, err := netip.ParsePrefix(cidr)
 		if err != nil {
 			return nil, err
 		}
@@ -29,8 +82,11 @@ func parseCidrs(cidr string) (*netipx.IPSet, error) {
 	return builder.IPSet()
 }
 
+// smallPoolWarningSize is the number of usable addresses under which skipping the end IPs of a cidr is logged
+const smallPoolWarningSize = 4
+
 // buildHostsFromCidr - Builds a IPSet constructed from the cidr and filters out
-// the broadcast IP and network IP for IPv4 networks
+// the broadcast IP and network IP for IPv4 networks, the IPSet is restricted to the usable range if set
 func buildHostsFromCidr(cidr string, kubevipLBConfig *config.KubevipLBConfig) (*netipx.IPSet, error) {
 	unfilteredSet, err := parseCidrs(cidr)
 	if err != nil {
@@ -62,15 +118,54 @@ func buildHostsFromCidr(cidr string, kubevipLBConfig *config.KubevipLBConfig) (*
 			// For 192.168.0.200/23, 192.168.0.206 is the BroadcastIP, and 192.168.0.201 is the NetworkID
 			if kubevipLBConfig != nil && kubevipLBConfig.SkipEndIPsInCIDR {
 				from, to = from.Next(), to.Prev()
+				if usable := 1<<(32-prefix.Bits()) - 2; usable < smallPoolWarningSize {
+					klog.Warningf("skipping the end IPs of cidr [%s] leaves only %d usable addresses in pool [%s]", prefix, usable, cidr)
+				}
 			}
 			builder.AddRange(netipx.IPRangeFrom(from, to))
 		}
 	}
+
+	// Only keep the usable subset of the cidr if one is configured
+	if kubevipLBConfig != nil && len(kubevipLBConfig.UsableRange) > 0 {
+		usableSet, err := buildAddressesFromRange(kubevipLBConfig.UsableRange)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse usable range [%s]: %v", kubevipLBConfig.UsableRange, err)
+		}
+		if !usableInCidr(usableSet, unfilteredSet) {
+			return nil, &UsableRangeOutsideCidrError{usableRange: kubevipLBConfig.UsableRange, cidr: cidr}
+		}
+		builder.Intersect(usableSet)
+	}
 	return builder.IPSet()
 }
 
-// buildHostsFromRange - Builds a IPSet constructed from the Range
+// usableInCidr returns true if the usable ranges are inside the cidrs, the usable ranges of an IP family the cidrs
+// don't have are ignored as they are meant for the cidrs of the other family of a dual-stack pool
+func usableInCidr(usableSet, cidrSet *netipx.IPSet) bool {
+	cidrHas4, cidrHas6 := false, false
+	for _, prefix := range cidrSet.Prefixes() {
+		cidrHas4 = cidrHas4 || prefix.Addr().Is4()
+		cidrHas6 = cidrHas6 || prefix.Addr().Is6()
+	}
+	for _, r := range usableSet.Ranges() {
+		if (r.From().Is4() && !cidrHas4) || (r.From().Is6() && !cidrHas6) {
+			continue
+		}
+		if !cidrSet.ContainsRange(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildAddressesFromRange - Returns the IPSet constructed from the Range, using the cache if possible
 func buildAddressesFromRange(ipRangeString string) (*netipx.IPSet, error) {
+	return parseCached("range", ipRangeString, buildRanges)
+}
+
+// buildRanges - Builds a IPSet constructed from the Range
+func buildRanges(ipRangeString string) (*netipx.IPSet, error) {
 	// Split the ipranges (comma separated)
 
 	ranges := strings.Split(ipRangeString, ",")
@@ -81,27 +176,109 @@ func buildAddressesFromRange(ipRangeString string) (*netipx.IPSet, error) {
 	builder := &netipx.IPSetBuilder{}
 
 	for x := range ranges {
-		ipRange := strings.Split(ranges[x], "-")
+		entry, _ := splitEntryMetadata(ranges[x])
+		ipRange := strings.Split(entry, "-")
 		// Make sure we have x.x.x.x-x.x.x.x or x:x:x:x:x:x:x:x:x-x:x:x:x:x:x:x:x:x
 		if len(ipRange) != 2 {
 			return nil, fmt.Errorf("unable to parse IP range [%s]", ranges[x])
 		}
 
-		start, err := netip.ParseAddr(ipRange[0])
+		start, err := parseRangeEndpoint(ipRange[0])
 		if err != nil {
 			return nil, err
 		}
-		end, err := netip.ParseAddr(ipRange[1])
+		end, err := parseRangeEndpoint(ipRange[1])
 		if err != nil {
 			return nil, err
 		}
 
+		// An invalid range would silently add no address
+		if start.BitLen() != end.BitLen() {
+			return nil, fmt.Errorf("invalid IP range [%s], %s and %s are not of the same IP family", ranges[x], start, end)
+		}
+		if end.Less(start) {
+			return nil, fmt.Errorf("invalid IP range [%s], the end %s is before the start %s, did you mean %s-%s?", ranges[x], end, start, end, start)
+		}
+
 		builder.AddRange(netipx.IPRangeFrom(start, end))
 	}
 
 	return builder.IPSet()
 }
 
+// parseRangeEndpoint parses the start or end of a range, either an address or a single host cidr,
+// e.g. 10.0.0.10/32 or fd00::10/128
+func parseRangeEndpoint(endpoint string) (netip.Addr, error) {
+	if !strings.Contains(endpoint, "/") {
+		return netip.ParseAddr(endpoint)
+	}
+	prefix, err := netip.ParsePrefix(endpoint)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !prefix.IsSingleIP() {
+		return netip.Addr{}, fmt.Errorf("invalid IP range endpoint [%s], only single host cidrs (/32 or /128) are allowed", endpoint)
+	}
+	return prefix.Addr(), nil
+}
+
+// IsCidrPool returns true if the pool is made of cidrs, false if it is made of ranges, whose endpoints may be
+// single host cidrs
+func IsCidrPool(pool string) bool {
+	pool = StripPoolMetadata(pool)
+	return strings.Contains(pool, "/") && !strings.Contains(pool, "-")
+}
+
+// parsePool returns the IPSet of the pool, the pool is either cidrs or ranges
+func parsePool(pool string) (*netipx.IPSet, error) {
+	if IsCidrPool(pool) {
+		return parseCidrs(pool)
+	}
+	return buildAddressesFromRange(pool)
+}
+
+// PoolContains returns true if the address is part of the pool, the pool is either cidrs or ranges
+func PoolContains(pool string, addr netip.Addr) (bool, error) {
+	poolIPSet, err := parsePool(pool)
+	if err != nil {
+		return false, err
+	}
+	return poolIPSet.Contains(addr), nil
+}
+
+// PoolSize returns the number of addresses of the pool, the pool is either cidrs or ranges
+func PoolSize(pool string) (*big.Int, error) {
+	poolIPSet, err := parsePool(pool)
+	if err != nil {
+		return nil, err
+	}
+	return addressCount(poolIPSet), nil
+}
+
+// FreeCount returns the number of addresses of the pool that aren't in use, the pool is either cidrs or ranges
+func FreeCount(pool string, inUseIPSet *netipx.IPSet) (*big.Int, error) {
+	poolIPSet, err := parsePool(pool)
+	if err != nil {
+		return nil, err
+	}
+	free, err := freeAddresses(poolIPSet, inUseIPSet)
+	if err != nil {
+		return nil, err
+	}
+	return addressCount(free), nil
+}
+
+// PoolUtilization returns the number of addresses of the pool and the number of them in use, the pool is either
+// cidrs or ranges
+func PoolUtilization(pool string, inUseIPSet *netipx.IPSet) (size, inUse float64, err error) {
+	poolIPSet, err := parsePool(pool)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, inUse = Utilization(poolIPSet, inUseIPSet)
+	return size, inUse, nil
+}
+
 // SplitCIDRsByIPFamily splits the cidrs into separate lists of ipv4
 // and ipv6 CIDRs
 func SplitCIDRsByIPFamily(cidrs string) (ipv4 string, ipv6 string, err error) {
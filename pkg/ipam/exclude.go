@@ -0,0 +1,41 @@
+package ipam
+
+import (
+	"net/netip"
+
+	"go4.org/netipx"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+// excludedAddresses returns the IPSet of the excluded addresses of the kubevipLBConfig, nil if there are none or they
+// can't be parsed, the provider only sets valid ranges
+func excludedAddresses(kubevipLBConfig *config.KubevipLBConfig) *netipx.IPSet {
+	if kubevipLBConfig == nil || len(kubevipLBConfig.ExcludedIPs) == 0 {
+		return nil
+	}
+	excludedSet, err := buildAddressesFromRange(kubevipLBConfig.ExcludedIPs)
+	if err != nil {
+		return nil
+	}
+	return excludedSet
+}
+
+// withoutExcluded returns the addresses of the pool that aren't excluded. The excluded addresses are removed after the
+// end IPs of the cidrs were skipped, so an address both skipped and excluded is only removed once.
+func withoutExcluded(poolIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (*netipx.IPSet, error) {
+	excludedSet := excludedAddresses(kubevipLBConfig)
+	if excludedSet == nil {
+		return poolIPSet, nil
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolIPSet)
+	builder.RemoveSet(excludedSet)
+	return builder.IPSet()
+}
+
+// IsExcluded returns true if the address is excluded from allocation by the kubevipLBConfig
+func IsExcluded(addr netip.Addr, kubevipLBConfig *config.KubevipLBConfig) bool {
+	excludedSet := excludedAddresses(kubevipLBConfig)
+	return excludedSet != nil && excludedSet.Contains(addr)
+}
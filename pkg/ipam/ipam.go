@@ -4,12 +4,28 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
 	"go4.org/netipx"
 	"k8s.io/klog"
 )
 
+// TraceLevel is the klog verbosity of the allocation decision logs
+const TraceLevel klog.Level = 5
+
+// Tracef logs the allocation decision trace at TraceLevel, or at the default verbosity if the allocation is debugged
+func Tracef(kubevipLBConfig *config.KubevipLBConfig, format string, args ...interface{}) {
+	if kubevipLBConfig != nil && kubevipLBConfig.Debug {
+		klog.InfoDepth(1, fmt.Sprintf(format, args...))
+		return
+	}
+	if klog.V(TraceLevel) {
+		klog.InfoDepth(1, fmt.Sprintf(format, args...))
+	}
+}
+
 // OutOfIPsError stores informations that are required to return out of ip error
 type OutOfIPsError struct {
 	namespace string
@@ -25,109 +41,178 @@ func (e *OutOfIPsError) Error() string {
 	return fmt.Sprintf("no addresses available in [%s] %s [%s]", e.namespace, what, e.pool)
 }
 
-// Manager - handles the addresses for each namespace/vip
+// NoUsableAddressesError is returned when the pool could be parsed but all of its addresses are skipped,
+// e.g. a pool made only of network or broadcast addresses
+type NoUsableAddressesError struct {
+	namespace string
+	pool      string
+	isCidr    bool
+}
+
+func (e *NoUsableAddressesError) Error() string {
+	what := "range"
+	if e.isCidr {
+		what = "cidr"
+	}
+	return fmt.Sprintf("no usable addresses in [%s] %s [%s], all addresses are skipped", e.namespace, what, e.pool)
+}
+
+// UsableRangeOutsideCidrError is returned when the usable range of a cidr pool has addresses outside of the cidr,
+// they couldn't be routed by the advertised cidr
+type UsableRangeOutsideCidrError struct {
+	usableRange string
+	cidr        string
+}
+
+func (e *UsableRangeOutsideCidrError) Error() string {
+	return fmt.Sprintf("usable range [%s] is not inside cidr [%s]", e.usableRange, e.cidr)
+}
+
+// ErrNoUsableAddresses is returned by FindFreeAddress when the pool has no address that could ever be allocated
+var ErrNoUsableAddresses = errors.New("no usable address in pool")
+
+// newPoolError returns the error matching the reason no address could be found in the pool
+func newPoolError(err error, namespace, pool string, isCidr bool) error {
+	if errors.Is(err, ErrNoUsableAddresses) {
+		return &NoUsableAddressesError{namespace: namespace, pool: pool, isCidr: isCidr}
+	}
+	return &OutOfIPsError{namespace: namespace, pool: pool, isCidr: isCidr}
+}
+
+// Manager - handles the addresses for each namespace and pool
 var Manager []ipManager
 
+// managerLock guards the Manager against concurrent syncs and resets
+var managerLock sync.Mutex
+
+// ManagerEntry describes a pool cached by the Manager for a namespace
+type ManagerEntry struct {
+	Namespace string   `json:"namespace"`
+	Cidr      string   `json:"cidr,omitempty"`
+	Range     string   `json:"range,omitempty"`
+	Pool      []string `json:"pool"`
+}
+
 // ipManager defines the mapping to a namespace and address pool
 type ipManager struct {
 	// Identifies the manager
 	namespace string
 
 	// The network configuration
-	cidr    string
-	ipRange string
+	cidr        string
+	ipRange     string
+	usableRange string
 
 	// todo - This confuses me ...
 	poolIPSet *netipx.IPSet
 }
 
-// FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromRange(namespace, ipRange string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (string, error) {
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].ipRange != ipRange {
-				klog.Infof("Updating IP address range from [%s] to [%s]", Manager[x].ipRange, ipRange)
-
-				// If not rebuild the available hosts
-				poolIPSet, err := buildAddressesFromRange(ipRange)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].poolIPSet = poolIPSet
-				Manager[x].ipRange = ipRange
-			}
+// maxManagedPools bounds the number of pools kept in the Manager, the pools of an edited configmap aren't dropped
+// otherwise
+const maxManagedPools = 256
 
-			addr, err := FindFreeAddress(Manager[x].poolIPSet, inUseIPSet, kubevipLBConfig)
-			if err != nil {
-				return "", &OutOfIPsError{namespace: namespace, pool: ipRange, isCidr: false}
-			}
-			return addr.String(), nil
+// managedPool returns the manager of the pool of the namespace, adding it if needed. The Manager is keyed by the
+// namespace and the pool: a namespace allocates from shared pools too, e.g. the global overflow or burst pool, and a
+// dual-stack pool is allocated per family, so they must not replace the cached pool of each other.
+func managedPool(namespace, cidr, ipRange, usable string, build func() (*netipx.IPSet, error)) (*ipManager, error) {
+	for x := range Manager {
+		if Manager[x].namespace == namespace && Manager[x].cidr == cidr && Manager[x].ipRange == ipRange && Manager[x].usableRange == usable {
+			return &Manager[x], nil
 		}
 	}
-	poolIPSet, err := buildAddressesFromRange(ipRange)
+	poolIPSet, err := build()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace: namespace,
-		poolIPSet: poolIPSet,
-		ipRange:   ipRange,
+	if len(Manager) >= maxManagedPools {
+		klog.Infof("Address manager holds %d pools, dropping them", len(Manager))
+		Manager = nil
 	}
+	Manager = append(Manager, ipManager{
+		namespace:   namespace,
+		cidr:        cidr,
+		ipRange:     ipRange,
+		usableRange: usable,
+		poolIPSet:   poolIPSet,
+	})
+	return &Manager[len(Manager)-1], nil
+}
 
-	Manager = append(Manager, newManager)
+// FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
+func FindAvailableHostFromRange(namespace, ipRange string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (string, error) {
+	managerLock.Lock()
+	defer managerLock.Unlock()
 
-	addr, err := FindFreeAddress(poolIPSet, inUseIPSet, kubevipLBConfig)
+	manager, err := managedPool(namespace, "", ipRange, "", func() (*netipx.IPSet, error) {
+		return buildAddressesFromRange(ipRange)
+	})
 	if err != nil {
-		return "", &OutOfIPsError{namespace: namespace, pool: ipRange, isCidr: false}
+		return "", err
+	}
+
+	addr, err := FindFreeAddress(manager.poolIPSet, inUseIPSet, kubevipLBConfig)
+	recordPoolMetrics(namespace, ipRange, manager.poolIPSet, inUseIPSet, addr)
+	if err != nil {
+		return "", newPoolError(err, namespace, ipRange, false)
 	}
 	return addr.String(), nil
 }
 
 // FindAvailableHostFromCidr - will look through the cidr and the address Manager and find a free address (if possible)
 func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (string, error) {
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].cidr != cidr {
-				// If not rebuild the available hosts
-				poolIPSet, err := buildHostsFromCidr(cidr, kubevipLBConfig)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].poolIPSet = poolIPSet
-				Manager[x].cidr = cidr
-			}
-			addr, err := FindFreeAddress(Manager[x].poolIPSet, inUseIPSet, kubevipLBConfig)
-			if err != nil {
-				return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
-			}
-			return addr.String(), nil
-		}
-	}
-	poolIPSet, err := buildHostsFromCidr(cidr, kubevipLBConfig)
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	manager, err := managedPool(namespace, cidr, "", usableRange(kubevipLBConfig), func() (*netipx.IPSet, error) {
+		return buildHostsFromCidr(cidr, kubevipLBConfig)
+	})
 	if err != nil {
 		return "", err
 	}
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace: namespace,
-		poolIPSet: poolIPSet,
-		cidr:      cidr,
-	}
-	Manager = append(Manager, newManager)
 
-	addr, err := FindFreeAddress(poolIPSet, inUseIPSet, kubevipLBConfig)
+	addr, err := FindFreeAddress(manager.poolIPSet, inUseIPSet, kubevipLBConfig)
+	recordPoolMetrics(namespace, cidr, manager.poolIPSet, inUseIPSet, addr)
 	if err != nil {
-		return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
+		return "", newPoolError(err, namespace, cidr, true)
 	}
 	return addr.String(), nil
 }
 
+// ListManager returns the pools currently cached by the Manager
+func ListManager() []ManagerEntry {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	entries := make([]ManagerEntry, 0, len(Manager))
+	for x := range Manager {
+		entry := ManagerEntry{
+			Namespace: Manager[x].namespace,
+			Cidr:      Manager[x].cidr,
+			Range:     Manager[x].ipRange,
+			Pool:      []string{},
+		}
+		if Manager[x].poolIPSet != nil {
+			for _, r := range Manager[x].poolIPSet.Ranges() {
+				entry.Pool = append(entry.Pool, r.String())
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ResetManager clears the Manager, the pools are rebuilt from the ConfigMap on the next sync. The pool metrics are
+// deleted and recorded again on the next allocation from each pool.
+func ResetManager() {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	klog.Infof("Resetting the address manager, dropping %d cached pools", len(Manager))
+	Manager = nil
+	resetParsedPools()
+	resetPoolSeries()
+}
+
 // // RenewAddress - removes the mark on an address
 // func RenewAddress(namespace, address string) {
 // 	for x := range Manager {
@@ -150,40 +235,134 @@ func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet,
 // }
 
 // FindFreeAddress returns the next free IP Address in a range based on a set of existing addresses.
-// It will skip assumed gateway ip or broadcast ip for IPv4 address
+// It will skip assumed gateway ip or broadcast ip for IPv4 address unless KeepEndIPs is set, ErrNoUsableAddresses
+// is returned if the pool has no address left once those are skipped. The addresses released recently are skipped
+// during the cooldowns of the kubevipLBConfig, the addresses of the reserved ranges if RejectReservedRanges is set and the
+// ExcludedIPs.
 func FindFreeAddress(poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (netip.Addr, error) {
-	if kubevipLBConfig != nil && kubevipLBConfig.ReturnIPInDescOrder {
+	descOrder := kubevipLBConfig != nil && kubevipLBConfig.ReturnIPInDescOrder
+	keepEndIPs := kubevipLBConfig != nil && kubevipLBConfig.KeepEndIPs
+	stride := 1
+	if kubevipLBConfig != nil && kubevipLBConfig.AllocationStride > 1 {
+		stride = kubevipLBConfig.AllocationStride
+	}
+	Tracef(kubevipLBConfig, "finding a free address in pool ranges %v with %d in-use ranges, descending order: %t, stride: %d",
+		poolIPSet.Ranges(), len(inUseIPSet.Ranges()), descOrder, stride)
+	coolingDown := releases.coolingDown(kubevipLBConfig, time.Now())
+	poolIPSet, err := withoutExcluded(poolIPSet, kubevipLBConfig)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	isFree := func(ip netip.Addr) bool {
+		if inUseIPSet.Contains(ip) {
+			Tracef(kubevipLBConfig, "skipping address %s, it is in use", ip)
+			return false
+		}
+		if rel, ok := coolingDown[ip]; ok {
+			Tracef(kubevipLBConfig, "skipping address %s, it was released by namespace [%s] at %s and is cooling down",
+				ip, rel.namespace, rel.at.Format(time.RFC3339))
+			return false
+		}
+		if !keepEndIPs && ip.Is4() && isNetworkIDOrBroadcastIP(ip.As4()) {
+			Tracef(kubevipLBConfig, "skipping address %s, it is a network or broadcast address", ip)
+			return false
+		}
+		if !AllowsReservedAddress(ip, kubevipLBConfig) {
+			return false
+		}
+		Tracef(kubevipLBConfig, "chose address %s", ip)
+		return true
+	}
+
+	if descOrder {
+		// Stepping down from the end of a large IPv6 range over the addresses in use is pathological, the in use
+		// addresses are removed from the pool first so the last free address is the end of the last free range.
+		// With a stride, the pool ranges are scanned instead so the allocated addresses stay aligned on their end.
 		ipranges := poolIPSet.Ranges()
+		if stride == 1 {
+			freeIPSet, err := freeAddresses(poolIPSet, inUseIPSet)
+			if err != nil {
+				return netip.Addr{}, err
+			}
+			ipranges = freeIPSet.Ranges()
+		}
 		for i := range len(ipranges) {
 			iprange := ipranges[len(ipranges)-1-i]
 			ip := iprange.To()
 			for {
-				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4())) {
+				if isFree(ip) {
 					return ip, nil
 				}
-				if ip == iprange.From() {
+				var ok bool
+				if ip, ok = stepAddress(ip, iprange.From(), stride, netip.Addr.Prev); !ok {
 					break
 				}
-				ip = ip.Prev()
 			}
 		}
 	} else {
 		for _, iprange := range poolIPSet.Ranges() {
 			ip := iprange.From()
 			for {
-				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4())) {
+				if isFree(ip) {
 					return ip, nil
 				}
-				if ip == iprange.To() {
+				var ok bool
+				if ip, ok = stepAddress(ip, iprange.To(), stride, netip.Addr.Next); !ok {
 					break
 				}
-				ip = ip.Next()
 			}
 		}
 	}
+	if !keepEndIPs && !hasUsableAddress(poolIPSet) {
+		return netip.Addr{}, ErrNoUsableAddresses
+	}
 	return netip.Addr{}, errors.New("no address available")
 }
 
+// stepAddress returns the address stride steps from ip towards last, false if last is passed
+func stepAddress(ip, last netip.Addr, stride int, step func(netip.Addr) netip.Addr) (netip.Addr, bool) {
+	for range stride {
+		if ip == last {
+			return ip, false
+		}
+		ip = step(ip)
+	}
+	return ip, true
+}
+
+// freeAddresses returns the addresses of the pool that aren't in use
+func freeAddresses(poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet) (*netipx.IPSet, error) {
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolIPSet)
+	builder.RemoveSet(inUseIPSet)
+	return builder.IPSet()
+}
+
+// hasUsableAddress returns true if the pool has at least one address that isn't skipped
+func hasUsableAddress(poolIPSet *netipx.IPSet) bool {
+	for _, iprange := range poolIPSet.Ranges() {
+		ip := iprange.From()
+		for {
+			if !ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4()) {
+				return true
+			}
+			if ip == iprange.To() {
+				break
+			}
+			ip = ip.Next()
+		}
+	}
+	return false
+}
+
+func usableRange(kubevipLBConfig *config.KubevipLBConfig) string {
+	if kubevipLBConfig == nil {
+		return ""
+	}
+	return kubevipLBConfig.UsableRange
+}
+
 func isNetworkIDOrBroadcastIP(ip [4]byte) bool {
 	return ip[3] == 0 || ip[3] == 255
 }
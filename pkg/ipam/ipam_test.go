@@ -1,10 +1,14 @@
 package ipam
 
 import (
+	"fmt"
 	"net/netip"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
 	"go4.org/netipx"
 )
 
@@ -90,6 +94,27 @@ func Test_buildHostsFromRange(t *testing.T) {
 			want:    []string{"fe80::10", "fe80::11", "fe80::12", "fe80::13", "fe80::14"},
 			wantErr: false,
 		},
+		{
+			name: "reversed range",
+			args: args{
+				"10.0.0.20-10.0.0.10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "ipv6, reversed range",
+			args: args{
+				"fe80::14-fe80::13",
+			},
+			wantErr: true,
+		},
+		{
+			name: "range across IP families",
+			args: args{
+				"10.0.0.10-fe80::13",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -98,6 +123,9 @@ func Test_buildHostsFromRange(t *testing.T) {
 				t.Errorf("buildHostsFromRange() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				return
+			}
 
 			builder := &netipx.IPSetBuilder{}
 			for i := range tt.want {
@@ -121,6 +149,64 @@ func Test_buildHostsFromRange(t *testing.T) {
 	}
 }
 
+func Test_buildHostsFromReversedRange(t *testing.T) {
+	_, err := buildAddressesFromRange("192.168.0.10-192.168.0.11,10.0.0.20-10.0.0.10")
+	if err == nil {
+		t.Fatal("buildAddressesFromRange() expected an error for a reversed range")
+	}
+	want := "invalid IP range [10.0.0.20-10.0.0.10], the end 10.0.0.10 is before the start 10.0.0.20, did you mean 10.0.0.10-10.0.0.20?"
+	if err.Error() != want {
+		t.Errorf("buildAddressesFromRange() error = %q, want %q", err, want)
+	}
+}
+
+func Test_buildHostsFromRangeWithCidrEndpoints(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs string
+		plain string
+	}{
+		{
+			name:  "IPv4 single host cidrs",
+			cidrs: "10.0.0.10/32-10.0.0.20/32",
+			plain: "10.0.0.10-10.0.0.20",
+		},
+		{
+			name:  "mixed forms",
+			cidrs: "10.0.0.10-10.0.0.20/32,10.0.1.1/32-10.0.1.5",
+			plain: "10.0.0.10-10.0.0.20,10.0.1.1-10.0.1.5",
+		},
+		{
+			name:  "IPv6 single host cidrs",
+			cidrs: "fd00::10/128-fd00::20/128",
+			plain: "fd00::10-fd00::20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildAddressesFromRange(tt.cidrs)
+			if err != nil {
+				t.Fatalf("buildAddressesFromRange(%q) error = %v", tt.cidrs, err)
+			}
+			want, err := buildAddressesFromRange(tt.plain)
+			if err != nil {
+				t.Fatalf("buildAddressesFromRange(%q) error = %v", tt.plain, err)
+			}
+			if !slices.Equal(got.Ranges(), want.Ranges()) {
+				t.Errorf("buildAddressesFromRange(%q) = %v, want %v", tt.cidrs, got.Ranges(), want.Ranges())
+			}
+			if IsCidrPool(tt.cidrs) {
+				t.Errorf("IsCidrPool(%q) = true, want false", tt.cidrs)
+			}
+		})
+	}
+
+	// only single host cidrs are allowed
+	if _, err := buildAddressesFromRange("10.0.0.0/28-10.0.0.31"); err == nil {
+		t.Error("buildAddressesFromRange() expected an error for a cidr endpoint with several hosts")
+	}
+}
+
 func Test_buildHostsFromCidr(t *testing.T) {
 	type args struct {
 		cidr  string
@@ -225,6 +311,57 @@ func Test_buildHostsFromCidr(t *testing.T) {
 			want:    []string{"fe80::10", "fe80::11", "fe80::12", "fe80::13"},
 			wantErr: false,
 		},
+		{
+			name: "usable range restricts the cidr",
+			args: args{
+				cidr:  "10.0.0.0/24",
+				kvlbc: &config.KubevipLBConfig{UsableRange: "10.0.0.50-10.0.0.52"},
+			},
+			want:    []string{"10.0.0.50", "10.0.0.51", "10.0.0.52"},
+			wantErr: false,
+		},
+		{
+			name: "usable range inside the cidr, if skipEndIPsInCIDR is set",
+			args: args{
+				cidr:  "10.0.0.0/30",
+				kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, UsableRange: "10.0.0.2-10.0.0.3"},
+			},
+			want:    []string{"10.0.0.2"},
+			wantErr: false,
+		},
+		{
+			name: "usable range partially outside of the cidr",
+			args: args{
+				cidr:  "10.0.0.0/30",
+				kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, UsableRange: "10.0.0.2-10.0.0.10"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "usable range outside of the cidr",
+			args: args{
+				cidr:  "10.0.0.0/30",
+				kvlbc: &config.KubevipLBConfig{UsableRange: "10.0.1.1-10.0.1.10"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ipv4 usable range doesn't fail an ipv6 cidr",
+			args: args{
+				cidr:  "fe80::10/127",
+				kvlbc: &config.KubevipLBConfig{UsableRange: "10.0.0.1-10.0.0.10"},
+			},
+			want:    []string{},
+			wantErr: false,
+		},
+		{
+			name: "invalid usable range",
+			args: args{
+				cidr:  "10.0.0.0/30",
+				kvlbc: &config.KubevipLBConfig{UsableRange: "10.0.0.1"},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -233,6 +370,9 @@ func Test_buildHostsFromCidr(t *testing.T) {
 				t.Errorf("buildHostsFromCidr() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil {
+				return
+			}
 
 			builder := &netipx.IPSetBuilder{}
 			for i := range tt.want {
@@ -840,6 +980,26 @@ func TestFindAvailableHostFromCIDR(t *testing.T) {
 			},
 			want: "2001::13",
 		},
+		{
+			name: "usable range within the cidr",
+			args: args{
+				namespace:        "default2",
+				cidr:             "10.0.0.0/24",
+				existingServices: []string{"10.0.0.50"},
+				kvlbc:            &config.KubevipLBConfig{UsableRange: "10.0.0.50-10.0.0.100"},
+			},
+			want: "10.0.0.51",
+		},
+		{
+			name: "usable range within the cidr, reverse order",
+			args: args{
+				namespace:        "default2",
+				cidr:             "10.0.0.0/24",
+				existingServices: []string{"10.0.0.100"},
+				kvlbc:            &config.KubevipLBConfig{UsableRange: "10.0.0.50-10.0.0.100", ReturnIPInDescOrder: true},
+			},
+			want: "10.0.0.99",
+		},
 	}
 
 	for _, tt := range tests {
@@ -871,3 +1031,563 @@ func TestFindAvailableHostFromCIDR(t *testing.T) {
 		})
 	}
 }
+
+func TestFindAvailableHostNoUsableAddresses(t *testing.T) {
+	tests := []struct {
+		name             string
+		pool             string
+		existingServices []string
+		kvlbc            *config.KubevipLBConfig
+		wantNoUsable     bool
+	}{
+		{
+			name:         "cidr with only a network address",
+			pool:         "192.168.0.0/32",
+			wantNoUsable: true,
+		},
+		{
+			name:         "cidr with only a broadcast address, reverse order",
+			pool:         "192.168.0.255/32",
+			kvlbc:        &config.KubevipLBConfig{ReturnIPInDescOrder: true},
+			wantNoUsable: true,
+		},
+		{
+			name:         "range made of broadcast and network addresses",
+			pool:         "192.168.0.255-192.168.1.0",
+			wantNoUsable: true,
+		},
+		{
+			name:             "cidr exhausted by in-use addresses",
+			pool:             "192.168.0.255/30",
+			existingServices: []string{"192.168.0.254", "192.168.0.252", "192.168.0.253"},
+		},
+		{
+			name:             "range exhausted by in-use addresses",
+			pool:             "192.168.0.254-192.168.1.0",
+			existingServices: []string{"192.168.0.254"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for i := range tt.existingServices {
+				builder.Add(netip.MustParseAddr(tt.existingServices[i]))
+			}
+			s, err := builder.IPSet()
+			if err != nil {
+				t.Fatalf("failed to build in-use set: %v", err)
+			}
+
+			if strings.Contains(tt.pool, "/") {
+				_, err = FindAvailableHostFromCidr("nousable", tt.pool, s, tt.kvlbc)
+			} else {
+				_, err = FindAvailableHostFromRange("nousable", tt.pool, s, tt.kvlbc)
+			}
+			if err == nil {
+				t.Fatalf("expected an error for pool %s", tt.pool)
+			}
+
+			_, noUsable := err.(*NoUsableAddressesError)
+			_, outOfIPs := err.(*OutOfIPsError)
+			if noUsable != tt.wantNoUsable || outOfIPs == tt.wantNoUsable {
+				t.Errorf("unexpected error type %T for pool %s: %v", err, tt.pool, err)
+			}
+			// clean up the ipManager so it doesn't impact other test
+			Manager = []ipManager{}
+		})
+	}
+}
+
+func TestFindAvailableHostPointToPoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidr  string
+		kvlbc *config.KubevipLBConfig
+		want  []string
+	}{
+		{
+			name: "ipv4 /31 yields both addresses",
+			cidr: "192.168.0.10/31",
+			want: []string{"192.168.0.10", "192.168.0.11"},
+		},
+		{
+			name:  "ipv4 /31 yields both addresses when skipping the end IPs",
+			cidr:  "192.168.0.10/31",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			want:  []string{"192.168.0.10", "192.168.0.11"},
+		},
+		{
+			name: "ipv6 /127 yields both addresses",
+			cidr: "fe80::10/127",
+			want: []string{"fe80::10", "fe80::11"},
+		},
+		{
+			name:  "ipv6 /127 yields both addresses when skipping the end IPs",
+			cidr:  "fe80::10/127",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			want:  []string{"fe80::10", "fe80::11"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer ResetManager()
+
+			builder := &netipx.IPSetBuilder{}
+			var got []string
+			for range tt.want {
+				inUse, err := builder.IPSet()
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr, err := FindAvailableHostFromCidr("p2p", tt.cidr, inUse, tt.kvlbc)
+				if err != nil {
+					t.Fatalf("FindAvailableHostFromCidr() error: %v", err)
+				}
+				got = append(got, addr)
+				builder.Add(netip.MustParseAddr(addr))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected addresses %v, got %v", tt.want, got)
+			}
+
+			// both addresses are allocated, the pool is exhausted
+			inUse, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = FindAvailableHostFromCidr("p2p", tt.cidr, inUse, tt.kvlbc)
+			if _, outOfIPs := err.(*OutOfIPsError); !outOfIPs {
+				t.Errorf("expected an OutOfIPsError once both addresses are allocated, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPointToPointRangeMatchesCidr(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidr  string
+		rng   string
+		kvlbc *config.KubevipLBConfig
+		want  []string
+	}{
+		{
+			name: "ipv4 /31",
+			cidr: "192.168.0.10/31",
+			rng:  "192.168.0.10-192.168.0.11",
+			want: []string{"192.168.0.10", "192.168.0.11"},
+		},
+		{
+			name:  "ipv4 /31 when skipping the end IPs",
+			cidr:  "192.168.0.10/31",
+			rng:   "192.168.0.10-192.168.0.11",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			want:  []string{"192.168.0.10", "192.168.0.11"},
+		},
+		{
+			// the address ending in .0 is skipped by both
+			name: "ipv4 /31 starting at .0",
+			cidr: "10.0.0.0/31",
+			rng:  "10.0.0.0-10.0.0.1",
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name:  "ipv4 /31 starting at .0 when skipping the end IPs",
+			cidr:  "10.0.0.0/31",
+			rng:   "10.0.0.0-10.0.0.1",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			want:  []string{"10.0.0.1"},
+		},
+		{
+			name:  "ipv4 /32 when skipping the end IPs",
+			cidr:  "10.0.0.5/32",
+			rng:   "10.0.0.5-10.0.0.5",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			want:  []string{"10.0.0.5"},
+		},
+		{
+			name: "ipv6 /127",
+			cidr: "fd00::10/127",
+			rng:  "fd00::10-fd00::11",
+			want: []string{"fd00::10", "fd00::11"},
+		},
+	}
+
+	// allocatable returns all the addresses allocated from the pool until it is exhausted
+	allocatable := func(t *testing.T, find func(inUse *netipx.IPSet) (string, error)) []string {
+		builder := &netipx.IPSetBuilder{}
+		var got []string
+		for {
+			inUse, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, err := find(inUse)
+			if err != nil {
+				return got
+			}
+			got = append(got, addr)
+			builder.Add(netip.MustParseAddr(addr))
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer ResetManager()
+
+			fromCidr := allocatable(t, func(inUse *netipx.IPSet) (string, error) {
+				return FindAvailableHostFromCidr("p2p-cidr", tt.cidr, inUse, tt.kvlbc)
+			})
+			fromRange := allocatable(t, func(inUse *netipx.IPSet) (string, error) {
+				return FindAvailableHostFromRange("p2p-range", tt.rng, inUse, tt.kvlbc)
+			})
+			if strings.Join(fromCidr, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected addresses %v from cidr %s, got %v", tt.want, tt.cidr, fromCidr)
+			}
+			if strings.Join(fromRange, ",") != strings.Join(fromCidr, ",") {
+				t.Errorf("expected range %s to yield the addresses %v of cidr %s, got %v", tt.rng, fromCidr, tt.cidr, fromRange)
+			}
+		})
+	}
+}
+
+func TestSkipEndIPsWithExcludedIPs(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidr  string
+		kvlbc *config.KubevipLBConfig
+		want  []string
+	}{
+		{
+			name:  "excluded addresses inside the cidr",
+			cidr:  "10.0.0.0/29",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, ExcludedIPs: "10.0.0.2-10.0.0.2,10.0.0.4-10.0.0.5"},
+			want:  []string{"10.0.0.1", "10.0.0.3", "10.0.0.6"},
+		},
+		{
+			// the end IPs are only removed once
+			name:  "excluded end IPs",
+			cidr:  "10.0.0.8/29",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, ExcludedIPs: "10.0.0.8-10.0.0.9,10.0.0.15-10.0.0.15"},
+			want:  []string{"10.0.0.10", "10.0.0.11", "10.0.0.12", "10.0.0.13", "10.0.0.14"},
+		},
+		{
+			name:  "excluded addresses outside the cidr",
+			cidr:  "10.0.0.16/30",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, ExcludedIPs: "10.0.1.0-10.0.1.255"},
+			want:  []string{"10.0.0.17", "10.0.0.18"},
+		},
+		{
+			name:  "excluded addresses without skipping the end IPs",
+			cidr:  "10.0.0.16/30",
+			kvlbc: &config.KubevipLBConfig{ExcludedIPs: "10.0.0.17-10.0.0.17"},
+			want:  []string{"10.0.0.16", "10.0.0.18", "10.0.0.19"},
+		},
+		{
+			name:  "descending order",
+			cidr:  "10.0.0.0/29",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true, ReturnIPInDescOrder: true, ExcludedIPs: "10.0.0.5-10.0.0.6"},
+			want:  []string{"10.0.0.4", "10.0.0.3", "10.0.0.2", "10.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer ResetManager()
+
+			builder := &netipx.IPSetBuilder{}
+			var got []string
+			for {
+				inUse, err := builder.IPSet()
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr, err := FindAvailableHostFromCidr("skip-exclude", tt.cidr, inUse, tt.kvlbc)
+				if err != nil {
+					break
+				}
+				got = append(got, addr)
+				builder.Add(netip.MustParseAddr(addr))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected addresses %v from cidr %s, got %v", tt.want, tt.cidr, got)
+			}
+		})
+	}
+}
+
+func TestExcludedIPsLeaveNoUsableAddresses(t *testing.T) {
+	defer ResetManager()
+
+	kvlbc := &config.KubevipLBConfig{SkipEndIPsInCIDR: true, ExcludedIPs: "10.0.0.1-10.0.0.2"}
+	_, err := FindAvailableHostFromCidr("skip-exclude", "10.0.0.0/30", &netipx.IPSet{}, kvlbc)
+	if _, ok := err.(*NoUsableAddressesError); !ok {
+		t.Errorf("expected a NoUsableAddressesError, got %v", err)
+	}
+}
+
+func TestParsedPoolsCache(t *testing.T) {
+	resetParsedPools()
+	defer resetParsedPools()
+
+	pool := "10.0.0.1-10.0.0.10,10.0.1.1-10.0.1.10"
+	first, err := buildAddressesFromRange(pool)
+	if err != nil {
+		t.Fatalf("buildAddressesFromRange() error = %v", err)
+	}
+	second, err := buildAddressesFromRange(pool)
+	if err != nil {
+		t.Fatalf("buildAddressesFromRange() error = %v", err)
+	}
+	if first != second {
+		t.Errorf("expected identical pools to share the parsed IPSet")
+	}
+
+	// the same string parsed as a cidr must not hit the range cache
+	if _, err := parseCidrs(pool); err == nil {
+		t.Errorf("expected an error parsing range %s as cidrs", pool)
+	}
+
+	// failed parses aren't cached
+	if _, err := buildAddressesFromRange("10.0.0.1"); err == nil {
+		t.Errorf("expected an error parsing invalid range")
+	}
+	if len(parsedPools) != 1 {
+		t.Errorf("expected 1 cached pool, got %d", len(parsedPools))
+	}
+
+	ResetManager()
+	if len(parsedPools) != 0 {
+		t.Errorf("expected the cache to be dropped on reset, got %d cached pools", len(parsedPools))
+	}
+}
+
+// largeRangePool returns a pool made of n single-address ranges
+func largeRangePool(n int) string {
+	ranges := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("10.%d.%d.1", i/256, i%256)
+		ranges = append(ranges, addr+"-"+addr)
+	}
+	return strings.Join(ranges, ",")
+}
+
+func BenchmarkBuildAddressesFromRange(b *testing.B) {
+	pool := largeRangePool(5000)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resetParsedPools()
+			if _, err := buildAddressesFromRange(pool); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		resetParsedPools()
+		for i := 0; i < b.N; i++ {
+			if _, err := buildAddressesFromRange(pool); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFindFreeAddressDescendingLargeRange(t *testing.T) {
+	pool, err := parseCidrs("fd00::/64")
+	if err != nil {
+		t.Fatalf("parseCidrs() error = %v", err)
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddPrefix(netip.MustParsePrefix("fd00::ffff:ffff:0:0/96"))
+	builder.Add(netip.MustParseAddr("fd00::ffff:fffe:ffff:ffff"))
+	inUse, err := builder.IPSet()
+	if err != nil {
+		t.Fatalf("failed to build in-use set: %v", err)
+	}
+
+	got, err := FindFreeAddress(pool, inUse, &config.KubevipLBConfig{ReturnIPInDescOrder: true})
+	if err != nil {
+		t.Fatalf("FindFreeAddress() error = %v", err)
+	}
+	if want := netip.MustParseAddr("fd00::ffff:fffe:ffff:fffe"); got != want {
+		t.Errorf("FindFreeAddress() = %v, want %v", got, want)
+	}
+}
+
+func TestFindFreeAddressStride(t *testing.T) {
+	tests := []struct {
+		name   string
+		pool   string
+		config *config.KubevipLBConfig
+		want   []string
+	}{
+		{
+			name:   "stride 2 yields every other address",
+			pool:   "10.0.0.1-10.0.0.8",
+			config: &config.KubevipLBConfig{AllocationStride: 2},
+			want:   []string{"10.0.0.1", "10.0.0.3", "10.0.0.5", "10.0.0.7"},
+		},
+		{
+			name:   "stride 3 in descending order counts from the end of the range",
+			pool:   "10.0.0.1-10.0.0.8",
+			config: &config.KubevipLBConfig{AllocationStride: 3, ReturnIPInDescOrder: true},
+			want:   []string{"10.0.0.8", "10.0.0.5", "10.0.0.2"},
+		},
+		{
+			name:   "stride 2 in a cidr skips the network address",
+			pool:   "10.0.0.0/29",
+			config: &config.KubevipLBConfig{AllocationStride: 2},
+			want:   []string{"10.0.0.2", "10.0.0.4", "10.0.0.6"},
+		},
+		{
+			name:   "stride 1 yields every address",
+			pool:   "10.0.0.1-10.0.0.3",
+			config: &config.KubevipLBConfig{AllocationStride: 1},
+			want:   []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := parsePool(tt.pool)
+			if err != nil {
+				t.Fatalf("failed to parse pool: %v", err)
+			}
+			builder := &netipx.IPSetBuilder{}
+			var got []string
+			for {
+				inUse, err := builder.IPSet()
+				if err != nil {
+					t.Fatalf("failed to build in-use set: %v", err)
+				}
+				addr, err := FindFreeAddress(pool, inUse, tt.config)
+				if err != nil {
+					break
+				}
+				got = append(got, addr.String())
+				builder.Add(addr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FindFreeAddress() allocated %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkFindFreeAddressDescendingIPv6(b *testing.B) {
+	pool, err := parseCidrs("fd00::/64")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The top /96 of the pool is in use, 2^32 addresses to step over address by address
+	builder := &netipx.IPSetBuilder{}
+	builder.AddPrefix(netip.MustParsePrefix("fd00::ffff:ffff:0:0/96"))
+	inUse, err := builder.IPSet()
+	if err != nil {
+		b.Fatal(err)
+	}
+	kvlbc := &config.KubevipLBConfig{ReturnIPInDescOrder: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FindFreeAddress(pool, inUse, kvlbc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBuildHostsFromCidrSmallPoolWarning(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidr        string
+		kvlbc       *config.KubevipLBConfig
+		wantWarning string
+	}{
+		{
+			name:        "/30 with skipping",
+			cidr:        "10.0.0.0/30",
+			kvlbc:       &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+			wantWarning: "skipping the end IPs of cidr [10.0.0.0/30] leaves only 2 usable addresses in pool [10.0.0.0/30]",
+		},
+		{
+			name: "/30 without skipping",
+			cidr: "10.0.0.0/30",
+		},
+		{
+			name:  "/31 with skipping keeps both addresses",
+			cidr:  "10.0.0.0/31",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+		},
+		{
+			name:  "/29 with skipping",
+			cidr:  "10.0.0.0/29",
+			kvlbc: &config.KubevipLBConfig{SkipEndIPsInCIDR: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, restore := tu.CaptureKlog(t, "0")
+			_, err := buildHostsFromCidr(tt.cidr, tt.kvlbc)
+			restore()
+			if err != nil {
+				t.Fatalf("buildHostsFromCidr() error = %v", err)
+			}
+			if len(tt.wantWarning) > 0 && !strings.Contains(buf.String(), tt.wantWarning) {
+				t.Errorf("expected warning %q to be logged, got log:\n%s", tt.wantWarning, buf.String())
+			}
+			if len(tt.wantWarning) == 0 && strings.Contains(buf.String(), "usable addresses") {
+				t.Errorf("expected no warning, got log:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestFindFreeAddressTrace(t *testing.T) {
+	pool, err := buildAddressesFromRange("10.0.0.0-10.0.0.2")
+	if err != nil {
+		t.Fatalf("buildAddressesFromRange() error = %v", err)
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.Add(netip.MustParseAddr("10.0.0.1"))
+	inUse, err := builder.IPSet()
+	if err != nil {
+		t.Fatalf("failed to build in-use set: %v", err)
+	}
+
+	trace := []string{
+		"finding a free address in pool ranges [10.0.0.0-10.0.0.2] with 1 in-use ranges",
+		"skipping address 10.0.0.0, it is a network or broadcast address",
+		"skipping address 10.0.0.1, it is in use",
+		"chose address 10.0.0.2",
+	}
+
+	tests := []struct {
+		name      string
+		verbosity string
+		wantTrace bool
+	}{
+		{name: "default verbosity", verbosity: "0", wantTrace: false},
+		{name: "trace verbosity", verbosity: "5", wantTrace: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, restore := tu.CaptureKlog(t, tt.verbosity)
+			addr, err := FindFreeAddress(pool, inUse, &config.KubevipLBConfig{})
+			restore()
+			if err != nil {
+				t.Fatalf("FindFreeAddress() error = %v", err)
+			}
+			if addr.String() != "10.0.0.2" {
+				t.Errorf("FindFreeAddress() = %s, want 10.0.0.2", addr)
+			}
+			for _, line := range trace {
+				if strings.Contains(buf.String(), line) != tt.wantTrace {
+					t.Errorf("expected trace %q to be logged: %t, got log:\n%s", line, tt.wantTrace, buf.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// poolMetadataSeparator separates a cidr, range or address of a pool from its metadata, e.g. 10.0.0.50#zone=a
+	poolMetadataSeparator = "#"
+
+	// ZoneMetadataKey is the metadata key of the zone of the addresses of a pool entry, e.g. 10.0.0.0/28#zone=a
+	ZoneMetadataKey = "zone"
+)
+
+// splitEntryMetadata returns the cidr, range or address of the pool entry and its metadata, "" if it has none
+func splitEntryMetadata(entry string) (string, string) {
+	address, metadata, _ := strings.Cut(entry, poolMetadataSeparator)
+	return address, metadata
+}
+
+// StripPoolMetadata returns the pool without the metadata of its entries
+func StripPoolMetadata(pool string) string {
+	if !strings.Contains(pool, poolMetadataSeparator) {
+		return pool
+	}
+	entries := strings.Split(pool, ",")
+	for x := range entries {
+		entries[x], _ = splitEntryMetadata(entries[x])
+	}
+	return strings.Join(entries, ",")
+}
+
+// parseEntryMetadata returns the metadata of a pool entry as key value pairs, only the zone key is supported
+func parseEntryMetadata(metadata string) (map[string]string, error) {
+	key, value, ok := strings.Cut(strings.TrimSpace(metadata), "=")
+	if !ok || key != ZoneMetadataKey || len(value) == 0 {
+		return nil, fmt.Errorf("invalid pool metadata [%s], expected %s=<zone>", metadata, ZoneMetadataKey)
+	}
+	return map[string]string{key: value}, nil
+}
+
+// AddressMetadata returns the metadata of the entry of the pool holding the address, nil if the entry has none or
+// the address isn't part of the pool
+func AddressMetadata(pool string, addr netip.Addr) (map[string]string, error) {
+	if !strings.Contains(pool, poolMetadataSeparator) {
+		return nil, nil
+	}
+	for _, entry := range strings.Split(pool, ",") {
+		address, metadata := splitEntryMetadata(entry)
+		if len(metadata) == 0 {
+			continue
+		}
+		contains, err := PoolContains(address, addr)
+		if err != nil {
+			return nil, err
+		}
+		if contains {
+			return parseEntryMetadata(metadata)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,88 @@
+package ipam
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestStripPoolMetadata(t *testing.T) {
+	got := StripPoolMetadata("10.0.0.0/28#zone=a,10.0.1.0/28,fd00::/120#zone=b")
+	if want := "10.0.0.0/28,10.0.1.0/28,fd00::/120"; got != want {
+		t.Errorf("StripPoolMetadata() = %q, want %q", got, want)
+	}
+}
+
+func TestPoolWithMetadata(t *testing.T) {
+	// the metadata may contain the range separator
+	if !IsCidrPool("10.0.0.0/28#zone=us-east-1a") {
+		t.Error("IsCidrPool() = false, want true")
+	}
+	for _, pool := range []string{"10.0.0.0/30#zone=us-east-1a", "10.0.0.0-10.0.0.3#zone=us-east-1a"} {
+		size, err := PoolSize(pool)
+		if err != nil {
+			t.Fatalf("PoolSize(%s) error = %v", pool, err)
+		}
+		if size.Int64() != 4 {
+			t.Errorf("PoolSize(%s) = %s, want 4", pool, size)
+		}
+	}
+	ipv4, ipv6, err := SplitCIDRsByIPFamily("10.0.0.0/30#zone=a,fd00::/126#zone=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4 != "10.0.0.0/30" || ipv6 != "fd00::/126" {
+		t.Errorf("SplitCIDRsByIPFamily() = %q, %q", ipv4, ipv6)
+	}
+}
+
+func TestAddressMetadata(t *testing.T) {
+	pool := "10.0.0.0/30#zone=a,10.0.0.4-10.0.0.7,10.0.0.8-10.0.0.8#zone=b"
+	tests := []struct {
+		name    string
+		pool    string
+		addr    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "cidr with a zone",
+			pool: pool,
+			addr: "10.0.0.1",
+			want: map[string]string{ZoneMetadataKey: "a"},
+		},
+		{
+			name: "entry without metadata",
+			pool: pool,
+			addr: "10.0.0.5",
+		},
+		{
+			name: "single address with a zone",
+			pool: pool,
+			addr: "10.0.0.8",
+			want: map[string]string{ZoneMetadataKey: "b"},
+		},
+		{
+			name: "address outside of the pool",
+			pool: pool,
+			addr: "10.0.1.1",
+		},
+		{
+			name:    "unsupported metadata key",
+			pool:    "10.0.0.0/30#rack=1",
+			addr:    "10.0.0.1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressMetadata(tt.pool, netip.MustParseAddr(tt.addr))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddressMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AddressMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package ipam
+
+import (
+	"math/big"
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go4.org/netipx"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// poolFragmentationRatio is the number of free islands over the free addresses of a pool, 1/free for a
+// contiguous free pool up to 1 when no two free addresses are adjacent
+var poolFragmentationRatio = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Namespace:      "kubevip",
+		Subsystem:      "pool",
+		Name:           "fragmentation_ratio",
+		Help:           "Number of free address islands over the number of free addresses of the pool",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace", "pool"},
+)
+
+// poolAddresses is the number of addresses of a pool
+var poolAddresses = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Namespace:      "kubevip",
+		Subsystem:      "pool",
+		Name:           "addresses",
+		Help:           "Number of addresses of the pool",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace", "pool"},
+)
+
+// poolAddressesInUse is the number of addresses of a pool used by services
+var poolAddressesInUse = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Namespace:      "kubevip",
+		Subsystem:      "pool",
+		Name:           "addresses_in_use",
+		Help:           "Number of addresses of the pool in use by services",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace", "pool"},
+)
+
+// poolUtilizationAlerts is the number of times a pool crossed the utilization alert threshold
+var poolUtilizationAlerts = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Namespace:      "kubevip",
+		Subsystem:      "pool",
+		Name:           "utilization_alerts_total",
+		Help:           "Number of times the pool crossed the utilization alert threshold",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace", "pool"},
+)
+
+// poolExhaustions is the number of allocations of services of a namespace that failed as their pool was exhausted
+var poolExhaustions = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Namespace:      "kubevip",
+		Subsystem:      "pool",
+		Name:           "exhausted_total",
+		Help:           "Number of allocations of services of the namespace that failed as the pool was exhausted",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace"},
+)
+
+const (
+	// AllocationOutcomeAllocated is the outcome of an allocation that gave IPs to the service
+	AllocationOutcomeAllocated = "allocated"
+
+	// AllocationOutcomeFailed is the outcome of an allocation that failed
+	AllocationOutcomeFailed = "failed"
+)
+
+// allocations is the number of IP allocations of services by outcome
+var allocations = metrics.NewCounterVec(
+	&metrics.CounterOpts{
+		Namespace:      "kubevip",
+		Name:           "allocations_total",
+		Help:           "Number of IP allocations of services by outcome",
+		StabilityLevel: metrics.ALPHA,
+	},
+	[]string{"namespace", "outcome"},
+)
+
+func init() {
+	legacyregistry.MustRegister(poolFragmentationRatio, poolAddresses, poolAddressesInUse, poolUtilizationAlerts, poolExhaustions, allocations)
+}
+
+// RecordAllocation counts an allocation of the service with the outcome, with exemplar set the namespace/name of the
+// service is attached to the counter as an OpenMetrics exemplar
+func RecordAllocation(namespace, name, outcome string, exemplar bool) {
+	counter := allocations.WithLabelValues(namespace, outcome)
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && exemplar {
+		adder.AddWithExemplar(1, prometheus.Labels{"service": namespace + "/" + name})
+		return
+	}
+	counter.Inc()
+}
+
+// RecordPoolUtilizationAlert counts a crossing of the utilization alert threshold by the pool of the namespace
+func RecordPoolUtilizationAlert(namespace, pool string) {
+	poolUtilizationAlerts.WithLabelValues(namespace, PoolLabel(pool)).Inc()
+}
+
+// RecordPoolExhausted counts an allocation of a service of the namespace that failed as the pool was exhausted
+func RecordPoolExhausted(namespace string) {
+	poolExhaustions.WithLabelValues(namespace).Inc()
+}
+
+// FragmentationRatio returns the number of free islands over the number of free addresses of the pool,
+// the free addresses are the pool minus the in-use addresses. It returns 0 if the pool has no free address.
+func FragmentationRatio(poolIPSet, inUseIPSet *netipx.IPSet) float64 {
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolIPSet)
+	builder.RemoveSet(inUseIPSet)
+	free, err := builder.IPSet()
+	if err != nil {
+		return 0
+	}
+
+	total := addressCount(free)
+	if total.Sign() == 0 {
+		return 0
+	}
+
+	ratio, _ := new(big.Float).Quo(big.NewFloat(float64(len(free.Ranges()))), new(big.Float).SetInt(total)).Float64()
+	return ratio
+}
+
+// Utilization returns the number of addresses of the pool and the number of them in use
+func Utilization(poolIPSet, inUseIPSet *netipx.IPSet) (size, inUse float64) {
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolIPSet)
+	builder.Intersect(inUseIPSet)
+	used, err := builder.IPSet()
+	if err != nil {
+		return 0, 0
+	}
+
+	size, _ = new(big.Float).SetInt(addressCount(poolIPSet)).Float64()
+	inUse, _ = new(big.Float).SetInt(addressCount(used)).Float64()
+	return size, inUse
+}
+
+// addressCount returns the number of addresses of the IPSet
+func addressCount(ipSet *netipx.IPSet) *big.Int {
+	total := new(big.Int)
+	for _, r := range ipSet.Ranges() {
+		from, to := r.From().As16(), r.To().As16()
+		size := new(big.Int).Sub(new(big.Int).SetBytes(to[:]), new(big.Int).SetBytes(from[:]))
+		total.Add(total, size.Add(size, big.NewInt(1)))
+	}
+	return total
+}
+
+// recordedPool is the namespace and IP family a pool was recorded for
+type recordedPool struct {
+	namespace string
+	ipv6      bool
+}
+
+// recordedPools holds the pool last recorded for each namespace and IP family, so the series of a pool are deleted
+// once the namespace is allocated from another pool. It's guarded by managerLock.
+var recordedPools = map[recordedPool]string{}
+
+// deletePoolSeries deletes the utilization and fragmentation series of the pool of the namespace
+func deletePoolSeries(namespace, pool string) {
+	poolAddresses.DeleteLabelValues(namespace, pool)
+	poolAddressesInUse.DeleteLabelValues(namespace, pool)
+	poolFragmentationRatio.DeleteLabelValues(namespace, pool)
+}
+
+// resetPoolSeries deletes the utilization and fragmentation series of all the pools, they are recorded again on the
+// next allocation from each pool
+func resetPoolSeries() {
+	for key, pool := range recordedPools {
+		deletePoolSeries(key.namespace, pool)
+	}
+	recordedPools = map[recordedPool]string{}
+}
+
+// recordPoolMetrics sets the utilization and fragmentation of the pool of the namespace, labelled with PoolLabel,
+// the allocated address is counted as in use if it is valid. The series of the pool previously recorded for the
+// namespace and the IP family of the pool are deleted.
+func recordPoolMetrics(namespace, pool string, poolIPSet, inUseIPSet *netipx.IPSet, allocated netip.Addr) {
+	pool = poolLabel(pool, poolIPSet)
+	if ranges := poolIPSet.Ranges(); len(ranges) > 0 {
+		key := recordedPool{namespace: namespace, ipv6: ranges[0].From().Is6()}
+		if previous, ok := recordedPools[key]; ok && previous != pool {
+			deletePoolSeries(namespace, previous)
+		}
+		recordedPools[key] = pool
+	}
+
+	if allocated.IsValid() {
+		builder := &netipx.IPSetBuilder{}
+		builder.AddSet(inUseIPSet)
+		builder.Add(allocated)
+		if withAllocated, err := builder.IPSet(); err == nil {
+			inUseIPSet = withAllocated
+		}
+	}
+
+	size, inUse := Utilization(poolIPSet, inUseIPSet)
+	poolAddresses.WithLabelValues(namespace, pool).Set(size)
+	poolAddressesInUse.WithLabelValues(namespace, pool).Set(inUse)
+	poolFragmentationRatio.WithLabelValues(namespace, pool).Set(FragmentationRatio(poolIPSet, inUseIPSet))
+}
@@ -0,0 +1,205 @@
+package ipam
+
+import (
+	"net/netip"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/ptr"
+)
+
+func TestFragmentationRatio(t *testing.T) {
+	pool, err := buildAddressesFromRange("192.168.0.1-192.168.0.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		inUse []string
+		want  float64
+	}{
+		{
+			name: "contiguous free pool",
+			want: 1.0 / 8,
+		},
+		{
+			name:  "contiguous free pool after allocations from the start",
+			inUse: []string{"192.168.0.1", "192.168.0.2", "192.168.0.3", "192.168.0.4"},
+			want:  1.0 / 4,
+		},
+		{
+			name:  "checkerboard",
+			inUse: []string{"192.168.0.1", "192.168.0.3", "192.168.0.5", "192.168.0.7"},
+			want:  1,
+		},
+		{
+			name:  "full pool",
+			inUse: []string{"192.168.0.1-192.168.0.8"},
+			want:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, ip := range tt.inUse {
+				if r, err := netipx.ParseIPRange(ip); err == nil {
+					builder.AddRange(r)
+					continue
+				}
+				builder.Add(netip.MustParseAddr(ip))
+			}
+			inUse, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.InDelta(t, tt.want, FragmentationRatio(pool, inUse), 1e-9)
+		})
+	}
+}
+
+func TestRecordPoolMetrics(t *testing.T) {
+	defer ResetManager()
+
+	inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindAvailableHostFromRange("metrics", "10.0.0.1-10.0.0.4", inUse, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.0.0.1 is allocated, 10.0.0.2-10.0.0.4 are free
+	ratio, err := testutil.GetGaugeMetricValue(poolFragmentationRatio.WithLabelValues("metrics", "10.0.0.1-10.0.0.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, 1.0/3, ratio, 1e-9)
+
+	size, err := testutil.GetGaugeMetricValue(poolAddresses.WithLabelValues("metrics", "10.0.0.1-10.0.0.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, float64(4), size)
+
+	used, err := testutil.GetGaugeMetricValue(poolAddressesInUse.WithLabelValues("metrics", "10.0.0.1-10.0.0.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, float64(1), used)
+}
+
+func TestRecordPoolMetricsDeletesStaleSeries(t *testing.T) {
+	defer ResetManager()
+
+	inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pool := range []string{"10.0.1.1-10.0.1.4", "fd00::1-fd00::4", "10.0.2.1-10.0.2.4"} {
+		if _, err := FindAvailableHostFromRange("stale", pool, inUse, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the IPv4 pool changed, the series of the previous IPv4 pool are deleted, the IPv6 pool is kept
+	want := []string{}
+	for _, name := range []string{"kubevip_pool_addresses", "kubevip_pool_addresses_in_use", "kubevip_pool_fragmentation_ratio"} {
+		want = append(want, name+" 10.0.2.1-10.0.2.4", name+" fd00::1-fd00::4")
+	}
+	assert.ElementsMatch(t, want, poolSeries(t, "stale"))
+
+	ResetManager()
+	assert.Empty(t, poolSeries(t, "stale"))
+}
+
+// poolSeries returns the utilization and fragmentation series of the namespace, as <metric> <pool>
+func poolSeries(t *testing.T, namespace string) []string {
+	t.Helper()
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []string{}
+	for _, family := range families {
+		switch family.GetName() {
+		case "kubevip_pool_addresses", "kubevip_pool_addresses_in_use", "kubevip_pool_fragmentation_ratio":
+		default:
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["namespace"] == namespace {
+				series = append(series, family.GetName()+" "+labels["pool"])
+			}
+		}
+	}
+	return series
+}
+
+func TestRecordAllocation(t *testing.T) {
+	tests := []struct {
+		name         string
+		namespace    string
+		exemplar     bool
+		wantExemplar []*dto.LabelPair
+	}{
+		{
+			name:      "without exemplar",
+			namespace: "no-exemplar",
+		},
+		{
+			name:         "with exemplar",
+			namespace:    "exemplar",
+			exemplar:     true,
+			wantExemplar: []*dto.LabelPair{{Name: ptr.To("service"), Value: ptr.To("exemplar/ingress")}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RecordAllocation(tt.namespace, "ingress", AllocationOutcomeAllocated, tt.exemplar)
+
+			counter := allocations.WithLabelValues(tt.namespace, AllocationOutcomeAllocated)
+			value, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, float64(1), value)
+
+			m := &dto.Metric{}
+			if err := counter.(metrics.Metric).Write(m); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantExemplar == nil {
+				assert.Nil(t, m.GetCounter().GetExemplar())
+				return
+			}
+			assert.Equal(t, tt.wantExemplar, m.GetCounter().GetExemplar().GetLabel())
+			assert.Equal(t, float64(1), m.GetCounter().GetExemplar().GetValue())
+		})
+	}
+}
+
+func TestRecordPoolExhausted(t *testing.T) {
+	RecordPoolExhausted("tenant-a")
+	RecordPoolExhausted("tenant-a")
+	RecordPoolExhausted("tenant-b")
+
+	for namespace, want := range map[string]float64{"tenant-a": 2, "tenant-b": 1, "tenant-c": 0} {
+		value, err := testutil.GetCounterMetricValue(poolExhaustions.WithLabelValues(namespace))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, value, namespace)
+	}
+}
@@ -0,0 +1,36 @@
+package ipam
+
+import (
+	"fmt"
+	"strings"
+
+	"go4.org/netipx"
+)
+
+// PoolOverlaps returns a description of every duplicate or overlapping pair of entries of the pool, the pool is either
+// cidrs or ranges. The entries are still merged into one pool, the overlaps often are a copy-paste error though.
+func PoolOverlaps(pool string) ([]string, error) {
+	entries := strings.Split(StripPoolMetadata(pool), ",")
+	sets := make([]*netipx.IPSet, len(entries))
+	for x := range entries {
+		entries[x] = strings.TrimSpace(entries[x])
+		set, err := parsePool(entries[x])
+		if err != nil {
+			return nil, err
+		}
+		sets[x] = set
+	}
+
+	var overlaps []string
+	for x := range sets {
+		for y := x + 1; y < len(sets); y++ {
+			switch {
+			case sets[x].Equal(sets[y]):
+				overlaps = append(overlaps, fmt.Sprintf("[%s] duplicates [%s]", entries[y], entries[x]))
+			case sets[x].Overlaps(sets[y]):
+				overlaps = append(overlaps, fmt.Sprintf("[%s] overlaps [%s]", entries[y], entries[x]))
+			}
+		}
+	}
+	return overlaps, nil
+}
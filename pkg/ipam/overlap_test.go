@@ -0,0 +1,51 @@
+package ipam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPoolOverlaps(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "disjoint ranges",
+			pool: "10.0.0.1-10.0.0.5,10.0.0.6-10.0.0.10",
+		},
+		{
+			name: "overlapping ranges",
+			pool: "10.0.0.1-10.0.0.5,10.0.0.4-10.0.0.10",
+			want: []string{"[10.0.0.4-10.0.0.10] overlaps [10.0.0.1-10.0.0.5]"},
+		},
+		{
+			name: "duplicate ranges",
+			pool: "10.0.0.1-10.0.0.5, 10.0.0.1-10.0.0.5",
+			want: []string{"[10.0.0.1-10.0.0.5] duplicates [10.0.0.1-10.0.0.5]"},
+		},
+		{
+			name: "nested cidrs with metadata",
+			pool: "10.0.0.0/24#zone=a,10.0.0.128/25#zone=b,fd00::/120",
+			want: []string{"[10.0.0.128/25] overlaps [10.0.0.0/24]"},
+		},
+		{
+			name:    "invalid range",
+			pool:    "10.0.0.1-10.0.0.5,10.0.0.x-10.0.0.8",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PoolOverlaps(tt.pool)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PoolOverlaps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PoolOverlaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package ipam
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+// DefaultReleaseHistorySize is the number of releases kept in the history of the release registry unless
+// release-history-size-global is set
+const DefaultReleaseHistorySize = 1000
+
+// release records when and by which service an address was released
+type release struct {
+	namespace string
+	name      string
+	at        time.Time
+	// seq orders the releases by the time they were recorded, the oldest are evicted from the history first
+	seq uint64
+}
+
+// ReleaseEntry describes a release kept by the release registry
+type ReleaseEntry struct {
+	Address    string    `json:"address"`
+	Namespace  string    `json:"namespace"`
+	Service    string    `json:"service,omitempty"`
+	ReleasedAt time.Time `json:"releasedAt"`
+}
+
+// releaseRegistry keeps the addresses released recently, FindFreeAddress doesn't hand them out again during the
+// cooldowns of the KubevipLBConfig. It is kept in memory, a restart of the controller ends the running cooldowns.
+// The releases enforcing the cooldowns are only forgotten once the cooldowns ended, the history listed by the admin
+// endpoint is kept apart and holds at most size releases, the least recently recorded are evicted first.
+type releaseRegistry struct {
+	mu       sync.Mutex
+	releases map[netip.Addr]release
+	history  map[netip.Addr]release
+	size     int
+	seq      uint64
+}
+
+var releases = &releaseRegistry{releases: map[netip.Addr]release{}, history: map[netip.Addr]release{}, size: DefaultReleaseHistorySize}
+
+// RecordRelease records the release of the addresses by the service name of the namespace, the name may be empty
+func RecordRelease(addrs []netip.Addr, namespace, name string, at time.Time) {
+	releases.mu.Lock()
+	defer releases.mu.Unlock()
+	for _, addr := range addrs {
+		releases.seq++
+		rel := release{namespace: namespace, name: name, at: at, seq: releases.seq}
+		releases.releases[addr] = rel
+		releases.history[addr] = rel
+	}
+	releases.evict()
+}
+
+// SetReleaseHistorySize sets the number of releases kept in the history of the release registry, the oldest are
+// evicted if it holds more. The running cooldowns aren't affected.
+func SetReleaseHistorySize(size int) {
+	releases.mu.Lock()
+	defer releases.mu.Unlock()
+	releases.size = size
+	releases.evict()
+}
+
+// RecentReleases returns the releases kept in the history of the release registry, the most recent first
+func RecentReleases() []ReleaseEntry {
+	releases.mu.Lock()
+	defer releases.mu.Unlock()
+	addrs := make([]netip.Addr, 0, len(releases.history))
+	for addr := range releases.history {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, func(a, b netip.Addr) int {
+		return cmp.Compare(releases.history[b].seq, releases.history[a].seq)
+	})
+	entries := make([]ReleaseEntry, 0, len(addrs))
+	for _, addr := range addrs {
+		rel := releases.history[addr]
+		entries = append(entries, ReleaseEntry{Address: addr.String(), Namespace: rel.namespace, Service: rel.name, ReleasedAt: rel.at})
+	}
+	return entries
+}
+
+// ReleasedBy returns the addresses last released by the service name of the namespace, the most recent first, so a
+// service recreated with the same name can reclaim them
+func ReleasedBy(namespace, name string) []netip.Addr {
+	releases.mu.Lock()
+	defer releases.mu.Unlock()
+	var addrs []netip.Addr
+	for addr, rel := range releases.releases {
+		if rel.namespace == namespace && rel.name == name {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.SortFunc(addrs, func(a, b netip.Addr) int {
+		return cmp.Compare(releases.releases[b].seq, releases.releases[a].seq)
+	})
+	return addrs
+}
+
+// ResetReleases forgets all the releases
+func ResetReleases() {
+	releases.mu.Lock()
+	defer releases.mu.Unlock()
+	clear(releases.releases)
+	clear(releases.history)
+}
+
+// evict forgets the least recently recorded releases of the history above the size of the registry, r.mu must be held
+func (r *releaseRegistry) evict() {
+	for r.size > 0 && len(r.history) > r.size {
+		var oldest netip.Addr
+		for addr, rel := range r.history {
+			if !oldest.IsValid() || rel.seq < r.history[oldest].seq {
+				oldest = addr
+			}
+		}
+		delete(r.history, oldest)
+	}
+}
+
+// IsCoolingDown returns true if the address was released too recently to be allocated with the KubevipLBConfig
+func IsCoolingDown(addr netip.Addr, kubevipLBConfig *config.KubevipLBConfig) bool {
+	_, ok := releases.coolingDown(kubevipLBConfig, time.Now())[addr]
+	return ok
+}
+
+// coolingDown returns the addresses that can't be allocated yet with the KubevipLBConfig: the ones released less than
+// ReleaseCooldown ago, and the ones released by another namespace less than CrossNamespaceCooldown ago. The releases
+// older than both cooldowns are forgotten.
+func (r *releaseRegistry) coolingDown(kubevipLBConfig *config.KubevipLBConfig, now time.Time) map[netip.Addr]release {
+	if kubevipLBConfig == nil || (kubevipLBConfig.ReleaseCooldown == 0 && kubevipLBConfig.CrossNamespaceCooldown == 0) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := map[netip.Addr]release{}
+	for addr, rel := range r.releases {
+		age := now.Sub(rel.at)
+		if age >= kubevipLBConfig.ReleaseCooldown && age >= kubevipLBConfig.CrossNamespaceCooldown {
+			delete(r.releases, addr)
+			continue
+		}
+		if age < kubevipLBConfig.ReleaseCooldown ||
+			(rel.namespace != kubevipLBConfig.Namespace && age < kubevipLBConfig.CrossNamespaceCooldown) {
+			addrs[addr] = rel
+		}
+	}
+	return addrs
+}
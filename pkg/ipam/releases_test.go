@@ -0,0 +1,149 @@
+package ipam
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"go4.org/netipx"
+)
+
+func Test_FindFreeAddressReleaseCooldown(t *testing.T) {
+	ResetReleases()
+	defer ResetReleases()
+
+	poolIPSet, err := buildAddressesFromRange("10.0.0.1-10.0.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUseIPSet := &netipx.IPSet{}
+	now := time.Now()
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, "team-a", "", now.Add(-30*time.Second))
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, "team-a", "", now.Add(-2*time.Minute))
+
+	tests := []struct {
+		name   string
+		config *config.KubevipLBConfig
+		want   string
+	}{
+		{
+			name:   "no cooldown",
+			config: &config.KubevipLBConfig{Namespace: "team-b"},
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "the addresses released by another namespace during the cross-namespace cooldown are skipped",
+			config: &config.KubevipLBConfig{Namespace: "team-b", CrossNamespaceCooldown: time.Hour},
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "the namespace that released the addresses can reuse them",
+			config: &config.KubevipLBConfig{Namespace: "team-a", CrossNamespaceCooldown: time.Hour},
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "both cooldowns apply together",
+			config: &config.KubevipLBConfig{Namespace: "team-a", ReleaseCooldown: time.Minute, CrossNamespaceCooldown: time.Hour},
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "the cooldowns apply in descending order",
+			config: &config.KubevipLBConfig{Namespace: "team-b", ReturnIPInDescOrder: true, CrossNamespaceCooldown: time.Hour},
+			want:   "10.0.0.4",
+		},
+		{
+			// runs last, the release of 10.0.0.2 is older than both cooldowns and is forgotten
+			name:   "the address released during the cooldown is skipped for every namespace",
+			config: &config.KubevipLBConfig{Namespace: "team-a", ReleaseCooldown: time.Minute},
+			want:   "10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindFreeAddress(poolIPSet, inUseIPSet, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("FindFreeAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_releaseRegistryForgetsExpiredReleases(t *testing.T) {
+	r := &releaseRegistry{releases: map[netip.Addr]release{}}
+	now := time.Now()
+	r.releases[netip.MustParseAddr("10.0.0.1")] = release{namespace: "team-a", at: now.Add(-30 * time.Second)}
+	r.releases[netip.MustParseAddr("fd00::1")] = release{namespace: "team-a", at: now.Add(-30 * time.Second)}
+	r.releases[netip.MustParseAddr("10.0.0.2")] = release{namespace: "team-a", at: now.Add(-2 * time.Minute)}
+
+	coolingDown := r.coolingDown(&config.KubevipLBConfig{Namespace: "team-b", CrossNamespaceCooldown: time.Minute}, now)
+	if len(coolingDown) != 2 {
+		t.Errorf("coolingDown() returned %d addresses, want 2", len(coolingDown))
+	}
+	if len(r.releases) != 2 {
+		t.Errorf("the expired release wasn't forgotten, %d releases are kept", len(r.releases))
+	}
+	// the releases are kept as long as no cooldown is configured
+	if r.coolingDown(&config.KubevipLBConfig{}, now.Add(time.Hour)) != nil || len(r.releases) != 2 {
+		t.Errorf("the releases were forgotten without a cooldown")
+	}
+}
+
+func Test_releaseRegistryEvictsAtHistorySize(t *testing.T) {
+	ResetReleases()
+	defer ResetReleases()
+	defer SetReleaseHistorySize(DefaultReleaseHistorySize)
+
+	SetReleaseHistorySize(2)
+	now := time.Now()
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, "team-a", "", now)
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, "team-a", "", now)
+	// released again, 10.0.0.1 is now the most recent release
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, "team-b", "", now)
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.3")}, "team-a", "", now)
+
+	want := []ReleaseEntry{
+		{Address: "10.0.0.3", Namespace: "team-a", ReleasedAt: now},
+		{Address: "10.0.0.1", Namespace: "team-b", ReleasedAt: now},
+	}
+	if got := RecentReleases(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RecentReleases() = %v, want %v", got, want)
+	}
+
+	// shrinking the history evicts the oldest releases
+	SetReleaseHistorySize(1)
+	if got := RecentReleases(); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("RecentReleases() = %v, want %v", got, want[:1])
+	}
+
+	// the releases evicted from the history still cool down and can be reclaimed
+	if !IsCoolingDown(netip.MustParseAddr("10.0.0.2"), &config.KubevipLBConfig{ReleaseCooldown: time.Hour}) {
+		t.Errorf("the cooldown of 10.0.0.2 ended with its eviction from the history")
+	}
+	if got := ReleasedBy("team-b", ""); !reflect.DeepEqual(got, []netip.Addr{netip.MustParseAddr("10.0.0.1")}) {
+		t.Errorf("ReleasedBy() = %v, want [10.0.0.1]", got)
+	}
+}
+
+func TestReleasedBy(t *testing.T) {
+	ResetReleases()
+	defer ResetReleases()
+
+	now := time.Now()
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}, "team-a", "web", now)
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, "team-a", "api", now)
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.3")}, "team-b", "web", now)
+	RecordRelease([]netip.Addr{netip.MustParseAddr("10.0.0.4")}, "team-a", "web", now)
+
+	want := []netip.Addr{netip.MustParseAddr("10.0.0.4"), netip.MustParseAddr("fd00::1"), netip.MustParseAddr("10.0.0.1")}
+	if got := ReleasedBy("team-a", "web"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReleasedBy() = %v, want %v", got, want)
+	}
+	if got := ReleasedBy("team-c", "web"); len(got) != 0 {
+		t.Errorf("ReleasedBy() = %v, want none", got)
+	}
+}
@@ -0,0 +1,54 @@
+package ipam
+
+import (
+	"net/netip"
+
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+// reservedRange is a well-known IANA range that should never be allocated to a service
+type reservedRange struct {
+	name   string
+	prefix netip.Prefix
+}
+
+var reservedRanges = []reservedRange{
+	{name: "this network", prefix: netip.MustParsePrefix("0.0.0.0/8")},
+	{name: "loopback", prefix: netip.MustParsePrefix("127.0.0.0/8")},
+	{name: "link-local", prefix: netip.MustParsePrefix("169.254.0.0/16")},
+	{name: "multicast", prefix: netip.MustParsePrefix("224.0.0.0/4")},
+	{name: "reserved", prefix: netip.MustParsePrefix("240.0.0.0/4")},
+	{name: "unspecified", prefix: netip.MustParsePrefix("::/128")},
+	{name: "loopback", prefix: netip.MustParsePrefix("::1/128")},
+	{name: "link-local", prefix: netip.MustParsePrefix("fe80::/10")},
+	{name: "multicast", prefix: netip.MustParsePrefix("ff00::/8")},
+}
+
+// reservedRangeOf returns the reserved range of the address, false if it isn't in one
+func reservedRangeOf(addr netip.Addr) (reservedRange, bool) {
+	for _, r := range reservedRanges {
+		if r.prefix.Contains(addr.Unmap()) {
+			return r, true
+		}
+	}
+	return reservedRange{}, false
+}
+
+// AllowsReservedAddress returns false if the address is in a well-known reserved range, e.g. multicast or loopback, and
+// RejectReservedRanges is set. Otherwise the address of a reserved range is allowed with a warning, the pool is likely
+// misconfigured.
+func AllowsReservedAddress(addr netip.Addr, kubevipLBConfig *config.KubevipLBConfig) bool {
+	r, ok := reservedRangeOf(addr)
+	if !ok {
+		return true
+	}
+	if kubevipLBConfig != nil && kubevipLBConfig.RejectReservedRanges {
+		Tracef(kubevipLBConfig, "skipping address %s, it is in the %s range %s", addr, r.name, r.prefix)
+		return false
+	}
+	klog.Warningf("allocating address %s of the %s range %s, the pool is likely misconfigured, set reject-reserved-ranges-global to refuse it",
+		addr, r.name, r.prefix)
+	return true
+}
@@ -0,0 +1,112 @@
+package ipam
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"go4.org/netipx"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func TestFindFreeAddressReservedRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        string
+		inUse       string
+		config      *config.KubevipLBConfig
+		want        string
+		wantErr     bool
+		wantWarning string
+	}{
+		{
+			name:        "a multicast address is allocated with a warning",
+			pool:        "223.255.255.253-224.0.0.2",
+			inUse:       "223.255.255.253-223.255.255.254",
+			config:      &config.KubevipLBConfig{},
+			want:        "224.0.0.1",
+			wantWarning: "allocating address 224.0.0.1 of the multicast range 224.0.0.0/4",
+		},
+		{
+			name:    "a multicast address is rejected",
+			pool:    "223.255.255.253-224.0.0.2",
+			inUse:   "223.255.255.253-223.255.255.254",
+			config:  &config.KubevipLBConfig{RejectReservedRanges: true},
+			wantErr: true,
+		},
+		{
+			name:   "the addresses before the multicast range are still allocated",
+			pool:   "223.255.255.253-224.0.0.2",
+			config: &config.KubevipLBConfig{RejectReservedRanges: true, ReturnIPInDescOrder: true},
+			want:   "223.255.255.254",
+		},
+		{
+			name:    "an IPv6 multicast address is rejected",
+			pool:    "feff:ffff:ffff:ffff:ffff:ffff:ffff:ffff-ff00::1",
+			inUse:   "feff:ffff:ffff:ffff:ffff:ffff:ffff:ffff-feff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			config:  &config.KubevipLBConfig{RejectReservedRanges: true},
+			wantErr: true,
+		},
+		{
+			name:    "a loopback address is rejected",
+			pool:    "127.0.0.1-127.0.0.2",
+			config:  &config.KubevipLBConfig{RejectReservedRanges: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poolIPSet, err := buildAddressesFromRange(tt.pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inUseIPSet := &netipx.IPSet{}
+			if len(tt.inUse) > 0 {
+				if inUseIPSet, err = buildAddressesFromRange(tt.inUse); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			buf, restore := tu.CaptureKlog(t, "0")
+			got, err := FindFreeAddress(poolIPSet, inUseIPSet, tt.config)
+			restore()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindFreeAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("FindFreeAddress() = %v, want %v", got, tt.want)
+			}
+			if len(tt.wantWarning) > 0 && !strings.Contains(buf.String(), tt.wantWarning) {
+				t.Errorf("expected warning %q, got %q", tt.wantWarning, buf.String())
+			}
+			if len(tt.wantWarning) == 0 && strings.Contains(buf.String(), "range") {
+				t.Errorf("unexpected warning %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestAllowsReservedAddress(t *testing.T) {
+	reject := &config.KubevipLBConfig{RejectReservedRanges: true}
+	for addr, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"224.0.0.251": false,
+		"239.1.1.1":   false,
+		"127.0.0.1":   false,
+		"169.254.1.1": false,
+		"240.0.0.1":   false,
+		"2001:db8::1": true,
+		"ff02::1":     false,
+		"fe80::1":     false,
+		"::1":         false,
+	} {
+		if got := AllowsReservedAddress(netip.MustParseAddr(addr), reject); got != want {
+			t.Errorf("AllowsReservedAddress(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
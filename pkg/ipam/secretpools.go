@@ -0,0 +1,55 @@
+package ipam
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"go4.org/netipx"
+)
+
+// secretPools holds the addresses of the pools kept in a Secret by key, nil if there is no such Secret
+var secretPools atomic.Pointer[map[string]*netipx.IPSet]
+
+// SetSecretPools sets the pools kept in a Secret by key, the metrics then label a pool overlapping one of them
+// secret:<key> instead of exposing its addresses. The pools that can't be parsed are ignored, nil forgets them all.
+func SetSecretPools(pools map[string]string) {
+	if pools == nil {
+		secretPools.Store(nil)
+		return
+	}
+	sets := make(map[string]*netipx.IPSet, len(pools))
+	for key, pool := range pools {
+		if poolIPSet, err := parsePool(pool); err == nil {
+			sets[key] = poolIPSet
+		}
+	}
+	secretPools.Store(&sets)
+}
+
+// PoolLabel returns the pool as labelled in the metrics, secret:<key> if it overlaps the pool of a Secret key
+func PoolLabel(pool string) string {
+	poolIPSet, err := parsePool(pool)
+	if err != nil {
+		return pool
+	}
+	return poolLabel(pool, poolIPSet)
+}
+
+// poolLabel returns the pool as labelled in the metrics given its addresses
+func poolLabel(pool string, poolIPSet *netipx.IPSet) string {
+	sets := secretPools.Load()
+	if sets == nil || poolIPSet == nil {
+		return pool
+	}
+	keys := make([]string, 0, len(*sets))
+	for key := range *sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if (*sets)[key].Overlaps(poolIPSet) {
+			return "secret:" + key
+		}
+	}
+	return pool
+}
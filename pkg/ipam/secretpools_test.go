@@ -0,0 +1,39 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+)
+
+func TestRecordPoolMetricsRedactsSecretPools(t *testing.T) {
+	defer ResetManager()
+	defer SetSecretPools(nil)
+
+	SetSecretPools(map[string]string{
+		"cidr-global": "10.0.3.0/30,fd00::/126",
+		"range-prod":  "not a pool",
+	})
+	inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the IPv4 pool of the Secret, split by IP family, and a pool of the ConfigMap
+	if _, err := FindAvailableHostFromCidr("redacted", "10.0.3.0/30", inUse, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindAvailableHostFromRange("redacted", "fd00::10-fd00::13", inUse, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{}
+	for _, name := range []string{"kubevip_pool_addresses", "kubevip_pool_addresses_in_use", "kubevip_pool_fragmentation_ratio"} {
+		want = append(want, name+" secret:cidr-global", name+" fd00::10-fd00::13")
+	}
+	assert.ElementsMatch(t, want, poolSeries(t, "redacted"))
+
+	// the pools are exposed again once the Secret is gone
+	SetSecretPools(nil)
+	assert.Equal(t, "10.0.3.0/30", PoolLabel("10.0.3.0/30"))
+}
@@ -0,0 +1,76 @@
+package ipam
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog"
+)
+
+const (
+	// TextfilePathEnvKey environment key for the file the pool metrics are periodically written to in the Prometheus
+	// textfile collector format, e.g. /var/lib/node_exporter/textfile/kubevip.prom. Nothing is written unless it's set.
+	TextfilePathEnvKey = "KUBEVIP_TEXTFILE_PATH"
+
+	// textfileInterval is the interval the textfile is written at
+	textfileInterval = time.Minute
+
+	// textfileMetricPrefix is the prefix of the metrics written to the textfile, the other metrics of the registry
+	// (go runtime, client-go, ...) would clash with the ones of the node exporter
+	textfileMetricPrefix = "kubevip_"
+)
+
+// WriteTextfile writes the kube-vip metrics to the file in the Prometheus textfile collector format.
+// The file is written next to the path then renamed, so the collector never reads a partial file.
+func WriteTextfile(path string) error {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), textfileMetricPrefix) {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil { // #nosec G302 the node exporter reads the file
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// StartTextfileWriter writes the kube-vip metrics to the file every textfileInterval in the background
+func StartTextfileWriter(path string) {
+	go func() {
+		klog.Infof("writing pool metrics to textfile [%s] every %s", path, textfileInterval)
+		ticker := time.NewTicker(textfileInterval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			if err := WriteTextfile(path); err != nil {
+				klog.Errorf("unable to write pool metrics to textfile [%s]: %v", path, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package ipam
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	defer ResetManager()
+
+	inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindAvailableHostFromRange("textfile", "10.1.0.1-10.1.0.4", inUse, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "kubevip.prom")
+	if err := WriteTextfile(path); err != nil {
+		t.Fatalf("WriteTextfile() error: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, string(content), "# TYPE kubevip_pool_addresses gauge\n")
+	assert.Contains(t, string(content), `kubevip_pool_addresses{namespace="textfile",pool="10.1.0.1-10.1.0.4"} 4`+"\n")
+	assert.Contains(t, string(content), `kubevip_pool_addresses_in_use{namespace="textfile",pool="10.1.0.1-10.1.0.4"} 1`+"\n")
+	assert.Contains(t, string(content), `kubevip_pool_fragmentation_ratio{namespace="textfile",pool="10.1.0.1-10.1.0.4"} 0.3333333333333333`+"\n")
+	assert.NotContains(t, string(content), "go_goroutines", "only the kube-vip metrics are written")
+
+	// the temporary file is renamed in place
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+}
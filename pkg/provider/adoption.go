@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// discoverAdoption returns the selector of the services whose IPs are adopted from another load balancer implementation,
+// adopt-from-label-global, and the annotation holding their IPs, adopt-from-annotation-global. The selector is nil if
+// adoption isn't configured. Without annotation, the IPs are taken from the load balancer status of the service.
+func discoverAdoption(cm *v1.ConfigMap) (selector labels.Selector, annotation string) {
+	selectorStr, key, err := getGlobalConfig(cm, "adopt-from-label")
+	if err != nil || len(selectorStr) == 0 {
+		return nil, ""
+	}
+	selector, err = labels.Parse(selectorStr)
+	if err != nil {
+		klog.Warningf("invalid label selector [%s] in [%s], not adopting services: %v", selectorStr, key, err)
+		return nil, ""
+	}
+	annotation, _, _ = getGlobalConfig(cm, "adopt-from-annotation")
+	return selector, annotation
+}
+
+// foreignIPs returns the IPs given to the service by another load balancer implementation, from the annotation
+// if set, or from the load balancer status of the service
+func foreignIPs(service *v1.Service, annotation string) ([]netip.Addr, error) {
+	var ips []string
+	if len(annotation) > 0 {
+		for _, ip := range strings.Split(service.Annotations[annotation], ",") {
+			if ip = strings.TrimSpace(ip); len(ip) > 0 {
+				ips = append(ips, ip)
+			}
+		}
+	} else {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if len(ingress.IP) > 0 {
+				ips = append(ips, ingress.IP)
+			}
+		}
+	}
+
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// adoptableForeignIPs returns the IPs the service got from another load balancer implementation if the service matches
+// the adoption selector and all its IPs are in the pool and not used by another service, or an empty string otherwise
+func adoptableForeignIPs(service *v1.Service, cm *v1.ConfigMap, pool string, inUseIPSet *netipx.IPSet) string {
+	selector, annotation := discoverAdoption(cm)
+	if selector == nil || !selector.Matches(labels.Set(service.Labels)) {
+		return ""
+	}
+
+	addrs, err := foreignIPs(service, annotation)
+	if err != nil {
+		klog.Warningf("service '%s/%s' has invalid IPs to adopt, allocating from the pool: %v", service.Namespace, service.Name, err)
+		return ""
+	}
+	if len(addrs) == 0 {
+		klog.Infof("service '%s/%s' has no IP to adopt, allocating from the pool", service.Namespace, service.Name)
+		return ""
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if inPool, err := ipam.PoolContains(pool, addr); err != nil || !inPool {
+			klog.Warningf("service '%s/%s' IP [%s] is not in the pool [%s], allocating from the pool", service.Namespace, service.Name, addr, pool)
+			return ""
+		}
+		if inUseIPSet != nil && inUseIPSet.Contains(addr) {
+			klog.Warningf("service '%s/%s' IP [%s] is used by another service, allocating from the pool", service.Namespace, service.Name, addr)
+			return ""
+		}
+		ips = append(ips, addr.String())
+	}
+	return strings.Join(ips, ",")
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAdoptForeignIPs(t *testing.T) {
+	const metallbAnnotation = "metallb.universe.tf/loadBalancerIPs"
+
+	tests := []struct {
+		name         string
+		data         map[string]string
+		labels       map[string]string
+		annotations  map[string]string
+		ingress      []v1.LoadBalancerIngress
+		existingIP   string
+		expectIPs    string
+		expectAdopt  bool
+		expectEvents int
+	}{
+		{
+			name: "IP from the foreign annotation in the pool is adopted",
+			data: map[string]string{
+				"cidr-global":                  "10.0.0.0/24",
+				"adopt-from-label-global":      "migrate-from=metallb",
+				"adopt-from-annotation-global": metallbAnnotation,
+			},
+			labels:       map[string]string{"migrate-from": "metallb"},
+			annotations:  map[string]string{metallbAnnotation: "10.0.0.42"},
+			expectIPs:    "10.0.0.42",
+			expectAdopt:  true,
+			expectEvents: 1,
+		},
+		{
+			name: "IP from the load balancer status is adopted without annotation",
+			data: map[string]string{
+				"cidr-global":             "10.0.0.0/24",
+				"adopt-from-label-global": "migrate-from",
+			},
+			labels:       map[string]string{"migrate-from": "metallb"},
+			ingress:      []v1.LoadBalancerIngress{{IP: "10.0.0.43"}},
+			expectIPs:    "10.0.0.43",
+			expectAdopt:  true,
+			expectEvents: 1,
+		},
+		{
+			name: "service not matching the label gets an IP from the pool",
+			data: map[string]string{
+				"cidr-global":                  "10.0.0.0/24",
+				"adopt-from-label-global":      "migrate-from=metallb",
+				"adopt-from-annotation-global": metallbAnnotation,
+			},
+			annotations: map[string]string{metallbAnnotation: "10.0.0.42"},
+			expectIPs:   "10.0.0.1",
+		},
+		{
+			name: "IP out of the pool isn't adopted",
+			data: map[string]string{
+				"cidr-global":                  "10.0.0.0/24",
+				"adopt-from-label-global":      "migrate-from=metallb",
+				"adopt-from-annotation-global": metallbAnnotation,
+			},
+			labels:      map[string]string{"migrate-from": "metallb"},
+			annotations: map[string]string{metallbAnnotation: "192.168.0.42"},
+			expectIPs:   "10.0.0.1",
+		},
+		{
+			name: "IP used by another service isn't adopted",
+			data: map[string]string{
+				"cidr-global":                  "10.0.0.0/24",
+				"adopt-from-label-global":      "migrate-from=metallb",
+				"adopt-from-annotation-global": metallbAnnotation,
+			},
+			labels:      map[string]string{"migrate-from": "metallb"},
+			annotations: map[string]string{metallbAnnotation: "10.0.0.1"},
+			existingIP:  "10.0.0.1",
+			expectIPs:   "10.0.0.2",
+		},
+		{
+			name: "adoption isn't configured",
+			data: map[string]string{
+				"cidr-global": "10.0.0.0/24",
+			},
+			labels:      map[string]string{"migrate-from": "metallb"},
+			annotations: map[string]string{metallbAnnotation: "10.0.0.42"},
+			expectIPs:   "10.0.0.1",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.existingIP) > 0 {
+				existing := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        "existing",
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: tt.existingIP},
+					},
+				}
+				createService(t, client, existing)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "migrated",
+					Labels:      tt.labels,
+					Annotations: tt.annotations,
+				},
+				Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: tt.ingress}},
+			}
+			createService(t, client, svc)
+
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, ImplementationLabelValue, res.Labels[ImplementationLabelKey])
+			assert.Equal(t, tt.expectAdopt, res.Annotations[AllocationStrategyAnnotationKey] == AllocationStrategyAdopted)
+			assert.Len(t, recorder.Events, tt.expectEvents)
+			if tt.expectAdopt {
+				assert.Equal(t, "Normal LoadBalancerAdopted Adopted IPs "+tt.expectIPs+" from another load balancer implementation", <-recorder.Events)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// AllocationsStatusConfigMap is the name of the ConfigMap that reflects the current allocations,
+	// it is created in the same namespace as the pool ConfigMap.
+	// Each key is <namespace>.<service name> and the value is the IPs of the service.
+	AllocationsStatusConfigMap = "kubevip-allocations-status"
+
+	// EnableAllocationsStatusEnvKey environment key for enabling the allocations status ConfigMap.
+	EnableAllocationsStatusEnvKey = "KUBEVIP_ENABLE_ALLOCATIONS_STATUS"
+
+	// allocationsStatusQueueKey is the only key of the workqueue, every service event leads to a full resync
+	allocationsStatusQueueKey = "allocations"
+)
+
+// allocationsStatusController keeps the allocations status ConfigMap in sync with the IPs
+// currently assigned to the services implemented by kube-vip.
+type allocationsStatusController struct {
+	kubeClient          kubernetes.Interface
+	serviceLister       corelisters.ServiceLister
+	serviceListerSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+
+	cmName      string
+	cmNamespace string
+}
+
+func newAllocationsStatusController(
+	sharedInformer informers.SharedInformerFactory,
+	kubeClient kubernetes.Interface,
+	cmName, cmNamespace string,
+) *allocationsStatusController {
+	serviceInformer := sharedInformer.Core().V1().Services().Informer()
+	c := &allocationsStatusController{
+		kubeClient:          kubeClient,
+		serviceLister:       sharedInformer.Core().V1().Services().Lister(),
+		serviceListerSynced: serviceInformer.HasSynced,
+
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "AllocationsStatus"),
+
+		cmName:      cmName,
+		cmNamespace: cmNamespace,
+	}
+
+	_, _ = serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(_ interface{}) {
+			c.workqueue.Add(allocationsStatusQueueKey)
+		},
+		UpdateFunc: func(_ interface{}, _ interface{}) {
+			c.workqueue.Add(allocationsStatusQueueKey)
+		},
+		DeleteFunc: func(_ interface{}) {
+			c.workqueue.Add(allocationsStatusQueueKey)
+		},
+	})
+
+	return c
+}
+
+// Run starts the worker to process allocation updates
+func (c *allocationsStatusController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	if !cache.WaitForNamedCacheSync("allocations-status", stopCh, c.serviceListerSynced) {
+		return
+	}
+
+	klog.V(4).Info("Starting allocations status worker.")
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *allocationsStatusController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *allocationsStatusController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workqueue.Done(obj)
+
+	if err := c.syncAllocationsStatus(context.Background()); err != nil {
+		c.workqueue.AddRateLimited(obj)
+		utilruntime.HandleError(fmt.Errorf("error syncing allocations status: %s, requeuing", err.Error()))
+		return true
+	}
+
+	c.workqueue.Forget(obj)
+	return true
+}
+
+// syncAllocationsStatus rebuilds the allocations status and the pool status ConfigMaps from the services in the lister
+func (c *allocationsStatusController) syncAllocationsStatus(ctx context.Context) error {
+	svcs, err := c.serviceLister.List(labels.SelectorFromSet(labels.Set{implementationLabelKey: ImplementationLabelValue}))
+	if err != nil {
+		return err
+	}
+
+	allocations := map[string]string{}
+	for _, svc := range svcs {
+		if !svc.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if ips, ok := svc.Annotations[LoadbalancerIPsAnnotation]; ok && len(ips) > 0 {
+			allocations[allocationsStatusKey(svc)] = ips
+		}
+	}
+
+	cm, err := getConfigMap(ctx, c.kubeClient, AllocationsStatusConfigMap, c.cmNamespace)
+	if apierrors.IsNotFound(err) {
+		cm, err = createConfigMap(ctx, c.kubeClient, AllocationsStatusConfigMap, c.cmNamespace)
+	}
+	if err != nil {
+		return err
+	}
+
+	if (len(cm.Data) > 0 || len(allocations) > 0) && !reflect.DeepEqual(cm.Data, allocations) {
+		updated := cm.DeepCopy()
+		updated.Data = allocations
+		klog.V(4).Infof("Updating allocations status configMap [%s] in %s with %d allocations", AllocationsStatusConfigMap, c.cmNamespace, len(allocations))
+		if _, err = c.kubeClient.CoreV1().ConfigMaps(c.cmNamespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return c.syncPoolStatus(ctx, svcs)
+}
+
+// allocationsStatusKey returns the key of the service in the allocations status ConfigMap,
+// namespaces and service names can't contain dots so the key is unambiguous.
+func allocationsStatusKey(svc *corev1.Service) string {
+	return fmt.Sprintf("%s.%s", svc.Namespace, svc.Name)
+}
@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func tweakImplemented(ips string) tu.ServiceTweak {
+	return func(s *corev1.Service) {
+		s.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+		s.Annotations = map[string]string{LoadbalancerIPsAnnotation: ips}
+	}
+}
+
+func TestSyncAllocationsStatus(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	serviceInformer := informerFactory.Core().V1().Services()
+
+	c := &allocationsStatusController{
+		kubeClient:          client,
+		serviceLister:       serviceInformer.Lister(),
+		serviceListerSynced: alwaysReady,
+		workqueue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "AllocationsStatus"),
+		cmNamespace:         KubeVipClientConfigNamespace,
+	}
+
+	ctx := context.Background()
+	indexer := serviceInformer.Informer().GetIndexer()
+
+	svc1 := tu.NewService("svc1", tweakImplemented("10.0.0.1"))
+	svc2 := tu.NewService("svc2", tu.TweakNamespace("other"), tweakImplemented("10.0.0.2,2001::1"))
+	notManaged := tu.NewService("svc3")
+
+	getStatus := func() map[string]string {
+		cm, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(ctx, AllocationsStatusConfigMap, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get allocations status configmap: %v", err)
+		}
+		return cm.Data
+	}
+
+	// the status configmap is created even if nothing is allocated yet
+	if err := c.syncAllocationsStatus(ctx); err != nil {
+		t.Fatalf("failed to sync allocations status: %v", err)
+	}
+	assert.Empty(t, getStatus())
+
+	for _, svc := range []*corev1.Service{svc1, svc2, notManaged} {
+		if err := indexer.Add(svc); err != nil {
+			t.Fatalf("failed to add service %s: %v", svc.Name, err)
+		}
+	}
+	if err := c.syncAllocationsStatus(ctx); err != nil {
+		t.Fatalf("failed to sync allocations status: %v", err)
+	}
+	assert.Equal(t, map[string]string{
+		"default.svc1": "10.0.0.1",
+		"other.svc2":   "10.0.0.2,2001::1",
+	}, getStatus())
+
+	if err := indexer.Delete(svc1); err != nil {
+		t.Fatalf("failed to delete service %s: %v", svc1.Name, err)
+	}
+	if err := c.syncAllocationsStatus(ctx); err != nil {
+		t.Fatalf("failed to sync allocations status: %v", err)
+	}
+	assert.Equal(t, map[string]string{
+		"other.svc2": "10.0.0.2,2001::1",
+	}, getStatus())
+}
+
+func TestSyncPoolStatus(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	serviceInformer := informerFactory.Core().V1().Services()
+
+	c := &allocationsStatusController{
+		kubeClient:          client,
+		serviceLister:       serviceInformer.Lister(),
+		serviceListerSynced: alwaysReady,
+		workqueue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "AllocationsStatus"),
+		cmName:              KubeVipClientConfig,
+		cmNamespace:         KubeVipClientConfigNamespace,
+	}
+
+	ctx := context.Background()
+	poolCM := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipClientConfig, Namespace: KubeVipClientConfigNamespace},
+		Data:       map[string]string{"range-global": "10.0.0.1-10.0.0.2", "allow-share-global": "true"},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, poolCM, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	indexer := serviceInformer.Informer().GetIndexer()
+
+	getCondition := func() metav1.Condition {
+		if err := c.syncAllocationsStatus(ctx); err != nil {
+			t.Fatalf("failed to sync allocations status: %v", err)
+		}
+		cm, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(ctx, PoolStatusConfigMap, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get pool status configmap: %v", err)
+		}
+		assert.Len(t, cm.Data, 1)
+		var condition metav1.Condition
+		if err := json.Unmarshal([]byte(cm.Data["range-global"]), &condition); err != nil {
+			t.Fatalf("failed to parse the condition of range-global: %v", err)
+		}
+		assert.Equal(t, PoolConditionExhausted, condition.Type)
+		return condition
+	}
+
+	svc1 := tu.NewService("svc1", tweakImplemented("10.0.0.1"))
+	svc2 := tu.NewService("svc2", tweakImplemented("10.0.0.2"))
+
+	if err := indexer.Add(svc1); err != nil {
+		t.Fatal(err)
+	}
+	condition := getCondition()
+	assert.Equal(t, metav1.ConditionFalse, condition.Status)
+	assert.Equal(t, "1 of 2 addresses of pool [10.0.0.1-10.0.0.2] are free", condition.Message)
+
+	// the pool fills up
+	if err := indexer.Add(svc2); err != nil {
+		t.Fatal(err)
+	}
+	condition = getCondition()
+	assert.Equal(t, metav1.ConditionTrue, condition.Status)
+	assert.Equal(t, "NoFreeAddresses", condition.Reason)
+	exhaustedAt := condition.LastTransitionTime
+
+	// the condition doesn't transition while the pool stays exhausted
+	condition = getCondition()
+	assert.Equal(t, metav1.ConditionTrue, condition.Status)
+	assert.Equal(t, exhaustedAt, condition.LastTransitionTime)
+
+	// the pool frees an address
+	if err := indexer.Delete(svc2); err != nil {
+		t.Fatal(err)
+	}
+	condition = getCondition()
+	assert.Equal(t, metav1.ConditionFalse, condition.Status)
+	assert.Equal(t, "FreeAddresses", condition.Reason)
+}
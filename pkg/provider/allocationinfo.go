@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// allocationInfo is the allocation decision of a service recorded in its allocationInfo annotation
+type allocationInfo struct {
+	IPs        string      `json:"ips"`
+	SourcePool string      `json:"sourcePool,omitempty"`
+	Strategy   string      `json:"strategy,omitempty"`
+	AssignedAt string      `json:"assignedAt,omitempty"`
+	PoolFree   json.Number `json:"poolFree,omitempty"`
+	Zone       string      `json:"zone,omitempty"`
+}
+
+// discoverAllocationInfo returns true if allocation-info-global is set, the services allocated from a pool are then
+// annotated with their allocation decision as JSON in kube-vip.io/allocationInfo
+func discoverAllocationInfo(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "allocation-info")
+}
+
+// setAllocationInfo sets the allocationInfo annotation of the service from its informational annotations, or removes it
+// if disabled. The annotations of the service must not be nil.
+func setAllocationInfo(service *v1.Service, enabled bool) {
+	if !enabled {
+		delete(service.Annotations, AllocationInfoAnnotationKey)
+		return
+	}
+	info := allocationInfo{
+		IPs:        service.Annotations[LoadbalancerIPsAnnotation],
+		SourcePool: service.Annotations[SourcePoolAnnotationKey],
+		Strategy:   service.Annotations[AllocationStrategyAnnotationKey],
+		AssignedAt: service.Annotations[IPAssignedAtAnnotationKey],
+		// the free count may exceed an int64 for an IPv6 pool
+		PoolFree: json.Number(service.Annotations[PoolFreeAnnotationKey]),
+		Zone:     service.Annotations[IPZoneAnnotationKey],
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		klog.Warningf("service '%s/%s': error encoding the allocation info: %v", service.Namespace, service.Name, err)
+		return
+	}
+	service.Annotations[AllocationInfoAnnotationKey] = string(data)
+}
+
+// refreshAllocationInfo updates the allocationInfo annotation of the service, if it has one, after its IPs were rewritten
+// outside of the allocation, e.g. pinned, compacted or upgraded to dual-stack, so it never describes former IPs. The
+// annotations of the service must not be nil.
+func refreshAllocationInfo(service *v1.Service) {
+	if _, ok := service.Annotations[AllocationInfoAnnotationKey]; ok {
+		setAllocationInfo(service, true)
+	}
+}
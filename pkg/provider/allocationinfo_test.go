@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_discoverAllocationInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want bool
+	}{
+		{name: "unset"},
+		{name: "enabled", data: map[string]string{"allocation-info-global": "true"}, want: true},
+		{name: "disabled", data: map[string]string{"allocation-info-global": "false"}},
+		{name: "invalid", data: map[string]string{"allocation-info-global": "json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverAllocationInfo(&v1.ConfigMap{Data: tt.data}))
+		})
+	}
+}
+
+func Test_syncLoadBalancerAllocationInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "annotated when enabled", enabled: true},
+		{name: "not annotated by default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "10.0.0.1-10.0.0.4",
+					"range-team":   "10.1.0.1-10.1.0.2#zone=a",
+				},
+			}
+			if tt.enabled {
+				cm.Data["allocation-info-global"] = "true"
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			allocate := func(namespace, name string) *v1.Service {
+				return createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+			}
+
+			global := allocate("default", "web")
+			team := allocate("team", "api")
+			if !tt.enabled {
+				assert.NotContains(t, global.Annotations, AllocationInfoAnnotationKey)
+				assert.NotContains(t, team.Annotations, AllocationInfoAnnotationKey)
+				return
+			}
+
+			var info map[string]interface{}
+			if err := json.Unmarshal([]byte(global.Annotations[AllocationInfoAnnotationKey]), &info); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, map[string]interface{}{
+				"ips":        "10.0.0.1",
+				"sourcePool": SourcePoolGlobal,
+				"strategy":   AllocationStrategyAsc,
+				"assignedAt": global.Annotations[IPAssignedAtAnnotationKey],
+				"poolFree":   float64(3),
+			}, info)
+
+			info = nil
+			if err := json.Unmarshal([]byte(team.Annotations[AllocationInfoAnnotationKey]), &info); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, map[string]interface{}{
+				"ips":        "10.1.0.1",
+				"sourcePool": SourcePoolNamespace,
+				"strategy":   AllocationStrategyAsc,
+				"assignedAt": team.Annotations[IPAssignedAtAnnotationKey],
+				"poolFree":   float64(1),
+				"zone":       "a",
+			}, info)
+		})
+	}
+}
+
+func Test_refreshAllocationInfo(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"}}}
+	setAllocationInfo(svc, true)
+
+	// the IPs are rewritten outside of the allocation, e.g. upgraded to dual-stack
+	svc.Annotations[LoadbalancerIPsAnnotation] = "10.0.0.1,fd00::1"
+	refreshAllocationInfo(svc)
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(svc.Annotations[AllocationInfoAnnotationKey]), &info); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1,fd00::1", info["ips"])
+
+	// a service without the annotation doesn't get one
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.2"}}}
+	refreshAllocationInfo(other)
+	assert.NotContains(t, other.Annotations, AllocationInfoAnnotationKey)
+}
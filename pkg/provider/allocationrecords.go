@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// AllocationRecordsEnvKey environment key for writing a single-line record of every allocation and release to stdout,
+// so the IPAM state can be rebuilt from the logs
+const AllocationRecordsEnvKey = "KUBEVIP_ALLOCATION_RECORDS"
+
+// allocationRecords is true if AllocationRecordsEnvKey is set
+var allocationRecords bool
+
+var (
+	// allocationRecordWriter is where the records are written, stdout unless replaced by the tests
+	allocationRecordWriter io.Writer = os.Stdout
+	allocationRecordLock   sync.Mutex
+)
+
+// The records are parsed by downstream tools, their format must stay stable: new fields are only ever appended.
+//
+//	ALLOC ns=<namespace> svc=<name> ip=<ips> pool=<pool>
+//	RELEASE ns=<namespace> svc=<name> ip=<ips>
+//
+// The IPs are comma separated, the pool is - when the IPs weren't allocated from a pool, e.g. they were requested by the
+// service. The IPs of a release are all the IPs the service held, even if another service still shares them.
+const (
+	allocationRecordFormat = "ALLOC ns=%s svc=%s ip=%s pool=%s\n"
+	releaseRecordFormat    = "RELEASE ns=%s svc=%s ip=%s\n"
+)
+
+// writeAllocationRecord writes the ALLOC record of the IPs allocated to the service from the pool
+func writeAllocationRecord(service *v1.Service, ips, pool string) {
+	if !allocationRecords || len(ips) == 0 {
+		return
+	}
+	writeRecord(allocationRecordFormat, service.Namespace, service.Name, recordField(ips), recordField(pool))
+}
+
+// writeReleaseRecord writes the RELEASE record of the IPs of the service
+func writeReleaseRecord(service *v1.Service) {
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	if !allocationRecords || len(ips) == 0 {
+		return
+	}
+	writeRecord(releaseRecordFormat, service.Namespace, service.Name, recordField(ips))
+}
+
+func writeRecord(format string, args ...interface{}) {
+	allocationRecordLock.Lock()
+	defer allocationRecordLock.Unlock()
+	_, _ = fmt.Fprintf(allocationRecordWriter, format, args...)
+}
+
+// recordField returns the value without spaces so a record stays a list of space separated fields, - if it is empty
+func recordField(value string) string {
+	value = strings.Join(strings.Fields(value), "")
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAllocationRecords(t *testing.T) {
+	buf := &bytes.Buffer{}
+	allocationRecords, allocationRecordWriter = true, buf
+	defer func() {
+		allocationRecords, allocationRecordWriter = false, os.Stdout
+	}()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web"},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	createService(t, client, svc)
+	if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ALLOC ns=team-a svc=web ip=10.0.0.1,fd00::1 pool=10.0.0.1-10.0.0.3,fd00::1-fd00::3\n", buf.String())
+
+	// the IPs requested by a service weren't allocated from a pool
+	buf.Reset()
+	static := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "team-a",
+			Name:        "static",
+			Annotations: map[string]string{LoadbalancerIPsAnnotation: "192.168.1.10"},
+		},
+	}
+	createService(t, client, static)
+	if _, err := syncLoadBalancer(ctx, client, static, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ALLOC ns=team-a svc=static ip=192.168.1.10 pool=-\n", buf.String())
+
+	buf.Reset()
+	res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifyRelease(ctx, client, res)
+	assert.Equal(t, "RELEASE ns=team-a svc=web ip=10.0.0.1,fd00::1\n", buf.String())
+
+	// no record without IPs
+	buf.Reset()
+	notifyRelease(ctx, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "pending"}})
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// allowsBurst returns true if the allow burst annotation of the service is true
+func allowsBurst(service *v1.Service) bool {
+	allow, _ := strconv.ParseBool(service.Annotations[AllowBurstAnnotationKey])
+	return allow
+}
+
+// discoverBurstPool returns the burst pool, burst-global, which the services annotated with AllowBurstAnnotationKey
+// are allocated from once their pool is exhausted. It returns "" if it isn't set or invalid.
+func discoverBurstPool(cm *v1.ConfigMap) string {
+	pool, key, err := getGlobalConfig(cm, "burst")
+	if err != nil {
+		return ""
+	}
+	if _, err := ipam.PoolSize(pool); err != nil {
+		klog.Warningf("invalid value [%s] in [%s], expected cidrs or ranges, ignoring the burst pool: %v", pool, key, err)
+		return ""
+	}
+	return pool
+}
+
+// discoverVIPsFromBurstPool allocates the IPs of the service from the burst pool once its pool is exhausted, the burst
+// pool is shared by every namespace so the addresses of the services of every namespace are in use. The usable range
+// and the preferred IPs of the pool of the service don't apply to the burst pool.
+func discoverVIPsFromBurstPool(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, service *v1.Service, burstPool, cmNamespace string,
+	kubevipLBConfig *config.KubevipLBConfig, ipFamilies, familyOrder []v1.IPFamily) (string, error) {
+	inUseSet, err := clusterInUseSet(ctx, kubeClient, cm, cmNamespace)
+	if err != nil {
+		return "", err
+	}
+	burstLBConfig := *kubevipLBConfig
+	burstLBConfig.UsableRange = ""
+	burstLBConfig.PreferredIPs = nil
+	burstLBConfig.ReclaimableIPs = nil
+	return discoverVIPs(service.Namespace, burstPool, "", inUseSet, &burstLBConfig, service.Spec.IPFamilyPolicy, ipFamilies, familyOrder)
+}
@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func Test_discoverBurstPool(t *testing.T) {
+	assert.Equal(t, "", discoverBurstPool(&v1.ConfigMap{}))
+	assert.Equal(t, "10.0.2.0/24", discoverBurstPool(&v1.ConfigMap{Data: map[string]string{"burst-global": "10.0.2.0/24"}}))
+	assert.Equal(t, "", discoverBurstPool(&v1.ConfigMap{Data: map[string]string{"burst-global": "10.0.2.x/24"}}))
+}
+
+func TestSyncLoadBalancerBurstPool(t *testing.T) {
+	tests := []struct {
+		name           string
+		primaryFull    bool
+		allowBurst     bool
+		wantIPs        string
+		wantSourcePool string
+		wantErr        bool
+		wantEvent      string
+	}{
+		{
+			name:           "annotated service is allocated from its pool while it has room",
+			allowBurst:     true,
+			wantIPs:        "10.0.0.1",
+			wantSourcePool: SourcePoolGlobal,
+		},
+		{
+			name:           "annotated service is allocated from the burst pool once its pool is full",
+			primaryFull:    true,
+			allowBurst:     true,
+			wantIPs:        "10.0.2.1",
+			wantSourcePool: SourcePoolBurst,
+			wantEvent:      "Warning PoolBurst Pool is exhausted, allocated IPs 10.0.2.1 from the burst pool",
+		},
+		{
+			name:        "service without the annotation isn't allocated from the burst pool",
+			primaryFull: true,
+			wantErr:     true,
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "10.0.0.1-10.0.0.1",
+					"burst-global": "10.0.2.1-10.0.2.3",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.primaryFull {
+				full := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "full",
+					Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
+				}}
+				createService(t, client, full)
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "spike"}}
+			if tt.allowBurst {
+				svc.Annotations = map[string]string{AllowBurstAnnotationKey: "true"}
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if tt.wantErr {
+				var outOfIPsErr *ipam.OutOfIPsError
+				if !errors.As(err, &outOfIPsErr) {
+					t.Fatalf("expected an OutOfIPsError, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.wantSourcePool, res.Annotations[SourcePoolAnnotationKey])
+			if len(tt.wantEvent) > 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
+
+func TestSyncLoadBalancerBurstKeepsNamespacePool(t *testing.T) {
+	t.Cleanup(ipam.ResetManager)
+	defer func() { eventRecorder = nil }()
+	eventRecorder = record.NewFakeRecorder(10)
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-team":   "10.0.0.1-10.0.0.1",
+			"burst-global": "10.9.0.0/24",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "a"}})
+	assert.Equal(t, "10.0.0.1", a.Annotations[LoadbalancerIPsAnnotation])
+	b := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "team",
+		Name:        "b",
+		Annotations: map[string]string{AllowBurstAnnotationKey: "true"},
+	}})
+	assert.Equal(t, "10.9.0.1", b.Annotations[LoadbalancerIPsAnnotation])
+
+	// the burst pool doesn't replace the cached pool of the namespace, its address is allocated again once released
+	if err := client.CoreV1().Services("team").Delete(ctx, "a", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "c"}})
+	assert.Equal(t, "10.0.0.1", c.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, SourcePoolNamespace, c.Annotations[SourcePoolAnnotationKey])
+}
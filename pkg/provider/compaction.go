@@ -0,0 +1,230 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/utils/set"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// discoverCompactSharedIPs returns true if compact-shared-ips-global is true, the services sharing an IP are then moved
+// onto another shared IP of their pool when their ports fit there, freeing their IP
+func discoverCompactSharedIPs(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "compact-shared-ips")
+}
+
+const (
+	// CompactOrderShared moves the services towards the addresses used by more services, this is the default
+	CompactOrderShared = "shared"
+
+	// CompactOrderAge moves the services towards the addresses of older services, the oldest service keeps its address
+	CompactOrderAge = "age"
+)
+
+// discoverCompactByAge returns true if compact-order-global is age, the compaction then keeps the older services on
+// their address and only moves the newer ones, to minimize the disruption of established VIPs
+func discoverCompactByAge(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "compact-order", CompactOrderShared, CompactOrderAge) == CompactOrderAge
+}
+
+// poolAllocatedStrategies are the allocation strategies of the IPs allocated from the pool, which can be changed by a
+// reconcile, the IPs requested or adopted by a service are kept
+var poolAllocatedStrategies = set.New(AllocationStrategyAsc, AllocationStrategyDesc, AllocationStrategyShared)
+
+// compactSharedIP moves the service onto another IPv4 address of its pool shared by other services, if all the services
+// of its address fit there: their ports are free, the max-services-per-ip isn't exceeded, the share groups match and
+// the session affinities match if share-respect-affinity is set. The others follow on their reconcile, so the address
+// is freed.
+// The services only move to an address used by more services, or by as many with a lower address, which converges
+// and never moves them back. With compact-order-global set to age, they only move to an address whose oldest service
+// is older than theirs instead, so the oldest services keep their address.
+func compactSharedIP(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	if !poolAllocatedStrategies.Has(service.Annotations[AllocationStrategyAnnotationKey]) || len(service.Spec.Ports) == 0 || isDedicated(service) {
+		return nil
+	}
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	addr, err := netip.ParseAddr(ips)
+	if err != nil || !addr.Is4() || addr.IsUnspecified() {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	if !discoverCompactSharedIPs(controllerCM) {
+		return nil
+	}
+	namespaceLabels, err := getNamespaceLabels(ctx, kubeClient, controllerCM, service.Namespace)
+	if err != nil {
+		return err
+	}
+	pool, global, allowShare, err := discoverServicePool(controllerCM, service, namespaceLabels, controllerCM.Name)
+	if err != nil || !allowShare || pool == DHCPPool {
+		return nil
+	}
+	serviceNamespace := service.Namespace
+	if global {
+		serviceNamespace = ""
+	}
+	svcs, err := listInUseServices(ctx, kubeClient, serviceNamespace)
+	if err != nil {
+		return err
+	}
+
+	groups := mapSharedAddresses(svcs)
+	current := groups[addr]
+	for _, peer := range current {
+		// the address is only freed if all of its services can move
+		if !poolAllocatedStrategies.Has(peer.Annotations[AllocationStrategyAnnotationKey]) || strings.Contains(peer.Annotations[LoadbalancerIPsAnnotation], ",") {
+			return nil
+		}
+	}
+	currentPorts := groupPorts(current)
+	if currentPorts.Has(0) {
+		return nil
+	}
+	respectAffinity := discoverShareRespectAffinity(controllerCM, service.Namespace, controllerCM.Name)
+	maxServicesPerIP := discoverMaxServicesPerIP(controllerCM)
+	better := func(a netip.Addr, peersA []*v1.Service, b netip.Addr, peersB []*v1.Service) bool {
+		return moreShared(len(peersA), a, len(peersB), b)
+	}
+	if discoverCompactByAge(controllerCM) {
+		better = func(a netip.Addr, peersA []*v1.Service, b netip.Addr, peersB []*v1.Service) bool {
+			return older(oldestCreation(peersA), a, oldestCreation(peersB), b)
+		}
+	}
+
+	var target netip.Addr
+	for candidate, peers := range groups {
+		if !better(candidate, peers, addr, current) {
+			continue
+		}
+		if target.IsValid() && !better(candidate, peers, target, groups[target]) {
+			continue
+		}
+		if inPool, err := ipam.PoolContains(pool, candidate); err != nil || !inPool {
+			continue
+		}
+		if maxServicesPerIP > 0 && len(peers)+len(current) > maxServicesPerIP {
+			continue
+		}
+		if portsConflict(currentPorts, groupPorts(peers)) {
+			continue
+		}
+		if respectAffinity && !groupAffinities(peers).Equal(groupAffinities(current)) {
+			continue
+		}
+		if !groupShareGroups(peers).Equal(groupShareGroups(current)) {
+			continue
+		}
+		target = candidate
+	}
+	if !target.IsValid() {
+		return nil
+	}
+
+	moved, err := rewriteServiceIPs(ctx, kubeClient, service, ips, func(recentService *v1.Service) error {
+		setLoadBalancerIPs(recentService, target.String())
+		recentService.Annotations[AllocationStrategyAnnotationKey] = AllocationStrategyShared
+		recentService.Spec.LoadBalancerIP = target.String()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error moving Service [%s] to shared IP [%s] : %v", service.Name, target, err)
+	}
+	if !moved {
+		return nil
+	}
+
+	klog.Infof("service '%s/%s' moved from shared IP [%s] to [%s] to compact the shared IPs", service.Namespace, service.Name, addr, target)
+	recordEventf(service, v1.EventTypeNormal, "SharedIPCompacted", "Moved from IP %s to IP %s shared with %d services", addr, target, len(groups[target]))
+	notifyRelease(ctx, kubeClient, service)
+	notifyAllocation(service, target.String(), pool)
+	return nil
+}
+
+// moreShared returns true if the address a used by countA services is a better place to share than the address b used by
+// countB services: it is used by more services, or by as many with a lower address
+func moreShared(countA int, a netip.Addr, countB int, b netip.Addr) bool {
+	if countA != countB {
+		return countA > countB
+	}
+	return a.Less(b)
+}
+
+// older returns true if the address a whose oldest service was created at createdA is a better place to share than the
+// address b whose oldest service was created at createdB: its oldest service is older, or as old with a lower address
+func older(createdA time.Time, a netip.Addr, createdB time.Time, b netip.Addr) bool {
+	if !createdA.Equal(createdB) {
+		return createdA.Before(createdB)
+	}
+	return a.Less(b)
+}
+
+// oldestCreation returns the creation time of the oldest of the services
+func oldestCreation(svcs []*v1.Service) time.Time {
+	var oldest time.Time
+	for _, svc := range svcs {
+		if created := svc.CreationTimestamp.Time; oldest.IsZero() || created.Before(oldest) {
+			oldest = created
+		}
+	}
+	return oldest
+}
+
+// mapSharedAddresses returns the services using each IPv4 address
+func mapSharedAddresses(svcs *v1.ServiceList) map[netip.Addr][]*v1.Service {
+	groups := map[netip.Addr][]*v1.Service{}
+	for x := range svcs.Items {
+		addrs, err := parseAddrList(svcs.Items[x].Annotations[LoadbalancerIPsAnnotation])
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Is4() && !addr.IsUnspecified() {
+				groups[addr] = append(groups[addr], &svcs.Items[x])
+			}
+		}
+	}
+	return groups
+}
+
+// groupPorts returns the ports of the services, 0 if one of them defines no ports or has a dedicated IP and accounts for
+// the whole address
+func groupPorts(svcs []*v1.Service) set.Set[int32] {
+	ports := set.New[int32]()
+	for _, svc := range svcs {
+		if len(svc.Spec.Ports) == 0 || isDedicated(svc) {
+			ports.Insert(0)
+			continue
+		}
+		ports = ports.Union(servicePortSet(svc))
+	}
+	return ports
+}
+
+// groupAffinities returns the session affinities of the services
+func groupAffinities(svcs []*v1.Service) set.Set[v1.ServiceAffinity] {
+	affinities := set.New[v1.ServiceAffinity]()
+	for _, svc := range svcs {
+		affinities.Insert(serviceAffinity(svc))
+	}
+	return affinities
+}
+
+// groupShareGroups returns the share groups of the services
+func groupShareGroups(svcs []*v1.Service) set.Set[string] {
+	shareGroups := set.New[string]()
+	for _, svc := range svcs {
+		shareGroups.Insert(svc.Annotations[ShareGroupAnnotationKey])
+	}
+	return shareGroups
+}
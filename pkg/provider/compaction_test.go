@@ -0,0 +1,225 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSyncLoadBalancerCompactSharedIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		ports   map[string]int32
+		wantIPs map[string]string
+	}{
+		{
+			name: "two sparsely shared IPs are consolidated into one",
+			data: map[string]string{"compact-shared-ips-global": "true"},
+			ports: map[string]int32{
+				"a": 80, "b": 443, "c": 8080, "d": 8443,
+			},
+			wantIPs: map[string]string{
+				"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.1", "d": "10.0.0.1",
+			},
+		},
+		{
+			name: "the services stay on their IP if their ports conflict",
+			data: map[string]string{"compact-shared-ips-global": "true"},
+			ports: map[string]int32{
+				"a": 80, "b": 443, "c": 80, "d": 8443,
+			},
+			wantIPs: map[string]string{
+				"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.2", "d": "10.0.0.2",
+			},
+		},
+		{
+			name: "the services stay on their IP if the max services per IP would be exceeded",
+			data: map[string]string{"compact-shared-ips-global": "true", "max-services-per-ip-global": "3"},
+			ports: map[string]int32{
+				"a": 80, "b": 443, "c": 8080, "d": 8443,
+			},
+			wantIPs: map[string]string{
+				"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.2", "d": "10.0.0.2",
+			},
+		},
+		{
+			name: "no compaction by default",
+			ports: map[string]int32{
+				"a": 80, "b": 443, "c": 8080, "d": 8443,
+			},
+			wantIPs: map[string]string{
+				"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.2", "d": "10.0.0.2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":        "10.0.0.0/24",
+					"allow-share-global": "true",
+				},
+			}
+			for k, v := range tt.data {
+				cm.Data[k] = v
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// a and b share 10.0.0.1, c and d share 10.0.0.2
+			initialIPs := map[string]string{"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.2", "d": "10.0.0.2"}
+			for _, name := range []string{"a", "b", "c", "d"} {
+				svc := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "default",
+						Name:      name,
+						Labels:    map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{
+							LoadbalancerIPsAnnotation:       initialIPs[name],
+							AllocationStrategyAnnotationKey: AllocationStrategyShared,
+						},
+					},
+					Spec: v1.ServiceSpec{
+						LoadBalancerIP: initialIPs[name],
+						Ports:          []v1.ServicePort{{Port: tt.ports[name]}},
+					},
+				}
+				createService(t, client, svc)
+			}
+
+			// two rounds of reconciles, the second one must not move the services back
+			for range 2 {
+				for _, name := range []string{"c", "d", "a", "b"} {
+					svc, err := client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for name, want := range tt.wantIPs {
+				res, err := client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, res.Annotations[LoadbalancerIPsAnnotation], name)
+				assert.Equal(t, want, res.Spec.LoadBalancerIP, name)
+			}
+		})
+	}
+}
+
+func TestSyncLoadBalancerCompactSharedIPsByAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   string
+		wantIPs map[string]string
+	}{
+		{
+			name:  "by default the services move to the lower address",
+			order: CompactOrderShared,
+			wantIPs: map[string]string{
+				"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.1", "d": "10.0.0.1",
+			},
+		},
+		{
+			name:  "by age the oldest service keeps its address and the newer ones move",
+			order: CompactOrderAge,
+			wantIPs: map[string]string{
+				"a": "10.0.0.2", "b": "10.0.0.2", "c": "10.0.0.2", "d": "10.0.0.2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":               "10.0.0.0/24",
+					"allow-share-global":        "true",
+					"compact-shared-ips-global": "true",
+					"compact-order-global":      tt.order,
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// a and b share 10.0.0.1, c and d share 10.0.0.2, c is the oldest service
+			now := time.Now()
+			initialIPs := map[string]string{"a": "10.0.0.1", "b": "10.0.0.1", "c": "10.0.0.2", "d": "10.0.0.2"}
+			ages := map[string]time.Duration{"a": 2 * time.Hour, "b": 30 * time.Minute, "c": 3 * time.Hour, "d": time.Hour}
+			ports := map[string]int32{"a": 80, "b": 443, "c": 8080, "d": 8443}
+			for _, name := range []string{"a", "b", "c", "d"} {
+				svc := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:         "default",
+						Name:              name,
+						CreationTimestamp: metav1.NewTime(now.Add(-ages[name])),
+						Labels:            map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{
+							LoadbalancerIPsAnnotation:       initialIPs[name],
+							AllocationStrategyAnnotationKey: AllocationStrategyShared,
+						},
+					},
+					Spec: v1.ServiceSpec{
+						LoadBalancerIP: initialIPs[name],
+						Ports:          []v1.ServicePort{{Port: ports[name]}},
+					},
+				}
+				createService(t, client, svc)
+			}
+
+			// two rounds of reconciles, the second one must not move the services back
+			for range 2 {
+				for _, name := range []string{"a", "b", "c", "d"} {
+					svc, err := client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for name, want := range tt.wantIPs {
+				res, err := client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, res.Annotations[LoadbalancerIPsAnnotation], name)
+			}
+		})
+	}
+}
+
+func Test_discoverCompactByAge(t *testing.T) {
+	assert.False(t, discoverCompactByAge(&v1.ConfigMap{}))
+	assert.False(t, discoverCompactByAge(&v1.ConfigMap{Data: map[string]string{"compact-order-global": CompactOrderShared}}))
+	assert.True(t, discoverCompactByAge(&v1.ConfigMap{Data: map[string]string{"compact-order-global": CompactOrderAge}}))
+	assert.False(t, discoverCompactByAge(&v1.ConfigMap{Data: map[string]string{"compact-order-global": "oldest"}}))
+}
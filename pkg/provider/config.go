@@ -2,12 +2,20 @@ package provider
 
 import (
 	"context"
+	"fmt"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ConfigMapReadOnlyEnvKey environment key for never writing ConfigMaps, a missing pool ConfigMap is then an error
+// instead of being created, so the provider only needs get on configmaps
+const ConfigMapReadOnlyEnvKey = "KUBEVIP_CONFIG_MAP_READ_ONLY"
+
+// configMapReadOnly is true if ConfigMaps are never written
+var configMapReadOnly bool
+
 // Services functions - once the service data is taken from the configMap, these functions will interact with the data
 
 // func (s *kubevipServices) addService(newSvc services) {
@@ -52,6 +60,10 @@ func getConfigMap(ctx context.Context, kubeClient kubernetes.Interface, cm, nm s
 }
 
 func createConfigMap(ctx context.Context, kubeClient kubernetes.Interface, cm, nm string) (*v1.ConfigMap, error) {
+	if configMapReadOnly {
+		return nil, fmt.Errorf("not creating configMap [%s] in %s, %s is set", cm, nm, ConfigMapReadOnlyEnvKey)
+	}
+
 	// Create new configuration map in the correct namespace
 	newConfigMap := v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
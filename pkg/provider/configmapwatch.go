@@ -0,0 +1,127 @@
+package provider
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// PauseOnConfigMapDeletionEnvKey environment key for pausing the allocations while the pool ConfigMap is deleted,
+// instead of recreating an empty ConfigMap. The services keep their IPs, the new ones stay pending until it's back.
+const PauseOnConfigMapDeletionEnvKey = "KUBEVIP_PAUSE_ON_CONFIGMAP_DELETION"
+
+// pauseOnConfigMapDeletion is true if PauseOnConfigMapDeletionEnvKey is set
+var pauseOnConfigMapDeletion bool
+
+// allocationPaused is true while the pool ConfigMap is deleted and pauseOnConfigMapDeletion is set
+var allocationPaused atomic.Bool
+
+// AllocationPausedError is returned for the services needing IPs while the pool ConfigMap is deleted
+type AllocationPausedError struct {
+	ConfigMap string
+	Namespace string
+}
+
+func (e *AllocationPausedError) Error() string {
+	return fmt.Sprintf("allocation paused, pool configMap [%s] in %s was deleted", e.ConfigMap, e.Namespace)
+}
+
+// configMapWatcher applies the settings of the pool ConfigMap kept in memory, e.g. release-history-size-global, when it
+// changes. With pauseOnConfigMapDeletion, it also pauses the allocations when the pool ConfigMap is deleted and resumes
+// them once it's recreated.
+type configMapWatcher struct {
+	informerFactory informers.SharedInformerFactory
+
+	cmName      string
+	cmNamespace string
+}
+
+func newConfigMapWatcher(kubeClient kubernetes.Interface, cmName, cmNamespace string) *configMapWatcher {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(cmNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", cmName).String()
+		}))
+	w := &configMapWatcher{
+		informerFactory: informerFactory,
+		cmName:          cmName,
+		cmNamespace:     cmNamespace,
+	}
+	_, _ = informerFactory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.configMapAdded,
+		UpdateFunc: func(_, cur interface{}) { w.configMapUpdated(cur) },
+		DeleteFunc: w.configMapDeleted,
+	})
+	return w
+}
+
+// Run watches the pool ConfigMap in the background
+func (w *configMapWatcher) Run(stopCh <-chan struct{}) {
+	if pauseOnConfigMapDeletion {
+		klog.Infof("pausing the allocations while configMap [%s] in %s is deleted", w.cmName, w.cmNamespace)
+	}
+	w.informerFactory.Start(stopCh)
+}
+
+// applySettings applies the settings of the pool ConfigMap kept in memory
+func applySettings(cm *corev1.ConfigMap) {
+	ipam.SetReleaseHistorySize(discoverReleaseHistorySize(cm))
+}
+
+// configMapUpdated applies the settings of the updated pool ConfigMap
+func (w *configMapWatcher) configMapUpdated(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok || cm.Name != w.cmName {
+		return
+	}
+	applySettings(cm)
+}
+
+// configMapAdded applies the settings of the pool ConfigMap and resumes the allocations paused by its deletion
+func (w *configMapWatcher) configMapAdded(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok || cm.Name != w.cmName {
+		return
+	}
+	applySettings(cm)
+	if !allocationPaused.CompareAndSwap(true, false) {
+		return
+	}
+	klog.Infof("configMap [%s] in %s was recreated, resuming the allocations", w.cmName, w.cmNamespace)
+	if eventRecorder != nil {
+		eventRecorder.Eventf(cm, corev1.EventTypeNormal, "AllocationResumed", "Pool configMap was recreated, resuming the allocations")
+	}
+}
+
+// configMapDeleted pauses the allocations, the services keep their IPs
+func (w *configMapWatcher) configMapDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok || cm.Name != w.cmName || !pauseOnConfigMapDeletion {
+		return
+	}
+	allocationPaused.Store(true)
+	klog.Warningf("configMap [%s] in %s was deleted, pausing the allocations until it's recreated", w.cmName, w.cmNamespace)
+	if eventRecorder != nil {
+		eventRecorder.Eventf(cm, corev1.EventTypeWarning, "AllocationPaused", "Pool configMap was deleted, pausing the allocations, the services keep their IPs")
+	}
+}
+
+// allocationPausedError emits an AllocationPaused event on the service and returns the AllocationPausedError
+func allocationPausedError(service *corev1.Service, cmName, cmNamespace string) error {
+	pausedErr := &AllocationPausedError{ConfigMap: cmName, Namespace: cmNamespace}
+	klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, pausedErr)
+	recordEventf(service, corev1.EventTypeWarning, "AllocationPaused", "%v", pausedErr)
+	return pausedErr
+}
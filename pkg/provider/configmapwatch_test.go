@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func TestConfigMapDeletionPausesAllocation(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	pauseOnConfigMapDeletion = true
+	defer func() {
+		eventRecorder = nil
+		pauseOnConfigMapDeletion = false
+		allocationPaused.Store(false)
+	}()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.3",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	watcher := newConfigMapWatcher(client, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	watcher.Run(stopCh)
+	watcher.informerFactory.WaitForCacheSync(stopCh)
+
+	existing := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "existing"}}
+	existing = createAndSyncService(t, client, existing)
+	assert.Equal(t, "10.0.0.1", existing.Annotations[LoadbalancerIPsAnnotation])
+
+	if err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Delete(ctx, KubeVipClientConfig, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, allocationPaused.Load, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Warning AllocationPaused Pool configMap was deleted, pausing the allocations, the services keep their IPs", <-recorder.Events)
+
+	// the existing service keeps its IPs
+	res := mustSyncService(t, client, existing)
+	assert.Equal(t, existing.Annotations, res.Annotations)
+	assert.Equal(t, existing.Labels, res.Labels)
+
+	// a new service stays pending and the configmap isn't recreated
+	pending := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "pending"}}
+	createService(t, client, pending)
+	_, err := syncLoadBalancer(ctx, client, pending, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	var pausedErr *AllocationPausedError
+	assert.True(t, errors.As(err, &pausedErr), "expected an AllocationPausedError, got %v", err)
+	assert.Equal(t, "Warning AllocationPaused allocation paused, pool configMap [kubevip] in kube-system was deleted", <-recorder.Events)
+	_, err = client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(ctx, KubeVipClientConfig, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "configMap was recreated")
+
+	// the allocations resume once the configmap is recreated
+	cm.ResourceVersion = ""
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool { return !allocationPaused.Load() }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Normal AllocationResumed Pool configMap was recreated, resuming the allocations", <-recorder.Events)
+	res = mustSyncService(t, client, pending)
+	assert.Equal(t, "10.0.0.2", res.Annotations[LoadbalancerIPsAnnotation])
+}
+
+func TestSyncLoadBalancerConfigMapMissingPaused(t *testing.T) {
+	pauseOnConfigMapDeletion = true
+	defer func() { pauseOnConfigMapDeletion = false }()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}}
+	createService(t, client, svc)
+	_, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	assert.EqualError(t, err, "allocation paused, pool configMap [kubevip] in kube-system was deleted")
+	_, err = client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(ctx, KubeVipClientConfig, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err), "configMap was created")
+}
+
+func TestConfigMapWatcherAppliesReleaseHistorySize(t *testing.T) {
+	ipam.ResetReleases()
+	defer ipam.ResetReleases()
+	defer ipam.SetReleaseHistorySize(ipam.DefaultReleaseHistorySize)
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{"release-history-size-global": "2"},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	watcher := newConfigMapWatcher(client, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	watcher.Run(stopCh)
+	watcher.informerFactory.WaitForCacheSync(stopCh)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		ipam.RecordRelease([]netip.Addr{netip.MustParseAddr(ip)}, "test", "", time.Now())
+	}
+	assert.Len(t, ipam.RecentReleases(), 2)
+
+	// the size is applied again when the configmap is updated
+	cm.Data["release-history-size-global"] = "1"
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool { return len(ipam.RecentReleases()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, allocationPaused.Load())
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"strings"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// ConfigSecretEnvKey environment key for the name of a Secret, in the namespace of the pool ConfigMap, holding pool
+// definitions with the same keys as the ConfigMap, e.g. cidr-global, for operators considering their ranges sensitive
+const ConfigSecretEnvKey = "KUBEVIP_CONFIG_SECRET"
+
+// configSecret is the name of the Secret holding pool definitions, empty if ConfigSecretEnvKey isn't set
+var configSecret string
+
+// configSecretPools holds the pool keys of the Secret, nil until it's seen or once it's deleted
+var configSecretPools atomic.Pointer[map[string]string]
+
+// configSecretWatcher keeps the pool keys of the Secret up to date
+type configSecretWatcher struct {
+	informerFactory informers.SharedInformerFactory
+
+	secretName      string
+	secretNamespace string
+}
+
+func newConfigSecretWatcher(kubeClient kubernetes.Interface, secretName, secretNamespace string) *configSecretWatcher {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(secretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", secretName).String()
+		}))
+	w := &configSecretWatcher{
+		informerFactory: informerFactory,
+		secretName:      secretName,
+		secretNamespace: secretNamespace,
+	}
+	_, _ = informerFactory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.secretUpdated,
+		UpdateFunc: func(_, newObj interface{}) { w.secretUpdated(newObj) },
+		DeleteFunc: w.secretDeleted,
+	})
+	return w
+}
+
+// Run watches the Secret in the background
+func (w *configSecretWatcher) Run(stopCh <-chan struct{}) {
+	klog.Infof("reading pool definitions from secret [%s] in %s", w.secretName, w.secretNamespace)
+	w.informerFactory.Start(stopCh)
+}
+
+// secretUpdated stores the pool keys of the Secret, the other keys are ignored
+func (w *configSecretWatcher) secretUpdated(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || secret.Name != w.secretName {
+		return
+	}
+	pools := make(map[string]string)
+	for key, value := range secret.Data {
+		if isPoolKey(key) {
+			pools[key] = string(value)
+		} else {
+			klog.V(3).Infof("ignoring key [%s] of secret [%s] in %s, it doesn't define a pool", key, w.secretName, w.secretNamespace)
+		}
+	}
+	configSecretPools.Store(&pools)
+	ipam.SetSecretPools(pools)
+}
+
+// secretDeleted forgets the pool keys of the Secret
+func (w *configSecretWatcher) secretDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || secret.Name != w.secretName {
+		return
+	}
+	klog.Warningf("secret [%s] in %s was deleted, its pools are no longer available", w.secretName, w.secretNamespace)
+	configSecretPools.Store(nil)
+	ipam.SetSecretPools(nil)
+}
+
+// isPoolKey returns true if the key defines a pool, e.g. cidr-global or range-<namespace>
+func isPoolKey(key string) bool {
+	if strings.HasPrefix(key, "allow-share") {
+		return false
+	}
+	for _, name := range poolConfigNames {
+		if strings.HasPrefix(key, name+"-") || strings.HasPrefix(key, name+config.NamespaceKeyDelimiter) {
+			return true
+		}
+	}
+	return false
+}
+
+// withConfigSecretPools returns a copy of the ConfigMap holding the pool keys of the Secret too, the keys of the
+// ConfigMap take precedence. The ConfigMap is returned as is if no Secret is configured.
+func withConfigSecretPools(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	pools := configSecretPools.Load()
+	if pools == nil || len(*pools) == 0 {
+		return cm
+	}
+	merged := cm.DeepCopy()
+	if merged.Data == nil {
+		merged.Data = make(map[string]string, len(*pools))
+	}
+	for key, value := range *pools {
+		if _, ok := merged.Data[key]; !ok {
+			merged.Data[key] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func TestConfigSecretPools(t *testing.T) {
+	defer configSecretPools.Store(nil)
+	defer ipam.SetSecretPools(nil)
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-prod": "10.0.1.1-10.0.1.3",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubevip-pools",
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string][]byte{
+			"range-global": []byte("10.0.0.1-10.0.0.3"),
+			"range-prod":   []byte("10.0.2.1-10.0.2.3"),
+			"search-order": []byte("desc"),
+		},
+	}
+	if _, err := client.CoreV1().Secrets(KubeVipClientConfigNamespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	watcher := newConfigSecretWatcher(client, "kubevip-pools", KubeVipClientConfigNamespace)
+	watcher.Run(stopCh)
+	watcher.informerFactory.WaitForCacheSync(stopCh)
+	assert.Eventually(t, func() bool { return configSecretPools.Load() != nil }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]string{"range-global": "10.0.0.1-10.0.0.3", "range-prod": "10.0.2.1-10.0.2.3"}, *configSecretPools.Load())
+	// the metrics don't expose the pools of the Secret
+	assert.Equal(t, "secret:range-global", ipam.PoolLabel("10.0.0.1-10.0.0.3"))
+	assert.Equal(t, "10.0.1.1-10.0.1.3", ipam.PoolLabel("10.0.1.1-10.0.1.3"))
+
+	tests := []struct {
+		namespace string
+		wantIPs   string
+	}{
+		// the pool of the Secret
+		{namespace: "test", wantIPs: "10.0.0.1"},
+		// the pool of the ConfigMap takes precedence
+		{namespace: "prod", wantIPs: "10.0.1.1"},
+	}
+	for _, tt := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "web"}}
+		res := createAndSyncService(t, client, svc)
+		assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation], tt.namespace)
+	}
+
+	// the pools of a deleted Secret are forgotten
+	if err := client.CoreV1().Secrets(KubeVipClientConfigNamespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool { return configSecretPools.Load() == nil }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "10.0.0.1-10.0.0.3", ipam.PoolLabel("10.0.0.1-10.0.0.3"))
+	pending := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "pending"}}
+	createService(t, client, pending)
+	if _, err := syncLoadBalancer(ctx, client, pending, KubeVipClientConfig, KubeVipClientConfigNamespace); err == nil {
+		t.Fatal("expected an error without the pool of the Secret")
+	}
+}
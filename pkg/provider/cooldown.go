@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// discoverCrossNamespaceCooldown returns the value of cross-namespace-cooldown-seconds-global, an IP released by a
+// service isn't handed out to the services of another namespace during that time
+func discoverCrossNamespaceCooldown(cm *v1.ConfigMap) time.Duration {
+	return discoverCooldown(cm, "cross-namespace-cooldown-seconds")
+}
+
+// discoverReleaseCooldown returns the value of release-cooldown-seconds-global, an IP released by a service isn't
+// handed out to any service during that time
+func discoverReleaseCooldown(cm *v1.ConfigMap) time.Duration {
+	return discoverCooldown(cm, "release-cooldown-seconds")
+}
+
+// discoverCooldown returns the number of seconds of the global key, 0 if it isn't set or invalid
+func discoverCooldown(cm *v1.ConfigMap, name string) time.Duration {
+	secondsStr, key, err := getGlobalConfig(cm, name)
+	if err != nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(secondsStr)
+	if err != nil || seconds < 0 {
+		klog.Warningf("invalid value [%s] in [%s], expected a positive number of seconds, ignoring the cooldown", secondsStr, key)
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// discoverReleaseHistorySize returns the value of release-history-size-global, the number of releases kept in memory for
+// the admin endpoint, ipam.DefaultReleaseHistorySize if it isn't set or invalid
+func discoverReleaseHistorySize(cm *v1.ConfigMap) int {
+	sizeStr, key, err := getGlobalConfig(cm, "release-history-size")
+	if err != nil {
+		return ipam.DefaultReleaseHistorySize
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 1 {
+		klog.Warningf("invalid value [%s] in [%s], expected a positive number, defaulting to %d", sizeStr, key, ipam.DefaultReleaseHistorySize)
+		return ipam.DefaultReleaseHistorySize
+	}
+	return size
+}
+
+// recordRelease records the release of the comma separated IPs by the service name of the namespace in the release
+// registry of the ipam
+func recordRelease(ips, namespace, name string) {
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return
+	}
+	ipam.RecordRelease(addrs, namespace, name, time.Now())
+}
+
+// discoverStickyByName returns true if sticky-by-name-global is true, a service recreated with the namespace/name of a
+// deleted one then reclaims the IPs it released if they are still free
+func discoverStickyByName(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "sticky-by-name")
+}
+
+// reclaimableIPs returns the IPs last released by the service name of the namespace, the most recent first
+func reclaimableIPs(namespace, name string) []string {
+	var ips []string
+	for _, addr := range ipam.ReleasedBy(namespace, name) {
+		ips = append(ips, addr.String())
+	}
+	return ips
+}
@@ -0,0 +1,188 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func TestDiscoverCrossNamespaceCooldown(t *testing.T) {
+	assert.Equal(t, 90*time.Second, discoverCrossNamespaceCooldown(&v1.ConfigMap{Data: map[string]string{"cross-namespace-cooldown-seconds-global": "90"}}))
+	assert.Equal(t, time.Duration(0), discoverCrossNamespaceCooldown(&v1.ConfigMap{Data: map[string]string{"cross-namespace-cooldown-seconds-global": "-1"}}))
+	assert.Equal(t, time.Duration(0), discoverCrossNamespaceCooldown(&v1.ConfigMap{}))
+	assert.Equal(t, 30*time.Second, discoverReleaseCooldown(&v1.ConfigMap{Data: map[string]string{"release-cooldown-seconds-global": "30"}}))
+}
+
+func TestDiscoverReleaseHistorySize(t *testing.T) {
+	assert.Equal(t, 50, discoverReleaseHistorySize(&v1.ConfigMap{Data: map[string]string{"release-history-size-global": "50"}}))
+	assert.Equal(t, ipam.DefaultReleaseHistorySize, discoverReleaseHistorySize(&v1.ConfigMap{Data: map[string]string{"release-history-size-global": "0"}}))
+	assert.Equal(t, ipam.DefaultReleaseHistorySize, discoverReleaseHistorySize(&v1.ConfigMap{}))
+}
+
+func TestSyncLoadBalancerCrossNamespaceCooldown(t *testing.T) {
+	ipam.ResetReleases()
+	defer ipam.ResetReleases()
+
+	ctx := context.Background()
+	mgr := &kubevipLoadBalancerManager{
+		kubeClient:     fake.NewSimpleClientset(),
+		namespace:      KubeVipClientConfigNamespace,
+		cloudConfigMap: KubeVipClientConfig,
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.10",
+			"cross-namespace-cooldown-seconds-global": "3600",
+		},
+	}
+	if _, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(namespace, name string) string {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		if _, err := mgr.kubeClient.CoreV1().Services(namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syncLoadBalancer(ctx, mgr.kubeClient, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatal(err)
+		}
+		res, err := mgr.kubeClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Annotations[LoadbalancerIPsAnnotation]
+	}
+	release := func(namespace, name string) {
+		svc, err := mgr.kubeClient.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.kubeClient.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.EnsureLoadBalancerDeleted(ctx, "", svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, "10.0.0.1", allocate("team-a", "first"))
+	release("team-a", "first")
+
+	// another namespace doesn't get the freed IP during the cooldown
+	assert.Equal(t, "10.0.0.2", allocate("team-b", "other"))
+	// the namespace that released it can reuse it
+	assert.Equal(t, "10.0.0.1", allocate("team-a", "second"))
+}
+
+func TestSyncLoadBalancerStickyByName(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          map[string]string
+		wantRecreated string
+		wantTaken     string
+	}{
+		{
+			name:          "recreated service gets the lowest free IP by default",
+			wantRecreated: "10.0.0.1",
+			wantTaken:     "10.0.0.2",
+		},
+		{
+			name:          "recreated service reclaims its previous IP",
+			data:          map[string]string{"sticky-by-name-global": "true"},
+			wantRecreated: "10.0.0.2",
+			wantTaken:     "10.0.0.4",
+		},
+		{
+			name:          "recreated service reclaims its previous IP during the release cooldown",
+			data:          map[string]string{"sticky-by-name-global": "true", "release-cooldown-seconds-global": "3600"},
+			wantRecreated: "10.0.0.2",
+			wantTaken:     "10.0.0.4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipam.ResetReleases()
+			defer ipam.ResetReleases()
+
+			ctx := context.Background()
+			mgr := &kubevipLoadBalancerManager{
+				kubeClient:     fake.NewSimpleClientset(),
+				namespace:      KubeVipClientConfigNamespace,
+				cloudConfigMap: KubeVipClientConfig,
+			}
+			data := map[string]string{"range-global": "10.0.0.1-10.0.0.10"}
+			for key, value := range tt.data {
+				data[key] = value
+			}
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: data,
+			}
+			if _, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			allocate := func(name string) string {
+				svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: name}}
+				createService(t, mgr.kubeClient, svc)
+				if _, err := syncLoadBalancer(ctx, mgr.kubeClient, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+					t.Fatal(err)
+				}
+				res, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res.Annotations[LoadbalancerIPsAnnotation]
+			}
+			release := func(name string) {
+				svc, err := mgr.kubeClient.CoreV1().Services("team-a").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := mgr.kubeClient.CoreV1().Services("team-a").Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				if err := mgr.EnsureLoadBalancerDeleted(ctx, "", svc); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			assert.Equal(t, "10.0.0.1", allocate("web"))
+			assert.Equal(t, "10.0.0.2", allocate("api"))
+			assert.Equal(t, "10.0.0.3", allocate("db"))
+			release("web")
+			release("api")
+
+			// the service is recreated with the same namespace/name, and a new UID
+			assert.Equal(t, tt.wantRecreated, allocate("api"))
+
+			// the IP of web is taken by another service before web is recreated
+			if _, err := mgr.kubeClient.CoreV1().Services("team-a").Create(ctx, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "team-a",
+					Name:        "squatter",
+					Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
+				},
+			}, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantTaken, allocate("web"))
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+// EffectiveConfig is the configuration the provider resolved from the pool ConfigMap and its environment, served on
+// the /config path of the admin endpoint for support bundles
+type EffectiveConfig struct {
+	// ConfigMap is the <namespace>/<name> of the pool ConfigMap
+	ConfigMap string `json:"configMap"`
+	// Pools are the cidr, range and allowlist keys of the ConfigMap with their pools
+	Pools map[string]string `json:"pools"`
+	// Global is the configuration of the namespaces without keys of their own
+	Global NamespaceConfig `json:"global"`
+	// Namespaces is the configuration of the namespaces named in the keys of the ConfigMap
+	Namespaces map[string]NamespaceConfig `json:"namespaces,omitempty"`
+	// Settings are the settings of the provider set by environment variables
+	Settings map[string]string `json:"settings"`
+}
+
+// NamespaceConfig is the configuration resolved for a namespace, the global keys applying to the namespace included
+type NamespaceConfig struct {
+	Pool                  string   `json:"pool,omitempty"`
+	GlobalPool            bool     `json:"globalPool"`
+	AllowShare            bool     `json:"allowShare"`
+	SearchOrder           string   `json:"searchOrder"`
+	SkipEndIPs            bool     `json:"skipEndIPs"`
+	UsableRange           string   `json:"usableRange,omitempty"`
+	ExcludedIPs           string   `json:"excludedIPs,omitempty"`
+	PreferredIPs          []string `json:"preferredIPs,omitempty"`
+	Interface             string   `json:"interface,omitempty"`
+	Advertisement         string   `json:"advertisement,omitempty"`
+	DefaultIPFamilyPolicy string   `json:"defaultIPFamilyPolicy,omitempty"`
+	MaxFill               []string `json:"maxFill,omitempty"`
+}
+
+// namespacedConfigNames are the configs whose keys name a namespace, <name>-<namespace>
+var namespacedConfigNames = []string{"cidr", "range", "allow", "allow-share", "interface", config.ConfigMapSearchOrderKey, "usable", "preferred", "advertisement", "default-ip-family-policy", "max-fill", "exclude-ips"}
+
+// effectiveConfig returns the configuration resolved from the pool ConfigMap and the environment of the provider
+func (p *KubeVipCloudProvider) effectiveConfig(ctx context.Context) (interface{}, error) {
+	cm, err := getConfigMap(ctx, p.kubeClient, p.configMapName, p.namespace)
+	if err != nil {
+		return nil, err
+	}
+	return buildEffectiveConfig(cm, p.configMapName, map[string]string{
+		EnableLoadbalancerClassEnvKey:        strconv.FormatBool(p.enableLBClass),
+		CustomLoadbalancerClassNameEnvKey:    loadbalancerClassName,
+		AcceptDefaultLoadbalancerClassEnvKey: strconv.FormatBool(acceptDefaultLoadbalancerClass),
+		EnableAllocationsStatusEnvKey:        strconv.FormatBool(p.enableAllocationsStatus),
+		VerboseEventsEnvKey:                  strconv.FormatBool(p.verboseEvents),
+		PriorityQueueEnvKey:                  strconv.FormatBool(p.priorityQueue),
+		RestoreStatusEnvKey:                  strconv.FormatBool(p.restoreStatus),
+		AllocationOrderEnvKey:                p.allocationOrder,
+		MaxSyncRetriesEnvKey:                 strconv.Itoa(p.maxSyncRetries),
+		AllocationFailedStatusEnvKey:         strconv.FormatBool(p.allocationFailedStatus),
+		ConfigMapReadOnlyEnvKey:              strconv.FormatBool(configMapReadOnly),
+		PauseOnConfigMapDeletionEnvKey:       strconv.FormatBool(pauseOnConfigMapDeletion),
+		AllocationRecordsEnvKey:              strconv.FormatBool(allocationRecords),
+		ConfigSecretEnvKey:                   configSecret,
+		ImplementationLabelKeyEnvKey:         implementationLabelKey,
+		ServiceDenylistEnvKey:                strings.Join(serviceDenylist, ","),
+		NamespaceRegexEnvKey:                 namespaceRegexString(),
+		config.ConfigMapKeyDelimiterEnvKey:   config.NamespaceKeyDelimiter,
+		config.GlobalKeywordEnvKey:           config.GlobalKeyword,
+		config.ClusterNameEnvKey:             config.ClusterName,
+	}), nil
+}
+
+// buildEffectiveConfig resolves the configuration of the global pool and of the namespaces named in the keys of the
+// ConfigMap. The pools selected by namespace labels aren't resolved, the labels of the namespaces are unknown here.
+func buildEffectiveConfig(cm *v1.ConfigMap, cmName string, settings map[string]string) *EffectiveConfig {
+	effective := &EffectiveConfig{
+		ConfigMap:  cm.Namespace + "/" + cmName,
+		Pools:      map[string]string{},
+		Global:     resolveNamespaceConfig(cm, "", cmName),
+		Namespaces: map[string]NamespaceConfig{},
+		Settings:   settings,
+	}
+	for _, key := range poolKeys(cm) {
+		effective.Pools[key] = poolOfKey(cm, key)
+	}
+	for _, namespace := range configuredNamespaces(cm) {
+		effective.Namespaces[namespace] = resolveNamespaceConfig(cm, namespace, cmName)
+	}
+	return effective
+}
+
+// configuredNamespaces returns the sorted namespaces named in the keys of the ConfigMap
+func configuredNamespaces(cm *v1.ConfigMap) []string {
+	var namespaces []string
+	for key := range cm.Data {
+		for _, name := range namespacedConfigNames {
+			namespace, ok := strings.CutPrefix(key, name+config.NamespaceKeyDelimiter)
+			if !ok || len(namespace) == 0 || namespace == config.GlobalKeyword || strings.HasPrefix(namespace, RegionPoolPrefix) {
+				continue
+			}
+			// allow-share-<namespace> also starts with allow-
+			if name == "allow" && strings.HasPrefix(namespace, "share"+config.NamespaceKeyDelimiter) {
+				continue
+			}
+			if !slices.Contains(namespaces, namespace) {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// resolveNamespaceConfig resolves the configuration of the namespace, the global one if the namespace is empty
+func resolveNamespaceConfig(cm *v1.ConfigMap, namespace, cmName string) NamespaceConfig {
+	pool, global, allowShare, _ := discoverPool(cm, namespace, cmName)
+	lbConfig := config.GetKubevipLBConfig(cm, namespace)
+	resolved := NamespaceConfig{
+		Pool:          pool,
+		GlobalPool:    global || len(namespace) == 0,
+		AllowShare:    allowShare,
+		SearchOrder:   "asc",
+		SkipEndIPs:    lbConfig.SkipEndIPsInCIDR,
+		UsableRange:   discoverUsableRange(cm, namespace, global || len(namespace) == 0),
+		ExcludedIPs:   discoverExcludedIPs(cm, namespace),
+		PreferredIPs:  discoverPreferredIPs(cm, namespace, cmName),
+		Interface:     discoverInterface(cm, namespace),
+		Advertisement: discoverAdvertisement(cm, namespace, cmName),
+	}
+	if lbConfig.ReturnIPInDescOrder {
+		resolved.SearchOrder = "desc"
+	}
+	if policy := discoverDefaultIPFamilyPolicy(cm, namespace, cmName); policy != nil {
+		resolved.DefaultIPFamilyPolicy = string(*policy)
+	}
+	for _, limit := range discoverMaxFill(cm, namespace, cmName, len(namespace) == 0) {
+		resolved.MaxFill = append(resolved.MaxFill, fmt.Sprintf("%s=%d", limit.prefix, limit.percent))
+	}
+	return resolved
+}
@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildEffectiveConfig(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipClientConfig, Namespace: KubeVipClientConfigNamespace},
+		Data: map[string]string{
+			"cidr-global":                     "192.168.0.0/24",
+			"range-team-a":                    "10.0.0.1-10.0.0.10",
+			"cidr-team-b":                     "10.1.0.0/28",
+			"cidr-region-west-global":         "10.2.0.0/28",
+			"allow-team-c":                    "10.3.0.1,10.3.0.2",
+			"allow-share-team-b":              "true",
+			"search-order-team-a":             "desc",
+			"skip-end-ips-in-cidr":            "true",
+			"interface-global":                "eth0",
+			"interface-team-a":                "eth1",
+			"advertisement-global":            "bgp",
+			"default-ip-family-policy-team-b": "PreferDualStack",
+		},
+	}
+
+	effective := buildEffectiveConfig(cm, KubeVipClientConfig, map[string]string{PriorityQueueEnvKey: "true"})
+
+	assert.Equal(t, KubeVipClientConfigNamespace+"/"+KubeVipClientConfig, effective.ConfigMap)
+	assert.Equal(t, map[string]string{
+		"cidr-global":             "192.168.0.0/24",
+		"range-team-a":            "10.0.0.1-10.0.0.10",
+		"cidr-team-b":             "10.1.0.0/28",
+		"cidr-region-west-global": "10.2.0.0/28",
+		"allow-team-c":            "10.3.0.1-10.3.0.1,10.3.0.2-10.3.0.2",
+	}, effective.Pools)
+	assert.Equal(t, map[string]string{PriorityQueueEnvKey: "true"}, effective.Settings)
+
+	assert.Equal(t, NamespaceConfig{
+		Pool:          "192.168.0.0/24",
+		GlobalPool:    true,
+		SearchOrder:   "asc",
+		SkipEndIPs:    true,
+		Interface:     "eth0",
+		Advertisement: AdvertisementBGP,
+	}, effective.Global)
+	assert.Equal(t, map[string]NamespaceConfig{
+		"team-a": {
+			Pool:          "10.0.0.1-10.0.0.10",
+			SearchOrder:   "desc",
+			SkipEndIPs:    true,
+			Interface:     "eth1",
+			Advertisement: AdvertisementBGP,
+		},
+		"team-b": {
+			Pool:                  "10.1.0.0/28",
+			AllowShare:            true,
+			SearchOrder:           "asc",
+			SkipEndIPs:            true,
+			Interface:             "eth0",
+			Advertisement:         AdvertisementBGP,
+			DefaultIPFamilyPolicy: string(v1.IPFamilyPolicyPreferDualStack),
+		},
+		"team-c": {
+			Pool:          "10.3.0.1-10.3.0.1,10.3.0.2-10.3.0.2",
+			SearchOrder:   "asc",
+			SkipEndIPs:    true,
+			Interface:     "eth0",
+			Advertisement: AdvertisementBGP,
+		},
+	}, effective.Namespaces)
+
+	// the dump is served as JSON
+	_, err := json.Marshal(effective)
+	assert.NoError(t, err)
+}
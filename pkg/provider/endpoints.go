@@ -0,0 +1,224 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// EnableEndpointNodesEnvKey environment key for watching the EndpointSlices of the ExternalTrafficPolicy Local services,
+// the nodes of their ready endpoints are kept in the kube-vip.io/endpointNodes annotation
+const EnableEndpointNodesEnvKey = "KUBEVIP_ENABLE_ENDPOINT_NODES"
+
+// endpointNodesController keeps the endpoint nodes annotation of the ExternalTrafficPolicy Local services up to date
+// when their endpoints move between nodes
+type endpointNodesController struct {
+	kubeClient                kubernetes.Interface
+	serviceLister             corelisters.ServiceLister
+	serviceListerSynced       cache.InformerSynced
+	endpointSliceLister       discoverylisters.EndpointSliceLister
+	endpointSliceListerSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+}
+
+func newEndpointNodesController(sharedInformer informers.SharedInformerFactory, kubeClient kubernetes.Interface) *endpointNodesController {
+	serviceInformer := sharedInformer.Core().V1().Services().Informer()
+	endpointSliceInformer := sharedInformer.Discovery().V1().EndpointSlices().Informer()
+	c := &endpointNodesController{
+		kubeClient:                kubeClient,
+		serviceLister:             sharedInformer.Core().V1().Services().Lister(),
+		serviceListerSynced:       serviceInformer.HasSynced,
+		endpointSliceLister:       sharedInformer.Discovery().V1().EndpointSlices().Lister(),
+		endpointSliceListerSynced: endpointSliceInformer.HasSynced,
+
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "EndpointNodes"),
+	}
+
+	_, _ = endpointSliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.endpointSliceChanged,
+		UpdateFunc: func(_, cur interface{}) { c.endpointSliceChanged(cur) },
+		DeleteFunc: c.endpointSliceChanged,
+	})
+	_, _ = serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.serviceUpdated,
+	})
+
+	return c
+}
+
+// endpointSliceChanged enqueues the service of the EndpointSlice
+func (c *endpointNodesController) endpointSliceChanged(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	if len(name) == 0 {
+		return
+	}
+	c.workqueue.Add(slice.Namespace + "/" + name)
+}
+
+// serviceUpdated enqueues the service if its external traffic policy changed or it got its IPs
+func (c *endpointNodesController) serviceUpdated(old, cur interface{}) {
+	oldSvc, ok1 := old.(*corev1.Service)
+	curSvc, ok2 := cur.(*corev1.Service)
+	if !ok1 || !ok2 {
+		return
+	}
+	if oldSvc.Spec.ExternalTrafficPolicy != curSvc.Spec.ExternalTrafficPolicy ||
+		oldSvc.Annotations[LoadbalancerIPsAnnotation] != curSvc.Annotations[LoadbalancerIPsAnnotation] {
+		c.workqueue.Add(curSvc.Namespace + "/" + curSvc.Name)
+	}
+}
+
+// Run starts the worker to process endpoint changes
+func (c *endpointNodesController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	if !cache.WaitForNamedCacheSync("endpointslice", stopCh, c.serviceListerSynced, c.endpointSliceListerSynced) {
+		return
+	}
+
+	klog.V(4).Info("Starting endpoint nodes worker.")
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *endpointNodesController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *endpointNodesController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workqueue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.workqueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+		return true
+	}
+
+	if err := c.syncService(context.Background(), key); err != nil {
+		c.workqueue.AddRateLimited(obj)
+		utilruntime.HandleError(fmt.Errorf("error syncing endpoint nodes of '%s': %s, requeuing", key, err.Error()))
+		return true
+	}
+
+	c.workqueue.Forget(obj)
+	return true
+}
+
+// syncService sets the endpoint nodes annotation of an ExternalTrafficPolicy Local service with IPs,
+// and removes it from the other services
+func (c *endpointNodesController) syncService(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isImplemented(svc) || !svc.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	current, annotated := svc.Annotations[EndpointNodesAnnotationKey]
+	if svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal || len(svc.Annotations[LoadbalancerIPsAnnotation]) == 0 {
+		if !annotated {
+			return nil
+		}
+		return c.updateEndpointNodes(ctx, svc, nil)
+	}
+
+	slices, err := c.endpointSliceLister.EndpointSlices(namespace).List(labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: name}))
+	if err != nil {
+		return err
+	}
+	nodes := endpointNodes(slices)
+	if annotated && current == nodes {
+		return nil
+	}
+	klog.Infof("service '%s/%s' ready endpoints are on nodes [%s]", svc.Namespace, svc.Name, nodes)
+	return c.updateEndpointNodes(ctx, svc, &nodes)
+}
+
+// updateEndpointNodes sets the endpoint nodes annotation of the service, or removes it if nodes is nil
+func (c *endpointNodesController) updateEndpointNodes(ctx context.Context, svc *corev1.Service, nodes *string) error {
+	err := retryOnConflict(func() error {
+		recentService, getErr := c.kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if nodes == nil {
+			delete(recentService.Annotations, EndpointNodesAnnotationKey)
+		} else {
+			if recentService.Annotations == nil {
+				recentService.Annotations = make(map[string]string)
+			}
+			recentService.Annotations[EndpointNodesAnnotationKey] = *nodes
+		}
+		_, updateErr := c.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("error updating annotation '%s' of Service [%s] : %v", EndpointNodesAnnotationKey, svc.Name, err)
+	}
+	return nil
+}
+
+// endpointNodes returns the sorted comma separated nodes of the ready endpoints of the EndpointSlices,
+// an endpoint without a ready condition is ready
+func endpointNodes(slices []*discoveryv1.EndpointSlice) string {
+	nodeSet := map[string]struct{}{}
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName == nil || len(*endpoint.NodeName) == 0 {
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			nodeSet[*endpoint.NodeName] = struct{}{}
+		}
+	}
+
+	nodes := make([]string, 0, len(nodeSet))
+	for node := range nodeSet {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return strings.Join(nodes, ",")
+}
@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+)
+
+func newTestEndpointNodesController() (*endpointNodesController, *fake.Clientset, informers.SharedInformerFactory) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	c := &endpointNodesController{
+		kubeClient:                client,
+		serviceLister:             informerFactory.Core().V1().Services().Lister(),
+		serviceListerSynced:       alwaysReady,
+		endpointSliceLister:       informerFactory.Discovery().V1().EndpointSlices().Lister(),
+		endpointSliceListerSynced: alwaysReady,
+		workqueue:                 workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "EndpointNodes"),
+	}
+	return c, client, informerFactory
+}
+
+func newTestEndpointSlice(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "name"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+	}
+}
+
+func newTestEndpoint(node string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{"10.244.0.1"},
+		NodeName:   ptr.To(node),
+		Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ready)},
+	}
+}
+
+func TestEndpointSliceChanged(t *testing.T) {
+	c, _, _ := newTestEndpointNodesController()
+
+	c.endpointSliceChanged(newTestEndpointSlice("name-abcde"))
+	c.endpointSliceChanged(&discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "unmanaged"}})
+	assert.Equal(t, 1, c.workqueue.Len())
+	key, _ := c.workqueue.Get()
+	assert.Equal(t, "test/name", key)
+}
+
+func TestEndpointNodesSyncService(t *testing.T) {
+	c, client, informerFactory := newTestEndpointNodesController()
+	services := informerFactory.Core().V1().Services().Informer().GetIndexer()
+	slices := informerFactory.Discovery().V1().EndpointSlices().Informer().GetIndexer()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "name",
+			Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+			Annotations: map[string]string{LoadbalancerIPsAnnotation: "192.168.1.1"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:                  corev1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+		},
+	}
+	createService(t, client, svc)
+
+	sync := func() *corev1.Service {
+		recent, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := services.Update(recent); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.syncService(context.Background(), "test/name"); err != nil {
+			t.Fatalf("syncService() error: %v", err)
+		}
+		res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// the not ready endpoints are left out
+	first := newTestEndpointSlice("name-abcde", newTestEndpoint("node-2", true), newTestEndpoint("node-3", false))
+	second := newTestEndpointSlice("name-fghij", newTestEndpoint("node-1", true), newTestEndpoint("node-2", true))
+	for _, slice := range []*discoveryv1.EndpointSlice{first, second} {
+		if err := slices.Add(slice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := services.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	res := sync()
+	assert.Equal(t, "node-1,node-2", res.Annotations[EndpointNodesAnnotationKey])
+
+	// the endpoints move to another node
+	if err := slices.Delete(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := slices.Update(newTestEndpointSlice("name-abcde", newTestEndpoint("node-3", true))); err != nil {
+		t.Fatal(err)
+	}
+	res = sync()
+	assert.Equal(t, "node-3", res.Annotations[EndpointNodesAnnotationKey])
+
+	// no ready endpoint left
+	if err := slices.Update(newTestEndpointSlice("name-abcde", newTestEndpoint("node-3", false))); err != nil {
+		t.Fatal(err)
+	}
+	res = sync()
+	value, ok := res.Annotations[EndpointNodesAnnotationKey]
+	assert.True(t, ok)
+	assert.Equal(t, "", value)
+
+	// the annotation is removed once the service no longer uses the Local policy
+	res.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+	if _, err := client.CoreV1().Services(res.Namespace).Update(context.Background(), res, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res = sync()
+	assert.NotContains(t, res.Annotations, EndpointNodesAnnotationKey)
+}
@@ -0,0 +1,54 @@
+package provider
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// ExternalIPsError is returned when the spec.externalIPs of a service can't be advertised
+type ExternalIPsError struct {
+	IP     string
+	Reason string
+}
+
+func (e *ExternalIPsError) Error() string {
+	return fmt.Sprintf("external IP [%s] can't be advertised: %s", e.IP, e.Reason)
+}
+
+// discoverUseExternalIPs returns true if use-external-ips-<namespace> or use-external-ips-global is true, the
+// spec.externalIPs of the services are then advertised instead of addresses from the pool
+func discoverUseExternalIPs(cm *v1.ConfigMap, namespace, configMapName string) bool {
+	useStr, _, err := getConfig(cm, namespace, configMapName, "use-external-ips", "config")
+	if err != nil {
+		return false
+	}
+	use, _ := strconv.ParseBool(useStr)
+	return use
+}
+
+// serviceExternalIPs returns the spec.externalIPs of the service if they are all in the pool and not used by another
+// service, an empty string if the service has none, or an ExternalIPsError otherwise
+func serviceExternalIPs(service *v1.Service, pool string, inUseIPSet *netipx.IPSet) (string, error) {
+	ips := make([]string, 0, len(service.Spec.ExternalIPs))
+	for _, ip := range service.Spec.ExternalIPs {
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return "", &ExternalIPsError{IP: ip, Reason: "it is not a valid IP"}
+		}
+		if inPool, err := ipam.PoolContains(pool, addr); err != nil || !inPool {
+			return "", &ExternalIPsError{IP: ip, Reason: fmt.Sprintf("it is not in the pool [%s]", pool)}
+		}
+		if inUseIPSet != nil && inUseIPSet.Contains(addr) {
+			return "", &ExternalIPsError{IP: ip, Reason: "it is used by another service"}
+		}
+		ips = append(ips, addr.String())
+	}
+	return strings.Join(ips, ","), nil
+}
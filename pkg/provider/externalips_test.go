@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestServiceExternalIPs(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		externalIPs    []string
+		existingIP     string
+		expectIPs      string
+		expectStrategy string
+		expectEvent    string
+	}{
+		{
+			name:           "in-pool external IPs are advertised",
+			data:           map[string]string{"cidr-global": "10.0.0.0/24", "use-external-ips-global": "true"},
+			externalIPs:    []string{"10.0.0.42", "10.0.0.43"},
+			expectIPs:      "10.0.0.42,10.0.0.43",
+			expectStrategy: AllocationStrategyExternalIPs,
+		},
+		{
+			name:        "out-of-pool external IP is rejected",
+			data:        map[string]string{"cidr-global": "10.0.0.0/24", "use-external-ips-global": "true"},
+			externalIPs: []string{"10.0.0.42", "192.168.0.42"},
+			expectEvent: "Warning ExternalIPsRejected external IP [192.168.0.42] can't be advertised: it is not in the pool [10.0.0.0/24]",
+		},
+		{
+			name:        "external IP used by another service is rejected",
+			data:        map[string]string{"cidr-global": "10.0.0.0/24", "use-external-ips-global": "true"},
+			externalIPs: []string{"10.0.0.42"},
+			existingIP:  "10.0.0.42",
+			expectEvent: "Warning ExternalIPsRejected external IP [10.0.0.42] can't be advertised: it is used by another service",
+		},
+		{
+			name:           "external IPs are ignored unless enabled",
+			data:           map[string]string{"cidr-global": "10.0.0.0/24"},
+			externalIPs:    []string{"10.0.0.42"},
+			expectIPs:      "10.0.0.1",
+			expectStrategy: AllocationStrategyAsc,
+		},
+		{
+			name:           "service without external IPs gets an IP from the pool",
+			data:           map[string]string{"cidr-global": "10.0.0.0/24", "use-external-ips-global": "true"},
+			expectIPs:      "10.0.0.1",
+			expectStrategy: AllocationStrategyAsc,
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.existingIP) > 0 {
+				existing := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        "existing",
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: tt.existingIP},
+					},
+				}
+				createService(t, client, existing)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "external"},
+				Spec:       v1.ServiceSpec{ExternalIPs: tt.externalIPs},
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if len(tt.expectEvent) > 0 {
+				var externalIPsErr *ExternalIPsError
+				assert.ErrorAs(t, err, &externalIPsErr)
+				assert.Len(t, recorder.Events, 1)
+				assert.Equal(t, tt.expectEvent, <-recorder.Events)
+			} else if err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.expectStrategy, res.Annotations[AllocationStrategyAnnotationKey])
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+const (
+	// FamilyChangeBehaviorDetect only emits an event when the pool of a PreferDualStack service that got a single IP now
+	// has a pool for its missing IP family, this is the default
+	FamilyChangeBehaviorDetect = "detect"
+
+	// FamilyChangeBehaviorUpgrade allocates the IP of the missing IP family to the PreferDualStack service on reconcile
+	FamilyChangeBehaviorUpgrade = "upgrade"
+)
+
+// missingFamilyPools holds the pool of the missing IP family last acted upon for each PreferDualStack service, keyed by
+// <namespace>/<name>, so the event is emitted and the upgrade attempted once per pool change instead of on every reconcile
+var missingFamilyPools sync.Map
+
+// forgetMissingIPFamily forgets the pool of the missing IP family acted upon for the service
+func forgetMissingIPFamily(service *v1.Service) {
+	missingFamilyPools.Delete(service.Namespace + "/" + service.Name)
+}
+
+// discoverFamilyChangeUpgrade returns true if family-change-behavior-global is upgrade
+func discoverFamilyChangeUpgrade(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "family-change-behavior", FamilyChangeBehaviorDetect, FamilyChangeBehaviorUpgrade) == FamilyChangeBehaviorUpgrade
+}
+
+// checkMissingIPFamily detects a PreferDualStack service that fell back to a single IP family at allocation while its
+// pool now serves the other family too, e.g. after an IPv6 cidr was added to an IPv4 pool. With
+// family-change-behavior-global set to upgrade, the service gets an IP of the missing family, otherwise an
+// IPFamilyAvailable event is emitted. Both only happen once until the pool of the missing family changes. The single-stack
+// services are never changed.
+func checkMissingIPFamily(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	if !poolAllocatedStrategies.Has(service.Annotations[AllocationStrategyAnnotationKey]) {
+		return nil
+	}
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	addrs, err := parseAddrList(ips)
+	if err != nil || len(addrs) != 1 || addrs[0].IsUnspecified() {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	ipFamilyPolicy := service.Spec.IPFamilyPolicy
+	if ipFamilyPolicy == nil {
+		ipFamilyPolicy = discoverDefaultIPFamilyPolicy(controllerCM, service.Namespace, controllerCM.Name)
+	}
+	if ipFamilyPolicy == nil || *ipFamilyPolicy != v1.IPFamilyPolicyPreferDualStack {
+		return nil
+	}
+
+	namespaceLabels, err := getNamespaceLabels(ctx, kubeClient, controllerCM, service.Namespace)
+	if err != nil {
+		return err
+	}
+	pool, global, _, err := discoverServicePool(controllerCM, service, namespaceLabels, controllerCM.Name)
+	if err != nil || pool == DHCPPool {
+		return nil
+	}
+	var ipv4Pool, ipv6Pool string
+	if ipam.IsCidrPool(pool) {
+		ipv4Pool, ipv6Pool, err = ipam.SplitCIDRsByIPFamily(pool)
+	} else {
+		ipv4Pool, ipv6Pool, err = ipam.SplitRangesByIPFamily(pool)
+	}
+	if err != nil {
+		return nil
+	}
+	missingPool, missingFamily := ipv6Pool, v1.IPv6Protocol
+	if addrs[0].Is6() {
+		missingPool, missingFamily = ipv4Pool, v1.IPv4Protocol
+	}
+	if len(missingPool) == 0 {
+		return nil
+	}
+	key := service.Namespace + "/" + service.Name
+	if seen, ok := missingFamilyPools.Load(key); ok && seen == missingPool {
+		return nil
+	}
+	missingFamilyPools.Store(key, missingPool)
+
+	if !discoverFamilyChangeUpgrade(controllerCM) {
+		klog.Infof("PreferDualStack service '%s/%s' has IP [%s] only, its pool now has an %s pool [%s]", service.Namespace, service.Name, ips, missingFamily, missingPool)
+		recordEventf(service, v1.EventTypeNormal, "IPFamilyAvailable", "Pool now serves %s, set family-change-behavior-global to %s to add an %s IP",
+			missingFamily, FamilyChangeBehaviorUpgrade, missingFamily)
+		return nil
+	}
+
+	serviceNamespace := service.Namespace
+	if global {
+		serviceNamespace = ""
+	}
+	kubevipLBConfig := serviceLBConfig(controllerCM, service, controllerCM.Name, pool, global)
+
+	var upgradedIPs string
+	var upgraded bool
+	var allocErr error
+	lock := func() func() { return lockPool(pool) }
+	err = allocateProbed(kubevipLBConfig, lock, func() error {
+		allocErr = nil
+		var rewriteErr error
+		upgraded, rewriteErr = rewriteServiceIPs(ctx, kubeClient, service, ips, func(recentService *v1.Service) error {
+			svcs, err := listInUseServices(ctx, kubeClient, serviceNamespace)
+			if err != nil {
+				return err
+			}
+			inUseSet, _, err := mapImplementedServices(svcs, false)
+			if err != nil {
+				return err
+			}
+			// the address manager caches the pool of the missing family apart from the pool of the namespace, as for a
+			// dual-stack allocation
+			vip, err := discoverAddress(service.Namespace, missingPool, inUseSet, kubevipLBConfig)
+			if err != nil {
+				allocErr = err
+				return err
+			}
+
+			families := recentService.Spec.IPFamilies
+			if familyOrder, err := parseFamilyOrder(recentService.Annotations[FamilyOrderAnnotationKey]); err == nil && len(familyOrder) > 0 {
+				families = familyOrder
+			}
+			// the IP the service already has stays first unless the families order the new one first
+			upgradedIPs = orderIPsByFamily(ips+","+vip, families)
+			setLoadBalancerIPs(recentService, upgradedIPs)
+			recentService.Spec.LoadBalancerIP = legacyLoadBalancerIP(upgradedIPs, discoverLegacyLBIPFamily(controllerCM))
+			return nil
+		})
+		return rewriteErr
+	})
+	if allocErr != nil {
+		// the service keeps its IP, as at allocation a PreferDualStack service may be single-stack
+		klog.Warningf("PreferDualStack service '%s/%s' stays single-stack, no %s IP could be allocated: %v", service.Namespace, service.Name, missingFamily, allocErr)
+		return nil
+	}
+	if err != nil {
+		// the update failed, the upgrade is attempted again on the next reconcile
+		missingFamilyPools.Delete(key)
+		return fmt.Errorf("error adding an %s IP to Service [%s] : %v", missingFamily, service.Name, err)
+	}
+	forgetMissingIPFamily(service)
+	if !upgraded {
+		return nil
+	}
+
+	klog.Infof("PreferDualStack service '%s/%s' upgraded from IP [%s] to IPs [%s]", service.Namespace, service.Name, ips, upgradedIPs)
+	recordEventf(service, v1.EventTypeNormal, "IPFamilyUpgraded", "Added %s IP, the IPs are now %s", missingFamily, upgradedIPs)
+	notifyAllocation(service, upgradedIPs, pool)
+	return nil
+}
+
+// trimExtraIPFamily corrects a single-stack service holding an IP of each family, e.g. after a pool change, to the IP of
+// its spec.IPFamilies, or to its first IP. The extra IP is released. The IPs requested by the service aren't changed.
+// It returns true if the IPs were trimmed.
+func trimExtraIPFamily(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) (bool, error) {
+	if !poolAllocatedStrategies.Has(service.Annotations[AllocationStrategyAnnotationKey]) {
+		return false, nil
+	}
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	addrs, err := parseAddrList(ips)
+	if err != nil || len(addrs) != 2 || addrs[0].Is4() == addrs[1].Is4() {
+		return false, nil
+	}
+
+	ipFamilyPolicy := service.Spec.IPFamilyPolicy
+	if ipFamilyPolicy == nil && controllerCM != nil {
+		ipFamilyPolicy = discoverDefaultIPFamilyPolicy(controllerCM, service.Namespace, controllerCM.Name)
+	}
+	if ipFamilyPolicy != nil && *ipFamilyPolicy != v1.IPFamilyPolicySingleStack {
+		return false, nil
+	}
+
+	kept, extra := addrs[0], addrs[1]
+	if len(service.Spec.IPFamilies) > 0 && (service.Spec.IPFamilies[0] == v1.IPv6Protocol) != kept.Is6() {
+		kept, extra = extra, kept
+	}
+
+	trimmed, err := rewriteServiceIPs(ctx, kubeClient, service, ips, func(recentService *v1.Service) error {
+		setLoadBalancerIPs(recentService, kept.String())
+		recentService.Spec.LoadBalancerIP = kept.String()
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("error trimming the IPs of Service [%s] to a single IP family : %v", service.Name, err)
+	}
+	if !trimmed {
+		return false, nil
+	}
+
+	klog.Infof("single-stack service '%s/%s' had IPs [%s], trimmed to IP [%s]", service.Namespace, service.Name, ips, kept)
+	recordEventf(service, v1.EventTypeNormal, "IPFamilyTrimmed", "Single-stack service had IPs %s, released IP %s", ips, extra)
+	released := service.DeepCopy()
+	released.Annotations[LoadbalancerIPsAnnotation] = extra.String()
+	notifyRelease(ctx, kubeClient, released)
+	notifyAllocation(service, kept.String(), "")
+	return true, nil
+}
@@ -0,0 +1,225 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+func TestSyncLoadBalancerMissingIPFamily(t *testing.T) {
+	tests := []struct {
+		name            string
+		behavior        string
+		wantDualStack   string
+		wantSingleStack string
+		wantEvent       string
+		wantChangeEvent string
+	}{
+		{
+			name:            "upgrade adds the IPv6 IP to the PreferDualStack service",
+			behavior:        FamilyChangeBehaviorUpgrade,
+			wantDualStack:   "10.0.0.1,fd00::10",
+			wantSingleStack: "10.0.0.2",
+			wantEvent:       "Normal IPFamilyUpgraded Added IPv6 IP, the IPs are now 10.0.0.1,fd00::10",
+		},
+		{
+			name:            "detect only emits an event",
+			wantDualStack:   "10.0.0.1",
+			wantSingleStack: "10.0.0.2",
+			wantEvent:       "Normal IPFamilyAvailable Pool now serves IPv6, set family-change-behavior-global to upgrade to add an IPv6 IP",
+			wantChangeEvent: "Normal IPFamilyAvailable Pool now serves IPv6, set family-change-behavior-global to upgrade to add an IPv6 IP",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(ipam.ResetManager)
+			t.Cleanup(func() { missingFamilyPools = sync.Map{} })
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "10.0.0.0/24",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			sync := func(name string) string {
+				svc, err := client.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return mustSyncService(t, client, svc).Annotations[LoadbalancerIPsAnnotation]
+			}
+			services := []*v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dual-stack"},
+					Spec: v1.ServiceSpec{
+						IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyPreferDualStack),
+						IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "single-stack"},
+					Spec:       v1.ServiceSpec{IPFamilyPolicy: ptr.To(v1.IPFamilyPolicySingleStack)},
+				},
+			}
+			for _, svc := range services {
+				createService(t, client, svc)
+			}
+
+			// the pool is IPv4 only, the PreferDualStack service falls back to single-stack
+			assert.Equal(t, "10.0.0.1", sync("dual-stack"))
+			assert.Equal(t, "10.0.0.2", sync("single-stack"))
+
+			// an IPv6 cidr is added to the pool
+			cm.Data["cidr-global"] = "10.0.0.0/24,fd00::10/124"
+			if len(tt.behavior) > 0 {
+				cm.Data["family-change-behavior-global"] = tt.behavior
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+			assert.Equal(t, tt.wantDualStack, sync("dual-stack"))
+			assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			assert.Equal(t, tt.wantSingleStack, sync("single-stack"))
+			assert.Empty(t, recorder.Events)
+
+			// the next reconciles don't act on the same pool again
+			assert.Equal(t, tt.wantDualStack, sync("dual-stack"))
+			assert.Empty(t, recorder.Events)
+
+			// the IPv6 cidr of the pool changes
+			cm.Data["cidr-global"] = "10.0.0.0/24,fd00::20/124"
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			sync("dual-stack")
+			if len(tt.wantChangeEvent) > 0 {
+				assert.Equal(t, tt.wantChangeEvent, <-recorder.Events)
+			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
+
+func TestSyncLoadBalancerTrimExtraIPFamily(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *v1.IPFamilyPolicy
+		families  []v1.IPFamily
+		strategy  string
+		wantIPs   string
+		wantEvent string
+	}{
+		{
+			name:      "single-stack IPv4 service keeps its IPv4 IP",
+			policy:    ptr.To(v1.IPFamilyPolicySingleStack),
+			families:  []v1.IPFamily{v1.IPv4Protocol},
+			strategy:  AllocationStrategyAsc,
+			wantIPs:   "10.0.0.1",
+			wantEvent: "Normal IPFamilyTrimmed Single-stack service had IPs 10.0.0.1,fd00::1, released IP fd00::1",
+		},
+		{
+			name:      "single-stack IPv6 service keeps its IPv6 IP",
+			policy:    ptr.To(v1.IPFamilyPolicySingleStack),
+			families:  []v1.IPFamily{v1.IPv6Protocol},
+			strategy:  AllocationStrategyAsc,
+			wantIPs:   "fd00::1",
+			wantEvent: "Normal IPFamilyTrimmed Single-stack service had IPs 10.0.0.1,fd00::1, released IP 10.0.0.1",
+		},
+		{
+			name:      "service without families keeps its first IP",
+			strategy:  AllocationStrategyDesc,
+			wantIPs:   "10.0.0.1",
+			wantEvent: "Normal IPFamilyTrimmed Single-stack service had IPs 10.0.0.1,fd00::1, released IP fd00::1",
+		},
+		{
+			name:     "dual-stack service is untouched",
+			policy:   ptr.To(v1.IPFamilyPolicyRequireDualStack),
+			families: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			strategy: AllocationStrategyAsc,
+			wantIPs:  "10.0.0.1,fd00::1",
+		},
+		{
+			name:     "requested IPs are untouched",
+			policy:   ptr.To(v1.IPFamilyPolicySingleStack),
+			families: []v1.IPFamily{v1.IPv4Protocol},
+			strategy: AllocationStrategyStatic,
+			wantIPs:  "10.0.0.1,fd00::1",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "stale",
+					Labels:    map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "10.0.0.1,fd00::1",
+						AllocationStrategyAnnotationKey: tt.strategy,
+					},
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: tt.policy,
+					IPFamilies:     tt.families,
+					LoadBalancerIP: "10.0.0.1",
+				},
+			}
+			createService(t, client, svc)
+			if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			if len(tt.wantEvent) > 0 {
+				assert.Equal(t, tt.wantIPs, res.Spec.LoadBalancerIP)
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
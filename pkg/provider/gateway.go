@@ -0,0 +1,332 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"go4.org/netipx"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+const (
+	// GatewayClassesEnvKey environment key for the comma separated gateway classes whose Gateways get an address,
+	// the Gateway API isn't watched unless it is set
+	GatewayClassesEnvKey = "KUBEVIP_GATEWAY_CLASSES"
+
+	// GatewayClassPoolPrefix is the prefix of the pool of a gateway class, e.g. cidr-gatewayclass-<class>,
+	// Gateways of a class without a pool take an address from the global pool
+	GatewayClassPoolPrefix = "gatewayclass-"
+
+	// gatewayAddressTypeIP is the Gateway API address type of an IP address
+	gatewayAddressTypeIP = "IPAddress"
+)
+
+// gatewayGVR is the resource of the Gateway API Gateways
+var gatewayGVR = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+
+// gatewayAddresses holds the addresses of the Gateways by namespace/name, they are in use for the services too
+var gatewayAddresses sync.Map
+
+// trackGatewayAddresses records the addresses of the Gateway from its annotation, or forgets them if it has none
+func trackGatewayAddresses(key, ips string) {
+	if len(ips) == 0 {
+		gatewayAddresses.Delete(key)
+		return
+	}
+	gatewayAddresses.Store(key, ips)
+}
+
+// addGatewayAddresses adds the addresses of the Gateways to the builder
+func addGatewayAddresses(builder *netipx.IPSetBuilder) error {
+	var err error
+	gatewayAddresses.Range(func(_, value interface{}) bool {
+		var addrs []netip.Addr
+		addrs, err = parseAddrList(value.(string))
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			builder.Add(addr)
+		}
+		return true
+	})
+	return err
+}
+
+// gatewayController allocates addresses to the Gateways of the configured gateway classes
+type gatewayController struct {
+	kubeClient    kubernetes.Interface
+	dynamicClient dynamic.Interface
+
+	gatewayListerSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+
+	gatewayClasses []string
+
+	cmName      string
+	cmNamespace string
+}
+
+func newGatewayController(
+	dynamicInformer dynamicinformer.DynamicSharedInformerFactory,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	gatewayClasses []string,
+	cmName, cmNamespace string,
+) *gatewayController {
+	gatewayInformer := dynamicInformer.ForResource(gatewayGVR).Informer()
+	c := &gatewayController{
+		kubeClient:          kubeClient,
+		dynamicClient:       dynamicClient,
+		gatewayListerSynced: gatewayInformer.HasSynced,
+
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Gateways"),
+
+		gatewayClasses: gatewayClasses,
+
+		cmName:      cmName,
+		cmNamespace: cmNamespace,
+	}
+
+	_, _ = gatewayInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.trackGateway(obj)
+			c.enqueueGateway(obj)
+		},
+		UpdateFunc: func(_ interface{}, cur interface{}) {
+			c.trackGateway(cur)
+			c.enqueueGateway(cur)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				gatewayAddresses.Delete(key)
+			}
+		},
+	})
+
+	return c
+}
+
+func (c *gatewayController) enqueueGateway(obj interface{}) {
+	gw, ok := obj.(*unstructured.Unstructured)
+	if !ok || !c.wantsAddress(gw) {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+// trackGateway records the addresses of any Gateway, an address set by hand is in use too
+func (c *gatewayController) trackGateway(obj interface{}) {
+	gw, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	trackGatewayAddresses(key, gw.GetAnnotations()[LoadbalancerIPsAnnotation])
+}
+
+// wantsAddress returns true if the Gateway belongs to one of the configured gateway classes
+func (c *gatewayController) wantsAddress(gw *unstructured.Unstructured) bool {
+	className, _, _ := unstructured.NestedString(gw.Object, "spec", "gatewayClassName")
+	return slices.Contains(c.gatewayClasses, className)
+}
+
+// Run starts the worker to process Gateway updates
+func (c *gatewayController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	if !cache.WaitForNamedCacheSync("gateway", stopCh, c.gatewayListerSynced) {
+		return
+	}
+
+	klog.V(4).Info("Starting gateway worker.")
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *gatewayController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *gatewayController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workqueue.Done(obj)
+
+	key, ok := obj.(string)
+	if !ok {
+		c.workqueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+		return true
+	}
+
+	if err := c.syncGateway(context.Background(), key); err != nil {
+		c.workqueue.AddRateLimited(obj)
+		utilruntime.HandleError(fmt.Errorf("error syncing gateway '%s': %s, requeuing", key, err.Error()))
+		return true
+	}
+
+	c.workqueue.Forget(obj)
+	return true
+}
+
+// syncGateway allocates an address to the Gateway if it belongs to a configured class and has none yet
+func (c *gatewayController) syncGateway(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	gw, err := c.dynamicClient.Resource(gatewayGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !c.wantsAddress(gw) || !gw.GetDeletionTimestamp().IsZero() {
+		return nil
+	}
+	if ips, ok := gw.GetAnnotations()[LoadbalancerIPsAnnotation]; ok && len(ips) > 0 {
+		return nil
+	}
+
+	controllerCM, err := getConfigMap(ctx, c.kubeClient, c.cmName, c.cmNamespace)
+	if err != nil {
+		return err
+	}
+
+	className, _, _ := unstructured.NestedString(gw.Object, "spec", "gatewayClassName")
+	pool, _, _, err := discoverPool(controllerCM, GatewayClassPoolPrefix+className, c.cmName)
+	if err != nil {
+		return err
+	}
+
+	// the pool may be shared with the services, they must not be allocated the same address concurrently
+	unlock := lockPool(pool)
+	defer unlock()
+	inUseSet, err := c.inUseAddresses(ctx)
+	if err != nil {
+		return err
+	}
+
+	kubevipLBConfig := config.GetKubevipLBConfig(controllerCM, namespace)
+	vip, err := discoverVIPs(namespace, pool, "", inUseSet, kubevipLBConfig, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Updating gateway [%s], with load balancer IPAM address [%s]", key, vip)
+	if err := c.setGatewayAddress(ctx, namespace, name, vip); err != nil {
+		return err
+	}
+	// recorded before the informer sees the update, the next service allocated from the pool skips the address
+	trackGatewayAddresses(key, vip)
+	return nil
+}
+
+// inUseAddresses returns the addresses of the services holding IPs and of the Gateways
+func (c *gatewayController) inUseAddresses(ctx context.Context) (*netipx.IPSet, error) {
+	svcs, err := listInUseServices(ctx, c.kubeClient, "")
+	if err != nil {
+		return nil, err
+	}
+	gws, err := c.dynamicClient.Resource(gatewayGVR).Namespace("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// the services addresses include those of the tracked Gateways, the listed ones are added in case the informer
+	// lags behind
+	inUseSet, _, err := mapImplementedServices(svcs, false)
+	if err != nil {
+		return nil, err
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for x := range gws.Items {
+		ips := gws.Items[x].GetAnnotations()[LoadbalancerIPsAnnotation]
+		if len(ips) == 0 {
+			continue
+		}
+		addrs, err := parseAddrList(ips)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			builder.Add(addr)
+		}
+	}
+	return builder.IPSet()
+}
+
+// setGatewayAddress records the address in the annotation and spec.addresses of the Gateway, then in its status
+func (c *gatewayController) setGatewayAddress(ctx context.Context, namespace, name, vip string) error {
+	gateways := c.dynamicClient.Resource(gatewayGVR).Namespace(namespace)
+	addresses := []interface{}{
+		map[string]interface{}{"type": gatewayAddressTypeIP, "value": vip},
+	}
+
+	err := retryOnConflict(func() error {
+		recentGateway, getErr := gateways.Get(ctx, name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		annotations := recentGateway.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[LoadbalancerIPsAnnotation] = vip
+		recentGateway.SetAnnotations(annotations)
+		if err := unstructured.SetNestedSlice(recentGateway.Object, addresses, "spec", "addresses"); err != nil {
+			return err
+		}
+
+		updated, updateErr := gateways.Update(ctx, recentGateway, metav1.UpdateOptions{})
+		if updateErr != nil {
+			return updateErr
+		}
+
+		if err := unstructured.SetNestedSlice(updated.Object, addresses, "status", "addresses"); err != nil {
+			return err
+		}
+		_, updateErr = gateways.UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("error updating Gateway [%s/%s] : %v", namespace, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newGateway(name, className string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata": map[string]interface{}{
+			"namespace": "gateways",
+			"name":      name,
+		},
+		"spec": map[string]interface{}{
+			"gatewayClassName": className,
+		},
+	}}
+}
+
+func TestSyncGateway(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-gatewayclass-kube-vip": "10.0.0.1-10.0.0.2",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// a service already uses the first address of the pool
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "svc",
+			Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+			Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
+		},
+	}
+	createService(t, client, svc)
+
+	t.Cleanup(func() { gatewayAddresses = sync.Map{} })
+	// the tracker of the fake client only serves the unstructured objects it created
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gatewayGVR: "GatewayList"})
+	for _, gw := range []*unstructured.Unstructured{newGateway("matching", "kube-vip"), newGateway("other", "other-class")} {
+		if _, err := dynamicClient.Resource(gatewayGVR).Namespace("gateways").Create(ctx, gw, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &gatewayController{
+		kubeClient:          client,
+		dynamicClient:       dynamicClient,
+		gatewayListerSynced: alwaysReady,
+		workqueue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Gateways"),
+		gatewayClasses:      []string{"kube-vip"},
+		cmName:              KubeVipClientConfig,
+		cmNamespace:         KubeVipClientConfigNamespace,
+	}
+
+	c.enqueueGateway(newGateway("matching", "kube-vip"))
+	c.enqueueGateway(newGateway("other", "other-class"))
+	assert.Equal(t, 1, c.workqueue.Len(), "only the gateway of a configured class is enqueued")
+
+	for _, name := range []string{"matching", "other"} {
+		if err := c.syncGateway(ctx, "gateways/"+name); err != nil {
+			t.Fatalf("failed to sync gateway %s: %v", name, err)
+		}
+	}
+
+	matching, err := dynamicClient.Resource(gatewayGVR).Namespace("gateways").Get(ctx, "matching", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", matching.GetAnnotations()[LoadbalancerIPsAnnotation])
+	wantAddresses := []interface{}{map[string]interface{}{"type": "IPAddress", "value": "10.0.0.2"}}
+	specAddresses, _, _ := unstructured.NestedSlice(matching.Object, "spec", "addresses")
+	assert.Equal(t, wantAddresses, specAddresses)
+	statusAddresses, _, _ := unstructured.NestedSlice(matching.Object, "status", "addresses")
+	assert.Equal(t, wantAddresses, statusAddresses)
+
+	other, err := dynamicClient.Resource(gatewayGVR).Namespace("gateways").Get(ctx, "other", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, other.GetAnnotations()[LoadbalancerIPsAnnotation])
+	_, found, _ := unstructured.NestedSlice(other.Object, "spec", "addresses")
+	assert.False(t, found)
+
+	// the allocated gateway keeps its address and the pool is now exhausted for new gateways
+	if err := c.syncGateway(ctx, "gateways/matching"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dynamicClient.Resource(gatewayGVR).Namespace("gateways").Create(ctx, newGateway("second", "kube-vip"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, c.syncGateway(ctx, "gateways/second"))
+
+	// the address of the gateway isn't allocated to a service of the same pool
+	cm.Data["range-global"] = "10.0.0.1-10.0.0.3"
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res := createAndSyncService(t, client, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "next"}})
+	assert.Equal(t, "10.0.0.3", res.Annotations[LoadbalancerIPsAnnotation])
+}
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// IPFamilyPrecedenceSpec keeps spec.IPFamilies when the kube-vip.io/ipFamily annotation of a service conflicts with
+	// it, the annotation is ignored, this is the default
+	IPFamilyPrecedenceSpec = "spec"
+
+	// IPFamilyPrecedenceAnnotation allocates the IP family of the kube-vip.io/ipFamily annotation of a service when it
+	// conflicts with spec.IPFamilies
+	IPFamilyPrecedenceAnnotation = "annotation"
+)
+
+// discoverIPFamilyPrecedence returns ip-family-precedence-global, spec or annotation
+func discoverIPFamilyPrecedence(cm *v1.ConfigMap) string {
+	return discoverGlobalEnum(cm, "ip-family-precedence", IPFamilyPrecedenceSpec, IPFamilyPrecedenceAnnotation)
+}
+
+// parseIPFamily returns the IP family of the kube-vip.io/ipFamily annotation, ipv4 or ipv6
+func parseIPFamily(family string) (v1.IPFamily, error) {
+	switch strings.ToLower(strings.TrimSpace(family)) {
+	case "ipv4":
+		return v1.IPv4Protocol, nil
+	case "ipv6":
+		return v1.IPv6Protocol, nil
+	default:
+		return "", fmt.Errorf("invalid %s [%s], expected ipv4 or ipv6", IPFamilyAnnotationKey, family)
+	}
+}
+
+// requestedIPFamilies returns the IP families to allocate to the service: spec.IPFamilies, or the family of its
+// kube-vip.io/ipFamily annotation if spec.IPFamilies is unset. When spec.IPFamilies doesn't list the family of the
+// annotation, ip-family-precedence-global decides which one wins and an IPFamilyConflict event is emitted.
+func requestedIPFamilies(cm *v1.ConfigMap, service *v1.Service) ([]v1.IPFamily, error) {
+	annotation, ok := service.Annotations[IPFamilyAnnotationKey]
+	if !ok {
+		return service.Spec.IPFamilies, nil
+	}
+	family, err := parseIPFamily(annotation)
+	if err != nil {
+		return nil, err
+	}
+	if len(service.Spec.IPFamilies) == 0 {
+		return []v1.IPFamily{family}, nil
+	}
+	if slices.Contains(service.Spec.IPFamilies, family) {
+		return service.Spec.IPFamilies, nil
+	}
+
+	if discoverIPFamilyPrecedence(cm) == IPFamilyPrecedenceAnnotation {
+		klog.Warningf("service '%s/%s' spec.ipFamilies %v conflicts with %s [%s], allocating %s", service.Namespace, service.Name,
+			service.Spec.IPFamilies, IPFamilyAnnotationKey, annotation, family)
+		recordEventf(service, v1.EventTypeWarning, "IPFamilyConflict", "spec.ipFamilies %v conflicts with %s %s, allocating %s as ip-family-precedence-global is %s",
+			service.Spec.IPFamilies, IPFamilyAnnotationKey, annotation, family, IPFamilyPrecedenceAnnotation)
+		return []v1.IPFamily{family}, nil
+	}
+	klog.Warningf("service '%s/%s' spec.ipFamilies %v conflicts with %s [%s], ignoring the annotation", service.Namespace, service.Name,
+		service.Spec.IPFamilies, IPFamilyAnnotationKey, annotation)
+	recordEventf(service, v1.EventTypeWarning, "IPFamilyConflict", "spec.ipFamilies %v conflicts with %s %s, ignoring the annotation as ip-family-precedence-global is %s",
+		service.Spec.IPFamilies, IPFamilyAnnotationKey, annotation, IPFamilyPrecedenceSpec)
+	return service.Spec.IPFamilies, nil
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSyncLoadBalancerIPFamilyConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence string
+		families   []v1.IPFamily
+		wantIPs    string
+		wantEvent  string
+	}{
+		{
+			name:      "spec wins by default",
+			families:  []v1.IPFamily{v1.IPv4Protocol},
+			wantIPs:   "10.0.0.1",
+			wantEvent: "Warning IPFamilyConflict spec.ipFamilies [IPv4] conflicts with kube-vip.io/ipFamily ipv6, ignoring the annotation as ip-family-precedence-global is spec",
+		},
+		{
+			name:       "spec wins",
+			precedence: IPFamilyPrecedenceSpec,
+			families:   []v1.IPFamily{v1.IPv4Protocol},
+			wantIPs:    "10.0.0.1",
+			wantEvent:  "Warning IPFamilyConflict spec.ipFamilies [IPv4] conflicts with kube-vip.io/ipFamily ipv6, ignoring the annotation as ip-family-precedence-global is spec",
+		},
+		{
+			name:       "annotation wins",
+			precedence: IPFamilyPrecedenceAnnotation,
+			families:   []v1.IPFamily{v1.IPv4Protocol},
+			wantIPs:    "fd00::1",
+			wantEvent:  "Warning IPFamilyConflict spec.ipFamilies [IPv4] conflicts with kube-vip.io/ipFamily ipv6, allocating IPv6 as ip-family-precedence-global is annotation",
+		},
+		{
+			name:    "annotation applies without spec.ipFamilies",
+			wantIPs: "fd00::1",
+		},
+		{
+			name:       "no conflict",
+			precedence: IPFamilyPrecedenceAnnotation,
+			families:   []v1.IPFamily{v1.IPv6Protocol},
+			wantIPs:    "fd00::1",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+				},
+			}
+			if len(tt.precedence) > 0 {
+				cm.Data["ip-family-precedence-global"] = tt.precedence
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "svc",
+					Annotations: map[string]string{IPFamilyAnnotationKey: "ipv6"},
+				},
+				Spec: v1.ServiceSpec{IPFamilies: tt.families},
+			}
+			createService(t, client, svc)
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			if len(tt.wantEvent) > 0 {
+				assert.Len(t, recorder.Events, 1)
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			} else {
+				assert.Empty(t, recorder.Events)
+			}
+		})
+	}
+}
+
+func Test_requestedIPFamiliesInvalid(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "svc",
+			Annotations: map[string]string{IPFamilyAnnotationKey: "ipv5"},
+		},
+	}
+	_, err := requestedIPFamilies(&v1.ConfigMap{}, svc)
+	assert.EqualError(t, err, "invalid kube-vip.io/ipFamily [ipv5], expected ipv4 or ipv6")
+}
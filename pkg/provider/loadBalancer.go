@@ -1,23 +1,36 @@
 package provider
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/netip"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"go4.org/netipx"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
+	"k8s.io/utils/ptr"
 	"k8s.io/utils/set"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/webhook"
 )
 
 const (
@@ -26,6 +39,9 @@ const (
 	// Example: kube-vip.io/loadbalancerIPs: 10.1.2.3,fd00::100
 	LoadbalancerIPsAnnotation = "kube-vip.io/loadbalancerIPs"
 
+	// AnnotationPrefix is the prefix of the annotations kube-vip cares about
+	AnnotationPrefix = "kube-vip.io/"
+
 	// ImplementationLabelKey is the label key showing the service is implemented by kube-vip
 	ImplementationLabelKey = "implementation"
 
@@ -35,8 +51,458 @@ const (
 	// LegacyIpamAddressLabelKey is the legacy label key showing the service is implemented by kube-vip
 	LegacyIpamAddressLabelKey = "ipam-address"
 
-	// LoadbalancerServiceInterfaceAnnotationKey is the annotation key for specifying the service interface for a load balancer
+	// LoadbalancerServiceInterfaceAnnotationKey is the annotation key for specifying the service interface for a load balancer,
+	// a comma separated list of interfaces to advertise the service on several NICs
+	// Example: kube-vip.io/serviceInterface: eth0,eth1
 	LoadbalancerServiceInterfaceAnnotationKey = "kube-vip.io/serviceInterface"
+
+	// PreviousInterfaceAnnotationKey is the annotation key recording the service interface replaced by the last
+	// allocation, e.g. when a reallocated service moves to a pool on another interface
+	// Example: kube-vip.io/previousInterface: eth0
+	PreviousInterfaceAnnotationKey = "kube-vip.io/previousInterface"
+
+	// AllocationStrategyAnnotationKey is the annotation key recording how the IPs of the service were obtained
+	AllocationStrategyAnnotationKey = "kube-vip.io/allocationStrategy"
+
+	// FamilyOrderAnnotationKey is the annotation key for choosing the IP family order of a dual-stack service
+	// independently of spec.IPFamilies
+	// Example: kube-vip.io/familyOrder: ipv6,ipv4
+	FamilyOrderAnnotationKey = "kube-vip.io/familyOrder"
+
+	// IPFamilyAnnotationKey is the annotation key for requesting the IP family of a single-stack service, see
+	// ip-family-precedence-global when it conflicts with spec.IPFamilies
+	// Example: kube-vip.io/ipFamily: ipv6
+	IPFamilyAnnotationKey = "kube-vip.io/ipFamily"
+
+	// RegionAnnotationKey is the annotation key for the region of the service in a stretched cluster,
+	// the service takes its IPs from the regional pool cidr-region-<region>-<namespace> or cidr-region-<region>-global
+	// Example: kube-vip.io/region: west
+	RegionAnnotationKey = "kube-vip.io/region"
+
+	// ShareGroupAnnotationKey is the annotation key for the share group of the service, a service only shares an
+	// IP with the services of the same share group, the services without the annotation form a group of their own
+	// Example: kube-vip.io/shareGroup: group-a
+	ShareGroupAnnotationKey = "kube-vip.io/shareGroup"
+
+	// FreezeAnnotationKey is the annotation key for freezing the IPs of a service, the IPs of a frozen service
+	// are never changed by a reconcile, e.g. to pin critical VIPs during migrations
+	// Example: kube-vip.io/freeze: "true"
+	FreezeAnnotationKey = "kube-vip.io/freeze"
+
+	// AllowBurstAnnotationKey is the annotation key allowing the service to be allocated from the burst pool, burst-global,
+	// once its pool is exhausted
+	// Example: kube-vip.io/allowBurst: "true"
+	AllowBurstAnnotationKey = "kube-vip.io/allowBurst"
+
+	// DedicatedIPAnnotationKey is the annotation key for giving a service an IP of its own while sharing is enabled,
+	// the service doesn't share the IP of other services and other services don't share its IP
+	// Example: kube-vip.io/dedicatedIP: "true"
+	DedicatedIPAnnotationKey = "kube-vip.io/dedicatedIP"
+
+	// SkipFinalizerAnnotationKey is the annotation key for not adding the cleanup finalizer to a service handled by the
+	// loadbalancerClass controller, e.g. for GitOps tools with deletion ordering quirks
+	// Example: kube-vip.io/skipFinalizer: "true"
+	SkipFinalizerAnnotationKey = "kube-vip.io/skipFinalizer"
+
+	// ReconcileAnnotationKey is the annotation key for forcing a reconcile of a service without changing its spec,
+	// any change of its value triggers a reconcile
+	// Example: kube-vip.io/reconcile: "2024-05-01T10:00:00Z"
+	ReconcileAnnotationKey = "kube-vip.io/reconcile"
+
+	// IPAssignedAtAnnotationKey is the annotation key recording when the IPs of the service last changed, in RFC3339
+	// Example: kube-vip.io/ipAssignedAt: "2024-05-01T10:00:00Z"
+	IPAssignedAtAnnotationKey = "kube-vip.io/ipAssignedAt"
+
+	// PoolFreeAnnotationKey is the annotation key recording the number of free addresses left in the pool when the IPs
+	// of the service were allocated, it is informational
+	// Example: kube-vip.io/poolFree: "12"
+	PoolFreeAnnotationKey = "kube-vip.io/poolFree"
+
+	// IPZoneAnnotationKey is the annotation key recording the zone of the IPs of the service, taken from the metadata
+	// of the pool entry they were allocated from, e.g. 10.0.0.0/28#zone=a
+	// Example: kube-vip.io/ipZone: a
+	IPZoneAnnotationKey = "kube-vip.io/ipZone"
+
+	// LastErrorAnnotationKey is the annotation key recording the last sync failure of the service with its time,
+	// it is removed once the service syncs successfully
+	// Example: kube-vip.io/lastError: "2024-05-01T10:00:00Z: configmap [kubevip] has no pools defined"
+	LastErrorAnnotationKey = "kube-vip.io/lastError"
+
+	// SourcePoolAnnotationKey is the annotation key recording whether the IPs of the service were allocated from
+	// the pool of its namespace or from the global pool
+	// Example: kube-vip.io/sourcePool: global
+	SourcePoolAnnotationKey = "kube-vip.io/sourcePool"
+
+	// AllocationInfoAnnotationKey is the annotation key recording the allocation decision of the service as JSON when
+	// allocation-info-global is set, it consolidates the informational annotations
+	// Example: kube-vip.io/allocationInfo: '{"ips":"10.0.0.1","sourcePool":"namespace","strategy":"asc","assignedAt":"2024-05-01T10:00:00Z","poolFree":12}'
+	AllocationInfoAnnotationKey = "kube-vip.io/allocationInfo"
+
+	// AllocationPriorityAnnotationKey is the annotation key for the priority of the service in the queue of the
+	// loadbalancerClass controller when PriorityQueueEnvKey is set, higher priorities are synced first
+	// Example: kube-vip.io/allocationPriority: "100"
+	AllocationPriorityAnnotationKey = "kube-vip.io/allocationPriority"
+
+	// EndpointNodesAnnotationKey is the annotation key listing the nodes of the ready endpoints of an ExternalTrafficPolicy
+	// Local service when EnableEndpointNodesEnvKey is set, so kube-vip advertises the IPs from the right nodes
+	// Example: kube-vip.io/endpointNodes: node-1,node-2
+	EndpointNodesAnnotationKey = "kube-vip.io/endpointNodes"
+
+	// DebugAnnotationKey is the annotation key logging the allocation decision trace of the service at the default
+	// verbosity, instead of verbosity 5
+	// Example: kube-vip.io/debug: "true"
+	DebugAnnotationKey = "kube-vip.io/debug"
+
+	// VipAdvertisementAnnotationKey is the annotation key for the way kube-vip advertises the IPs of the service, it is
+	// set from the advertisement-<namespace> or advertisement-global key of the configmap unless already defined
+	// Example: kube-vip.io/vipAdvertisement: bgp
+	VipAdvertisementAnnotationKey = "kube-vip.io/vipAdvertisement"
+
+	// AdvertisementARP means kube-vip advertises the IPs of the service with ARP
+	AdvertisementARP = "arp"
+
+	// AdvertisementBGP means kube-vip advertises the IPs of the service with BGP
+	AdvertisementBGP = "bgp"
+
+	// RegionPoolPrefix is the prefix of the regional pools, e.g. cidr-region-<region>-global
+	RegionPoolPrefix = "region-"
+
+	// ImplementationLabelKeyEnvKey environment key for overriding the implementation label key,
+	// services labeled with ImplementationLabelKey are relabeled on startup.
+	ImplementationLabelKeyEnvKey = "KUBEVIP_IMPLEMENTATION_LABEL_KEY"
+
+	// ServiceDenylistEnvKey environment key for the comma separated namespace/name patterns of the services
+	// that are never allocated an address, an empty value disables the denylist
+	ServiceDenylistEnvKey = "KUBEVIP_SERVICE_DENYLIST"
+
+	// DefaultServiceDenylist protects the kubernetes service and the critical kube-system services
+	DefaultServiceDenylist = "default/kubernetes,kube-system/kube-dns,kube-system/coredns,kube-system/metrics-server"
+
+	// InterfaceConfigMapEnvKey environment key for the name of an optional ConfigMap, in the namespace of the pool
+	// ConfigMap, holding the interface-<namespace> and interface-global keys, e.g. managed by the networking team.
+	// Interfaces missing from it are looked up in the pool ConfigMap.
+	InterfaceConfigMapEnvKey = "KUBEVIP_INTERFACE_CONFIG_MAP"
+
+	// DefaultInterfaceEnvKey environment key for the service interface of the services without an interface-<namespace>
+	// or interface-global key, it is the lowest priority fallback
+	DefaultInterfaceEnvKey = "KUBEVIP_DEFAULT_INTERFACE"
+
+	// ConflictRetryStepsEnvKey environment key for the number of attempts of a service update that conflicts
+	ConflictRetryStepsEnvKey = "KUBEVIP_CONFLICT_RETRY_STEPS"
+
+	// ConflictRetryDurationEnvKey environment key for the initial wait between the attempts of a service update that
+	// conflicts, e.g. 10ms, the wait is multiplied by 5 after each attempt
+	ConflictRetryDurationEnvKey = "KUBEVIP_CONFLICT_RETRY_DURATION"
+
+	// ConflictFailFastEnvKey environment key for not retrying a service update that conflicts, the service is requeued
+	// instead and the rate limiter of the workqueue handles the backoff
+	ConflictFailFastEnvKey = "KUBEVIP_CONFLICT_FAIL_FAST"
+
+	// AllocationExemplarsEnvKey environment key for attaching the namespace/name of the service as an OpenMetrics
+	// exemplar to the kubevip_allocations_total counter
+	AllocationExemplarsEnvKey = "KUBEVIP_ALLOCATION_EXEMPLARS"
+)
+
+// ownedAnnotations are the annotations kube-vip sets on the services it implements, they are removed when it hands off
+// a service
+var ownedAnnotations = []string{
+	LoadbalancerIPsAnnotation,
+	AllocationStrategyAnnotationKey,
+	SourcePoolAnnotationKey,
+	AllocationInfoAnnotationKey,
+	LastErrorAnnotationKey,
+	IPAssignedAtAnnotationKey,
+	PoolFreeAnnotationKey,
+	IPZoneAnnotationKey,
+	LoadbalancerServiceInterfaceAnnotationKey,
+	PreviousInterfaceAnnotationKey,
+	VipAdvertisementAnnotationKey,
+	EndpointNodesAnnotationKey,
+}
+
+// conflictBackoff is the backoff of the service updates that conflict
+var conflictBackoff = retry.DefaultRetry
+
+// retryOnConflict runs the update with the conflict backoff
+func retryOnConflict(fn func() error) error {
+	return retry.RetryOnConflict(conflictBackoff, fn)
+}
+
+// parseConflictBackoff returns the backoff of the service updates that conflict from the values of the environment keys,
+// an empty value keeps the default. Fail-fast makes a single attempt.
+func parseConflictBackoff(steps, duration, failFast string) (wait.Backoff, error) {
+	backoff := retry.DefaultRetry
+	if len(steps) > 0 {
+		n, err := strconv.Atoi(steps)
+		if err != nil {
+			return backoff, fmt.Errorf("error parsing value of %s: %s", ConflictRetryStepsEnvKey, err.Error())
+		}
+		if n < 1 {
+			return backoff, fmt.Errorf("error parsing value of %s: %d is less than 1", ConflictRetryStepsEnvKey, n)
+		}
+		backoff.Steps = n
+	}
+	if len(duration) > 0 {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return backoff, fmt.Errorf("error parsing value of %s: %s", ConflictRetryDurationEnvKey, err.Error())
+		}
+		backoff.Duration = d
+	}
+	if len(failFast) > 0 {
+		ff, err := strconv.ParseBool(failFast)
+		if err != nil {
+			return backoff, fmt.Errorf("error parsing value of %s: %s", ConflictFailFastEnvKey, err.Error())
+		}
+		if ff {
+			backoff.Steps = 1
+		}
+	}
+	return backoff, nil
+}
+
+// interfaceConfigMap is the name of the ConfigMap the service interfaces are looked up in first, empty if unset
+var interfaceConfigMap string
+
+// defaultInterface is the service interface used when no ConfigMap key matches, empty if unset
+var defaultInterface string
+
+// serviceDenylist holds the namespace/name patterns of the services that are never allocated an address
+var serviceDenylist = strings.Split(DefaultServiceDenylist, ",")
+
+// parseServiceDenylist returns the namespace/name patterns of the comma separated denylist,
+// the patterns use the path.Match syntax, e.g. kube-system/*
+func parseServiceDenylist(value string) ([]string, error) {
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if strings.Count(pattern, "/") != 1 {
+			return nil, fmt.Errorf("invalid pattern [%s], expected namespace/name", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern [%s]: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// isFrozen returns true if the freeze annotation of the service is true
+func isFrozen(service *v1.Service) bool {
+	frozen, _ := strconv.ParseBool(service.Annotations[FreezeAnnotationKey])
+	return frozen
+}
+
+// isDedicated returns true if the dedicated IP annotation of the service is true
+func isDedicated(service *v1.Service) bool {
+	dedicated, _ := strconv.ParseBool(service.Annotations[DedicatedIPAnnotationKey])
+	return dedicated
+}
+
+// isDebugged returns true if the debug annotation of the service is true
+func isDebugged(service *v1.Service) bool {
+	debug, _ := strconv.ParseBool(service.Annotations[DebugAnnotationKey])
+	return debug
+}
+
+// isDenylisted returns true if the service matches a pattern of the service denylist
+func isDenylisted(service *v1.Service) bool {
+	key := service.Namespace + "/" + service.Name
+	for _, pattern := range serviceDenylist {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// eventRecorder records the events of the services synced by the cloud provider, it's nil unless set in Initialize
+var eventRecorder record.EventRecorder
+
+// recordEventf records an event for the service if an event recorder is set
+func recordEventf(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if eventRecorder == nil {
+		return
+	}
+	eventRecorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
+
+// InvalidLoadBalancerIPError is returned when spec.loadBalancerIP of a service isn't an IP address
+type InvalidLoadBalancerIPError struct {
+	IP  string
+	Err error
+}
+
+func (e *InvalidLoadBalancerIPError) Error() string {
+	return fmt.Sprintf("invalid spec.loadBalancerIP [%s]: %v", e.IP, e.Err)
+}
+
+func (e *InvalidLoadBalancerIPError) Unwrap() error {
+	return e.Err
+}
+
+// validateLegacyLoadBalancerIP checks that spec.loadBalancerIP of the service is an IPv4 or IPv6 address the service can
+// use: an IPv6 address can't have a zone or map an IPv4 address, and the address must be of one of spec.ipFamilies
+func validateLegacyLoadBalancerIP(service *v1.Service) error {
+	addr, err := netip.ParseAddr(service.Spec.LoadBalancerIP)
+	if err != nil {
+		return err
+	}
+	if len(addr.Zone()) > 0 {
+		return fmt.Errorf("IPv6 zone %s isn't allowed", addr.Zone())
+	}
+	if addr.Is4In6() {
+		return fmt.Errorf("IPv4-mapped IPv6 address isn't allowed, use %s", addr.Unmap())
+	}
+	family := v1.IPv4Protocol
+	if addr.Is6() {
+		family = v1.IPv6Protocol
+	}
+	if len(service.Spec.IPFamilies) > 0 && !slices.Contains(service.Spec.IPFamilies, family) {
+		return fmt.Errorf("IP family %s isn't one of the service IP families %v", family, service.Spec.IPFamilies)
+	}
+	return nil
+}
+
+// PortlessLoadBalancerError is returned when a service without ports is refused by reject-portless-lb-global
+type PortlessLoadBalancerError struct{}
+
+func (e *PortlessLoadBalancerError) Error() string {
+	return "service defines no ports and reject-portless-lb-global is set, no address is allocated"
+}
+
+// InvalidServiceInterfaceError is returned when the kube-vip.io/serviceInterface annotation of a service isn't a comma
+// separated list of interface names
+type InvalidServiceInterfaceError struct {
+	Interfaces string
+	Err        error
+}
+
+func (e *InvalidServiceInterfaceError) Error() string {
+	return fmt.Sprintf("invalid annotation %s [%s]: %v", LoadbalancerServiceInterfaceAnnotationKey, e.Interfaces, e.Err)
+}
+
+func (e *InvalidServiceInterfaceError) Unwrap() error {
+	return e.Err
+}
+
+// maxInterfaceNameLength is the maximum length of a Linux interface name, IFNAMSIZ without the trailing NUL
+const maxInterfaceNameLength = 15
+
+// validateInterfaceList returns an error if the value isn't a comma separated list of interface names, e.g. eth0,eth1
+func validateInterfaceList(interfaces string) error {
+	for _, name := range strings.Split(interfaces, ",") {
+		switch {
+		case len(name) == 0:
+			return errors.New("empty interface name")
+		case len(name) > maxInterfaceNameLength:
+			return fmt.Errorf("interface name [%s] is longer than %d characters", name, maxInterfaceNameLength)
+		case name == "." || name == ".." || strings.ContainsAny(name, "/ \t\n"):
+			return fmt.Errorf("interface name [%s] is invalid", name)
+		}
+	}
+	return nil
+}
+
+// implementationLabelKey is the label key in use to mark services implemented by kube-vip
+var implementationLabelKey = ImplementationLabelKey
+
+// poolLocks serializes the allocations from a pool, so services synced concurrently, e.g. by several workers of the
+// cloud-controller-manager service controller, don't compute the same free address
+var (
+	poolLocks     = map[string]*sync.Mutex{}
+	poolLocksLock sync.Mutex
+)
+
+// lockPool locks the pool and returns the func unlocking it
+func lockPool(pool string) func() {
+	poolLocksLock.Lock()
+	lock, ok := poolLocks[pool]
+	if !ok {
+		lock = &sync.Mutex{}
+		poolLocks[pool] = lock
+	}
+	poolLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// allocationNotifier posts allocation changes to an external webhook, it's nil unless the webhook is configured
+var allocationNotifier *webhook.Notifier
+
+// allocationExemplars is true if the allocations are counted with the service as exemplar
+var allocationExemplars bool
+
+const (
+	// InvalidLoadBalancerIPBehaviorAllocate allocates an address from the pool to services with an invalid spec.loadBalancerIP, this is the default
+	InvalidLoadBalancerIPBehaviorAllocate = "allocate"
+
+	// InvalidLoadBalancerIPBehaviorPending leaves services with an invalid spec.loadBalancerIP pending
+	InvalidLoadBalancerIPBehaviorPending = "pending"
+
+	// LegacyLBIPFamilyIPv4 sets the IPv4 IP of a dual-stack service in spec.loadBalancerIP
+	LegacyLBIPFamilyIPv4 = "ipv4"
+
+	// LegacyLBIPFamilyPrimary sets the primary IP of a dual-stack service in spec.loadBalancerIP, this is the default
+	LegacyLBIPFamilyPrimary = "primary"
+
+	// LegacyLBIPFamilyNone leaves spec.loadBalancerIP of a dual-stack service empty
+	LegacyLBIPFamilyNone = "none"
+
+	// NamespaceSelectorPrefix is the prefix of the ConfigMap keys selecting a pool by namespace labels,
+	// e.g. namespace-selector-<pool>: team=a makes the namespaces labeled team=a use cidr-<pool> or range-<pool>
+	NamespaceSelectorPrefix = "namespace-selector-"
+
+	// EmptyPoolBehaviorError fails the sync of services without a pool, this is the default
+	EmptyPoolBehaviorError = "error"
+
+	// EmptyPoolBehaviorDHCP assigns DHCP (0.0.0.0) to services without a pool
+	EmptyPoolBehaviorDHCP = "dhcp"
+
+	// DHCPPool is the special pool giving services the DHCP address 0.0.0.0, it is the pool of a namespace
+	// with dhcp-<namespace>: "true"
+	DHCPPool = "0.0.0.0/32"
+
+	// AllocationStrategyAsc means the IPs were allocated from the pool in ascending order
+	AllocationStrategyAsc = "asc"
+
+	// AllocationStrategyDesc means the IPs were allocated from the pool in descending order
+	AllocationStrategyDesc = "desc"
+
+	// AllocationStrategyShared means the IPv4 address is shared with another service
+	AllocationStrategyShared = "shared"
+
+	// AllocationStrategyStatic means the IPs were pre-defined on the service
+	AllocationStrategyStatic = "static"
+
+	// AllocationStrategyDHCP means the special DHCP address was assigned
+	AllocationStrategyDHCP = "dhcp"
+
+	// AllocationStrategyAdopted means the IPs were adopted from another load balancer implementation
+	AllocationStrategyAdopted = "adopted"
+
+	// AllocationStrategyExternalIPs means the IPs are the spec.externalIPs of the service
+	AllocationStrategyExternalIPs = "externalIPs"
+
+	// RegionFamilyMismatchError fails the services whose regional pool doesn't serve their IP families
+	RegionFamilyMismatchError = "error"
+
+	// RegionFamilyMismatchFallback allocates the services whose regional pool doesn't serve their IP families from the pool
+	// of their namespace
+	RegionFamilyMismatchFallback = "fallback"
+
+	// SourcePoolNamespace means the IPs were allocated from the pool of the namespace of the service
+	SourcePoolNamespace = "namespace"
+
+	// SourcePoolGlobal means the IPs were allocated from the global pool, or from a pool shared by several namespaces
+	SourcePoolGlobal = "global"
+
+	// SourcePoolBurst means the IPs were allocated from the burst pool while the pool of the service was exhausted
+	SourcePoolBurst = "burst"
 )
 
 // kubevipLoadBalancerManager -
@@ -69,7 +535,7 @@ func (k *kubevipLoadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Conte
 }
 
 func (k *kubevipLoadBalancerManager) GetLoadBalancer(_ context.Context, _ string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	if service.Labels[ImplementationLabelKey] == ImplementationLabelValue {
+	if isImplemented(service) {
 		return &service.Status.LoadBalancer, true, nil
 	}
 	return nil, false, nil
@@ -85,18 +551,26 @@ func getDefaultLoadBalancerName(service *v1.Service) string {
 	return cloudprovider.DefaultLoadBalancerName(service)
 }
 
-func (k *kubevipLoadBalancerManager) deleteLoadBalancer(_ context.Context, service *v1.Service) error {
+func (k *kubevipLoadBalancerManager) deleteLoadBalancer(ctx context.Context, service *v1.Service) error {
 	klog.Infof("deleting service '%s' (%s)", service.Name, service.UID)
+	notifyRelease(ctx, k.kubeClient, service)
+	forgetMissingIPFamily(service)
 
 	return nil
 }
 
+// checkLegacyLoadBalancerIPAnnotation migrates the spec.loadBalancerIP of a legacy service, IPv4 or IPv6, to the
+// LoadbalancerIPsAnnotation. It returns nil if the service already has the annotation.
 func checkLegacyLoadBalancerIPAnnotation(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service) (*v1.LoadBalancerStatus, error) {
 	if service.Spec.LoadBalancerIP != "" {
 		if v, ok := service.Annotations[LoadbalancerIPsAnnotation]; !ok || len(v) == 0 {
+			if err := validateLegacyLoadBalancerIP(service); err != nil {
+				return nil, &InvalidLoadBalancerIPError{IP: service.Spec.LoadBalancerIP, Err: err}
+			}
 			klog.Warningf("service.Spec.LoadBalancerIP is defined but annotations '%s' is not, assume it's a legacy service, updates its annotations", LoadbalancerIPsAnnotation)
 			// assume it's legacy service, need to update the annotation.
-			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			var labeled bool
+			err := retryOnConflict(func() error {
 				recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
@@ -104,23 +578,171 @@ func checkLegacyLoadBalancerIPAnnotation(ctx context.Context, kubeClient kuberne
 				if recentService.Annotations == nil {
 					recentService.Annotations = make(map[string]string)
 				}
-				recentService.Annotations[LoadbalancerIPsAnnotation] = service.Spec.LoadBalancerIP
+				setLoadBalancerIPs(recentService, service.Spec.LoadBalancerIP)
 				// remove ipam-address label
 				delete(recentService.Labels, LegacyIpamAddressLabelKey)
+				// Set label ImplementationLabelKey, the same way as for a service created with pre-defined IPs
+				needsLabel := recentService.Labels[implementationLabelKey] != ImplementationLabelValue
+				if needsLabel {
+					if recentService.Labels == nil {
+						recentService.Labels = make(map[string]string)
+					}
+					recentService.Labels[implementationLabelKey] = ImplementationLabelValue
+					recentService.Annotations[AllocationStrategyAnnotationKey] = AllocationStrategyStatic
+				}
+				refreshAllocationInfo(recentService)
 
 				// Update the actual service with the annotations
-				_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
-				return updateErr
+				if _, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{}); updateErr != nil {
+					return updateErr
+				}
+				// the migration is done once, it is retried only if a concurrent edit restored the legacy label
+				labeled = labeled || needsLabel
+				return checkLegacyLabelRemoved(ctx, kubeClient, service)
 			})
 			if err != nil {
 				return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
 			}
+			if labeled {
+				notifyAllocation(service, service.Spec.LoadBalancerIP, "")
+			}
+			return &service.Status.LoadBalancer, nil
 		}
-		return &service.Status.LoadBalancer, nil
 	}
+	// the service has the annotation, its IPs are checked from it
 	return nil, nil
 }
 
+// checkLegacyLabelRemoved returns a conflict if the legacy ipam-address label is still set on the service after its
+// migration, e.g. restored by a concurrent edit, so the migration is retried
+func checkLegacyLabelRemoved(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service) error {
+	migrated, err := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := migrated.Labels[LegacyIpamAddressLabelKey]; !ok {
+		return nil
+	}
+	klog.Infof("label '%s' of service '%s/%s' was restored during its migration, retrying", LegacyIpamAddressLabelKey, service.Namespace, service.Name)
+	return apierrors.NewConflict(v1.Resource("services"), service.Name, fmt.Errorf("label %s is still set after the migration", LegacyIpamAddressLabelKey))
+}
+
+// loadBalancerIPDrifted returns true if the spec.loadBalancerIP disagrees with the primary IP of the annotation, and
+// with its IPv4 IP which is set there instead with legacy-lbip-family-global
+func loadBalancerIPDrifted(service *v1.Service) bool {
+	ips, ok := service.Annotations[LoadbalancerIPsAnnotation]
+	if !ok || len(ips) == 0 || len(service.Spec.LoadBalancerIP) == 0 {
+		return false
+	}
+	return service.Spec.LoadBalancerIP != legacyLoadBalancerIP(ips, LegacyLBIPFamilyPrimary) && service.Spec.LoadBalancerIP != legacyLoadBalancerIP(ips, LegacyLBIPFamilyIPv4)
+}
+
+// reconcileLoadBalancerIPDrift re-synchronizes the spec.loadBalancerIP and the annotation of the service.
+// The spec IP is adopted into the annotation if it is in the pool of the service and not used by another service,
+// otherwise the spec is restored from the annotation.
+func reconcileLoadBalancerIPDrift(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) (*v1.LoadBalancerStatus, error) {
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	specIP := service.Spec.LoadBalancerIP
+	restored := legacyLoadBalancerIP(ips, legacyLBIPFamily(controllerCM))
+	klog.Infof("service '%s/%s' spec.loadBalancerIP [%s] drifted from annotation '%s' [%s]", service.Namespace, service.Name, specIP, LoadbalancerIPsAnnotation, ips)
+
+	adoptedIPs, reason := adoptableLoadBalancerIP(ctx, kubeClient, service, controllerCM)
+
+	err := retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		if len(adoptedIPs) > 0 {
+			setLoadBalancerIPs(recentService, adoptedIPs)
+			recentService.Annotations[AllocationStrategyAnnotationKey] = AllocationStrategyStatic
+			refreshAllocationInfo(recentService)
+		} else {
+			recentService.Spec.LoadBalancerIP = restored
+		}
+
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
+	}
+
+	if len(adoptedIPs) > 0 {
+		klog.Infof("service '%s/%s' adopted spec.loadBalancerIP [%s], IPs [%s] -> [%s]", service.Namespace, service.Name, specIP, ips, adoptedIPs)
+		recordEventf(service, v1.EventTypeNormal, "LoadBalancerIPAdopted", "Adopted spec.loadBalancerIP %s, IPs %s -> %s", specIP, ips, adoptedIPs)
+		notifyRelease(ctx, kubeClient, service)
+		notifyAllocation(service, adoptedIPs, "")
+	} else {
+		klog.Warningf("service '%s/%s' spec.loadBalancerIP [%s] restored to [%s]: %s", service.Namespace, service.Name, specIP, restored, reason)
+		recordEventf(service, v1.EventTypeWarning, "LoadBalancerIPRestored", "Restored spec.loadBalancerIP %s -> %s, %s", specIP, restored, reason)
+	}
+	return &service.Status.LoadBalancer, nil
+}
+
+// adoptableLoadBalancerIP returns the IPs of the service with its spec.loadBalancerIP as primary IP, if the spec IP
+// is in the pool of the service and not used by another service. Otherwise it returns the reason it can't be adopted.
+func adoptableLoadBalancerIP(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) (ips string, reason string) {
+	specAddr, err := netip.ParseAddr(service.Spec.LoadBalancerIP)
+	if err != nil {
+		return "", "it is not a valid IP address"
+	}
+	addrs, err := parseAddrList(service.Annotations[LoadbalancerIPsAnnotation])
+	if err != nil {
+		return "", fmt.Sprintf("the annotation can't be parsed: %v", err)
+	}
+	if specAddr.Is4() != addrs[0].Is4() {
+		return "", "it is not of the family of the primary IP"
+	}
+
+	if controllerCM == nil {
+		return "", "the configmap doesn't exist"
+	}
+	namespaceLabels, err := getNamespaceLabels(ctx, kubeClient, controllerCM, service.Namespace)
+	if err != nil {
+		return "", fmt.Sprintf("the namespace labels can't be read: %v", err)
+	}
+	pool, global, _, err := discoverRegionalPool(controllerCM, service.Namespace, service.Annotations[RegionAnnotationKey], namespaceLabels, controllerCM.Name)
+	if err != nil {
+		return "", fmt.Sprintf("no pool: %v", err)
+	}
+	if contained, err := ipam.PoolContains(pool, specAddr); err != nil || !contained {
+		return "", fmt.Sprintf("it is not in the pool [%s]", pool)
+	}
+
+	var serviceNamespace = ""
+	if !global {
+		serviceNamespace = service.Namespace
+	}
+	svcs, err := listInUseServices(ctx, kubeClient, serviceNamespace)
+	if err != nil {
+		return "", fmt.Sprintf("the services can't be listed: %v", err)
+	}
+	others := &v1.ServiceList{}
+	for x := range svcs.Items {
+		if svcs.Items[x].Namespace != service.Namespace || svcs.Items[x].Name != service.Name {
+			others.Items = append(others.Items, svcs.Items[x])
+		}
+	}
+	inUseSet, _, err := mapImplementedServices(others, false)
+	if err != nil {
+		return "", fmt.Sprintf("the IPs in use can't be mapped: %v", err)
+	}
+	if inUseSet.Contains(specAddr) {
+		return "", "it is used by another service"
+	}
+
+	addrs[0] = specAddr
+	adopted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		adopted = append(adopted, addr.String())
+	}
+	return strings.Join(adopted, ","), ""
+}
+
 func parseAddrList(inputString string) (addrs []netip.Addr, err error) {
 	addrStringList := strings.Split(inputString, ",")
 	var addrList []netip.Addr
@@ -146,7 +768,9 @@ func mapImplementedServices(svcs *v1.ServiceList, allowShare bool) (inUseSet *ne
 	for x := range svcs.Items {
 		var svc = svcs.Items[x]
 
-		if ips, ok := svc.Annotations[LoadbalancerIPsAnnotation]; ok {
+		// a service carrying only the implementation label may belong to another tool using the same label, only
+		// the IPs of our annotation are in use
+		if ips := svc.Annotations[LoadbalancerIPsAnnotation]; len(ips) > 0 {
 			addrs, err := parseAddrList(ips)
 			if err != nil {
 				return nil, nil, err
@@ -158,7 +782,11 @@ func mapImplementedServices(svcs *v1.ServiceList, allowShare bool) (inUseSet *ne
 
 				// Store service port mapping to help decide whether services could share the same IP.
 				if allowShare && addr.Is4() {
-					if len(svc.Spec.Ports) != 0 {
+					if isDedicated(&svc) {
+						// the IP of a service with a dedicated IP isn't shared
+						newSet := set.New[int32](0)
+						servicePortMap[ip] = &newSet
+					} else if len(svc.Spec.Ports) != 0 {
 						for p := range svc.Spec.Ports {
 							var port = svc.Spec.Ports[p].Port
 
@@ -184,6 +812,10 @@ func mapImplementedServices(svcs *v1.ServiceList, allowShare bool) (inUseSet *ne
 			}
 		}
 	}
+	// the addresses of the Gateways are in use too, they aren't shared with the services
+	if err := addGatewayAddresses(builder); err != nil {
+		return nil, nil, err
+	}
 	inUseSet, err = builder.IPSet()
 	if err != nil {
 		return nil, nil, err
@@ -192,6 +824,97 @@ func mapImplementedServices(svcs *v1.ServiceList, allowShare bool) (inUseSet *ne
 	return inUseSet, servicePortMap, nil
 }
 
+// mapServiceCounts returns the number of services using each IPv4 address
+func mapServiceCounts(svcs *v1.ServiceList) map[string]int {
+	serviceCountMap := map[string]int{}
+
+	for x := range svcs.Items {
+		ips, ok := svcs.Items[x].Annotations[LoadbalancerIPsAnnotation]
+		if !ok {
+			continue
+		}
+		addrs, err := parseAddrList(ips)
+		if err != nil {
+			continue
+		}
+		for a := range addrs {
+			if addrs[a].Is4() {
+				serviceCountMap[addrs[a].String()]++
+			}
+		}
+	}
+
+	return serviceCountMap
+}
+
+// mapServiceAffinities returns the session affinities of the services using each IPv4 address
+func mapServiceAffinities(svcs *v1.ServiceList) map[string]set.Set[v1.ServiceAffinity] {
+	serviceAffinityMap := map[string]set.Set[v1.ServiceAffinity]{}
+
+	for x := range svcs.Items {
+		var svc = svcs.Items[x]
+
+		ips, ok := svc.Annotations[LoadbalancerIPsAnnotation]
+		if !ok {
+			continue
+		}
+		addrs, err := parseAddrList(ips)
+		if err != nil {
+			continue
+		}
+		for a := range addrs {
+			if !addrs[a].Is4() {
+				continue
+			}
+			ip := addrs[a].String()
+			if _, ok := serviceAffinityMap[ip]; !ok {
+				serviceAffinityMap[ip] = set.New[v1.ServiceAffinity]()
+			}
+			serviceAffinityMap[ip].Insert(serviceAffinity(&svc))
+		}
+	}
+
+	return serviceAffinityMap
+}
+
+// mapServiceShareGroups returns the share groups of the services using each IPv4 address
+func mapServiceShareGroups(svcs *v1.ServiceList) map[string]set.Set[string] {
+	serviceShareGroupMap := map[string]set.Set[string]{}
+
+	for x := range svcs.Items {
+		var svc = svcs.Items[x]
+
+		ips, ok := svc.Annotations[LoadbalancerIPsAnnotation]
+		if !ok {
+			continue
+		}
+		addrs, err := parseAddrList(ips)
+		if err != nil {
+			continue
+		}
+		for a := range addrs {
+			if !addrs[a].Is4() {
+				continue
+			}
+			ip := addrs[a].String()
+			if _, ok := serviceShareGroupMap[ip]; !ok {
+				serviceShareGroupMap[ip] = set.New[string]()
+			}
+			serviceShareGroupMap[ip].Insert(svc.Annotations[ShareGroupAnnotationKey])
+		}
+	}
+
+	return serviceShareGroupMap
+}
+
+// serviceAffinity returns the session affinity of the service, defaulting to None
+func serviceAffinity(svc *v1.Service) v1.ServiceAffinity {
+	if len(svc.Spec.SessionAffinity) == 0 {
+		return v1.ServiceAffinityNone
+	}
+	return svc.Spec.SessionAffinity
+}
+
 // syncLoadBalancer
 // 1. Is this loadBalancer already created, and does it have an address? return status
 // 2. Is this a new loadBalancer (with no IP address)
@@ -200,22 +923,142 @@ func mapImplementedServices(svcs *v1.ServiceList, allowShare bool) (inUseSet *ne
 // 2c. Between the two find a free address
 
 func syncLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, cmName, cmNamespace string) (*v1.LoadBalancerStatus, error) {
+	status, err := syncLoadBalancerAddresses(ctx, kubeClient, service, cmName, cmNamespace)
+	recordLastError(ctx, kubeClient, service, err)
+	return status, err
+}
+
+// recordLastError sets the last error annotation of the service if the sync failed, and removes it if the sync succeeded.
+// The annotation isn't rewritten while the sync keeps failing with the same error, so it keeps the time of the first failure.
+// The service in hand is checked first, so a sync leaving the annotation as it is doesn't cost a GET.
+func recordLastError(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, syncErr error) {
+	if lastErrorRecorded(service, syncErr) {
+		return
+	}
+	err := retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if lastErrorRecorded(recentService, syncErr) {
+			return nil
+		}
+
+		if syncErr == nil {
+			delete(recentService.Annotations, LastErrorAnnotationKey)
+		} else {
+			if recentService.Annotations == nil {
+				recentService.Annotations = make(map[string]string)
+			}
+			recentService.Annotations[LastErrorAnnotationKey] = time.Now().UTC().Format(time.RFC3339) + ": " + syncErr.Error()
+		}
+
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		klog.Warningf("unable to update annotation '%s' of service '%s/%s': %v", LastErrorAnnotationKey, service.Namespace, service.Name, err)
+	}
+}
+
+// lastErrorRecorded returns true if the last error annotation of the service already matches the result of the sync:
+// absent if the sync succeeded, or holding the same error
+func lastErrorRecorded(service *v1.Service, syncErr error) bool {
+	lastError, found := service.Annotations[LastErrorAnnotationKey]
+	if syncErr == nil {
+		return !found
+	}
+	_, message, _ := strings.Cut(lastError, ": ")
+	return found && message == syncErr.Error()
+}
+
+// syncLoadBalancerAddresses allocates the addresses of the service
+func syncLoadBalancerAddresses(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, cmName, cmNamespace string) (*v1.LoadBalancerStatus, error) {
 	// This function reconciles the load balancer state
 	klog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
 
-	// The loadBalancer address has already been populated
-	if status, err := checkLegacyLoadBalancerIPAnnotation(ctx, kubeClient, service); status != nil || err != nil {
+	if isDenylisted(service) {
+		klog.Infof("service '%s/%s' is denylisted by %s, skipping it", service.Namespace, service.Name, ServiceDenylistEnvKey)
+		return &service.Status.LoadBalancer, nil
+	}
+	if !isNamespaceAllowed(service) {
+		klog.Infof("namespace of service '%s/%s' doesn't match %s, skipping it", service.Namespace, service.Name, NamespaceRegexEnvKey)
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The pool configmap is read once and passed to the checks of the sync, it is nil if it can't be read
+	controllerCM, cmErr := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
+	if cmErr != nil {
+		controllerCM = nil
+	}
+
+	// The IP pinned to the service in the configmap overrides any other IP
+	if status, pinned, err := syncPinnedService(ctx, kubeClient, service, controllerCM); pinned {
+		return status, err
+	}
+
+	// The IPs of a frozen service are never changed
+	if ips := service.Annotations[LoadbalancerIPsAnnotation]; len(ips) > 0 && isFrozen(service) {
+		klog.Infof("service '%s/%s' is frozen by annotation '%s', keeping IPs [%s]", service.Namespace, service.Name, FreezeAnnotationKey, ips)
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The services keep their IPs while the pool configmap is deleted
+	if ips := service.Annotations[LoadbalancerIPsAnnotation]; len(ips) > 0 && allocationPaused.Load() {
+		klog.Infof("allocation paused, service '%s/%s' keeps IPs [%s]", service.Namespace, service.Name, ips)
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The allocated services are checked against the pool configmap, they are synced again once it can be read
+	if ips := service.Annotations[LoadbalancerIPsAnnotation]; len(ips) > 0 && cmErr != nil && !apierrors.IsNotFound(cmErr) {
+		return nil, cmErr
+	}
+
+	// The spec.loadBalancerIP was edited after the IPs were allocated
+	if loadBalancerIPDrifted(service) {
+		return reconcileLoadBalancerIPDrift(ctx, kubeClient, service, controllerCM)
+	}
+
+	// The loadBalancer address has already been populated
+	status, err := checkLegacyLoadBalancerIPAnnotation(ctx, kubeClient, service)
+	var invalidIPErr *InvalidLoadBalancerIPError
+	if errors.As(err, &invalidIPErr) {
+		klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, invalidIPErr)
+		recordEventf(service, v1.EventTypeWarning, "InvalidLoadBalancerIP", "%v", invalidIPErr)
+	} else if status != nil || err != nil {
 		return status, err
 	}
 
 	// Check if the service already got a LoadbalancerIPsAnnotation,
 	// if so, check if LoadbalancerIPsAnnotation was created by cloud-controller (ImplementationLabelKey == ImplementationLabelValue)
 	if v, ok := service.Annotations[LoadbalancerIPsAnnotation]; ok && len(v) != 0 {
-		klog.Infof("service '%s/%s' annotations '%s' is defined but service.Spec.LoadBalancerIP is not. Assume it's not legacy service", service.Namespace, service.Name, LoadbalancerIPsAnnotation)
+		klog.Infof("service '%s/%s' annotations '%s' is defined, assume it's not a legacy service", service.Namespace, service.Name, LoadbalancerIPsAnnotation)
+		// A single-stack service holding an IP of each family is trimmed to a single IP, the update syncs it again
+		if trimmed, err := trimExtraIPFamily(ctx, kubeClient, service, controllerCM); trimmed || err != nil {
+			return &service.Status.LoadBalancer, err
+		}
 		// Set label ImplementationLabelKey, otherwise cloud-provider will skip the service
-		if service.Labels == nil || service.Labels[ImplementationLabelKey] != ImplementationLabelValue {
+		if service.Labels == nil || service.Labels[implementationLabelKey] != ImplementationLabelValue {
 			klog.Infof("service '%s/%s' created with pre-defined ip '%s'", service.Namespace, service.Name, v)
-			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			// A static IP can only land on a shared address if its ports are free there
+			if err := checkStaticIPPorts(ctx, kubeClient, service, controllerCM); err != nil {
+				var conflictErr *StaticIPPortConflictError
+				if errors.As(err, &conflictErr) {
+					klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, conflictErr)
+					recordEventf(service, v1.EventTypeWarning, "StaticIPPortConflict", "%v", conflictErr)
+				}
+				return nil, err
+			}
+			// A static IP must be part of the pool of the service if enforce-pool-boundaries-global is set
+			if err := checkStaticIPPool(ctx, kubeClient, service, controllerCM); err != nil {
+				var outsideErr *StaticIPOutsidePoolError
+				if errors.As(err, &outsideErr) {
+					klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, outsideErr)
+					recordEventf(service, v1.EventTypeWarning, "StaticIPOutsidePool", "%v", outsideErr)
+				}
+				return nil, err
+			}
+			err := retryOnConflict(func() error {
 				recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
@@ -224,7 +1067,14 @@ func syncLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, serv
 					// Just because ..
 					recentService.Labels = make(map[string]string)
 				}
-				recentService.Labels[ImplementationLabelKey] = ImplementationLabelValue
+				recentService.Labels[implementationLabelKey] = ImplementationLabelValue
+				if recentService.Annotations == nil {
+					recentService.Annotations = make(map[string]string)
+				}
+				// A service that lost its label keeps the strategy its IPs were allocated with
+				if _, ok := recentService.Annotations[AllocationStrategyAnnotationKey]; !ok {
+					recentService.Annotations[AllocationStrategyAnnotationKey] = AllocationStrategyStatic
+				}
 				// Update the actual service with the annotations
 				_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
 				return updateErr
@@ -232,13 +1082,49 @@ func syncLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, serv
 			if err != nil {
 				return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
 			}
+			notifyAllocation(service, v, "")
+		} else if service.Annotations[AllocationStrategyAnnotationKey] != AllocationStrategyStatic {
+			// The IP families of a dual-stack service may have been reordered since the allocation, or the family of
+			// its spec.loadBalancerIP changed by legacy-lbip-family-global
+			legacyFamily := LegacyLBIPFamilyPrimary
+			if strings.Contains(v, ",") {
+				legacyFamily = legacyLBIPFamily(controllerCM)
+			}
+			if err := reorderLoadBalancerIPs(ctx, kubeClient, service, legacyFamily); err != nil {
+				return nil, err
+			}
+		}
+
+		// A PreferDualStack service that got a single IP may get the IP family its pool serves now
+		if err := checkMissingIPFamily(ctx, kubeClient, service, controllerCM); err != nil {
+			return nil, err
+		}
+
+		// Check that the IPs aren't shared if sharing is disabled
+		if err := checkSharedIPs(ctx, kubeClient, service, controllerCM); err != nil {
+			return nil, err
+		}
+		// Check that the services sharing the IPs still use different ports, e.g. after the ports changed
+		if err := checkSharedIPPorts(ctx, kubeClient, service, controllerCM); err != nil {
+			return nil, err
+		}
+		// Move the service onto a more shared IP if compact-shared-ips-global is set
+		if err := compactSharedIP(ctx, kubeClient, service, controllerCM); err != nil {
+			return nil, err
 		}
 		return &service.Status.LoadBalancer, nil
 	}
 
-	// Get the cloud controller configuration map
-	controllerCM, err := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
-	if err != nil {
+	// No IP is allocated while the pool configmap is deleted
+	if allocationPaused.Load() {
+		return nil, allocationPausedError(service, cmName, cmNamespace)
+	}
+
+	// The cloud controller configuration map is created if it can't be read
+	if cmErr != nil && pauseOnConfigMapDeletion && apierrors.IsNotFound(cmErr) {
+		return nil, allocationPausedError(service, cmName, cmNamespace)
+	}
+	if cmErr != nil {
 		klog.Errorf("Unable to retrieve kube-vip ipam config from configMap [%s] in %s", cmName, cmNamespace)
 		// TODO - determine best course of action, create one if it doesn't exist
 		controllerCM, err = createConfigMap(ctx, kubeClient, cmName, cmNamespace)
@@ -247,167 +1133,1420 @@ func syncLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, serv
 		}
 	}
 
-	// Get ip pool from configmap and determine if it is namespace specific or global
-	pool, global, allowShare, err := discoverPool(controllerCM, service.Namespace, cmName)
+	// Leave the service pending if its spec.loadBalancerIP is invalid, unless the configmap allows a pool allocation
+	if invalidIPErr != nil && discoverInvalidLoadBalancerIPPending(controllerCM) {
+		return nil, invalidIPErr
+	}
+
+	// A service without ports would hold a whole IP, refuse it if the configmap says so
+	if len(service.Spec.Ports) == 0 && discoverRejectPortlessLB(controllerCM) {
+		portlessErr := &PortlessLoadBalancerError{}
+		klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, portlessErr)
+		recordEventf(service, v1.EventTypeWarning, "PortlessLoadBalancerRejected", "%v", portlessErr)
+		return nil, portlessErr
+	}
+
+	// The interfaces requested by the service are passed through unchanged, they must be valid
+	if interfaces, ok := service.Annotations[LoadbalancerServiceInterfaceAnnotationKey]; ok {
+		if err := validateInterfaceList(interfaces); err != nil {
+			interfaceErr := &InvalidServiceInterfaceError{Interfaces: interfaces, Err: err}
+			klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, interfaceErr)
+			recordEventf(service, v1.EventTypeWarning, "InvalidServiceInterface", "%v", interfaceErr)
+			return nil, interfaceErr
+		}
+	}
+
+	// Get the labels of the namespace, only needed if pools are selected by namespace labels
+	namespaceLabels, err := getNamespaceLabels(ctx, kubeClient, controllerCM, service.Namespace)
 	if err != nil {
 		return nil, err
 	}
 
+	// Get ip pool from configmap and determine if it is namespace specific or global
+	pool, global, allowShare, err := discoverServicePool(controllerCM, service, namespaceLabels, cmName)
+	emptyPoolDHCP := discoverEmptyPoolDHCP(controllerCM)
+	var regionFamilyErr *RegionPoolFamilyError
+	if err != nil && (!emptyPoolDHCP || errors.As(err, &regionFamilyErr)) {
+		recordPoolError(service, err)
+		return nil, err
+	}
+	warnPoolOverlaps(controllerCM, pool)
+
 	var serviceNamespace = ""
+	var overflowPool, burstPool string
 	if !global {
 		serviceNamespace = service.Namespace
+		if pool != DHCPPool {
+			overflowPool = discoverOverflowPool(controllerCM, service.Namespace)
+		}
+	}
+	if pool != DHCPPool && allowsBurst(service) {
+		burstPool = discoverBurstPool(controllerCM)
+	}
+
+	kubevipLBConfig := serviceLBConfig(controllerCM, service, cmName, pool, global)
+	kubevipLBConfig.EmptyPoolDHCP = emptyPoolDHCP
+
+	familyOrder, err := parseFamilyOrder(service.Annotations[FamilyOrderAnnotationKey])
+	if err != nil {
+		return nil, err
+	}
+	ipFamilies, err := requestedIPFamilies(controllerCM, service)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate computes the IPs of the service from the services currently implemented by kube-vip
+	var loadBalancerIPs, strategy, allocatedPool string
+	var overflowed, bursted bool
+	var allocationInUseSet *netipx.IPSet
+	var allocationServices *v1.ServiceList
+	allocate := func() error {
+		overflowed, bursted, allocatedPool = false, false, pool
+
+		svcs, err := listInUseServices(ctx, kubeClient, serviceNamespace)
+		if err != nil {
+			return err
+		}
+
+		inUseSet, servicePortMap, err := mapImplementedServices(svcs, allowShare)
+		if err != nil {
+			return err
+		}
+
+		allocationServices = svcs
+
+		inUseSet, err = reservePinnedIPs(controllerCM, service, inUseSet)
+		if err != nil {
+			return err
+		}
+
+		if discoverExcludeOwnServices(controllerCM) {
+			inUseSet, err = excludeOwnServices(ctx, kubeClient, cmNamespace, inUseSet)
+			if err != nil {
+				return err
+			}
+		}
+
+		inUseSet, err = reserveFilledPrefixes(controllerCM, service, cmName, global, inUseSet)
+		if err != nil {
+			return err
+		}
+		allocationInUseSet = inUseSet
+
+		// The service migrates from another load balancer implementation and keeps its IPs
+		if adoptedIPs := adoptableForeignIPs(service, controllerCM, pool, inUseSet); len(adoptedIPs) > 0 {
+			loadBalancerIPs, strategy = adoptedIPs, AllocationStrategyAdopted
+			return nil
+		}
+
+		// The service brings its own addresses in spec.externalIPs
+		if len(service.Spec.ExternalIPs) > 0 && discoverUseExternalIPs(controllerCM, service.Namespace, cmName) {
+			externalIPs, err := serviceExternalIPs(service, pool, inUseSet)
+			if err != nil {
+				return err
+			}
+			loadBalancerIPs, strategy = externalIPs, AllocationStrategyExternalIPs
+			return nil
+		}
+
+		preferredIpv4ServiceIP := ""
+
+		if allowShare && isDedicated(service) {
+			klog.Infof("service '%s/%s' requests a dedicated IP with annotation '%s', not sharing an address", service.Namespace, service.Name, DedicatedIPAnnotationKey)
+		} else if allowShare {
+			preferredIpv4ServiceIP = discoverSharedVIPs(service, servicePortMap, newShareOptions(controllerCM, service.Namespace, cmName, svcs))
+		}
+
+		// If allowedShare is true but no IP could be shared, or allowedShare is false, switch to use IPAM lookup
+		loadBalancerIPs, err = discoverVIPs(service.Namespace, pool, preferredIpv4ServiceIP, inUseSet, kubevipLBConfig, service.Spec.IPFamilyPolicy, ipFamilies, familyOrder)
+		var outOfIPsErr *ipam.OutOfIPsError
+		if len(overflowPool) > 0 && errors.As(err, &outOfIPsErr) {
+			klog.Infof("pool of namespace [%s] is exhausted, allocating service '%s/%s' from the global pool", service.Namespace, service.Namespace, service.Name)
+			loadBalancerIPs, err = discoverVIPsFromOverflowPool(ctx, kubeClient, controllerCM, service, overflowPool, cmNamespace, kubevipLBConfig, ipFamilies, familyOrder)
+			overflowed, allocatedPool, preferredIpv4ServiceIP = true, overflowPool, ""
+		}
+		if len(burstPool) > 0 && errors.As(err, &outOfIPsErr) {
+			klog.Infof("pool of service '%s/%s' is exhausted, allocating it from the burst pool", service.Namespace, service.Name)
+			loadBalancerIPs, err = discoverVIPsFromBurstPool(ctx, kubeClient, controllerCM, service, burstPool, cmNamespace, kubevipLBConfig, ipFamilies, familyOrder)
+			overflowed, bursted, allocatedPool, preferredIpv4ServiceIP = false, true, burstPool, ""
+		}
+		if err != nil {
+			return err
+		}
+
+		strategy = allocationStrategy(loadBalancerIPs, preferredIpv4ServiceIP, kubevipLBConfig)
+		return nil
+	}
+
+	// lockPools locks the pools the service may be allocated from
+	lockPools := func() func() {
+		unlocks := []func(){lockPool(pool)}
+		if len(overflowPool) > 0 && overflowPool != pool {
+			unlocks = append(unlocks, lockPool(overflowPool))
+		}
+		if len(burstPool) > 0 && burstPool != pool && burstPool != overflowPool {
+			unlocks = append(unlocks, lockPool(burstPool))
+		}
+		return func() {
+			for x := len(unlocks) - 1; x >= 0; x-- {
+				unlocks[x]()
+			}
+		}
+	}
+
+	// Update the services with this new address, the IPs are recomputed on conflict as another service
+	// may have taken them in the meantime
+	var retryErr error
+	allocErr := allocateProbed(kubevipLBConfig, lockPools, func() error {
+		var attemptErr error
+		retryErr = retryOnConflict(func() error {
+			if attemptErr = allocate(); attemptErr != nil {
+				return attemptErr
+			}
+
+			// Get the loadbalancer interface and advertisement if they're defined for the namespace
+			var loadbalancerInterface, advertisement string
+			if len(loadBalancerIPs) > 0 {
+				loadbalancerInterface = discoverServiceInterface(ctx, kubeClient, controllerCM, service.Namespace, cmNamespace)
+				advertisement = discoverAdvertisement(controllerCM, service.Namespace, cmName)
+			}
+
+			recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+
+			klog.Infof("Updating service [%s], with load balancer IPAM address(es) [%s]", service.Name, loadBalancerIPs)
+
+			if recentService.Labels == nil {
+				// Just because ..
+				recentService.Labels = make(map[string]string)
+			}
+			// Set Label for service lookups
+			recentService.Labels[implementationLabelKey] = ImplementationLabelValue
+
+			if recentService.Annotations == nil {
+				recentService.Annotations = make(map[string]string)
+			}
+			// use annotation to specify static IP, instead of spec.LoadbalancerIP, to support IPv6 dualstack.
+			setLoadBalancerIPs(recentService, loadBalancerIPs)
+			recentService.Annotations[AllocationStrategyAnnotationKey] = strategy
+			recentService.Annotations[SourcePoolAnnotationKey] = SourcePoolNamespace
+			if global || overflowed {
+				recentService.Annotations[SourcePoolAnnotationKey] = SourcePoolGlobal
+			}
+			if bursted {
+				recentService.Annotations[SourcePoolAnnotationKey] = SourcePoolBurst
+			}
+			if poolFree := poolFreeCount(pool, allocationInUseSet, loadBalancerIPs); len(poolFree) > 0 {
+				recentService.Annotations[PoolFreeAnnotationKey] = poolFree
+			} else {
+				delete(recentService.Annotations, PoolFreeAnnotationKey)
+			}
+			if zone := ipZone(allocatedPool, loadBalancerIPs); len(zone) > 0 {
+				recentService.Annotations[IPZoneAnnotationKey] = zone
+			} else {
+				delete(recentService.Annotations, IPZoneAnnotationKey)
+			}
+			setAllocationInfo(recentService, discoverAllocationInfo(controllerCM))
+
+			// this line will be removed once kube-vip can recognize annotations
+			// Set IPAM address to Load Balancer Service
+			recentService.Spec.LoadBalancerIP = legacyLoadBalancerIP(loadBalancerIPs, discoverLegacyLBIPFamily(controllerCM))
+
+			if len(loadbalancerInterface) > 0 {
+				klog.Infof("Updating service [%s], with load balancer interface [%s]", service.Name, loadbalancerInterface)
+				setServiceInterface(recentService, loadbalancerInterface)
+			}
+
+			// The advertisement annotation of the service overrides the configmap
+			if _, ok := recentService.Annotations[VipAdvertisementAnnotationKey]; !ok && len(advertisement) > 0 {
+				recentService.Annotations[VipAdvertisementAnnotationKey] = advertisement
+			}
+
+			// Update the actual service with the address and the labels
+			_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+			return updateErr
+		})
+		return attemptErr
+	})
+	// checked once from the services of the last attempt, a conflict doesn't repeat the warning
+	if allocationServices != nil {
+		checkPoolCapacity(service, pool, allocationServices)
+	}
+	if allocErr != nil || retryErr != nil {
+		ipam.RecordAllocation(service.Namespace, service.Name, ipam.AllocationOutcomeFailed, allocationExemplars)
+	}
+	if allocErr != nil {
+		var externalIPsErr *ExternalIPsError
+		if errors.As(allocErr, &externalIPsErr) {
+			klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, externalIPsErr)
+			recordEventf(service, v1.EventTypeWarning, "ExternalIPsRejected", "%v", externalIPsErr)
+		}
+		var outOfIPsErr *ipam.OutOfIPsError
+		if errors.As(allocErr, &outOfIPsErr) {
+			ipam.RecordPoolExhausted(service.Namespace)
+		}
+		var probeLimitErr *ProbeLimitError
+		if errors.As(allocErr, &probeLimitErr) {
+			recordEventf(service, v1.EventTypeWarning, "ProbeLimitReached", "%v", probeLimitErr)
+		}
+		recordNamespaceEventf(controllerCM, service.Namespace, v1.EventTypeWarning, "AllocationFailed", "Service %s failed to get IPs: %v", service.Name, allocErr)
+		return nil, allocErr
+	}
+	if retryErr != nil {
+		return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, retryErr)
+	}
+	if strategy == AllocationStrategyAdopted {
+		klog.Infof("service '%s/%s' adopted IPs [%s] from another load balancer implementation", service.Namespace, service.Name, loadBalancerIPs)
+		recordEventf(service, v1.EventTypeNormal, "LoadBalancerAdopted", "Adopted IPs %s from another load balancer implementation", loadBalancerIPs)
+	}
+	if overflowed {
+		recordEventf(service, v1.EventTypeNormal, "PoolOverflow", "Pool of namespace %s is exhausted, allocated IPs %s from the global pool", service.Namespace, loadBalancerIPs)
+	}
+	if bursted {
+		recordEventf(service, v1.EventTypeWarning, "PoolBurst", "Pool is exhausted, allocated IPs %s from the burst pool", loadBalancerIPs)
+	}
+	if poolAllocatedStrategies.Has(strategy) && discoverRequireDualStackDowngrade(controllerCM) {
+		recordDualStackDowngrade(service, service.Spec.IPFamilyPolicy, loadBalancerIPs)
+	}
+	ipam.RecordAllocation(service.Namespace, service.Name, ipam.AllocationOutcomeAllocated, allocationExemplars)
+	notifyAllocation(service, loadBalancerIPs, allocatedPool)
+	checkPoolUtilization(ctx, kubeClient, controllerCM, pool, serviceNamespace)
+
+	return &service.Status.LoadBalancer, nil
+}
+
+// serviceLBConfig returns the allocation configuration of the service from the configmap for its pool
+func serviceLBConfig(controllerCM *v1.ConfigMap, service *v1.Service, cmName, pool string, global bool) *config.KubevipLBConfig {
+	kubevipLBConfig := config.GetKubevipLBConfig(controllerCM, service.Namespace)
+	kubevipLBConfig.UsableRange = discoverUsableRange(controllerCM, service.Namespace, global)
+	kubevipLBConfig.ProbeBeforeAssign = discoverProbeBeforeAssign(controllerCM, service.Namespace, cmName)
+	kubevipLBConfig.PreferredIPs = discoverPreferredIPs(controllerCM, service.Namespace, cmName)
+	if discoverStickyByName(controllerCM) {
+		kubevipLBConfig.ReclaimableIPs = reclaimableIPs(service.Namespace, service.Name)
+	}
+	kubevipLBConfig.KeepEndIPs = isAllowlistPool(controllerCM, service.Namespace, pool)
+	kubevipLBConfig.Debug = isDebugged(service)
+	kubevipLBConfig.DefaultIPFamilyPolicy = discoverDefaultIPFamilyPolicy(controllerCM, service.Namespace, cmName)
+	kubevipLBConfig.Namespace = service.Namespace
+	kubevipLBConfig.ReleaseCooldown = discoverReleaseCooldown(controllerCM)
+	kubevipLBConfig.CrossNamespaceCooldown = discoverCrossNamespaceCooldown(controllerCM)
+	kubevipLBConfig.AllocationStride = discoverAllocationStride(controllerCM)
+	kubevipLBConfig.RejectReservedRanges = discoverRejectReservedRanges(controllerCM)
+	kubevipLBConfig.DowngradeRequireDualStack = discoverRequireDualStackDowngrade(controllerCM)
+	kubevipLBConfig.ExcludedIPs = discoverExcludedIPs(controllerCM, service.Namespace)
+	return kubevipLBConfig
+}
+
+// discoverVIPsFromOverflowPool allocates the IPs of the service from the global pool once the pool of its namespace
+// is exhausted, the addresses of the services of every namespace are then in use
+func discoverVIPsFromOverflowPool(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, service *v1.Service, overflowPool, cmNamespace string,
+	kubevipLBConfig *config.KubevipLBConfig, ipFamilies, familyOrder []v1.IPFamily) (string, error) {
+	inUseSet, err := clusterInUseSet(ctx, kubeClient, cm, cmNamespace)
+	if err != nil {
+		return "", err
+	}
+	inUseSet, err = reserveFilledPrefixes(cm, service, cm.Name, true, inUseSet)
+	if err != nil {
+		return "", err
+	}
+
+	// The usable range of the namespace doesn't apply to the global pool
+	globalLBConfig := *kubevipLBConfig
+	globalLBConfig.UsableRange = discoverUsableRange(cm, service.Namespace, true)
+	return discoverVIPs(service.Namespace, overflowPool, "", inUseSet, &globalLBConfig, service.Spec.IPFamilyPolicy, ipFamilies, familyOrder)
+}
+
+// clusterInUseSet returns the addresses of the services of every namespace, for the pools shared by all of them
+func clusterInUseSet(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, cmNamespace string) (*netipx.IPSet, error) {
+	svcs, err := listInUseServices(ctx, kubeClient, "")
+	if err != nil {
+		return nil, err
+	}
+	inUseSet, _, err := mapImplementedServices(svcs, false)
+	if err != nil {
+		return nil, err
+	}
+	if discoverExcludeOwnServices(cm) {
+		return excludeOwnServices(ctx, kubeClient, cmNamespace, inUseSet)
+	}
+	return inUseSet, nil
+}
+
+// setLoadBalancerIPs sets the IPs annotation of the service, and stamps the time they were assigned if they changed.
+// The annotations of the service must not be nil.
+func setLoadBalancerIPs(service *v1.Service, ips string) {
+	if service.Annotations[LoadbalancerIPsAnnotation] != ips {
+		service.Annotations[IPAssignedAtAnnotationKey] = time.Now().UTC().Format(time.RFC3339)
+	}
+	service.Annotations[LoadbalancerIPsAnnotation] = ips
+}
+
+// rewriteServiceIPs re-reads the service and applies rewrite to it, then updates it, as long as the service still has
+// the IPs the rewrite was decided from: they may have been released to be reallocated, or moved by another worker, in
+// the meantime. It returns true if the service was updated, an error of rewrite is returned as is.
+func rewriteServiceIPs(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, ips string, rewrite func(*v1.Service) error) (bool, error) {
+	var updated bool
+	err := retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations[LoadbalancerIPsAnnotation] != ips {
+			return nil
+		}
+		if err := rewrite(recentService); err != nil {
+			return err
+		}
+		refreshAllocationInfo(recentService)
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		updated = updateErr == nil
+		return updateErr
+	})
+	return updated, err
+}
+
+// reorderLoadBalancerIPs reorders the IPs of a dual-stack service following its family order, the familyOrder
+// annotation or spec.IPFamilies, e.g. when spec.IPFamilies is changed from [IPv4, IPv6] to [IPv6, IPv4]. The
+// spec.loadBalancerIP is corrected following legacyFamily, to the primary IP, the IPv4 IP or nothing.
+func reorderLoadBalancerIPs(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, legacyFamily string) error {
+	families := service.Spec.IPFamilies
+	if familyOrder, err := parseFamilyOrder(service.Annotations[FamilyOrderAnnotationKey]); err == nil && len(familyOrder) > 0 {
+		families = familyOrder
+	}
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	ordered := orderIPsByFamily(ips, families)
+	legacyIP := legacyLoadBalancerIP(ordered, legacyFamily)
+	if ordered == ips && (len(service.Spec.LoadBalancerIP) == 0 || service.Spec.LoadBalancerIP == legacyIP) {
+		return nil
+	}
+
+	if ordered != ips {
+		klog.Infof("service '%s/%s' IP families are ordered %v, reordering IPs [%s] to [%s]", service.Namespace, service.Name, families, ips, ordered)
+	} else {
+		klog.Infof("service '%s/%s' correcting spec.loadBalancerIP [%s] to [%s]", service.Namespace, service.Name, service.Spec.LoadBalancerIP, legacyIP)
+	}
+	err := retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		// the IPs don't change, so the ipAssignedAt annotation is kept
+		recentService.Annotations[LoadbalancerIPsAnnotation] = ordered
+		refreshAllocationInfo(recentService)
+		recentService.Spec.LoadBalancerIP = legacyIP
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
+	}
+	return nil
+}
+
+// legacyLoadBalancerIP returns the IP of the comma separated IPs that is set in the legacy spec.loadBalancerIP following
+// legacyFamily: the primary IP, the IPv4 IP if there is one, as some consumers expect an IPv4 there, or nothing for a
+// dual-stack service. A single-stack service always gets its IP.
+func legacyLoadBalancerIP(ips string, legacyFamily string) string {
+	addrs := strings.Split(ips, ",")
+	if len(addrs) == 1 {
+		return addrs[0]
+	}
+	switch legacyFamily {
+	case LegacyLBIPFamilyIPv4:
+		for _, ip := range addrs {
+			if addr, err := netip.ParseAddr(ip); err == nil && addr.Is4() {
+				return ip
+			}
+		}
+	case LegacyLBIPFamilyNone:
+		return ""
+	}
+	return addrs[0]
+}
+
+// legacyLBIPFamily returns the legacy-lbip-family-global of the pool ConfigMap, primary if it doesn't exist
+func legacyLBIPFamily(cm *v1.ConfigMap) string {
+	if cm == nil {
+		return LegacyLBIPFamilyPrimary
+	}
+	return discoverLegacyLBIPFamily(cm)
+}
+
+// orderIPsByFamily sorts the comma separated IPs by the order of their family in families, the IPs of a family keep
+// their order. The IPs are returned unchanged if there is less than two families or an IP is invalid.
+func orderIPsByFamily(ips string, families []v1.IPFamily) string {
+	if len(families) < 2 {
+		return ips
+	}
+	rank := func(family v1.IPFamily) int {
+		if i := slices.Index(families, family); i >= 0 {
+			return i
+		}
+		return len(families)
+	}
+
+	addrs := strings.Split(ips, ",")
+	ranks := make(map[string]int, len(addrs))
+	for _, addr := range addrs {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return ips
+		}
+		family := v1.IPv4Protocol
+		if ip.Is6() {
+			family = v1.IPv6Protocol
+		}
+		ranks[addr] = rank(family)
+	}
+	slices.SortStableFunc(addrs, func(a, b string) int {
+		return ranks[a] - ranks[b]
+	})
+	return strings.Join(addrs, ",")
+}
+
+// setServiceInterface sets the service interface annotation of the service, and keeps the replaced interface in the
+// previous interface annotation if it changed. The annotations of the service must not be nil.
+func setServiceInterface(service *v1.Service, iface string) {
+	if previous := service.Annotations[LoadbalancerServiceInterfaceAnnotationKey]; len(previous) > 0 && previous != iface {
+		klog.Infof("service '%s/%s' interface changes from [%s] to [%s]", service.Namespace, service.Name, previous, iface)
+		service.Annotations[PreviousInterfaceAnnotationKey] = previous
+	}
+	service.Annotations[LoadbalancerServiceInterfaceAnnotationKey] = iface
+}
+
+// checkPoolCapacity warns if the services of the namespace hold more distinct addresses than the pool can hold,
+// which means pools overlap or services hold stale addresses
+func checkPoolCapacity(service *v1.Service, pool string, svcs *v1.ServiceList) {
+	if len(pool) == 0 || pool == DHCPPool {
+		return
+	}
+	size, err := ipam.PoolSize(pool)
+	if err != nil {
+		return
+	}
+
+	inUse := map[netip.Addr]struct{}{}
+	for x := range svcs.Items {
+		if svcs.Items[x].Namespace != service.Namespace {
+			continue
+		}
+		addrs, err := parseAddrList(svcs.Items[x].Annotations[LoadbalancerIPsAnnotation])
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if !addr.IsUnspecified() {
+				inUse[addr] = struct{}{}
+			}
+		}
+	}
+
+	if big.NewInt(int64(len(inUse))).Cmp(size) <= 0 {
+		return
+	}
+	klog.Warningf("services of namespace [%s] hold %d addresses, more than the %s addresses of pool [%s], pools may overlap or services hold stale addresses",
+		service.Namespace, len(inUse), size, pool)
+	recordEventf(service, v1.EventTypeWarning, "InUseExceedsPoolSize", "Services of namespace %s hold %d addresses, more than the %s addresses of pool [%s]",
+		service.Namespace, len(inUse), size, pool)
+}
+
+// poolFreeCount returns the number of addresses of the pool still free once the IPs are allocated, "" if the pool
+// is DHCP or can't be counted
+func poolFreeCount(pool string, inUseSet *netipx.IPSet, ips string) string {
+	if len(pool) == 0 || pool == DHCPPool || inUseSet == nil {
+		return ""
+	}
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return ""
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for _, addr := range addrs {
+		builder.Add(addr)
+	}
+	allocatedSet, err := builder.IPSet()
+	if err != nil {
+		return ""
+	}
+	free, err := ipam.FreeCount(pool, allocatedSet)
+	if err != nil {
+		return ""
+	}
+	return free.String()
+}
+
+// ipZone returns the zone of the first IP whose pool entry has a zone in its metadata, "" if none has
+func ipZone(pool, ips string) string {
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		metadata, err := ipam.AddressMetadata(pool, addr)
+		if err != nil {
+			klog.Warningf("unable to find the zone of IP [%s] in pool [%s]: %v", addr, pool, err)
+			continue
+		}
+		if zone := metadata[ipam.ZoneMetadataKey]; len(zone) > 0 {
+			return zone
+		}
+	}
+	return ""
+}
+
+// notifyAllocation writes the allocation record of the IPs allocated to the service from the pool, "" if they weren't
+// allocated from a pool, and sends them to the webhook if configured
+func notifyAllocation(service *v1.Service, ips, pool string) {
+	trackImplementedService(service)
+	writeAllocationRecord(service, ips, pool)
+	allocationNotifier.Notify(webhook.Payload{
+		Service:   service.Name,
+		Namespace: service.Namespace,
+		IP:        ips,
+		Action:    webhook.ActionAllocate,
+	})
+}
+
+// notifyRelease writes the release record of the IPs of the service, records the IPs released by the service for the
+// cross-namespace cooldown, and sends them to the webhook if configured. The IPs still shared with other services stay
+// in use and aren't released.
+func notifyRelease(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service) {
+	writeReleaseRecord(service)
+	ips := releasedIPs(ctx, kubeClient, service)
+	if len(ips) == 0 {
+		return
+	}
+	recordRelease(ips, service.Namespace, service.Name)
+	allocationNotifier.Notify(webhook.Payload{
+		Service:   service.Name,
+		Namespace: service.Namespace,
+		IP:        ips,
+		Action:    webhook.ActionRelease,
+	})
+}
+
+// releasedIPs returns the IPs of the service that no other service holds, "" if there are none
+func releasedIPs(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service) string {
+	addrs, err := parseAddrList(service.Annotations[LoadbalancerIPsAnnotation])
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	svcs, err := listInUseServices(ctx, kubeClient, "")
+	if err != nil {
+		klog.Warningf("unable to list services to check the IPs of service '%s/%s' are still shared: %v", service.Namespace, service.Name, err)
+		return service.Annotations[LoadbalancerIPsAnnotation]
+	}
+	others := &v1.ServiceList{}
+	for x := range svcs.Items {
+		if svcs.Items[x].Namespace != service.Namespace || svcs.Items[x].Name != service.Name {
+			others.Items = append(others.Items, svcs.Items[x])
+		}
+	}
+	inUseSet, _, err := mapImplementedServices(others, false)
+	if err != nil {
+		return service.Annotations[LoadbalancerIPsAnnotation]
+	}
+
+	released := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if inUseSet.Contains(addr) {
+			klog.Infof("IP [%s] of service '%s/%s' is still shared with other services, it isn't released", addr, service.Namespace, service.Name)
+			continue
+		}
+		released = append(released, addr.String())
+	}
+	return strings.Join(released, ",")
+}
+
+// allocationStrategy returns how the given IPs were obtained
+func allocationStrategy(vips, preferredIpv4ServiceIP string, kubevipLBConfig *config.KubevipLBConfig) string {
+	if vips == "0.0.0.0" {
+		return AllocationStrategyDHCP
+	}
+	if len(preferredIpv4ServiceIP) > 0 {
+		for _, vip := range strings.Split(vips, ",") {
+			if vip == preferredIpv4ServiceIP {
+				return AllocationStrategyShared
+			}
+		}
+	}
+	if kubevipLBConfig != nil && kubevipLBConfig.ReturnIPInDescOrder {
+		return AllocationStrategyDesc
+	}
+	return AllocationStrategyAsc
+}
+
+// getConfigWithNamespace returns the config of the namespace, the key scoped to the cluster, e.g. cidr-<cluster>-<namespace>,
+// takes precedence over the unscoped one
+func getConfigWithNamespace(cm *v1.ConfigMap, namespace, name string) (value, key string, err error) {
+	if len(config.ClusterName) > 0 {
+		scoped := config.ClusterScopedName(name)
+		if value, key, err := getConfigWithKey(cm, config.NamespaceKey(scoped, namespace), scoped); err == nil {
+			return value, key, nil
+		}
+	}
+	return getConfigWithKey(cm, config.NamespaceKey(name, namespace), name)
+}
+
+// getGlobalConfig returns the global config, the key scoped to the cluster, e.g. cidr-<cluster>-global, takes precedence
+// over the unscoped one
+func getGlobalConfig(cm *v1.ConfigMap, name string) (value, key string, err error) {
+	if len(config.ClusterName) > 0 {
+		scoped := config.ClusterScopedName(name)
+		if value, key, err := getConfigWithKey(cm, config.GlobalKey(scoped), scoped); err == nil {
+			return value, key, nil
+		}
+	}
+	value, key, ok := config.Lookup(cm, name, config.GlobalKey(name))
+	if !ok {
+		return "", key, fmt.Errorf("no config for %s", name)
+	}
+	return value, key, nil
+}
+
+// discoverGlobalBool returns the boolean value of the global config name, false if it isn't set or isn't a boolean
+func discoverGlobalBool(cm *v1.ConfigMap, name string) bool {
+	valueStr, key, err := getGlobalConfig(cm, name)
+	if err != nil {
+		return false
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		klog.Warningf("invalid value [%s] in [%s], expected a boolean, ignoring it", valueStr, key)
+		return false
+	}
+	return value
+}
+
+// discoverGlobalEnum returns the value of the global config name if it is one of values, the first value is the
+// default returned if it isn't set or is unknown
+func discoverGlobalEnum(cm *v1.ConfigMap, name string, values ...string) string {
+	value, key, err := getGlobalConfig(cm, name)
+	if err != nil {
+		return values[0]
+	}
+	if slices.Contains(values, value) {
+		return value
+	}
+	expected := strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+	klog.Warningf("unknown value [%s] in [%s], expected %s, defaulting to %s", value, key, expected, values[0])
+	return values[0]
+}
+
+func getConfigWithKey(cm *v1.ConfigMap, key, name string) (string, string, error) {
+	value, key, ok := config.Lookup(cm, name, key)
+	if !ok {
+		return "", key, fmt.Errorf("no config for %s", name)
+	}
+
+	return value, key, nil
+}
+
+// configLogged holds the config lookup messages already logged at the default verbosity, the lookups run on every
+// reconcile so repeating them would flood the logs of a busy cluster
+var configLogged sync.Map
+
+// logConfigOnce logs the config lookup message at the default verbosity the first time, then at verbosity 3
+func logConfigOnce(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if _, logged := configLogged.LoadOrStore(msg, struct{}{}); logged {
+		klog.V(3).Info(msg)
+		return
+	}
+	klog.Info(msg)
+}
+
+// skipEmptyPool returns an error if the value of a cidr or range key is empty, so an accidentally blanked key falls back
+// to the next pool instead of failing the allocation
+func skipEmptyPool(name, value, key string, err error) error {
+	if err != nil || (name != "cidr" && name != "range") || len(strings.TrimSpace(value)) > 0 {
+		return err
+	}
+	klog.Warningf("config key [%s] is empty, ignoring it", key)
+	return fmt.Errorf("empty config for %s", name)
+}
+
+func getConfig(cm *v1.ConfigMap, namespace, configMapName, name, configType string) (value string, global bool, err error) {
+	var key string
+
+	value, key, err = getConfigWithNamespace(cm, namespace, name)
+	err = skipEmptyPool(name, value, key, err)
+	if err != nil {
+		logConfigOnce("no %s config for namespace [%s] exists in key [%s] configmap [%s]", name, namespace, key, configMapName)
+		value, key, err = getGlobalConfig(cm, name)
+		err = skipEmptyPool(name, value, key, err)
+		if err != nil {
+			logConfigOnce("no global %s config exists [%s]", name, key)
+		} else {
+			logConfigOnce("Taking %s from [%s]", configType, key)
+			return value, true, nil
+		}
+	} else {
+		logConfigOnce("Taking %s from [%s]", configType, key)
+		return value, false, nil
+	}
+
+	return "", false, fmt.Errorf("no config for %s", name)
+}
+
+func discoverPool(cm *v1.ConfigMap, namespace, configMapName string) (pool string, global bool, allowShare bool, err error) {
+	var allowShareStr string
+
+	// The pools of the Secret are consulted too
+	cm = withConfigSecretPools(cm)
+
+	// Check for VIP sharing
+	allowShareStr, _, err = getConfig(cm, namespace, configMapName, "allow-share", "config")
+	if err == nil {
+		allowShare, _ = strconv.ParseBool(allowShareStr)
+	}
+
+	// Check if the namespace is in DHCP mode
+	if dhcp, key, dhcpErr := getConfigWithNamespace(cm, namespace, "dhcp"); dhcpErr == nil {
+		enabled, parseErr := strconv.ParseBool(dhcp)
+		if parseErr != nil {
+			klog.Warningf("invalid value [%s] in [%s], expected a boolean, ignoring it", dhcp, key)
+		} else if enabled {
+			klog.Infof("Taking address from [%s], namespace [%s] is in DHCP mode", key, namespace)
+			return DHCPPool, false, allowShare, nil
+		}
+	}
+
+	// Union the suffixed keys of the namespace, cidr-<namespace>-*
+	if discoverMultiKeyPools(cm) {
+		for _, name := range []string{"cidr", "range"} {
+			if pool, keys := getMultiKeyNamespaceConfig(cm, namespace, name); len(keys) > 0 {
+				klog.Infof("Taking address from %v in configmap [%s] for namespace [%s]", keys, configMapName, namespace)
+				return pool, false, allowShare, nil
+			}
+		}
+	}
+
+	// Any pool of the namespace, cidr, range or allowlist, takes precedence over the global pools
+	if pool, err := lookupPool(cm, namespace, configMapName, false); err == nil {
+		return pool, false, allowShare, nil
+	}
+	if pool, err := lookupPool(cm, namespace, configMapName, true); err == nil {
+		return pool, true, allowShare, nil
+	}
+
+	if !hasAnyPool(cm) {
+		return "", false, allowShare, &NoPoolsDefinedError{ConfigMap: cm.Name}
+	}
+	return "", false, allowShare, &NoNamespacePoolError{Namespace: namespace, ConfigMap: cm.Name}
+}
+
+// NoPoolsDefinedError is returned when the ConfigMap has no pool at all, neither for a namespace nor global
+type NoPoolsDefinedError struct {
+	ConfigMap string
+}
+
+func (e *NoPoolsDefinedError) Error() string {
+	return fmt.Sprintf("configmap [%s] has no pools defined", e.ConfigMap)
+}
+
+// NoNamespacePoolError is returned when the ConfigMap has pools, but none for the namespace and no global one
+type NoNamespacePoolError struct {
+	Namespace string
+	ConfigMap string
+}
+
+func (e *NoNamespacePoolError) Error() string {
+	return fmt.Sprintf("no pool for namespace [%s] and no global pool in configmap [%s]", e.Namespace, e.ConfigMap)
+}
+
+// recordPoolError emits an event telling apart a ConfigMap without any pool from a namespace without a pool
+func recordPoolError(service *v1.Service, err error) {
+	var noPoolsErr *NoPoolsDefinedError
+	var noNamespacePoolErr *NoNamespacePoolError
+	switch {
+	case errors.As(err, &noPoolsErr):
+		recordEventf(service, v1.EventTypeWarning, "NoPoolsDefined", "ConfigMap %s has no pools defined", noPoolsErr.ConfigMap)
+	case errors.As(err, &noNamespacePoolErr):
+		recordEventf(service, v1.EventTypeWarning, "NoPoolForNamespace", "No pool for namespace %s and no global pool in ConfigMap %s",
+			noNamespacePoolErr.Namespace, noNamespacePoolErr.ConfigMap)
+	}
+}
+
+// poolConfigNames are the config names of the keys defining a pool
+var poolConfigNames = []string{"cidr", "range", "allow"}
+
+// hasAnyPool returns true if the ConfigMap defines a pool for any namespace, a global pool or a DHCP namespace
+func hasAnyPool(cm *v1.ConfigMap) bool {
+	for key, value := range cm.Data {
+		if len(value) == 0 {
+			continue
+		}
+		if isPoolKey(key) {
+			return true
+		}
+		if strings.HasPrefix(key, "dhcp-") || strings.HasPrefix(key, "dhcp"+config.NamespaceKeyDelimiter) {
+			if enabled, _ := strconv.ParseBool(value); enabled {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupPool returns the first pool of the namespace, or the first global pool, in the order of poolConfigNames.
+// An allowlist lists exactly the allocatable addresses and ranges, e.g. 10.0.0.50,10.0.0.60-10.0.0.65, it is returned
+// as ranges.
+func lookupPool(cm *v1.ConfigMap, namespace, configMapName string, global bool) (string, error) {
+	for _, name := range poolConfigNames {
+		var value, key string
+		var err error
+		if global {
+			value, key, err = getGlobalConfig(cm, name)
+		} else {
+			value, key, err = getConfigWithNamespace(cm, namespace, name)
+		}
+		if err = skipEmptyPool(name, value, key, err); err != nil {
+			if global {
+				logConfigOnce("no global %s config exists [%s]", name, key)
+			} else {
+				logConfigOnce("no %s config for namespace [%s] exists in key [%s] configmap [%s]", name, namespace, key, configMapName)
+			}
+			continue
+		}
+		logConfigOnce("Taking address from [%s]", key)
+		if name == "allow" {
+			return allowlistRanges(value), nil
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("no pool config")
+}
+
+// isAllowlistPool returns true if the pool is the allowlist of the namespace or the global allowlist,
+// every address of an allowlist is allocatable, even those ending in .0 or .255
+func isAllowlistPool(cm *v1.ConfigMap, namespace, pool string) bool {
+	cm = withConfigSecretPools(cm)
+	allowlist, _, err := getConfigWithNamespace(cm, namespace, "allow")
+	if err != nil {
+		allowlist, _, err = getGlobalConfig(cm, "allow")
+	}
+	return err == nil && len(pool) > 0 && allowlistRanges(allowlist) == pool
+}
+
+// allowlistRanges turns the single addresses of an allowlist into ranges of one address, the metadata of the addresses
+// is kept, e.g. 10.0.0.50#zone=a becomes 10.0.0.50-10.0.0.50#zone=a
+func allowlistRanges(allowlist string) string {
+	entries := strings.Split(allowlist, ",")
+	for x := range entries {
+		entry, metadata, hasMetadata := strings.Cut(strings.TrimSpace(entries[x]), "#")
+		if !strings.Contains(entry, "-") {
+			entry = entry + "-" + entry
+		}
+		if hasMetadata {
+			entry += "#" + metadata
+		}
+		entries[x] = entry
+	}
+	return strings.Join(entries, ",")
+}
+
+// discoverPoolForNamespace returns the pool of the namespace, a namespace pool takes precedence over a pool
+// selected by namespace labels (namespace-selector-<pool>), which takes precedence over the global pool.
+// A selected pool is shared by several namespaces so it is reported as global.
+func discoverPoolForNamespace(cm *v1.ConfigMap, namespace string, namespaceLabels map[string]string, configMapName string) (pool string, global bool, allowShare bool, err error) {
+	if !hasNamespacePool(cm, namespace) {
+		if poolName := discoverSelectedPool(cm, namespaceLabels); len(poolName) > 0 {
+			klog.Infof("namespace [%s] selects pool [%s] from configmap [%s]", namespace, poolName, configMapName)
+			pool, _, allowShare, err = discoverPool(cm, poolName, configMapName)
+			return pool, true, allowShare, err
+		}
+	}
+	return discoverPool(cm, namespace, configMapName)
+}
+
+// discoverRegionalPool returns the regional pool of the region, cidr-region-<region> or range-region-<region> of the namespace
+// or global, and falls back to the pool of the namespace if the region is empty or has no pool.
+func discoverRegionalPool(cm *v1.ConfigMap, namespace, region string, namespaceLabels map[string]string, configMapName string) (pool string, global bool, allowShare bool, err error) {
+	pool, global, allowShare, err = discoverPoolForNamespace(cm, namespace, namespaceLabels, configMapName)
+	if len(region) == 0 {
+		return pool, global, allowShare, err
+	}
+
+	for _, name := range []string{"cidr", "range"} {
+		regionalPool, regionalGlobal, regionErr := getConfig(cm, namespace, configMapName, name+"-"+RegionPoolPrefix+region, "address")
+		if regionErr == nil {
+			return regionalPool, regionalGlobal, allowShare, nil
+		}
+	}
+	klog.Infof("no pool for region [%s] in configmap [%s], taking the pool of namespace [%s]", region, configMapName, namespace)
+	return pool, global, allowShare, err
+}
+
+// RegionPoolFamilyError is returned when the regional pool of a service doesn't serve the IP families it requires
+type RegionPoolFamilyError struct {
+	Region string
+	Pool   string
+	Err    error
+}
+
+func (e *RegionPoolFamilyError) Error() string {
+	return fmt.Sprintf("pool [%s] of region [%s] doesn't serve the IP families of the service: %v", e.Pool, e.Region, e.Err)
+}
+
+func (e *RegionPoolFamilyError) Unwrap() error {
+	return e.Err
+}
+
+// discoverServicePool returns the pool of the service, the regional pool of its kube-vip.io/region annotation or the
+// pool of its namespace. If the regional pool doesn't serve the IP families the service requires, the service fails or
+// falls back to the pool of its namespace, following region-family-mismatch-<namespace> or region-family-mismatch-global.
+func discoverServicePool(cm *v1.ConfigMap, service *v1.Service, namespaceLabels map[string]string, configMapName string) (pool string, global bool, allowShare bool, err error) {
+	region := service.Annotations[RegionAnnotationKey]
+	pool, global, allowShare, err = discoverRegionalPool(cm, service.Namespace, region, namespaceLabels, configMapName)
+	if err != nil || len(region) == 0 || pool == DHCPPool {
+		return pool, global, allowShare, err
+	}
+	namespacePool, namespaceGlobal, namespaceAllowShare, namespaceErr := discoverPoolForNamespace(cm, service.Namespace, namespaceLabels, configMapName)
+	if namespaceErr == nil && namespacePool == pool {
+		// the region has no pool
+		return pool, global, allowShare, nil
+	}
+
+	ipFamilyPolicy := service.Spec.IPFamilyPolicy
+	if ipFamilyPolicy == nil {
+		ipFamilyPolicy = discoverDefaultIPFamilyPolicy(cm, service.Namespace, configMapName)
+	}
+	familyErr := poolFamilyError(pool, ipFamilyPolicy, service.Spec.IPFamilies)
+	if familyErr == nil {
+		return pool, global, allowShare, nil
+	}
+
+	mismatchErr := &RegionPoolFamilyError{Region: region, Pool: pool, Err: familyErr}
+	if namespaceErr == nil && discoverRegionFamilyMismatch(cm, service.Namespace, configMapName) == RegionFamilyMismatchFallback {
+		klog.Warningf("service '%s/%s': %v, taking the pool of namespace [%s]", service.Namespace, service.Name, mismatchErr, service.Namespace)
+		recordEventf(service, v1.EventTypeWarning, "RegionPoolFamilyMismatch", "%v, taking the pool of namespace %s", mismatchErr, service.Namespace)
+		return namespacePool, namespaceGlobal, namespaceAllowShare, nil
+	}
+	klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, mismatchErr)
+	recordEventf(service, v1.EventTypeWarning, "RegionPoolFamilyMismatch", "%v", mismatchErr)
+	return "", false, false, mismatchErr
+}
+
+// poolFamilyError returns an error if the pool doesn't serve the IP families required by the policy: both families for
+// RequireDualStack, the first family of ipFamilies (IPv4 if unset) otherwise
+func poolFamilyError(pool string, ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily) error {
+	var ipv4Pool, ipv6Pool string
+	var err error
+	if ipam.IsCidrPool(pool) {
+		ipv4Pool, ipv6Pool, err = ipam.SplitCIDRsByIPFamily(pool)
+	} else {
+		ipv4Pool, ipv6Pool, err = ipam.SplitRangesByIPFamily(pool)
+	}
+	if err != nil {
+		// the allocation reports the invalid pool
+		return nil
+	}
+
+	if ipFamilyPolicy != nil && *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
+		if len(ipv4Pool) == 0 || len(ipv6Pool) == 0 {
+			return newDualStackPoolMismatchError(ipv4Pool, ipv6Pool)
+		}
+		return nil
+	}
+	family := v1.IPv4Protocol
+	if len(ipFamilies) > 0 {
+		family = ipFamilies[0]
+	}
+	if (family == v1.IPv4Protocol && len(ipv4Pool) == 0) || (family == v1.IPv6Protocol && len(ipv6Pool) == 0) {
+		return &NoFamilyPoolError{Family: family}
+	}
+	return nil
+}
+
+// discoverRegionFamilyMismatch returns the value of region-family-mismatch-<namespace> or region-family-mismatch-global,
+// RegionFamilyMismatchError if it is unset or invalid
+func discoverRegionFamilyMismatch(cm *v1.ConfigMap, namespace, configMapName string) string {
+	mismatch, _, err := getConfig(cm, namespace, configMapName, "region-family-mismatch", "config")
+	if err != nil {
+		return RegionFamilyMismatchError
+	}
+	mismatch = strings.ToLower(strings.TrimSpace(mismatch))
+	if mismatch != RegionFamilyMismatchError && mismatch != RegionFamilyMismatchFallback {
+		klog.Warningf("invalid region family mismatch handling [%s] in configmap [%s], expected %s or %s, using %s", mismatch, configMapName,
+			RegionFamilyMismatchError, RegionFamilyMismatchFallback, RegionFamilyMismatchError)
+		return RegionFamilyMismatchError
+	}
+	return mismatch
+}
+
+// hasNamespacePool returns true if a cidr, range or DHCP mode is configured for the namespace
+func hasNamespacePool(cm *v1.ConfigMap, namespace string) bool {
+	if dhcp, _, err := getConfigWithNamespace(cm, namespace, "dhcp"); err == nil {
+		if enabled, _ := strconv.ParseBool(dhcp); enabled {
+			return true
+		}
+	}
+	if discoverMultiKeyPools(cm) {
+		for _, name := range []string{"cidr", "range"} {
+			if _, keys := getMultiKeyNamespaceConfig(cm, namespace, name); len(keys) > 0 {
+				return true
+			}
+		}
+	}
+	if _, _, err := getConfigWithNamespace(cm, namespace, "cidr"); err == nil {
+		return true
+	}
+	if _, _, err := getConfigWithNamespace(cm, namespace, "range"); err == nil {
+		return true
+	}
+	_, _, err := getConfigWithNamespace(cm, namespace, "allow")
+	return err == nil
+}
+
+// getMultiKeyNamespaceConfig returns the union of <name>-<namespace> and the suffixed <name>-<namespace>-* keys,
+// and the keys it was built from, sorted
+func getMultiKeyNamespaceConfig(cm *v1.ConfigMap, namespace, name string) (value string, keys []string) {
+	key := config.NamespaceKey(name, namespace)
+	for k := range cm.Data {
+		if k == key || strings.HasPrefix(k, key+"-") {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, cm.Data[k])
+	}
+	return strings.Join(values, ","), keys
+}
+
+// namespaceSelectorPools returns the pool names with a namespace selector, sorted so the first match is stable
+func namespaceSelectorPools(cm *v1.ConfigMap) []string {
+	var pools []string
+	for key := range cm.Data {
+		if poolName, ok := strings.CutPrefix(key, NamespaceSelectorPrefix); ok && len(poolName) > 0 {
+			pools = append(pools, poolName)
+		}
+	}
+	slices.Sort(pools)
+	return pools
+}
+
+// discoverSelectedPool returns the name of the first pool whose namespace-selector-<pool> matches the namespace labels
+func discoverSelectedPool(cm *v1.ConfigMap, namespaceLabels map[string]string) string {
+	for _, poolName := range namespaceSelectorPools(cm) {
+		selector, err := labels.Parse(cm.Data[NamespaceSelectorPrefix+poolName])
+		if err != nil {
+			klog.Warningf("invalid namespace selector in [%s%s]: %v", NamespaceSelectorPrefix, poolName, err)
+			continue
+		}
+		if selector.Matches(labels.Set(namespaceLabels)) {
+			return poolName
+		}
+	}
+	return ""
+}
+
+// getNamespaceLabels returns the labels of the namespace if the configmap selects pools by namespace labels
+func getNamespaceLabels(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, namespace string) (map[string]string, error) {
+	if len(namespaceSelectorPools(cm)) == 0 {
+		return nil, nil
 	}
-
-	svcs, err := kubeClient.CoreV1().Services(serviceNamespace).List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	ns, err := kubeClient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
 	if err != nil {
-		return &service.Status.LoadBalancer, err
+		return nil, fmt.Errorf("unable to get namespace [%s] to select its pool: %v", namespace, err)
 	}
+	return ns.Labels, nil
+}
 
-	inUseSet, servicePortMap, err := mapImplementedServices(svcs, allowShare)
-	if err != nil {
-		return nil, err
+// discoverUsableRange returns the usable range matching the pool, usable-<namespace> for a
+// namespace pool or usable-global for the global pool
+func discoverUsableRange(cm *v1.ConfigMap, namespace string, global bool) string {
+	var usable string
+	if global {
+		usable, _, _ = getGlobalConfig(cm, "usable")
+	} else {
+		usable, _, _ = getConfigWithNamespace(cm, namespace, "usable")
 	}
+	return usable
+}
 
-	kubevipLBConfig := config.GetKubevipLBConfig(controllerCM)
+// discoverInvalidLoadBalancerIPPending returns true if invalid-loadbalancer-ip-behavior-global is pending,
+// services with an invalid spec.loadBalancerIP are then left pending instead of getting an address from the pool
+func discoverInvalidLoadBalancerIPPending(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "invalid-loadbalancer-ip-behavior", InvalidLoadBalancerIPBehaviorAllocate, InvalidLoadBalancerIPBehaviorPending) == InvalidLoadBalancerIPBehaviorPending
+}
 
-	preferredIpv4ServiceIP := ""
+// discoverEmptyPoolDHCP returns true if empty-pool-behavior-global is dhcp, services without a pool
+// are then assigned DHCP (0.0.0.0) instead of failing
+func discoverEmptyPoolDHCP(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "empty-pool-behavior", EmptyPoolBehaviorError, EmptyPoolBehaviorDHCP) == EmptyPoolBehaviorDHCP
+}
 
-	if allowShare {
-		preferredIpv4ServiceIP = discoverSharedVIPs(service, servicePortMap)
+// discoverPreferredIPs returns the ordered list of preferred IPs from preferred-<namespace> or preferred-global
+func discoverPreferredIPs(cm *v1.ConfigMap, namespace, configMapName string) []string {
+	preferred, _, err := getConfig(cm, namespace, configMapName, "preferred", "config")
+	if err != nil || len(preferred) == 0 {
+		return nil
 	}
+	return strings.Split(preferred, ",")
+}
 
-	// If allowedShare is true but no IP could be shared, or allowedShare is false, switch to use IPAM lookup
-	loadBalancerIPs, err := discoverVIPs(service.Namespace, pool, preferredIpv4ServiceIP, inUseSet, kubevipLBConfig, service.Spec.IPFamilyPolicy, service.Spec.IPFamilies)
+// discoverProbeBeforeAssign returns true if addresses should be probed on the network before being assigned
+func discoverProbeBeforeAssign(cm *v1.ConfigMap, namespace, configMapName string) bool {
+	probeStr, _, err := getConfig(cm, namespace, configMapName, "probe-before-assign", "config")
 	if err != nil {
-		return nil, err
+		return false
 	}
+	probe, _ := strconv.ParseBool(probeStr)
+	return probe
+}
 
-	// Get the loadbalancer interface if it's defined for the namespace
-	var loadbalancerInterface string
-	if len(loadBalancerIPs) > 0 {
-		loadbalancerInterface = discoverInterface(controllerCM, service.Namespace)
+// discoverMaxServicesPerIP returns the maximum number of services sharing an IP from max-services-per-ip-global,
+// 0 means there is no limit
+func discoverMaxServicesPerIP(cm *v1.ConfigMap) int {
+	maxStr, key, err := getGlobalConfig(cm, "max-services-per-ip")
+	if err != nil {
+		return 0
 	}
+	maxServices, err := strconv.Atoi(maxStr)
+	if err != nil || maxServices < 0 {
+		klog.Warningf("invalid value [%s] in [%s], expected a positive number, ignoring the limit", maxStr, key)
+		return 0
+	}
+	return maxServices
+}
 
-	// Update the services with this new address
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
-		if getErr != nil {
-			return getErr
-		}
-
-		klog.Infof("Updating service [%s], with load balancer IPAM address(es) [%s]", service.Name, loadBalancerIPs)
-
-		if recentService.Labels == nil {
-			// Just because ..
-			recentService.Labels = make(map[string]string)
-		}
-		// Set Label for service lookups
-		recentService.Labels[ImplementationLabelKey] = ImplementationLabelValue
+// discoverAllocationStride returns allocation-stride-global, only every Nth address of the pool ranges is then
+// allocated, 1 if it isn't set or invalid
+func discoverAllocationStride(cm *v1.ConfigMap) int {
+	strideStr, key, err := getGlobalConfig(cm, "allocation-stride")
+	if err != nil {
+		return 1
+	}
+	stride, err := strconv.Atoi(strideStr)
+	if err != nil || stride < 1 {
+		klog.Warningf("invalid value [%s] in [%s], expected a positive number, allocating every address", strideStr, key)
+		return 1
+	}
+	return stride
+}
 
-		if recentService.Annotations == nil {
-			recentService.Annotations = make(map[string]string)
+// discoverOverflowPool returns the global pool if overflow-to-global-<namespace> is true, the namespace then takes
+// its addresses from the global pool once its own pool is exhausted
+func discoverOverflowPool(cm *v1.ConfigMap, namespace string) string {
+	overflowStr, key, err := getConfigWithNamespace(cm, namespace, "overflow-to-global")
+	if err != nil {
+		return ""
+	}
+	overflow, err := strconv.ParseBool(overflowStr)
+	if err != nil {
+		klog.Warningf("invalid value [%s] in [%s], expected a boolean, ignoring it", overflowStr, key)
+		return ""
+	}
+	if !overflow {
+		return ""
+	}
+	for _, name := range []string{"cidr", "range"} {
+		if pool, _, err := getGlobalConfig(cm, name); err == nil {
+			return pool
 		}
-		// use annotation to specify static IP, instead of spec.LoadbalancerIP, to support IPv6 dualstack.
-		recentService.Annotations[LoadbalancerIPsAnnotation] = loadBalancerIPs
-
-		// this line will be removed once kube-vip can recognize annotations
-		// Set IPAM address to Load Balancer Service
-		recentService.Spec.LoadBalancerIP = strings.Split(loadBalancerIPs, ",")[0]
+	}
+	klog.Warningf("[%s] is true but there is no global pool to overflow to", key)
+	return ""
+}
 
-		if len(loadbalancerInterface) > 0 {
-			klog.Infof("Updating service [%s], with load balancer interface [%s]", service.Name, loadbalancerInterface)
-			recentService.Annotations[LoadbalancerServiceInterfaceAnnotationKey] = loadbalancerInterface
-		}
+// discoverLegacyIPPreferIPv4 returns true if legacy-ip-prefer-ipv4-global is true, the spec.loadBalancerIP of a
+// dual-stack service is then its IPv4 IP instead of its primary IP
+func discoverLegacyIPPreferIPv4(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "legacy-ip-prefer-ipv4")
+}
 
-		// Update the actual service with the address and the labels
-		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, retryErr)
+// discoverLegacyLBIPFamily returns legacy-lbip-family-global, ipv4, primary or none, which selects the IP of a
+// dual-stack service set in spec.loadBalancerIP. Without it, legacy-ip-prefer-ipv4-global set to true selects ipv4.
+func discoverLegacyLBIPFamily(cm *v1.ConfigMap) string {
+	if _, _, err := getGlobalConfig(cm, "legacy-lbip-family"); err != nil && discoverLegacyIPPreferIPv4(cm) {
+		return LegacyLBIPFamilyIPv4
 	}
-
-	return &service.Status.LoadBalancer, nil
+	return discoverGlobalEnum(cm, "legacy-lbip-family", LegacyLBIPFamilyPrimary, LegacyLBIPFamilyIPv4, LegacyLBIPFamilyNone)
 }
 
-func getConfigWithNamespace(cm *v1.ConfigMap, namespace, name string) (value, key string, err error) {
-	var ok bool
+// discoverRejectPortlessLB returns true if reject-portless-lb-global is true, the services without ports then get no
+// address instead of a dedicated address that isn't shared
+func discoverRejectPortlessLB(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "reject-portless-lb")
+}
 
-	key = fmt.Sprintf("%s-%s", name, namespace)
+// discoverRejectReservedRanges returns true if reject-reserved-ranges-global is true, the addresses of the well-known
+// reserved ranges of a pool, e.g. multicast or loopback, are then never allocated
+func discoverRejectReservedRanges(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "reject-reserved-ranges")
+}
 
-	if value, ok = cm.Data[key]; !ok {
-		return "", key, fmt.Errorf("no config for %s", name)
+// discoverExcludedIPs returns the addresses of exclude-ips-<namespace> or exclude-ips-global as ranges, e.g.
+// 10.0.0.5,10.0.0.10-10.0.0.12, they are never allocated from the pool. An invalid list is ignored with a warning.
+func discoverExcludedIPs(cm *v1.ConfigMap, namespace string) string {
+	excluded, key, err := getConfigWithNamespace(cm, namespace, "exclude-ips")
+	if err != nil {
+		excluded, key, err = getGlobalConfig(cm, "exclude-ips")
+	}
+	if err != nil || len(excluded) == 0 {
+		return ""
+	}
+	ranges := allowlistRanges(excluded)
+	if _, err := ipam.PoolSize(ranges); err != nil {
+		klog.Warningf("invalid value [%s] in [%s], expected addresses or ranges, ignoring it: %v", excluded, key, err)
+		return ""
 	}
+	return ranges
+}
 
-	return value, key, nil
+// discoverMultiKeyPools returns true if multi-key-pools-global is true, the pool of a namespace is then the union
+// of cidr-<namespace> and cidr-<namespace>-* (or range-<namespace> and range-<namespace>-*)
+func discoverMultiKeyPools(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "multi-key-pools")
 }
 
-func getConfig(cm *v1.ConfigMap, namespace, configMapName, name, configType string) (value string, global bool, err error) {
-	var key string
+// discoverExcludeOwnServices returns true if exclude-own-service-global is true
+func discoverExcludeOwnServices(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "exclude-own-service")
+}
 
-	value, key, err = getConfigWithNamespace(cm, namespace, name)
+// excludeOwnServices adds the IPs of the services in the controller namespace to the in-use set,
+// so the addresses used by the controller itself are never allocated
+func excludeOwnServices(ctx context.Context, kubeClient kubernetes.Interface, namespace string, inUseSet *netipx.IPSet) (*netipx.IPSet, error) {
+	svcs, err := kubeClient.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
-		klog.Info(fmt.Errorf("no %s config for namespace [%s] exists in key [%s] configmap [%s]", name, namespace, key, configMapName))
-		value, key, err = getConfigWithNamespace(cm, "global", name)
-		if err != nil {
-			klog.Info(fmt.Errorf("no global %s config exists [%s]", name, key))
-		} else {
-			klog.Infof("Taking %s from [%s]", configType, key)
-			return value, true, nil
-		}
-	} else {
-		klog.Infof("Taking %s from [%s]", configType, key)
-		return value, false, nil
+		return nil, err
 	}
 
-	return "", false, fmt.Errorf("no config for %s", name)
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for x := range svcs.Items {
+		for _, ip := range serviceIPs(&svcs.Items[x]) {
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				klog.V(ipam.TraceLevel).Infof("excluding address %s of service '%s/%s'", addr, namespace, svcs.Items[x].Name)
+				builder.Add(addr)
+			}
+		}
+	}
+	return builder.IPSet()
 }
 
-func discoverPool(cm *v1.ConfigMap, namespace, configMapName string) (pool string, global bool, allowShare bool, err error) {
-	var cidr, ipRange, allowShareStr string
-
-	// Check for VIP sharing
-	allowShareStr, _, err = getConfig(cm, namespace, configMapName, "allow-share", "config")
-	if err == nil {
-		allowShare, _ = strconv.ParseBool(allowShareStr)
+// serviceIPs returns all the IPs of the service: cluster, external, load balancer and ingress IPs
+func serviceIPs(svc *v1.Service) []string {
+	ips := append([]string{}, svc.Spec.ClusterIPs...)
+	ips = append(ips, svc.Spec.ExternalIPs...)
+	if len(svc.Spec.LoadBalancerIP) > 0 {
+		ips = append(ips, svc.Spec.LoadBalancerIP)
 	}
-
-	// Find Cidr
-	cidr, global, err = getConfig(cm, namespace, configMapName, "cidr", "address")
-	if err == nil {
-		return cidr, global, allowShare, nil
+	if lbIPs, ok := svc.Annotations[LoadbalancerIPsAnnotation]; ok && len(lbIPs) > 0 {
+		ips = append(ips, strings.Split(lbIPs, ",")...)
 	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if len(ingress.IP) > 0 {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	return ips
+}
 
-	// Find Range
-	ipRange, global, err = getConfig(cm, namespace, configMapName, "range", "address")
-	if err == nil {
-		return ipRange, global, allowShare, nil
+// discoverShareRespectAffinity returns true if services with a different session affinity shouldn't share a VIP
+func discoverShareRespectAffinity(cm *v1.ConfigMap, namespace, configMapName string) bool {
+	respectAffinityStr, _, err := getConfig(cm, namespace, configMapName, "share-respect-affinity", "config")
+	if err != nil {
+		return false
 	}
+	respectAffinity, _ := strconv.ParseBool(respectAffinityStr)
+	return respectAffinity
+}
+
+// shareOptions are the constraints on the IPs a service may share, the zero value only checks the ports
+type shareOptions struct {
+	// affinities are the session affinities of the services of each IP, only IPs used by services with the same
+	// session affinity are shared if it is set
+	affinities map[string]set.Set[v1.ServiceAffinity]
+	// shareGroups are the share groups of the services of each IP, only IPs used by services of the same share group
+	// are shared if it is set
+	shareGroups map[string]set.Set[string]
+	// counts are the number of services of each IP
+	counts map[string]int
+	// maxServicesPerIP is the number of services in counts above which an IP isn't shared, unlimited if 0
+	maxServicesPerIP int
+	// aggressive shares the IP used by the most services in counts first
+	aggressive bool
+}
 
-	return "", false, allowShare, fmt.Errorf("no address pools could be found")
+// newShareOptions returns the sharing constraints of the namespace set in the configmap, computed from the services
+// using the pool
+func newShareOptions(cm *v1.ConfigMap, namespace, configMapName string, svcs *v1.ServiceList) shareOptions {
+	opts := shareOptions{
+		shareGroups:      mapServiceShareGroups(svcs),
+		maxServicesPerIP: discoverMaxServicesPerIP(cm),
+		aggressive:       discoverShareAggressive(cm),
+	}
+	if discoverShareRespectAffinity(cm, namespace, configMapName) {
+		opts.affinities = mapServiceAffinities(svcs)
+	}
+	if opts.maxServicesPerIP > 0 || opts.aggressive {
+		opts.counts = mapServiceCounts(svcs)
+	}
+	return opts
 }
 
 // Multiplex addresses:
-// 1. get all used VipEndpoints (addr and port)
-// 2. build usedIpset
-// 3. find an IP in usedIps where the requested VipEndpoints are available
-//		if found: assign this IP and return. Services without a Ports account for the whole IP
-//		if not: find new free IP from Range and assign it
+//  1. get all used VipEndpoints (addr and port)
+//  2. build usedIpset
+//  3. find an IP in usedIps where the requested VipEndpoints are available
+//     if found: assign this IP and return. Services without a Ports account for the whole IP
+//     if not: find new free IP from Range and assign it
+//
+// The IPs shared are restricted by the constraints of opts.
+func discoverSharedVIPs(service *v1.Service, servicePortMap map[string]*set.Set[int32], opts shareOptions) (vips string) {
+	// a service without ports makes its address non-shareable, so it doesn't share the address of another service either
+	if len(service.Spec.Ports) == 0 {
+		klog.Infof("Service [%s] does not define ports, not sharing an address", service.Name)
+		return ""
+	}
 
-func discoverSharedVIPs(service *v1.Service, servicePortMap map[string]*set.Set[int32]) (vips string) {
 	servicePorts := set.New[int32]()
 	for p := range service.Spec.Ports {
 		servicePorts.Insert(service.Spec.Ports[p].Port)
 	}
 
-	for ip := range servicePortMap {
+	for _, ip := range shareCandidates(servicePortMap, opts.counts, opts.aggressive) {
 		portSet := *servicePortMap[ip]
 		if portSet.Has(0) {
 			continue
 		}
 
-		intersect := servicePorts.Intersection(portSet)
-		if intersect.Len() == 0 {
+		if opts.maxServicesPerIP > 0 && opts.counts[ip] >= opts.maxServicesPerIP {
+			klog.Infof("Not sharing address [%s] with service [%s], it is already used by %d services", ip, service.Name, opts.counts[ip])
+			continue
+		}
+
+		if opts.affinities != nil {
+			if affinities := opts.affinities[ip]; !affinities.Equal(set.New(serviceAffinity(service))) {
+				klog.Infof("Not sharing address [%s] with service [%s], session affinity %s differs from %s",
+					ip, service.Name, serviceAffinity(service), fmt.Sprint(affinities.SortedList()))
+				continue
+			}
+		}
+
+		if opts.shareGroups != nil {
+			shareGroup := service.Annotations[ShareGroupAnnotationKey]
+			if groups := opts.shareGroups[ip]; !groups.Equal(set.New(shareGroup)) {
+				klog.Infof("Not sharing address [%s] with service [%s], share group [%s] differs from %s",
+					ip, service.Name, shareGroup, fmt.Sprint(groups.SortedList()))
+				continue
+			}
+		}
+
+		if !portsConflict(servicePorts, portSet) {
 			klog.Infof("Share service [%s] ports %s, with address [%s] ports %s",
 				service.Name,
 				fmt.Sprint(servicePorts.SortedList()),
@@ -422,24 +2561,60 @@ func discoverSharedVIPs(service *v1.Service, servicePortMap map[string]*set.Set[
 	return ""
 }
 
+// shareCandidates returns the addresses a service may share. With aggressive sharing, the addresses used by the most
+// services come first, then the lowest, so the services are packed on as few addresses as possible. Otherwise the
+// order is unspecified.
+func shareCandidates(servicePortMap map[string]*set.Set[int32], serviceCountMap map[string]int, aggressive bool) []string {
+	candidates := make([]string, 0, len(servicePortMap))
+	for ip := range servicePortMap {
+		candidates = append(candidates, ip)
+	}
+	if !aggressive {
+		return candidates
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		if c := cmp.Compare(serviceCountMap[b], serviceCountMap[a]); c != 0 {
+			return c
+		}
+		addrA, errA := netip.ParseAddr(a)
+		addrB, errB := netip.ParseAddr(b)
+		if errA != nil || errB != nil {
+			return strings.Compare(a, b)
+		}
+		return addrA.Compare(addrB)
+	})
+	return candidates
+}
+
+// discoverShareAggressive returns true if share-aggressive-global is true, a service allowed to share then takes the
+// shareable address used by the most services instead of any shareable address
+func discoverShareAggressive(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "share-aggressive")
+}
+
 func discoverVIPsSingleStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4ServiceIP string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig,
 	ipFamilies []v1.IPFamily) (vips string, err error) {
 
-	ipPool := ipv4Pool
+	ipPool, family := ipv4Pool, v1.IPv4Protocol
 	if len(ipFamilies) == 0 {
 		if len(ipv4Pool) == 0 {
-			ipPool = ipv6Pool
+			ipPool, family = ipv6Pool, v1.IPv6Protocol
 		}
 	} else if ipFamilies[0] == v1.IPv6Protocol {
-		ipPool = ipv6Pool
+		ipPool, family = ipv6Pool, v1.IPv6Protocol
 	}
 	if len(ipPool) == 0 {
-		return "", fmt.Errorf("could not find suitable pool for the IP family of the service")
+		return "", &NoFamilyPoolError{Family: family}
 	}
 	if ipPool == ipv4Pool && len(preferredIpv4ServiceIP) > 0 {
 		return preferredIpv4ServiceIP, nil
 	}
-	return discoverAddress(namespace, ipPool, inUseIPSet, kubevipLBConfig)
+	vips, err = discoverAddress(namespace, ipPool, inUseIPSet, kubevipLBConfig)
+	var outOfIPs *ipam.OutOfIPsError
+	if errors.As(err, &outOfIPs) {
+		return "", &PoolExhaustedError{Family: family, Err: err}
+	}
+	return vips, err
 
 }
 
@@ -455,18 +2630,132 @@ func discoverFromPool(namespace, pool, preferredIpv4ServiceIP, ipv4Pool string,
 		vip, err = discoverAddress(namespace, pool, inUseIPSet, kubevipLBConfig)
 	}
 
+	var outOfIPs *ipam.OutOfIPsError
+	var noUsableIPs *ipam.NoUsableAddressesError
 	if err == nil {
 		*vipList = append(*vipList, vip)
 		return nil, nil
-	} else if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
+	} else if errors.As(err, &outOfIPs) {
+		poolError = err
+		return poolError, nil
+	} else if errors.As(err, &noUsableIPs) {
 		poolError = err
 		return poolError, nil
 	}
 	return nil, err
 }
 
+// NoFamilyPoolError is returned when the pool of the service has no address of the IP family of a single-stack service,
+// a pool of the family must be added
+type NoFamilyPoolError struct {
+	Family v1.IPFamily
+}
+
+func (e *NoFamilyPoolError) Error() string {
+	return fmt.Sprintf("no pool configured for IP family %s", e.Family)
+}
+
+// PoolExhaustedError is returned when the pool of the IP family of a single-stack service has no free address left,
+// the pool must be expanded
+type PoolExhaustedError struct {
+	Family v1.IPFamily
+	Err    error
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("pool for IP family %s is exhausted: %v", e.Family, e.Err)
+}
+
+func (e *PoolExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// DualStackPoolMismatchError is returned when a RequireDualStack service is given a pool that only has addresses of one IP family,
+// a pool of the missing family must be added
+type DualStackPoolMismatchError struct {
+	Family v1.IPFamily
+	// Kind is either CIDR or range, following the configured pool
+	Kind string
+}
+
+func newDualStackPoolMismatchError(ipv4Pool, ipv6Pool string) *DualStackPoolMismatchError {
+	family, pool := v1.IPv6Protocol, ipv4Pool
+	if len(ipv4Pool) == 0 {
+		family, pool = v1.IPv4Protocol, ipv6Pool
+	}
+	kind := "range"
+	if ipam.IsCidrPool(pool) {
+		kind = "CIDR"
+	}
+	return &DualStackPoolMismatchError{Family: family, Kind: kind}
+}
+
+func (e *DualStackPoolMismatchError) Error() string {
+	return fmt.Sprintf("dual-stack requested but pool has no %s %s", e.Family, e.Kind)
+}
+
+// FamilyPoolError is the error of allocating an address from the pool of a single IP family
+type FamilyPoolError struct {
+	Family v1.IPFamily
+	Err    error
+}
+
+func (e *FamilyPoolError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FamilyPoolError) Unwrap() error {
+	return e.Err
+}
+
+// newFamilyPoolError wraps the pool error with its IP family, it returns nil if there is no error
+func newFamilyPoolError(family v1.IPFamily, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FamilyPoolError{Family: family, Err: err}
+}
+
+// DualStackAllocationError aggregates the per-family errors of a dual-stack allocation,
+// use errors.As to find the error of a pool, e.g. *ipam.OutOfIPsError, or FamilyError for a given family
+type DualStackAllocationError struct {
+	Policy v1.IPFamilyPolicy
+	errs   []error
+	err    error
+}
+
+func newDualStackAllocationError(policy v1.IPFamilyPolicy, errs ...error) *DualStackAllocationError {
+	return &DualStackAllocationError{
+		Policy: policy,
+		errs:   errs,
+		err:    errors.Join(errs...),
+	}
+}
+
+func (e *DualStackAllocationError) Error() string {
+	if e.Policy == v1.IPFamilyPolicyPreferDualStack {
+		return fmt.Sprintf("could not allocate any IP address for PreferDualStack service: %s", renderErrors(e.errs...))
+	}
+	return fmt.Sprintf("could not allocate required IP addresses for RequireDualStack service: %s", renderErrors(e.errs...))
+}
+
+func (e *DualStackAllocationError) Unwrap() error {
+	return e.err
+}
+
+// FamilyError returns the error of the pool of the IP family, nil if the family got an address
+func (e *DualStackAllocationError) FamilyError(family v1.IPFamily) error {
+	for _, err := range e.errs {
+		var familyErr *FamilyPoolError
+		if errors.As(err, &familyErr) && familyErr.Family == family {
+			return familyErr.Err
+		}
+	}
+	return nil
+}
+
 func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4ServiceIP string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig,
-	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily) (vips string, err error) {
+	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily, familyOrder []v1.IPFamily) (vips string, err error) {
 
 	var vipList []string
 
@@ -474,16 +2763,35 @@ func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4Se
 		// With RequireDualStack, we want to make sure both pools with both IP
 		// families exist
 		if len(ipv4Pool) == 0 || len(ipv6Pool) == 0 {
-			return "", fmt.Errorf("service requires dual-stack, but the configuration does not have both IPv4 and IPv6 pools listed for the namespace")
+			mismatchErr := newDualStackPoolMismatchError(ipv4Pool, ipv6Pool)
+			if kubevipLBConfig == nil || !kubevipLBConfig.DowngradeRequireDualStack {
+				return "", mismatchErr
+			}
+			family := v1.IPv4Protocol
+			if len(ipv4Pool) == 0 {
+				family = v1.IPv6Protocol
+			}
+			klog.Warningf("RequireDualStack service will be single-stack %s because of error: %s", family, mismatchErr)
+			return discoverVIPsSingleStack(namespace, ipv4Pool, ipv6Pool, preferredIpv4ServiceIP, inUseIPSet, kubevipLBConfig, []v1.IPFamily{family})
 		}
 	}
 
+	// The family order annotation takes precedence over spec.IPFamilies, the families it lists must have a pool
+	if len(familyOrder) > 0 {
+		for _, family := range familyOrder {
+			if (family == v1.IPv4Protocol && len(ipv4Pool) == 0) || (family == v1.IPv6Protocol && len(ipv6Pool) == 0) {
+				return "", fmt.Errorf("%s lists %s, but the configuration does not have an %s pool listed for the namespace", FamilyOrderAnnotationKey, family, family)
+			}
+		}
+		ipFamilies = familyOrder
+	}
+
 	// Choose pool order
-	primaryPool := ipv4Pool
-	secondaryPool := ipv6Pool
+	primaryPool, primaryFamily := ipv4Pool, v1.IPv4Protocol
+	secondaryPool, secondaryFamily := ipv6Pool, v1.IPv6Protocol
 	if len(ipFamilies) > 0 && ipFamilies[0] == v1.IPv6Protocol {
-		primaryPool = ipv6Pool
-		secondaryPool = ipv4Pool
+		primaryPool, primaryFamily = ipv6Pool, v1.IPv6Protocol
+		secondaryPool, secondaryFamily = ipv4Pool, v1.IPv4Protocol
 	}
 
 	// Provide VIPs from both IP families if possible (guaranteed if RequireDualStack)
@@ -494,6 +2802,7 @@ func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4Se
 		if err != nil {
 			return "", err
 		}
+		primaryPoolErr = newFamilyPoolError(primaryFamily, primaryPoolErr)
 	}
 
 	if len(secondaryPool) > 0 {
@@ -501,11 +2810,12 @@ func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4Se
 		if err != nil {
 			return "", err
 		}
+		secondaryPoolErr = newFamilyPoolError(secondaryFamily, secondaryPoolErr)
 	}
 
 	if *ipFamilyPolicy == v1.IPFamilyPolicyPreferDualStack {
 		if primaryPoolErr != nil && secondaryPoolErr != nil {
-			return "", fmt.Errorf("could not allocate any IP address for PreferDualStack service: %s", renderErrors(primaryPoolErr, secondaryPoolErr))
+			return "", newDualStackAllocationError(*ipFamilyPolicy, primaryPoolErr, secondaryPoolErr)
 		}
 		singleError := primaryPoolErr
 		if secondaryPoolErr != nil {
@@ -516,7 +2826,7 @@ func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4Se
 		}
 	} else if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
 		if primaryPoolErr != nil || secondaryPoolErr != nil {
-			return "", fmt.Errorf("could not allocate required IP addresses for RequireDualStack service: %s", renderErrors(primaryPoolErr, secondaryPoolErr))
+			return "", newDualStackAllocationError(*ipFamilyPolicy, primaryPoolErr, secondaryPoolErr)
 		}
 	}
 
@@ -525,7 +2835,7 @@ func discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool string, preferredIpv4Se
 
 func discoverVIPs(
 	namespace, pool, preferredIpv4ServiceIP string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig,
-	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily,
+	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily, familyOrder []v1.IPFamily,
 ) (vips string, err error) {
 	var ipv4Pool, ipv6Pool string
 
@@ -534,8 +2844,11 @@ func discoverVIPs(
 		return "0.0.0.0", nil
 		// Check if ip pool contains a cidr, if not assume it is a range
 	} else if len(pool) == 0 {
+		if kubevipLBConfig != nil && kubevipLBConfig.EmptyPoolDHCP {
+			return "0.0.0.0", nil
+		}
 		return "", fmt.Errorf("could not discover address: pool is not specified")
-	} else if strings.Contains(pool, "/") {
+	} else if ipam.IsCidrPool(pool) {
 		ipv4Pool, ipv6Pool, err = ipam.SplitCIDRsByIPFamily(pool)
 	} else {
 		ipv4Pool, ipv6Pool, err = ipam.SplitRangesByIPFamily(pool)
@@ -544,18 +2857,96 @@ func discoverVIPs(
 		return "", err
 	}
 
+	// A RequireDualStack service listing a single IP family was created in a single-stack cluster, no pool can make it
+	// dual-stack
+	if ipFamilyPolicy != nil && *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack && len(ipFamilies) == 1 && len(familyOrder) == 0 {
+		singleStackErr := &SingleStackClusterError{Family: ipFamilies[0]}
+		if kubevipLBConfig == nil || !kubevipLBConfig.DowngradeRequireDualStack {
+			return "", singleStackErr
+		}
+		klog.Warningf("RequireDualStack service will be single-stack %s because of error: %s", ipFamilies[0], singleStackErr)
+		ipFamilyPolicy = ptr.To(v1.IPFamilyPolicySingleStack)
+	}
+
+	// The default of the configmap applies to the services without an IP family policy
+	if ipFamilyPolicy == nil && kubevipLBConfig != nil && kubevipLBConfig.DefaultIPFamilyPolicy != nil {
+		ipFamilyPolicy = kubevipLBConfig.DefaultIPFamilyPolicy
+	}
+
+	ipam.Tracef(kubevipLBConfig, "discovering VIPs for namespace [%s] from IPv4 pool [%s] and IPv6 pool [%s], ipFamilyPolicy: %v, ipFamilies: %v, preferred IPv4: [%s]",
+		namespace, ipv4Pool, ipv6Pool, ptr.Deref(ipFamilyPolicy, v1.IPFamilyPolicySingleStack), ipFamilies, preferredIpv4ServiceIP)
+
 	if ipFamilyPolicy == nil || *ipFamilyPolicy == v1.IPFamilyPolicySingleStack {
-		return discoverVIPsSingleStack(namespace, ipv4Pool, ipv6Pool, preferredIpv4ServiceIP, inUseIPSet, kubevipLBConfig, ipFamilies)
+		vips, err = discoverVIPsSingleStack(namespace, ipv4Pool, ipv6Pool, preferredIpv4ServiceIP, inUseIPSet, kubevipLBConfig, ipFamilies)
+	} else {
+		vips, err = discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool, preferredIpv4ServiceIP, inUseIPSet, kubevipLBConfig, ipFamilyPolicy, ipFamilies, familyOrder)
 	}
-	return discoverVIPsDualStack(namespace, ipv4Pool, ipv6Pool, preferredIpv4ServiceIP, inUseIPSet, kubevipLBConfig, ipFamilyPolicy, ipFamilies)
+	ipam.Tracef(kubevipLBConfig, "discovered VIPs [%s] for namespace [%s], error: %v", vips, namespace, err)
+	return vips, err
 }
 
 func discoverAddress(namespace, pool string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (vip string, err error) {
+	find := func(inUse *netipx.IPSet) (string, error) {
+		if vip, ok := preferredAddress(pool, inUse, kubevipLBConfig); ok {
+			return vip, nil
+		}
+		return findAddress(namespace, pool, inUse, kubevipLBConfig)
+	}
+	if kubevipLBConfig != nil && kubevipLBConfig.ProbeBeforeAssign {
+		return probeAddress(inUseIPSet, kubevipLBConfig.ProbedAddresses, find)
+	}
+	return find(inUseIPSet)
+}
+
+// preferredAddress returns the first reclaimable IP, then the first preferred IP, that is free and part of the pool (and
+// of the usable range if set)
+func preferredAddress(pool string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (string, bool) {
+	if kubevipLBConfig == nil || pool == "0.0.0.0/32" {
+		return "", false
+	}
+	for _, ip := range kubevipLBConfig.ReclaimableIPs {
+		// the service reclaims its own IP, the release cooldowns don't apply
+		if addr, ok := candidateAddress(pool, ip, inUseIPSet, kubevipLBConfig); ok {
+			ipam.Tracef(kubevipLBConfig, "reclaimed address %s released by the previous service of the same name", addr)
+			return addr.String(), true
+		}
+	}
+	for _, ip := range kubevipLBConfig.PreferredIPs {
+		if addr, ok := candidateAddress(pool, ip, inUseIPSet, kubevipLBConfig); ok && !ipam.IsCoolingDown(addr, kubevipLBConfig) {
+			ipam.Tracef(kubevipLBConfig, "chose preferred address %s", addr)
+			return addr.String(), true
+		}
+	}
+	return "", false
+}
+
+// candidateAddress returns the address of the IP if it is free and part of the pool (and of the usable range if set),
+// and it isn't excluded or reserved
+func candidateAddress(pool, ip string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil || inUseIPSet.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	if inPool, err := ipam.PoolContains(pool, addr); err != nil || !inPool {
+		return netip.Addr{}, false
+	}
+	if len(kubevipLBConfig.UsableRange) > 0 {
+		if usable, err := ipam.PoolContains(kubevipLBConfig.UsableRange, addr); err != nil || !usable {
+			return netip.Addr{}, false
+		}
+	}
+	if ipam.IsExcluded(addr, kubevipLBConfig) || !ipam.AllowsReservedAddress(addr, kubevipLBConfig) {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+func findAddress(namespace, pool string, inUseIPSet *netipx.IPSet, kubevipLBConfig *config.KubevipLBConfig) (vip string, err error) {
 	// Check if DHCP is required
 	if pool == "0.0.0.0/32" {
 		vip = "0.0.0.0"
 		// Check if ip pool contains a cidr, if not assume it is a range
-	} else if strings.Contains(pool, "/") {
+	} else if ipam.IsCidrPool(pool) {
 		vip, err = ipam.FindAvailableHostFromCidr(namespace, pool, inUseIPSet, kubevipLBConfig)
 		if err != nil {
 			return "", err
@@ -570,8 +2961,130 @@ func discoverAddress(namespace, pool string, inUseIPSet *netipx.IPSet, kubevipLB
 	return vip, err
 }
 
+// migrateImplementationLabel relabels the services implemented by kube-vip from oldKey to newKey.
+// Both labels are swapped within a single update, so the service is always discoverable.
+func migrateImplementationLabel(ctx context.Context, kubeClient kubernetes.Interface, oldKey, newKey string) error {
+	if oldKey == newKey {
+		return nil
+	}
+
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", oldKey, ImplementationLabelValue)})
+	if err != nil {
+		return err
+	}
+
+	for x := range svcs.Items {
+		svc := svcs.Items[x]
+		klog.Infof("relabeling service '%s/%s' from '%s' to '%s'", svc.Namespace, svc.Name, oldKey, newKey)
+		err := retryOnConflict(func() error {
+			recentService, getErr := kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			if recentService.Labels[oldKey] != ImplementationLabelValue {
+				return nil
+			}
+			recentService.Labels[newKey] = ImplementationLabelValue
+			delete(recentService.Labels, oldKey)
+
+			_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+			return updateErr
+		})
+		if err != nil {
+			return fmt.Errorf("error relabeling Service [%s/%s] : %v", svc.Namespace, svc.Name, err)
+		}
+	}
+	return nil
+}
+
 func getKubevipImplementationLabel() string {
-	return fmt.Sprintf("%s=%s", ImplementationLabelKey, ImplementationLabelValue)
+	return fmt.Sprintf("%s=%s", implementationLabelKey, ImplementationLabelValue)
+}
+
+// isImplemented returns true if the service is implemented by kube-vip. The implementation label alone isn't enough,
+// another tool may set the same label, so the service must carry the IPs kube-vip allocated in its annotation too.
+func isImplemented(svc *v1.Service) bool {
+	return svc.Labels[implementationLabelKey] == ImplementationLabelValue && len(svc.Annotations[LoadbalancerIPsAnnotation]) > 0
+}
+
+// implementedServices holds the <namespace>/<name> of the services seen holding IPs allocated by kube-vip, so a service
+// whose implementation label was removed is still found by listInUseServices until it is relabeled
+var implementedServices sync.Map
+
+// trackImplementedService records that the service holds IPs allocated by kube-vip
+func trackImplementedService(service *v1.Service) {
+	implementedServices.Store(service.Namespace+"/"+service.Name, struct{}{})
+}
+
+// listInUseServices returns the services of the namespace holding IPs in their annotation: every service implemented by
+// kube-vip has them, and a service whose label was removed keeps them, so its IPs aren't handed out again before it is
+// relabeled. A service with the implementation label but without our annotation belongs to another tool.
+// The labeled services are listed, the tracked services missing from the list are read one by one, they are forgotten
+// once they are deleted or released their IPs.
+func listInUseServices(ctx context.Context, kubeClient kubernetes.Interface, namespace string) (*v1.ServiceList, error) {
+	svcs, err := kubeClient.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		return nil, err
+	}
+	inUse := &v1.ServiceList{}
+	listed := set.New[string]()
+	for x := range svcs.Items {
+		svc := svcs.Items[x]
+		if len(svc.Annotations[LoadbalancerIPsAnnotation]) > 0 {
+			inUse.Items = append(inUse.Items, svc)
+			trackImplementedService(&svc)
+			listed.Insert(svc.Namespace + "/" + svc.Name)
+		}
+	}
+
+	var getErr error
+	implementedServices.Range(func(k, _ any) bool {
+		key := k.(string)
+		svcNamespace, name, _ := strings.Cut(key, "/")
+		if listed.Has(key) || (len(namespace) > 0 && svcNamespace != namespace) {
+			return true
+		}
+		svc, err := kubeClient.CoreV1().Services(svcNamespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && len(svc.Annotations[LoadbalancerIPsAnnotation]) == 0) {
+			implementedServices.Delete(key)
+			return true
+		}
+		if err != nil {
+			getErr = err
+			return false
+		}
+		inUse.Items = append(inUse.Items, *svc)
+		return true
+	})
+	if getErr != nil {
+		return nil, getErr
+	}
+	return inUse, nil
+}
+
+// parseFamilyOrder parses the value of the family order annotation, e.g. ipv6,ipv4
+func parseFamilyOrder(order string) ([]v1.IPFamily, error) {
+	if len(order) == 0 {
+		return nil, nil
+	}
+
+	var families []v1.IPFamily
+	for _, f := range strings.Split(order, ",") {
+		var family v1.IPFamily
+		switch strings.ToLower(strings.TrimSpace(f)) {
+		case "ipv4":
+			family = v1.IPv4Protocol
+		case "ipv6":
+			family = v1.IPv6Protocol
+		default:
+			return nil, fmt.Errorf("invalid %s [%s], unknown IP family [%s]", FamilyOrderAnnotationKey, order, f)
+		}
+		if slices.Contains(families, family) {
+			return nil, fmt.Errorf("invalid %s [%s], IP family [%s] is listed twice", FamilyOrderAnnotationKey, order, f)
+		}
+		families = append(families, family)
+	}
+	return families, nil
 }
 
 func renderErrors(errs ...error) string {
@@ -584,15 +3097,83 @@ func renderErrors(errs ...error) string {
 	return s.String()
 }
 
+// discoverServiceInterface returns the interface of the namespace from the interface ConfigMap if set,
+// falling back to the pool ConfigMap
+func discoverServiceInterface(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, svcNS, cmNamespace string) string {
+	if len(interfaceConfigMap) > 0 {
+		interfaceCM, err := getConfigMap(ctx, kubeClient, interfaceConfigMap, cmNamespace)
+		switch {
+		case apierrors.IsNotFound(err):
+			klog.V(4).Infof("interface configMap [%s] in %s doesn't exist, using configMap [%s]", interfaceConfigMap, cmNamespace, cm.Name)
+		case err != nil:
+			klog.Warningf("unable to retrieve interface configMap [%s] in %s, using configMap [%s]: %v", interfaceConfigMap, cmNamespace, cm.Name, err)
+		default:
+			if interfaceName := lookupInterface(interfaceCM, svcNS); len(interfaceName) > 0 {
+				return interfaceName
+			}
+		}
+	}
+	return discoverInterface(cm, svcNS)
+}
+
+// discoverAdvertisement returns the advertisement-<namespace> or advertisement-global key of the configmap,
+// "" if there is none or it isn't arp or bgp
+func discoverAdvertisement(cm *v1.ConfigMap, namespace, configMapName string) string {
+	advertisement, _, err := getConfig(cm, namespace, configMapName, "advertisement", "config")
+	if err != nil {
+		return ""
+	}
+	advertisement = strings.ToLower(strings.TrimSpace(advertisement))
+	if advertisement != AdvertisementARP && advertisement != AdvertisementBGP {
+		klog.Warningf("invalid advertisement [%s] in configmap [%s], expected %s or %s, ignoring it", advertisement, configMapName, AdvertisementARP, AdvertisementBGP)
+		return ""
+	}
+	return advertisement
+}
+
+// discoverDefaultIPFamilyPolicy returns the default-ip-family-policy-<namespace> or default-ip-family-policy-global
+// key of the configmap, nil if there is none or it isn't a valid IP family policy
+func discoverDefaultIPFamilyPolicy(cm *v1.ConfigMap, namespace, configMapName string) *v1.IPFamilyPolicy {
+	policyStr, _, err := getConfig(cm, namespace, configMapName, "default-ip-family-policy", "config")
+	if err != nil {
+		return nil
+	}
+	policy := v1.IPFamilyPolicy(strings.TrimSpace(policyStr))
+	switch policy {
+	case v1.IPFamilyPolicySingleStack, v1.IPFamilyPolicyPreferDualStack, v1.IPFamilyPolicyRequireDualStack:
+		return &policy
+	}
+	klog.Warningf("invalid default IP family policy [%s] in configmap [%s], expected %s, %s or %s, ignoring it", policyStr, configMapName,
+		v1.IPFamilyPolicySingleStack, v1.IPFamilyPolicyPreferDualStack, v1.IPFamilyPolicyRequireDualStack)
+	return nil
+}
+
 // found interface of that service from configmap.
-// if not found, return ""
+// if not found, return the default interface, "" if it is unset
 func discoverInterface(cm *v1.ConfigMap, svcNS string) string {
-	if interfaceName, ok := cm.Data[fmt.Sprintf("%s-%s", config.ConfigMapServiceInterfacePrefix, svcNS)]; ok {
+	if interfaceName := lookupInterface(cm, svcNS); len(interfaceName) > 0 {
 		return interfaceName
 	}
+	return defaultInterface
+}
+
+// lookupInterface returns the interface-<namespace> or interface-global key of the configmap, "" if there is none.
+// The keys may hold a comma separated list of interfaces, an invalid list is ignored with a warning.
+func lookupInterface(cm *v1.ConfigMap, svcNS string) string {
+	if interfaceName, key, ok := config.Lookup(cm, config.ConfigMapServiceInterfacePrefix, config.NamespaceKey(config.ConfigMapServiceInterfacePrefix, svcNS)); ok {
+		err := validateInterfaceList(interfaceName)
+		if err == nil {
+			return interfaceName
+		}
+		klog.Warningf("invalid interfaces [%s] in [%s], ignoring them: %v", interfaceName, key, err)
+	}
 	// fall back to global interface
-	if interfaceName, ok := cm.Data[fmt.Sprintf("%s-global", config.ConfigMapServiceInterfacePrefix)]; ok {
-		return interfaceName
+	if interfaceName, key, ok := config.Lookup(cm, config.ConfigMapServiceInterfacePrefix, config.GlobalKey(config.ConfigMapServiceInterfacePrefix)); ok {
+		err := validateInterfaceList(interfaceName)
+		if err == nil {
+			return interfaceName
+		}
+		klog.Warningf("invalid interfaces [%s] in [%s], ignoring them: %v", interfaceName, key, err)
 	}
 
 	return ""
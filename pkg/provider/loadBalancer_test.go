@@ -2,17 +2,73 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/webhook"
 	"github.com/stretchr/testify/assert"
 	"go4.org/netipx"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/set"
 )
 
+// createService creates the service in the fake cluster
+func createService(t *testing.T, client kubernetes.Interface, svc *v1.Service) {
+	t.Helper()
+	if _, err := client.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncService syncs the service with the default pool configmap, it returns the service as updated by the sync and
+// the error of the sync
+func syncService(t *testing.T, client kubernetes.Interface, svc *v1.Service) (*v1.Service, error) {
+	t.Helper()
+	_, syncErr := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, syncErr
+}
+
+// mustSyncService syncs the service like syncService, the sync must succeed
+func mustSyncService(t *testing.T, client kubernetes.Interface, svc *v1.Service) *v1.Service {
+	t.Helper()
+	res, err := syncService(t, client, svc)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error: %v", err)
+	}
+	return res
+}
+
+// createAndSyncService creates the service and syncs it, the sync must succeed
+func createAndSyncService(t *testing.T, client kubernetes.Interface, svc *v1.Service) *v1.Service {
+	t.Helper()
+	createService(t, client, svc)
+	return mustSyncService(t, client, svc)
+}
+
 func Test_DiscoveryPoolCIDR(t *testing.T) {
 	type args struct {
 		data v1.ConfigMap
@@ -86,6 +142,519 @@ func Test_DiscoveryPoolCIDR(t *testing.T) {
 	}
 }
 
+func Test_DiscoveryPoolKeyDelimiter(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"cidr-global":      "192.168.1.1/24",
+			"cidr.global":      "10.10.10.8/29",
+			"cidr.system":      "10.10.20.8/29",
+			"interface-global": "eth0",
+			"interface.global": "eth1",
+		},
+	}
+
+	tests := []struct {
+		name          string
+		delimiter     string
+		namespace     string
+		want          string
+		wantGlobal    bool
+		wantInterface string
+	}{
+		{
+			name:          "default delimiter, namespace named global takes the global pool",
+			delimiter:     config.DefaultNamespaceKeyDelimiter,
+			namespace:     "global",
+			want:          "192.168.1.1/24",
+			wantGlobal:    false,
+			wantInterface: "eth0",
+		},
+		{
+			name:          "dot delimiter, namespace named global doesn't shadow the global pool",
+			delimiter:     ".",
+			namespace:     "global",
+			want:          "10.10.10.8/29",
+			wantGlobal:    false,
+			wantInterface: "eth1",
+		},
+		{
+			name:          "dot delimiter, known namespace",
+			delimiter:     ".",
+			namespace:     "system",
+			want:          "10.10.20.8/29",
+			wantGlobal:    false,
+			wantInterface: "eth0",
+		},
+		{
+			name:          "dot delimiter, unknown namespace falls back to the global pool",
+			delimiter:     ".",
+			namespace:     "basic",
+			want:          "192.168.1.1/24",
+			wantGlobal:    true,
+			wantInterface: "eth0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := config.SetNamespaceKeyDelimiter(tt.delimiter); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { config.NamespaceKeyDelimiter = config.DefaultNamespaceKeyDelimiter }()
+
+			pool, global, _, err := discoverPool(cm, tt.namespace, "")
+			if err != nil {
+				t.Fatalf("discoverPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+			assert.Equal(t, tt.wantInterface, discoverInterface(cm, tt.namespace))
+		})
+	}
+}
+
+func Test_DiscoveryPoolClusterName(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"cidr-east-system": "10.10.10.8/29",
+			"cidr-west-system": "10.10.20.8/29",
+			"cidr-system":      "10.10.30.8/29",
+			"cidr-east-global": "192.168.1.1/24",
+			"cidr-global":      "192.168.2.1/24",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		clusterName string
+		namespace   string
+		want        string
+		wantGlobal  bool
+	}{
+		{
+			name:        "cluster-scoped namespace key",
+			clusterName: "east",
+			namespace:   "system",
+			want:        "10.10.10.8/29",
+		},
+		{
+			name:        "cluster-scoped global key",
+			clusterName: "east",
+			namespace:   "basic",
+			want:        "192.168.1.1/24",
+			wantGlobal:  true,
+		},
+		{
+			name:        "fallback to the unscoped namespace key",
+			clusterName: "north",
+			namespace:   "system",
+			want:        "10.10.30.8/29",
+		},
+		{
+			name:        "fallback to the unscoped global key",
+			clusterName: "north",
+			namespace:   "basic",
+			want:        "192.168.2.1/24",
+			wantGlobal:  true,
+		},
+		{
+			name:       "no cluster name ignores the scoped keys",
+			namespace:  "basic",
+			want:       "192.168.2.1/24",
+			wantGlobal: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ClusterName = tt.clusterName
+			defer func() { config.ClusterName = "" }()
+
+			pool, global, _, err := discoverPool(cm, tt.namespace, "")
+			if err != nil {
+				t.Fatalf("discoverPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+		})
+	}
+}
+
+func Test_DiscoveryPoolGlobalKeyword(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyword    string
+		data       map[string]string
+		namespace  string
+		want       string
+		wantGlobal bool
+	}{
+		{
+			name:      "a namespace named global takes the global pool by default",
+			data:      map[string]string{"cidr-global": "10.0.0.0/24", "cidr-_all": "192.168.0.0/24"},
+			namespace: "global",
+			want:      "10.0.0.0/24",
+		},
+		{
+			name:       "the other namespaces take the same pool by default",
+			data:       map[string]string{"cidr-global": "10.0.0.0/24", "cidr-_all": "192.168.0.0/24"},
+			namespace:  "team",
+			want:       "10.0.0.0/24",
+			wantGlobal: true,
+		},
+		{
+			name:      "a namespace named global gets its own pool",
+			keyword:   "_all",
+			data:      map[string]string{"cidr-global": "10.0.0.0/24", "cidr-_all": "192.168.0.0/24"},
+			namespace: "global",
+			want:      "10.0.0.0/24",
+		},
+		{
+			name:       "the other namespaces get the global pool",
+			keyword:    "_all",
+			data:       map[string]string{"cidr-global": "10.0.0.0/24", "cidr-_all": "192.168.0.0/24"},
+			namespace:  "team",
+			want:       "192.168.0.0/24",
+			wantGlobal: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.keyword) > 0 {
+				if err := config.SetGlobalKeyword(tt.keyword); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer func() { config.GlobalKeyword = config.DefaultGlobalKeyword }()
+
+			pool, global, _, err := discoverPool(&v1.ConfigMap{Data: tt.data}, tt.namespace, "")
+			if err != nil {
+				t.Fatalf("discoverPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+		})
+	}
+}
+
+func Test_syncLoadBalancerNoPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantErr   string
+		wantEvent string
+	}{
+		{
+			name:      "empty configmap",
+			data:      map[string]string{},
+			wantErr:   "configmap [kubevip] has no pools defined",
+			wantEvent: "Warning NoPoolsDefined ConfigMap kubevip has no pools defined",
+		},
+		{
+			name:      "configmap without pool keys",
+			data:      map[string]string{"allow-share-global": "true", "dhcp-team-a": "false"},
+			wantErr:   "configmap [kubevip] has no pools defined",
+			wantEvent: "Warning NoPoolsDefined ConfigMap kubevip has no pools defined",
+		},
+		{
+			name:      "configmap with pools for other namespaces only",
+			data:      map[string]string{"cidr-team-a": "10.0.0.0/24", "range-team-b": "10.0.1.1-10.0.1.10"},
+			wantErr:   "no pool for namespace [test] and no global pool in configmap [kubevip]",
+			wantEvent: "Warning NoPoolForNamespace No pool for namespace test and no global pool in ConfigMap kubevip",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			assert.EqualError(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantEvent, <-recorder.Events)
+		})
+	}
+}
+
+func Test_discoverServiceInterface(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":      "192.168.1.1/24",
+			"interface-global": "eth0",
+		},
+	}
+	interfaceCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubevip-interfaces",
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"interface-prod": "bond0",
+		},
+	}
+	noInterfaceCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+
+	tests := []struct {
+		name               string
+		interfaceConfigMap string
+		defaultInterface   string
+		configMaps         []*v1.ConfigMap
+		poolConfigMap      *v1.ConfigMap
+		namespace          string
+		want               string
+	}{
+		{
+			name:      "no interface configmap",
+			namespace: "prod",
+			want:      "eth0",
+		},
+		{
+			name:               "interface from the interface configmap",
+			interfaceConfigMap: "kubevip-interfaces",
+			configMaps:         []*v1.ConfigMap{interfaceCM},
+			namespace:          "prod",
+			want:               "bond0",
+		},
+		{
+			name:               "namespace missing from the interface configmap falls back to the pool configmap",
+			interfaceConfigMap: "kubevip-interfaces",
+			configMaps:         []*v1.ConfigMap{interfaceCM},
+			namespace:          "dev",
+			want:               "eth0",
+		},
+		{
+			name:               "absent interface configmap falls back to the pool configmap",
+			interfaceConfigMap: "kubevip-interfaces",
+			namespace:          "prod",
+			want:               "eth0",
+		},
+		{
+			name:             "the global interface takes precedence over the default interface",
+			defaultInterface: "eth9",
+			namespace:        "prod",
+			want:             "eth0",
+		},
+		{
+			name:               "the interface configmap takes precedence over the default interface",
+			interfaceConfigMap: "kubevip-interfaces",
+			defaultInterface:   "eth9",
+			configMaps:         []*v1.ConfigMap{interfaceCM},
+			poolConfigMap:      noInterfaceCM,
+			namespace:          "prod",
+			want:               "bond0",
+		},
+		{
+			name:               "default interface when no interface key matches",
+			interfaceConfigMap: "kubevip-interfaces",
+			defaultInterface:   "eth9",
+			configMaps:         []*v1.ConfigMap{interfaceCM},
+			poolConfigMap:      noInterfaceCM,
+			namespace:          "dev",
+			want:               "eth9",
+		},
+		{
+			name:          "no interface without a default interface",
+			poolConfigMap: noInterfaceCM,
+			namespace:     "dev",
+			want:          "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interfaceConfigMap, defaultInterface = tt.interfaceConfigMap, tt.defaultInterface
+			defer func() { interfaceConfigMap, defaultInterface = "", "" }()
+			poolCM := cm
+			if tt.poolConfigMap != nil {
+				poolCM = tt.poolConfigMap
+			}
+
+			client := fake.NewSimpleClientset()
+			for _, c := range tt.configMaps {
+				if _, err := client.CoreV1().ConfigMaps(c.Namespace).Create(context.Background(), c, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			assert.Equal(t, tt.want, discoverServiceInterface(context.Background(), client, poolCM, tt.namespace, KubeVipClientConfigNamespace))
+		})
+	}
+}
+
+func Test_syncLoadBalancerPreviousInterface(t *testing.T) {
+	tests := []struct {
+		name           string
+		interfaceAnno  string
+		expectPrevious string
+	}{
+		{
+			name:           "changed interface is kept as previous interface",
+			interfaceAnno:  "eth0",
+			expectPrevious: "eth0",
+		},
+		{
+			name:          "unchanged interface isn't recorded",
+			interfaceAnno: "eth1",
+		},
+		{
+			name: "first interface isn't recorded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":      "192.168.1.1/24",
+					"interface-global": "eth1",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the IPs of the service were released, e.g. to move it to another pool, the interface annotation stayed
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: map[string]string{}}}
+			if len(tt.interfaceAnno) > 0 {
+				svc.Annotations[LoadbalancerServiceInterfaceAnnotationKey] = tt.interfaceAnno
+			}
+			createService(t, client, svc)
+
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "eth1", res.Annotations[LoadbalancerServiceInterfaceAnnotationKey])
+			previous, found := res.Annotations[PreviousInterfaceAnnotationKey]
+			assert.Equal(t, len(tt.expectPrevious) > 0, found)
+			assert.Equal(t, tt.expectPrevious, previous)
+		})
+	}
+}
+
+func Test_syncLoadBalancerInterfaceList(t *testing.T) {
+	tests := []struct {
+		name          string
+		configIface   string
+		interfaceAnno string
+		expectIface   string
+		expectIPs     string
+		expectInvalid bool
+	}{
+		{
+			name:          "interface list of the annotation round-trips unchanged",
+			interfaceAnno: "eth0,eth1",
+			expectIface:   "eth0,eth1",
+			expectIPs:     "192.168.1.1",
+		},
+		{
+			name:        "interface list of the configmap is passed to the service",
+			configIface: "bond0,bond1",
+			expectIface: "bond0,bond1",
+			expectIPs:   "192.168.1.1",
+		},
+		{
+			name:        "invalid interface list of the configmap is ignored",
+			configIface: "bond0,,bond1",
+			expectIPs:   "192.168.1.1",
+		},
+		{
+			name:          "invalid interface list of the annotation is refused",
+			interfaceAnno: "eth0, eth1",
+			expectIface:   "eth0, eth1",
+			expectInvalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24",
+				},
+			}
+			if len(tt.configIface) > 0 {
+				cm.Data["interface-global"] = tt.configIface
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: map[string]string{}}}
+			if len(tt.interfaceAnno) > 0 {
+				svc.Annotations[LoadbalancerServiceInterfaceAnnotationKey] = tt.interfaceAnno
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if tt.expectInvalid {
+				var interfaceErr *InvalidServiceInterfaceError
+				assert.ErrorAs(t, err, &interfaceErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.expectIface, res.Annotations[LoadbalancerServiceInterfaceAnnotationKey])
+		})
+	}
+}
+
+func Test_validateInterfaceList(t *testing.T) {
+	assert.NoError(t, validateInterfaceList("eth0"))
+	assert.NoError(t, validateInterfaceList("eth0,bond0.100,eth1:1"))
+	assert.Error(t, validateInterfaceList(""))
+	assert.Error(t, validateInterfaceList("eth0,"))
+	assert.Error(t, validateInterfaceList("eth0 eth1"))
+	assert.Error(t, validateInterfaceList("a-very-long-interface-name"))
+	assert.Error(t, validateInterfaceList("eth0/1"))
+}
+
 func Test_DiscoveryPoolRange(t *testing.T) {
 	type args struct {
 		data    v1.ConfigMap
@@ -153,6 +722,51 @@ func Test_DiscoveryPoolRange(t *testing.T) {
 	}
 }
 
+func Test_DiscoveryPoolEmptyKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		want     string
+		wantBool bool
+		wantErr  bool
+	}{
+		{
+			name:     "empty namespace cidr falls back to the global cidr",
+			data:     map[string]string{"cidr-system": "", "cidr-global": "192.168.1.1/24"},
+			want:     "192.168.1.1/24",
+			wantBool: true,
+		},
+		{
+			name:     "blank namespace range falls back to the global range",
+			data:     map[string]string{"range-system": "  ", "range-global": "10.0.0.1-10.0.0.10"},
+			want:     "10.0.0.1-10.0.0.10",
+			wantBool: true,
+		},
+		{
+			name:     "empty global cidr falls back to the global range",
+			data:     map[string]string{"cidr-global": "", "range-global": "10.0.0.1-10.0.0.10"},
+			want:     "10.0.0.1-10.0.0.10",
+			wantBool: true,
+		},
+		{
+			name:    "empty keys only",
+			data:    map[string]string{"cidr-system": "", "cidr-global": ""},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotString, gotBool, _, err := discoverPool(&v1.ConfigMap{Data: tt.data}, "system", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverPool() error: %v, expected: %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, gotString)
+			assert.Equal(t, tt.wantBool, gotBool)
+		})
+	}
+}
+
 func Test_DiscoveryAddressCIDR(t *testing.T) {
 	type args struct {
 		namespace          string
@@ -329,6 +943,7 @@ func Test_discoverVIPs(t *testing.T) {
 	type args struct {
 		ipFamilyPolicy         *v1.IPFamilyPolicy
 		ipFamilies             []v1.IPFamily
+		familyOrder            []v1.IPFamily
 		pool                   string
 		preferredIpv4ServiceIP string
 		existingServiceIPS     []string
@@ -674,11 +1289,64 @@ func Test_discoverVIPs(t *testing.T) {
 			want:    "",
 			wantErr: true,
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			builder := &netipx.IPSetBuilder{}
+		{
+			name: "dualstack pool with PreferDualStack IPv4,IPv6 service and IPv6,IPv4 family order",
+			args: args{
+				ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+				ipFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				familyOrder:    []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				pool:           "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			},
+			want:    "fd00::1,10.10.10.8",
+			wantErr: false,
+		},
+		{
+			name: "dualstack pool with RequireDualStack IPv6,IPv4 service and IPv4,IPv6 family order",
+			args: args{
+				ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+				ipFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				familyOrder:    []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				pool:           "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			},
+			want:    "10.10.10.8,fd00::1",
+			wantErr: false,
+		},
+		{
+			name: "dualstack pool with PreferDualStack service and IPv6 family order",
+			args: args{
+				ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+				familyOrder:    []v1.IPFamily{v1.IPv6Protocol},
+				pool:           "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			},
+			want:    "fd00::1,10.10.10.8",
+			wantErr: false,
+		},
+		{
+			name: "IPv4 pool with PreferDualStack service and family order listing IPv6",
+			args: args{
+				ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+				familyOrder:    []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				pool:           "10.10.10.8-10.10.10.15",
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "single stack service ignores the family order",
+			args: args{
+				ipFamilyPolicy: nil,
+				ipFamilies:     []v1.IPFamily{v1.IPv4Protocol},
+				familyOrder:    []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				pool:           "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			},
+			want:    "10.10.10.8",
+			wantErr: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
 			for i := range tt.args.existingServiceIPS {
 				addr, err := netip.ParseAddr(tt.args.existingServiceIPS[i])
 				if err != nil {
@@ -693,7 +1361,7 @@ func Test_discoverVIPs(t *testing.T) {
 				return
 			}
 
-			gotString, err := discoverVIPs("discover-vips-test-ns", tt.args.pool, tt.args.preferredIpv4ServiceIP, s, &config.KubevipLBConfig{}, tt.args.ipFamilyPolicy, tt.args.ipFamilies)
+			gotString, err := discoverVIPs("discover-vips-test-ns", tt.args.pool, tt.args.preferredIpv4ServiceIP, s, &config.KubevipLBConfig{}, tt.args.ipFamilyPolicy, tt.args.ipFamilies, tt.args.familyOrder)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverVIP() error: %v, expected: %v", err, tt.wantErr)
 				return
@@ -705,368 +1373,4005 @@ func Test_discoverVIPs(t *testing.T) {
 	}
 }
 
-func Test_syncLoadBalancer(t *testing.T) {
+func Test_discoverVIPsDualStackErrors(t *testing.T) {
 	tests := []struct {
-		name             string
-		serviceNamespace string
-		serviceName      string
+		name               string
+		ipFamilyPolicy     v1.IPFamilyPolicy
+		existingServiceIPS []string
+		wantPrefix         string
+		wantIPv4OutOfIPs   bool
+		wantIPv6OutOfIPs   bool
+	}{
+		{
+			name:               "RequireDualStack with the IPv6 pool exhausted",
+			ipFamilyPolicy:     v1.IPFamilyPolicyRequireDualStack,
+			existingServiceIPS: []string{"fd00::1", "fd00::2"},
+			wantPrefix:         "could not allocate required IP addresses for RequireDualStack service: ",
+			wantIPv6OutOfIPs:   true,
+		},
+		{
+			name:               "RequireDualStack with the IPv4 pool exhausted",
+			ipFamilyPolicy:     v1.IPFamilyPolicyRequireDualStack,
+			existingServiceIPS: []string{"10.10.10.8", "10.10.10.9"},
+			wantPrefix:         "could not allocate required IP addresses for RequireDualStack service: ",
+			wantIPv4OutOfIPs:   true,
+		},
+		{
+			name:               "PreferDualStack with both pools exhausted",
+			ipFamilyPolicy:     v1.IPFamilyPolicyPreferDualStack,
+			existingServiceIPS: []string{"10.10.10.8", "10.10.10.9", "fd00::1", "fd00::2"},
+			wantPrefix:         "could not allocate any IP address for PreferDualStack service: ",
+			wantIPv4OutOfIPs:   true,
+			wantIPv6OutOfIPs:   true,
+		},
+	}
 
-		originalService v1.Service
-		poolConfigMap   *v1.ConfigMap
-		expectedService v1.Service
-		wantErr         bool
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, ip := range tt.existingServiceIPS {
+				builder.Add(netip.MustParseAddr(ip))
+			}
+			s, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = discoverVIPs("dualstack-errors-ns", "10.10.10.8-10.10.10.9,fd00::1-fd00::2", "", s, &config.KubevipLBConfig{},
+				ipFamilyPolicyPtr(tt.ipFamilyPolicy), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.True(t, strings.HasPrefix(err.Error(), tt.wantPrefix), "unexpected error message: %s", err)
+
+			var aggErr *DualStackAllocationError
+			if !errors.As(err, &aggErr) {
+				t.Fatalf("expected a DualStackAllocationError, got %T", err)
+			}
+			assert.Equal(t, tt.ipFamilyPolicy, aggErr.Policy)
+
+			var outOfIPs *ipam.OutOfIPsError
+			assert.True(t, errors.As(err, &outOfIPs))
+
+			for family, want := range map[v1.IPFamily]bool{v1.IPv4Protocol: tt.wantIPv4OutOfIPs, v1.IPv6Protocol: tt.wantIPv6OutOfIPs} {
+				familyErr := aggErr.FamilyError(family)
+				if !want {
+					assert.NoError(t, familyErr, family)
+					continue
+				}
+				assert.True(t, errors.As(familyErr, &outOfIPs), family)
+				assert.True(t, errors.Is(err, familyErr), family)
+			}
+		})
+	}
+}
+
+func Test_discoverVIPsDualStackPoolMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		wantFamily v1.IPFamily
+		wantErr    string
 	}{
 		{
-			name: "add new annotation to legacy service which already has spec.loadbalancerIP, remove legacy label",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-						"ipam-address":   "192.168.1.1",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
-				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
-				},
-			},
+			name:       "IPv4 CIDR pool",
+			pool:       "10.10.10.8/29",
+			wantFamily: v1.IPv6Protocol,
+			wantErr:    "dual-stack requested but pool has no IPv6 CIDR",
 		},
 		{
-			name: "add new annotation and loadbalancerIP to new service",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
-			},
-			poolConfigMap: &v1.ConfigMap{
+			name:       "IPv4 range pool",
+			pool:       "10.10.10.8-10.10.10.15",
+			wantFamily: v1.IPv6Protocol,
+			wantErr:    "dual-stack requested but pool has no IPv6 range",
+		},
+		{
+			name:       "IPv6 CIDR pool",
+			pool:       "fd00::/124",
+			wantFamily: v1.IPv4Protocol,
+			wantErr:    "dual-stack requested but pool has no IPv4 CIDR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := discoverVIPs("dualstack-mismatch-ns", tt.pool, "", &netipx.IPSet{}, &config.KubevipLBConfig{},
+				ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Equal(t, tt.wantErr, err.Error())
+
+			var mismatch *DualStackPoolMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected a DualStackPoolMismatchError, got %T", err)
+			}
+			assert.Equal(t, tt.wantFamily, mismatch.Family)
+		})
+	}
+}
+
+func Test_discoverVIPsSingleStackFamilyErrors(t *testing.T) {
+	inUse, err := netipx.ParseIPRange("fd00::1-fd00::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddRange(inUse)
+	inUseSet, err := builder.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		pool          string
+		wantNoPool    bool
+		wantExhausted bool
+		wantErr       string
+	}{
+		{
+			name:       "no IPv6 pool configured",
+			pool:       "10.10.10.8-10.10.10.9",
+			wantNoPool: true,
+			wantErr:    "no pool configured for IP family IPv6",
+		},
+		{
+			name:          "IPv6 pool exhausted",
+			pool:          "10.10.10.8-10.10.10.9,fd00::1-fd00::2",
+			wantExhausted: true,
+			wantErr:       "pool for IP family IPv6 is exhausted: no addresses available in [single-stack-ns] range [fd00::1-fd00::2]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := discoverVIPs("single-stack-ns", tt.pool, "", inUseSet, &config.KubevipLBConfig{},
+				ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack), []v1.IPFamily{v1.IPv6Protocol}, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Equal(t, tt.wantErr, err.Error())
+
+			var noPool *NoFamilyPoolError
+			assert.Equal(t, tt.wantNoPool, errors.As(err, &noPool))
+			var exhausted *PoolExhaustedError
+			assert.Equal(t, tt.wantExhausted, errors.As(err, &exhausted))
+			var outOfIPs *ipam.OutOfIPsError
+			assert.Equal(t, tt.wantExhausted, errors.As(err, &outOfIPs))
+			if tt.wantNoPool {
+				assert.Equal(t, v1.IPv6Protocol, noPool.Family)
+			}
+			if tt.wantExhausted {
+				assert.Equal(t, v1.IPv6Protocol, exhausted.Family)
+			}
+		})
+	}
+}
+
+func Test_parseFamilyOrder(t *testing.T) {
+	tests := []struct {
+		order   string
+		want    []v1.IPFamily
+		wantErr bool
+	}{
+		{order: "", want: nil},
+		{order: "ipv6,ipv4", want: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}},
+		{order: "IPv4, IPv6", want: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}},
+		{order: "ipv6", want: []v1.IPFamily{v1.IPv6Protocol}},
+		{order: "ipv6,ipv6", wantErr: true},
+		{order: "ipv5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			got, err := parseFamilyOrder(tt.order)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFamilyOrder() error: %v, expected: %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_discoverVIPsEmptyPool(t *testing.T) {
+	tests := []struct {
+		name          string
+		emptyPoolDHCP bool
+		want          string
+		wantErr       bool
+	}{
+		{
+			name:    "empty pool errors by default",
+			wantErr: true,
+		},
+		{
+			name:          "empty pool falls through to DHCP",
+			emptyPoolDHCP: true,
+			want:          "0.0.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discoverVIPs("empty-pool-ns", "", "", &netipx.IPSet{}, &config.KubevipLBConfig{EmptyPoolDHCP: tt.emptyPoolDHCP}, nil, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverVIPs() error: %v, expected: %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerEmptyPoolBehavior(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior string
+		wantIPs  string
+		wantErr  bool
+	}{
+		{
+			name:    "unconfigured namespace errors by default",
+			wantErr: true,
+		},
+		{
+			name:     "unconfigured namespace errors with error behavior",
+			behavior: EmptyPoolBehaviorError,
+			wantErr:  true,
+		},
+		{
+			name:     "unconfigured namespace errors with unknown behavior",
+			behavior: "unknown",
+			wantErr:  true,
+		},
+		{
+			name:     "unconfigured namespace gets DHCP with dhcp behavior",
+			behavior: EmptyPoolBehaviorDHCP,
+			wantIPs:  "0.0.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
 				Data: map[string]string{
-					"cidr-global": "192.168.1.1/24",
+					"cidr-configured": "192.168.1.1/24",
 				},
-			},
-			expectedService: v1.Service{
+			}
+			if len(tt.behavior) > 0 {
+				cm.Data["empty-pool-behavior-global"] = tt.behavior
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			svc := &v1.Service{
 				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
+					Namespace: "unconfigured",
 					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
 				},
-			},
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_DiscoveryPoolDHCP(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"cidr-global":      "192.168.1.1/24",
+			"cidr-dhcp":        "10.10.10.8/29",
+			"dhcp-dhcp":        "true",
+			"dhcp-disabled":    "false",
+			"dhcp-invalid":     "yes please",
+			"allow-share-dhcp": "true",
 		},
+	}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		want       string
+		wantGlobal bool
+		allowShare bool
+	}{
 		{
-			name: "add new annotation to new service which doesn't have spec.loadbalancerIP, doesn't add spec.loadbalancerIP",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
-					},
-				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
+			name:       "DHCP mode namespace takes the DHCP pool over its cidr",
+			namespace:  "dhcp",
+			want:       DHCPPool,
+			wantGlobal: false,
+			allowShare: true,
+		},
+		{
+			name:       "disabled DHCP mode takes the global pool",
+			namespace:  "disabled",
+			want:       "192.168.1.1/24",
+			wantGlobal: true,
+		},
+		{
+			name:       "invalid DHCP mode is ignored",
+			namespace:  "invalid",
+			want:       "192.168.1.1/24",
+			wantGlobal: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, global, allowShare, err := discoverPool(cm, tt.namespace, "")
+			if err != nil {
+				t.Fatalf("discoverPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+			assert.Equal(t, tt.allowShare, allowShare)
+			assert.Equal(t, !tt.wantGlobal, hasNamespacePool(cm, tt.namespace))
+		})
+	}
+}
+
+func Test_DiscoveryPoolMultiKey(t *testing.T) {
+	data := map[string]string{
+		"cidr-global":  "192.168.1.1/24",
+		"cidr-foo-a":   "10.10.10.0/30",
+		"cidr-foo-b":   "10.10.20.0/30",
+		"cidr-bar":     "10.20.0.0/30",
+		"cidr-bar-b":   "10.20.1.0/30",
+		"range-baz-a":  "10.30.0.1-10.30.0.2",
+		"range-baz-b":  "10.30.1.1-10.30.1.2",
+		"cidr-single":  "10.40.0.0/30",
+		"cidr-foobar":  "10.50.0.0/30",
+		"range-global": "192.168.2.1-192.168.2.10",
+	}
+
+	tests := []struct {
+		name       string
+		multiKey   bool
+		namespace  string
+		want       string
+		wantGlobal bool
+	}{
+		{
+			name:      "two suffixed keys are unioned",
+			multiKey:  true,
+			namespace: "foo",
+			want:      "10.10.10.0/30,10.10.20.0/30",
+		},
+		{
+			name:      "the namespace key is unioned with the suffixed keys",
+			multiKey:  true,
+			namespace: "bar",
+			want:      "10.20.0.0/30,10.20.1.0/30",
+		},
+		{
+			name:      "suffixed ranges are unioned",
+			multiKey:  true,
+			namespace: "baz",
+			want:      "10.30.0.1-10.30.0.2,10.30.1.1-10.30.1.2",
+		},
+		{
+			name:      "a single namespace key",
+			multiKey:  true,
+			namespace: "single",
+			want:      "10.40.0.0/30",
+		},
+		{
+			name:       "suffixed keys are ignored when disabled",
+			namespace:  "foo",
+			want:       "192.168.1.1/24",
+			wantGlobal: true,
+		},
+		{
+			name:      "suffixed keys are ignored when disabled, the namespace key is used",
+			namespace: "bar",
+			want:      "10.20.0.0/30",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &v1.ConfigMap{Data: map[string]string{}}
+			for k, v := range data {
+				cm.Data[k] = v
+			}
+			if tt.multiKey {
+				cm.Data["multi-key-pools-global"] = "true"
+			}
+
+			pool, global, _, err := discoverPool(cm, tt.namespace, "")
+			if err != nil {
+				t.Fatalf("discoverPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+			assert.Equal(t, !tt.wantGlobal, hasNamespacePool(cm, tt.namespace))
+		})
+	}
+}
+
+func Test_allowlistRanges(t *testing.T) {
+	assert.Equal(t, "10.0.0.50-10.0.0.50,10.0.0.60-10.0.0.65", allowlistRanges("10.0.0.50, 10.0.0.60-10.0.0.65"))
+	assert.Equal(t, "fd00::1-fd00::1", allowlistRanges("fd00::1"))
+}
+
+func Test_discoverPoolNamespaceFirst(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]string
+		want       string
+		wantGlobal bool
+	}{
+		{
+			name: "allowlist of the namespace over the global range",
+			data: map[string]string{"allow-team": "10.0.0.50", "range-global": "10.1.0.1-10.1.0.9"},
+			want: "10.0.0.50-10.0.0.50",
+		},
+		{
+			name: "range of the namespace over the global cidr",
+			data: map[string]string{"range-team": "10.0.0.1-10.0.0.9", "cidr-global": "10.1.0.0/24"},
+			want: "10.0.0.1-10.0.0.9",
+		},
+		{
+			name:       "global cidr without a namespace pool",
+			data:       map[string]string{"allow-other": "10.0.0.50", "cidr-global": "10.1.0.0/24", "range-global": "10.2.0.1-10.2.0.9"},
+			want:       "10.1.0.0/24",
+			wantGlobal: true,
+		},
+		{
+			name:       "global allowlist without a namespace pool",
+			data:       map[string]string{"allow-global": "10.0.0.50"},
+			want:       "10.0.0.50-10.0.0.50",
+			wantGlobal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, global, _, err := discoverPool(&v1.ConfigMap{Data: tt.data}, "team", KubeVipClientConfig)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+		})
+	}
+}
+
+func Test_syncLoadBalancerAllowlist(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"allow-global": "10.0.0.0,10.0.0.255,10.0.1.60-10.0.1.61",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the allowlisted addresses are allocated, including those ending in .0 and .255
+	var got []string
+	var syncErr error
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name}}
+		createService(t, client, svc)
+		if _, syncErr = syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); syncErr != nil {
+			break
+		}
+		res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, res.Annotations[LoadbalancerIPsAnnotation])
+	}
+	assert.Equal(t, []string{"10.0.0.0", "10.0.0.255", "10.0.1.60", "10.0.1.61"}, got)
+	var outOfIPsErr *ipam.OutOfIPsError
+	assert.ErrorAs(t, syncErr, &outOfIPsErr)
+}
+
+func Test_syncLoadBalancerMultiKeyPool(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-foo-a":            "10.10.10.1-10.10.10.1",
+			"range-foo-b":            "10.10.20.1-10.10.20.1",
+			"multi-key-pools-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second service gets its address from the second key once the first one is exhausted
+	var got []string
+	for _, name := range []string{"first", "second"} {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name}}
+		res := createAndSyncService(t, client, svc)
+		got = append(got, res.Annotations[LoadbalancerIPsAnnotation])
+	}
+	assert.Equal(t, []string{"10.10.10.1", "10.10.20.1"}, got)
+}
+
+func Test_syncLoadBalancerOverflowToGlobal(t *testing.T) {
+	tests := []struct {
+		name         string
+		overflow     string
+		expectIPs    []string
+		expectSource []string
+		expectErr    bool
+	}{
+		{
+			name:         "second service overflows into the global pool",
+			overflow:     "true",
+			expectIPs:    []string{"10.10.10.1", "10.20.0.2"},
+			expectSource: []string{SourcePoolNamespace, SourcePoolGlobal},
+		},
+		{
+			name:         "second service fails without overflow",
+			overflow:     "false",
+			expectIPs:    []string{"10.10.10.1", ""},
+			expectSource: []string{SourcePoolNamespace, ""},
+			expectErr:    true,
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-foo":              "10.10.10.1-10.10.10.1",
+					"range-global":           "10.20.0.1-10.20.0.2",
+					"overflow-to-global-foo": tt.overflow,
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			// a service of another namespace holds the first address of the global pool
+			other := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "bar",
+					Name:        "other",
+					Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.20.0.1"},
+				},
+			}
+			createService(t, client, other)
+
+			var gotIPs, gotSource []string
+			var syncErr error
+			for _, name := range []string{"first", "second"} {
+				svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: name}}
+				createService(t, client, svc)
+				res, err := syncService(t, client, svc)
+				syncErr = err
+				gotIPs = append(gotIPs, res.Annotations[LoadbalancerIPsAnnotation])
+				gotSource = append(gotSource, res.Annotations[SourcePoolAnnotationKey])
+			}
+			assert.Equal(t, tt.expectIPs, gotIPs)
+			assert.Equal(t, tt.expectSource, gotSource)
+			if tt.expectErr {
+				var outOfIPsErr *ipam.OutOfIPsError
+				assert.ErrorAs(t, syncErr, &outOfIPsErr)
+				assert.Empty(t, recorder.Events)
+			} else {
+				assert.NoError(t, syncErr)
+				assert.Equal(t, "Normal PoolOverflow Pool of namespace foo is exhausted, allocated IPs 10.20.0.2 from the global pool", <-recorder.Events)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerOverflowKeepsNamespacePool(t *testing.T) {
+	t.Cleanup(ipam.ResetManager)
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-foo":              "10.10.10.1-10.10.10.1",
+			"cidr-global":            "10.20.0.0/24",
+			"overflow-to-global-foo": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "first"}})
+	assert.Equal(t, "10.10.10.1", first.Annotations[LoadbalancerIPsAnnotation])
+	second := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "second"}})
+	assert.Equal(t, SourcePoolGlobal, second.Annotations[SourcePoolAnnotationKey])
+
+	// the overflow doesn't replace the cached pool of the namespace, its address is allocated again once released
+	if err := client.CoreV1().Services("foo").Delete(ctx, "first", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	third := createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "third"}})
+	assert.Equal(t, "10.10.10.1", third.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, SourcePoolNamespace, third.Annotations[SourcePoolAnnotationKey])
+}
+
+func Test_discoverGlobalSettings(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		"share-aggressive-global":       "true",
+		"reject-portless-lb-global":     "yes",
+		"compact-order-global":          CompactOrderAge,
+		"family-change-behavior-global": "sometimes",
+		"legacy-lbip-family-global":     LegacyLBIPFamilyNone,
+	}}
+
+	buf, restore := tu.CaptureKlog(t, "0")
+	assert.True(t, discoverGlobalBool(cm, "share-aggressive"))
+	assert.False(t, discoverGlobalBool(cm, "reject-portless-lb"))
+	assert.False(t, discoverGlobalBool(cm, "sticky-by-name"))
+	assert.Equal(t, CompactOrderAge, discoverGlobalEnum(cm, "compact-order", CompactOrderShared, CompactOrderAge))
+	assert.Equal(t, FamilyChangeBehaviorDetect, discoverGlobalEnum(cm, "family-change-behavior", FamilyChangeBehaviorDetect, FamilyChangeBehaviorUpgrade))
+	assert.Equal(t, SharingDisabledBehaviorDetect, discoverGlobalEnum(cm, "sharing-disabled-behavior", SharingDisabledBehaviorDetect, SharingDisabledBehaviorReallocate))
+	assert.Equal(t, LegacyLBIPFamilyNone, discoverLegacyLBIPFamily(cm))
+	restore()
+
+	assert.Contains(t, buf.String(), "invalid value [yes] in [reject-portless-lb-global], expected a boolean, ignoring it")
+	assert.Contains(t, buf.String(), "unknown value [sometimes] in [family-change-behavior-global], expected detect or upgrade, defaulting to detect")
+}
+
+func Test_discoverRegionalPool(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"cidr-global":             "192.168.1.1/24",
+			"cidr-team":               "10.10.10.8/29",
+			"cidr-region-west-global": "10.20.0.1/24",
+			"range-region-east-team":  "10.30.0.1-10.30.0.9",
+			"allow-share-team":        "true",
+		},
+	}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		region     string
+		want       string
+		wantGlobal bool
+		allowShare bool
+	}{
+		{
+			name:       "no region takes the global pool",
+			namespace:  "default",
+			want:       "192.168.1.1/24",
+			wantGlobal: true,
+		},
+		{
+			name:       "region takes the regional global pool",
+			namespace:  "default",
+			region:     "west",
+			want:       "10.20.0.1/24",
+			wantGlobal: true,
+		},
+		{
+			name:       "region takes the regional global pool over the namespace pool",
+			namespace:  "team",
+			region:     "west",
+			want:       "10.20.0.1/24",
+			wantGlobal: true,
+			allowShare: true,
+		},
+		{
+			name:       "region takes the regional namespace range",
+			namespace:  "team",
+			region:     "east",
+			want:       "10.30.0.1-10.30.0.9",
+			wantGlobal: false,
+			allowShare: true,
+		},
+		{
+			name:       "region without a pool falls back to the global pool",
+			namespace:  "default",
+			region:     "north",
+			want:       "192.168.1.1/24",
+			wantGlobal: true,
+		},
+		{
+			name:       "region without a pool falls back to the namespace pool",
+			namespace:  "team",
+			region:     "north",
+			want:       "10.10.10.8/29",
+			wantGlobal: false,
+			allowShare: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, global, allowShare, err := discoverRegionalPool(cm, tt.namespace, tt.region, nil, "")
+			if err != nil {
+				t.Fatalf("discoverRegionalPool() error: %v", err)
+			}
+			assert.Equal(t, tt.want, pool)
+			assert.Equal(t, tt.wantGlobal, global)
+			assert.Equal(t, tt.allowShare, allowShare)
+		})
+	}
+}
+
+func Test_syncLoadBalancerRegionFamilyMismatch(t *testing.T) {
+	pools := map[string]string{
+		"range-global":             "10.0.0.1-10.0.0.10,fd00::1-fd00::10",
+		"range-region-west-global": "10.1.0.1-10.1.0.10",
+	}
+	dualStack := []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	tests := []struct {
+		name           string
+		mismatch       map[string]string
+		ipFamilyPolicy *v1.IPFamilyPolicy
+		ipFamilies     []v1.IPFamily
+		wantIPs        string
+		wantErr        bool
+		wantEvent      string
+	}{
+		{
+			name:           "dual-stack service fails on an IPv4-only regional pool",
+			ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies:     dualStack,
+			wantErr:        true,
+			wantEvent:      "Warning RegionPoolFamilyMismatch pool [10.1.0.1-10.1.0.10] of region [west] doesn't serve the IP families of the service: dual-stack requested but pool has no IPv6 range",
+		},
+		{
+			name:           "dual-stack service falls back to the pool of its namespace",
+			mismatch:       map[string]string{"region-family-mismatch-global": "fallback"},
+			ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies:     dualStack,
+			wantIPs:        "10.0.0.1,fd00::1",
+			wantEvent:      "Warning RegionPoolFamilyMismatch pool [10.1.0.1-10.1.0.10] of region [west] doesn't serve the IP families of the service: dual-stack requested but pool has no IPv6 range, taking the pool of namespace test",
+		},
+		{
+			name:           "namespace handling takes precedence over global",
+			mismatch:       map[string]string{"region-family-mismatch-global": "error", "region-family-mismatch-test": "fallback"},
+			ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies:     dualStack,
+			wantIPs:        "10.0.0.1,fd00::1",
+			wantEvent:      "Warning RegionPoolFamilyMismatch pool [10.1.0.1-10.1.0.10] of region [west] doesn't serve the IP families of the service: dual-stack requested but pool has no IPv6 range, taking the pool of namespace test",
+		},
+		{
+			name:           "prefer dual-stack service takes the family the regional pool serves",
+			ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			ipFamilies:     dualStack,
+			wantIPs:        "10.1.0.1",
+		},
+		{
+			name:       "IPv6 service fails on an IPv4-only regional pool",
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			wantErr:    true,
+			wantEvent:  "Warning RegionPoolFamilyMismatch pool [10.1.0.1-10.1.0.10] of region [west] doesn't serve the IP families of the service: no pool configured for IP family IPv6",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			data := map[string]string{}
+			for k, v := range pools {
+				data[k] = v
+			}
+			for k, v := range tt.mismatch {
+				data[k] = v
+			}
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: map[string]string{RegionAnnotationKey: "west"}},
+				Spec:       v1.ServiceSpec{IPFamilyPolicy: tt.ipFamilyPolicy, IPFamilies: tt.ipFamilies},
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if tt.wantErr {
+				var mismatchErr *RegionPoolFamilyError
+				assert.ErrorAs(t, err, &mismatchErr)
+			} else if err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+			if len(tt.wantEvent) > 0 {
+				assert.Len(t, recorder.Events, 1)
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			} else {
+				assert.Empty(t, recorder.Events)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerRegion(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":             "192.168.1.1/24",
+			"cidr-region-west-global": "10.20.0.1/32",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		region  string
+		wantIPs string
+	}{
+		{
+			name:    "west service gets an IP of the west pool",
+			region:  "west",
+			wantIPs: "10.20.0.1",
+		},
+		{
+			name:    "east service without regional pool gets an IP of the global pool",
+			region:  "east",
+			wantIPs: "192.168.1.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        tt.region,
+					Annotations: map[string]string{RegionAnnotationKey: tt.region},
+				},
+			}
+			createService(t, client, svc)
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerDHCPNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+			"dhcp-edge":   "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, svc := range []*v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "edge", Name: "first"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "edge", Name: "second"}},
+	} {
+		createService(t, client, svc)
+		if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatalf("syncLoadBalancer() error: %v", err)
+		}
+
+		res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "0.0.0.0", res.Annotations[LoadbalancerIPsAnnotation])
+		assert.Equal(t, AllocationStrategyDHCP, res.Annotations[AllocationStrategyAnnotationKey])
+	}
+}
+
+func Test_syncLoadBalancerInvalidLoadBalancerIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior string
+		wantIPs  string
+		wantErr  bool
+	}{
+		{
+			name:    "invalid spec.loadBalancerIP gets an address from the pool by default",
+			wantIPs: "192.168.1.1",
+		},
+		{
+			name:     "invalid spec.loadBalancerIP gets an address from the pool with allocate behavior",
+			behavior: InvalidLoadBalancerIPBehaviorAllocate,
+			wantIPs:  "192.168.1.1",
+		},
+		{
+			name:     "invalid spec.loadBalancerIP is left pending with pending behavior",
+			behavior: InvalidLoadBalancerIPBehaviorPending,
+			wantErr:  true,
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-invalid-ip": "192.168.1.1/32",
+				},
+			}
+			if len(tt.behavior) > 0 {
+				cm.Data["invalid-loadbalancer-ip-behavior-global"] = tt.behavior
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "invalid-ip",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "not-an-ip",
+				},
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+			}
+			var invalidIPErr *InvalidLoadBalancerIPError
+			if tt.wantErr && !errors.As(err, &invalidIPErr) {
+				t.Errorf("expected an InvalidLoadBalancerIPError, got %T", err)
+			}
+
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.True(t, strings.HasPrefix(<-recorder.Events, "Warning InvalidLoadBalancerIP invalid spec.loadBalancerIP [not-an-ip]"))
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name             string
+		serviceNamespace string
+		serviceName      string
+
+		originalService v1.Service
+		poolConfigMap   *v1.ConfigMap
+		expectedService v1.Service
+		wantErr         bool
+	}{
+		{
+			name: "add new annotation to legacy service which already has spec.loadbalancerIP, remove legacy label",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+						"ipam-address":   "192.168.1.1",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation: "192.168.1.1",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "add new annotation and loadbalancerIP to new service",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "192.168.1.1",
+						AllocationStrategyAnnotationKey: AllocationStrategyAsc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "255",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "add new annotation to new service which doesn't have spec.loadbalancerIP, doesn't add spec.loadbalancerIP",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation: "192.168.1.1",
+					},
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "192.168.1.1",
+						AllocationStrategyAnnotationKey: AllocationStrategyStatic,
+					},
+				},
+			},
+		},
+		{
+			name: "ipv6, add new annotation and loadbalancerIP to new service",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "fe80::10/126",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "fe80::10",
+						AllocationStrategyAnnotationKey: AllocationStrategyAsc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "3",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "fe80::10",
+				},
+			},
+		},
+		{
+			name: "create config map with different name and namespace",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "load-balancer",
+					Namespace: "load-balancer-ns",
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "192.168.1.1",
+						AllocationStrategyAnnotationKey: AllocationStrategyAsc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "255",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "dualstack loadbalancer",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				},
+			},
+
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "10.120.120.1/24,fe80::10/126",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "fe80::10,10.120.120.1",
+						AllocationStrategyAnnotationKey: AllocationStrategyAsc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "258",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+					LoadBalancerIP: "fe80::10",
+				},
+			},
+		},
+		{
+			name: "descending search order, service gets the allocation strategy desc",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":  "192.168.1.1/24",
+					"search-order": "desc",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "192.168.1.254",
+						AllocationStrategyAnnotationKey: AllocationStrategyDesc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "255",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.254",
+				},
+			},
+		},
+		{
+			name: "dhcp pool, service gets the allocation strategy dhcp",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "0.0.0.0/32",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "0.0.0.0",
+						AllocationStrategyAnnotationKey: AllocationStrategyDHCP,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "0.0.0.0",
+				},
+			},
+		},
+		{
+			name: "service interface defined in global, service gets the interface config",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":      "192.168.1.1/24",
+					"interface-global": "eth0",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:                 "192.168.1.1",
+						AllocationStrategyAnnotationKey:           AllocationStrategyAsc,
+						SourcePoolAnnotationKey:                   SourcePoolGlobal,
+						PoolFreeAnnotationKey:                     "255",
+						LoadbalancerServiceInterfaceAnnotationKey: "eth0",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "service interface defined in service's namespace, service gets the interface config",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":    "192.168.1.1/24",
+					"interface-test": "eth0",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:                 "192.168.1.1",
+						AllocationStrategyAnnotationKey:           AllocationStrategyAsc,
+						SourcePoolAnnotationKey:                   SourcePoolGlobal,
+						PoolFreeAnnotationKey:                     "255",
+						LoadbalancerServiceInterfaceAnnotationKey: "eth0",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+		{
+			name: "service interface not defined in service's namespace, service doesn't get the interface config",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{},
+			},
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":    "192.168.1.1/24",
+					"interface-what": "eth0",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotation:       "192.168.1.1",
+						AllocationStrategyAnnotationKey: AllocationStrategyAsc,
+						SourcePoolAnnotationKey:         SourcePoolGlobal,
+						PoolFreeAnnotationKey:           "255",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					LoadBalancerIP: "192.168.1.1",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := KubeVipClientConfigNamespace
+			cm := KubeVipClientConfig
+			if tt.poolConfigMap != nil {
+				ns = tt.poolConfigMap.GetObjectMeta().GetNamespace()
+				cm = tt.poolConfigMap.GetObjectMeta().GetName()
+			}
+
+			mgr := &kubevipLoadBalancerManager{
+				kubeClient:     fake.NewSimpleClientset(),
+				namespace:      ns,
+				cloudConfigMap: cm,
+			}
+
+			// create dummy service
+			_, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), &tt.originalService, metav1.CreateOptions{}) // #nosec G601
+			if err != nil {
+				t.Error(err)
+			}
+
+			// create pool if needed
+			if tt.poolConfigMap != nil {
+				_, err := mgr.kubeClient.CoreV1().ConfigMaps(ns).Create(context.Background(), tt.poolConfigMap, metav1.CreateOptions{})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+
+			_, err = syncLoadBalancer(context.Background(), mgr.kubeClient, &tt.originalService, cm, ns) // #nosec G601
+			if err != nil {
+				t.Error(err)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+				return
+			}
+
+			resService, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "name", metav1.GetOptions{})
+			if err != nil {
+				t.Error(err)
+			}
+
+			// the time the IPs were assigned isn't predictable
+			delete(resService.Annotations, IPAssignedAtAnnotationKey)
+			assert.EqualValues(t, tt.expectedService, *resService)
+		})
+	}
+}
+
+func Test_syncLoadBalancerLoadBalancerIPDrift(t *testing.T) {
+	tests := []struct {
+		name       string
+		specIP     string
+		ips        string
+		wantSpecIP string
+		wantIPs    string
+		wantEvent  string
+		wantStatic bool
+	}{
+		{
+			name:       "free spec IP in the pool is adopted",
+			specIP:     "192.168.1.5",
+			ips:        "192.168.1.1",
+			wantSpecIP: "192.168.1.5",
+			wantIPs:    "192.168.1.5",
+			wantEvent:  "Normal LoadBalancerIPAdopted Adopted spec.loadBalancerIP 192.168.1.5, IPs 192.168.1.1 -> 192.168.1.5",
+			wantStatic: true,
+		},
+		{
+			name:       "dualstack, free spec IP replaces the primary IP",
+			specIP:     "192.168.1.5",
+			ips:        "192.168.1.1,fe80::10",
+			wantSpecIP: "192.168.1.5",
+			wantIPs:    "192.168.1.5,fe80::10",
+			wantEvent:  "Normal LoadBalancerIPAdopted Adopted spec.loadBalancerIP 192.168.1.5, IPs 192.168.1.1,fe80::10 -> 192.168.1.5,fe80::10",
+			wantStatic: true,
+		},
+		{
+			name:       "spec IP outside the pool is restored",
+			specIP:     "10.0.0.5",
+			ips:        "192.168.1.1",
+			wantSpecIP: "192.168.1.1",
+			wantIPs:    "192.168.1.1",
+			wantEvent:  "Warning LoadBalancerIPRestored Restored spec.loadBalancerIP 10.0.0.5 -> 192.168.1.1, it is not in the pool [192.168.1.1/24,fe80::10/127]",
+		},
+		{
+			name:       "spec IP used by another service is restored",
+			specIP:     "192.168.1.2",
+			ips:        "192.168.1.1",
+			wantSpecIP: "192.168.1.1",
+			wantIPs:    "192.168.1.1",
+			wantEvent:  "Warning LoadBalancerIPRestored Restored spec.loadBalancerIP 192.168.1.2 -> 192.168.1.1, it is used by another service",
+		},
+		{
+			name:       "spec IP of another family than the primary IP is restored",
+			specIP:     "fe80::11",
+			ips:        "192.168.1.1,fe80::10",
+			wantSpecIP: "192.168.1.1",
+			wantIPs:    "192.168.1.1,fe80::10",
+			wantEvent:  "Warning LoadBalancerIPRestored Restored spec.loadBalancerIP fe80::11 -> 192.168.1.1, it is not of the family of the primary IP",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24,fe80::10/127",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			other := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "other",
+					Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: "192.168.1.2"},
+				},
+				Spec: v1.ServiceSpec{LoadBalancerIP: "192.168.1.2"},
+			}
+			// the user edited spec.loadBalancerIP after the IPs were allocated
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "name",
+					Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: tt.ips},
+				},
+				Spec: v1.ServiceSpec{LoadBalancerIP: tt.specIP},
+			}
+			for _, s := range []*v1.Service{other, svc} {
+				createService(t, client, s)
+			}
+
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantSpecIP, res.Spec.LoadBalancerIP)
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.wantStatic, res.Annotations[AllocationStrategyAnnotationKey] == AllocationStrategyStatic)
+			assert.False(t, loadBalancerIPDrifted(res), "service still drifted")
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Equal(t, tt.wantEvent, <-recorder.Events)
+		})
+	}
+}
+
+func Test_parseServiceDenylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "empty denylist",
+			value: "",
+			want:  []string{},
+		},
+		{
+			name:  "patterns",
+			value: "kube-system/*, monitoring/prometheus-*",
+			want:  []string{"kube-system/*", "monitoring/prometheus-*"},
+		},
+		{
+			name:    "pattern without namespace",
+			value:   "kube-dns",
+			wantErr: true,
+		},
+		{
+			name:    "malformed pattern",
+			value:   "kube-system/[",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServiceDenylist(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServiceDenylist() error: %v, expected: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerDenylist(t *testing.T) {
+	tests := []struct {
+		name      string
+		denylist  string
+		namespace string
+		svcName   string
+		wantIPs   string
+	}{
+		{
+			name:      "kube-dns is denylisted by default",
+			namespace: "kube-system",
+			svcName:   "kube-dns",
+			wantIPs:   "",
+		},
+		{
+			name:      "other kube-system services are allocated by default",
+			namespace: "kube-system",
+			svcName:   "ingress",
+			wantIPs:   "192.168.1.1",
+		},
+		{
+			name:      "configured denylist pattern",
+			denylist:  "kube-system/*",
+			namespace: "kube-system",
+			svcName:   "ingress",
+			wantIPs:   "",
+		},
+	}
+
+	defer func() { serviceDenylist = strings.Split(DefaultServiceDenylist, ",") }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceDenylist = strings.Split(DefaultServiceDenylist, ",")
+			if len(tt.denylist) > 0 {
+				denylist, err := parseServiceDenylist(tt.denylist)
+				if err != nil {
+					t.Fatal(err)
+				}
+				serviceDenylist = denylist
+			}
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: tt.svcName}}
+			createService(t, client, svc)
+
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerConflictReallocates(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	createService(t, client, svc)
+
+	// the first update conflicts because a concurrent sync gave 192.168.1.1 to another service
+	var attempts []string
+	client.PrependReactor("update", "services", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		updated := action.(clientgotesting.UpdateAction).GetObject().(*v1.Service)
+		attempts = append(attempts, updated.Annotations[LoadbalancerIPsAnnotation])
+		if len(attempts) > 1 {
+			return false, nil, nil
+		}
+		other := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        "other",
+				Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: "192.168.1.1"},
+			},
+		}
+		if err := client.Tracker().Add(other); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(v1.Resource("services"), updated.Name, errors.New("the object has been modified"))
+	})
+
+	if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatalf("syncLoadBalancer() error: %v", err)
+	}
+
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, attempts)
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.1.2", res.Annotations[LoadbalancerIPsAnnotation])
+}
+
+func Test_syncLoadBalancerLegacyMigrationConcurrentEdit(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "name",
+			Labels:    map[string]string{LegacyIpamAddressLabelKey: "192.168.1.1"},
+		},
+		Spec: v1.ServiceSpec{LoadBalancerIP: "192.168.1.1"},
+	}
+	createService(t, client, svc)
+
+	// a concurrent edit restores the legacy label right after the first migration update
+	updates := 0
+	client.PrependReactor("update", "services", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates > 1 {
+			return false, nil, nil
+		}
+		updated := action.(clientgotesting.UpdateAction).GetObject().(*v1.Service).DeepCopy()
+		updated.Labels[LegacyIpamAddressLabelKey] = "192.168.1.1"
+		if err := client.Tracker().Update(v1.SchemeGroupVersion.WithResource("services"), updated, updated.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, updated, nil
+	})
+
+	if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatalf("syncLoadBalancer() error: %v", err)
+	}
+
+	assert.Equal(t, 2, updates)
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, res.Labels, LegacyIpamAddressLabelKey)
+	assert.Equal(t, ImplementationLabelValue, res.Labels[ImplementationLabelKey])
+	assert.Equal(t, "192.168.1.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, AllocationStrategyStatic, res.Annotations[AllocationStrategyAnnotationKey])
+}
+
+func Test_syncLoadBalancerFrozen(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "name",
+			Annotations: map[string]string{FreezeAnnotationKey: "true"},
+		},
+	}
+	createService(t, client, svc)
+
+	// a frozen service without IPs still gets IPs
+	allocated := mustSyncService(t, client, svc)
+	assert.Equal(t, "192.168.1.1", allocated.Annotations[LoadbalancerIPsAnnotation])
+
+	// the pool changes and spec.loadBalancerIP is edited to a free IP of the new pool
+	cm.Data["cidr-global"] = "10.0.0.1/24"
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	allocated.Spec.LoadBalancerIP = "10.0.0.5"
+	edited, err := client.CoreV1().Services(svc.Namespace).Update(context.Background(), allocated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.ClearActions()
+	if _, err := syncLoadBalancer(context.Background(), client, edited, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatalf("syncLoadBalancer() error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("frozen service was updated: %v", action)
+		}
+	}
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.1.1", res.Annotations[LoadbalancerIPsAnnotation])
+}
+
+func Test_syncLoadBalancerReadsConfigMapOnce(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":                    "10.0.0.0/24",
+			"allow-share-global":             "true",
+			"compact-shared-ips-global":      "true",
+			"enforce-pool-boundaries-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	allocated := createAndSyncService(t, client, &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	})
+	assert.Equal(t, "10.0.0.1", allocated.Annotations[LoadbalancerIPsAnnotation])
+
+	// the sync of an allocated service reads the configmap once for all its checks
+	client.ClearActions()
+	mustSyncService(t, client, allocated)
+	gets := 0
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "configmaps" && action.GetVerb() == "get" {
+			gets++
+		}
+	}
+	assert.Equal(t, 1, gets)
+}
+
+func Test_syncLoadBalancerIPAssignedAt(t *testing.T) {
+	const stale = "2000-01-01T00:00:00Z"
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "name",
+			Annotations: map[string]string{IPAssignedAtAnnotationKey: stale},
+		},
+	}
+	createService(t, client, svc)
+
+	// the IP changes, the timestamp is updated
+	allocated := mustSyncService(t, client, svc)
+	assert.Equal(t, "192.168.1.1", allocated.Annotations[LoadbalancerIPsAnnotation])
+	assignedAt := allocated.Annotations[IPAssignedAtAnnotationKey]
+	assert.NotEqual(t, stale, assignedAt)
+	if _, err := time.Parse(time.RFC3339, assignedAt); err != nil {
+		t.Errorf("expect an RFC3339 timestamp, got %q: %v", assignedAt, err)
+	}
+
+	// a no-op reconcile keeps the timestamp
+	allocated.Annotations[IPAssignedAtAnnotationKey] = stale
+	allocated, err := client.CoreV1().Services(svc.Namespace).Update(context.Background(), allocated, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncLoadBalancer(context.Background(), client, allocated, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatalf("syncLoadBalancer() error: %v", err)
+	}
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.1.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, stale, res.Annotations[IPAssignedAtAnnotationKey])
+}
+
+func Test_syncLoadBalancerPoolFree(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.4",
+			"cidr-dhcp":    "0.0.0.0/32",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(namespace, name string) *v1.Service {
+		return createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+	}
+
+	// the free count includes the IP just allocated to the service
+	assert.Equal(t, "3", allocate("default", "first").Annotations[PoolFreeAnnotationKey])
+	assert.Equal(t, "2", allocate("default", "second").Annotations[PoolFreeAnnotationKey])
+	// the DHCP pool has no free count
+	dhcp := allocate("dhcp", "dhcp")
+	assert.Equal(t, "0.0.0.0", dhcp.Annotations[LoadbalancerIPsAnnotation])
+	assert.NotContains(t, dhcp.Annotations, PoolFreeAnnotationKey)
+}
+
+func Test_syncLoadBalancerIPZone(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.1#zone=us-east-1a,10.0.0.2-10.0.0.2,10.0.0.3-10.0.0.3#zone=us-east-1b",
+			"allow-team":   "10.1.0.50#zone=a,10.1.0.51",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(namespace, name string) *v1.Service {
+		return createAndSyncService(t, client, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}})
+	}
+
+	first := allocate("default", "first")
+	assert.Equal(t, "10.0.0.1", first.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "us-east-1a", first.Annotations[IPZoneAnnotationKey])
+	// the entry of 10.0.0.2 has no metadata
+	second := allocate("default", "second")
+	assert.Equal(t, "10.0.0.2", second.Annotations[LoadbalancerIPsAnnotation])
+	assert.NotContains(t, second.Annotations, IPZoneAnnotationKey)
+	third := allocate("default", "third")
+	assert.Equal(t, "10.0.0.3", third.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "us-east-1b", third.Annotations[IPZoneAnnotationKey])
+
+	allowlisted := allocate("team", "allowlisted")
+	assert.Equal(t, "10.1.0.50", allowlisted.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "a", allowlisted.Annotations[IPZoneAnnotationKey])
+}
+
+func Test_syncLoadBalancerIPFamiliesReordered(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "10.120.120.1/24,fe80::10/126",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "name",
+		},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	svc, err := client.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(svc *v1.Service) *v1.Service {
+		svc, err := client.CoreV1().Services(svc.Namespace).Update(context.Background(), svc, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustSyncService(t, client, svc)
+	}
+
+	allocated := sync(svc)
+	assert.Equal(t, "10.120.120.1,fe80::10", allocated.Annotations[LoadbalancerIPsAnnotation])
+	assignedAt := allocated.Annotations[IPAssignedAtAnnotationKey]
+
+	// swapping the families flips the IPs, they are the same so the timestamp is kept
+	allocated.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	res := sync(allocated)
+	assert.Equal(t, "fe80::10,10.120.120.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "fe80::10", res.Spec.LoadBalancerIP)
+	assert.Equal(t, assignedAt, res.Annotations[IPAssignedAtAnnotationKey])
+
+	// the family order annotation takes precedence over spec.IPFamilies
+	res.Annotations[FamilyOrderAnnotationKey] = "ipv4,ipv6"
+	res = sync(res)
+	assert.Equal(t, "10.120.120.1,fe80::10", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "10.120.120.1", res.Spec.LoadBalancerIP)
+}
+
+func Test_syncLoadBalancerLegacyIPPreferIPv4(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":                  "10.120.120.1/24,fe80::10/126",
+			"legacy-ip-prefer-ipv4-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "name",
+		},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+	}
+	svc, err := client.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(svc *v1.Service) *v1.Service {
+		svc, err := client.CoreV1().Services(svc.Namespace).Update(context.Background(), svc, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustSyncService(t, client, svc)
+	}
+
+	// an IPv6-primary service gets its IPv4 in the legacy field
+	res := sync(svc)
+	assert.Equal(t, "fe80::10,10.120.120.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "10.120.120.1", res.Spec.LoadBalancerIP)
+
+	// it keeps it whatever the family order
+	res.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	res = sync(res)
+	assert.Equal(t, "10.120.120.1,fe80::10", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "10.120.120.1", res.Spec.LoadBalancerIP)
+	res.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+	res = sync(res)
+	assert.Equal(t, "fe80::10,10.120.120.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "10.120.120.1", res.Spec.LoadBalancerIP)
+
+	// the IPv4 isn't a drift, a reconcile corrects it to the primary IP once the key is removed
+	cm.Data = map[string]string{"cidr-global": "10.120.120.1/24,fe80::10/126"}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, loadBalancerIPDrifted(res))
+	res = sync(res)
+	assert.Equal(t, "fe80::10,10.120.120.1", res.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "fe80::10", res.Spec.LoadBalancerIP)
+}
+
+func Test_legacyLoadBalancerIP(t *testing.T) {
+	assert.Equal(t, "fd00::1", legacyLoadBalancerIP("fd00::1,10.0.0.1", LegacyLBIPFamilyPrimary))
+	assert.Equal(t, "10.0.0.1", legacyLoadBalancerIP("fd00::1,10.0.0.1", LegacyLBIPFamilyIPv4))
+	assert.Equal(t, "10.0.0.1", legacyLoadBalancerIP("10.0.0.1,fd00::1", LegacyLBIPFamilyIPv4))
+	assert.Equal(t, "", legacyLoadBalancerIP("fd00::1,10.0.0.1", LegacyLBIPFamilyNone))
+	// a single-stack IPv6 service keeps its IPv6
+	assert.Equal(t, "fd00::1", legacyLoadBalancerIP("fd00::1", LegacyLBIPFamilyIPv4))
+	assert.Equal(t, "fd00::1", legacyLoadBalancerIP("fd00::1", LegacyLBIPFamilyNone))
+}
+
+func Test_syncLoadBalancerLegacyLBIPFamily(t *testing.T) {
+	tests := []struct {
+		family string
+		want   string
+	}{
+		{family: LegacyLBIPFamilyIPv4, want: "10.120.120.1"},
+		{family: LegacyLBIPFamilyPrimary, want: "fe80::10"},
+		{family: LegacyLBIPFamilyNone, want: ""},
+		{family: "invalid", want: "fe80::10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.family, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global":               "10.120.120.1/24,fe80::10/126",
+					"legacy-lbip-family-global": tt.family,
+					// legacy-lbip-family-global takes precedence
+					"legacy-ip-prefer-ipv4-global": "true",
+				},
+			}
+			if tt.family == LegacyLBIPFamilyIPv4 {
+				delete(cm.Data, "legacy-ip-prefer-ipv4-global")
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+				},
+			}
+			createService(t, client, svc)
+
+			for range 2 {
+				svc, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				res := mustSyncService(t, client, svc)
+				// the field is stable on the next reconcile
+				assert.Equal(t, "fe80::10,10.120.120.1", res.Annotations[LoadbalancerIPsAnnotation])
+				assert.Equal(t, tt.want, res.Spec.LoadBalancerIP)
+			}
+		})
+	}
+}
+
+func Test_orderIPsByFamily(t *testing.T) {
+	v4v6 := []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	v6v4 := []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}
+
+	assert.Equal(t, "fd00::1,10.0.0.1", orderIPsByFamily("10.0.0.1,fd00::1", v6v4))
+	assert.Equal(t, "10.0.0.1,fd00::1", orderIPsByFamily("fd00::1,10.0.0.1", v4v6))
+	assert.Equal(t, "10.0.0.1,fd00::1", orderIPsByFamily("10.0.0.1,fd00::1", v4v6))
+	// the IPs of a family keep their order
+	assert.Equal(t, "fd00::2,fd00::1,10.0.0.2,10.0.0.1", orderIPsByFamily("10.0.0.2,fd00::2,10.0.0.1,fd00::1", v6v4))
+	// single-stack and invalid IPs are left alone
+	assert.Equal(t, "10.0.0.1,fd00::1", orderIPsByFamily("10.0.0.1,fd00::1", []v1.IPFamily{v1.IPv6Protocol}))
+	assert.Equal(t, "10.0.0.1,invalid", orderIPsByFamily("10.0.0.1,invalid", v6v4))
+}
+
+func Test_checkPoolCapacity(t *testing.T) {
+	newSvc := func(namespace, name, ips string) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        name,
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ips},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		pool      string
+		svcs      []v1.Service
+		wantEvent bool
+	}{
+		{
+			name: "in-use addresses fit in the pool",
+			pool: "10.0.0.1-10.0.0.2",
+			svcs: []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("test", "b", "10.0.0.2")},
+		},
+		{
+			name:      "in-use addresses exceed the pool",
+			pool:      "10.0.0.1-10.0.0.2",
+			svcs:      []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("test", "b", "10.0.0.2"), newSvc("test", "c", "192.168.0.1")},
+			wantEvent: true,
+		},
+		{
+			name:      "in-use addresses exceed a cidr pool",
+			pool:      "10.0.0.0/32",
+			svcs:      []v1.Service{newSvc("test", "a", "10.0.0.0,fd00::1")},
+			wantEvent: true,
+		},
+		{
+			name: "shared addresses are counted once",
+			pool: "10.0.0.1-10.0.0.1",
+			svcs: []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("test", "b", "10.0.0.1")},
+		},
+		{
+			name: "services of other namespaces aren't counted",
+			pool: "10.0.0.1-10.0.0.1",
+			svcs: []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("other", "b", "192.168.0.1")},
+		},
+		{
+			name: "DHCP addresses aren't counted",
+			pool: "10.0.0.1-10.0.0.1",
+			svcs: []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("test", "b", "0.0.0.0")},
+		},
+		{
+			name: "DHCP pool",
+			pool: DHCPPool,
+			svcs: []v1.Service{newSvc("test", "a", "10.0.0.1"), newSvc("test", "b", "10.0.0.2")},
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			service := newSvc("test", "new", "")
+			checkPoolCapacity(&service, tt.pool, &v1.ServiceList{Items: tt.svcs})
+
+			if !tt.wantEvent {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			if assert.Len(t, recorder.Events, 1) {
+				assert.Contains(t, <-recorder.Events, "Warning InUseExceedsPoolSize")
+			}
+		})
+	}
+}
+
+func Test_parseConflictBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     string
+		duration  string
+		failFast  string
+		wantSteps int
+		wantDur   time.Duration
+		wantErr   bool
+	}{
+		{
+			name:      "defaults",
+			wantSteps: retry.DefaultRetry.Steps,
+			wantDur:   retry.DefaultRetry.Duration,
+		},
+		{
+			name:      "steps and duration",
+			steps:     "10",
+			duration:  "50ms",
+			wantSteps: 10,
+			wantDur:   50 * time.Millisecond,
+		},
+		{
+			name:      "fail-fast makes a single attempt",
+			steps:     "10",
+			failFast:  "true",
+			wantSteps: 1,
+			wantDur:   retry.DefaultRetry.Duration,
+		},
+		{
+			name:      "fail-fast disabled",
+			failFast:  "false",
+			wantSteps: retry.DefaultRetry.Steps,
+			wantDur:   retry.DefaultRetry.Duration,
+		},
+		{
+			name:    "invalid steps",
+			steps:   "0",
+			wantErr: true,
+		},
+		{
+			name:     "invalid duration",
+			duration: "10",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid fail-fast",
+			failFast: "maybe",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff, err := parseConflictBackoff(tt.steps, tt.duration, tt.failFast)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSteps, backoff.Steps)
+			assert.Equal(t, tt.wantDur, backoff.Duration)
+		})
+	}
+}
+
+func Test_syncLoadBalancerLastError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	createService(t, client, svc)
+	getLastError := func() (string, bool) {
+		res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastError, ok := res.Annotations[LastErrorAnnotationKey]
+		return lastError, ok
+	}
+
+	// the sync fails without a pool
+	if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err == nil {
+		t.Fatal("expect syncLoadBalancer() to fail without a pool")
+	}
+	lastError, ok := getLastError()
+	assert.True(t, ok)
+	at, message, _ := strings.Cut(lastError, ": ")
+	assert.Equal(t, "configmap [kubevip] has no pools defined", message)
+	if _, err := time.Parse(time.RFC3339, at); err != nil {
+		t.Errorf("expect an RFC3339 timestamp, got %q: %v", at, err)
+	}
+
+	// the same failure keeps the time of the first one
+	res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Annotations[LastErrorAnnotationKey] = "2000-01-01T00:00:00Z: configmap [kubevip] has no pools defined"
+	res, err = client.CoreV1().Services(svc.Namespace).Update(context.Background(), res, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncLoadBalancer(context.Background(), client, res, KubeVipClientConfig, KubeVipClientConfigNamespace); err == nil {
+		t.Fatal("expect syncLoadBalancer() to fail without a pool")
+	}
+	lastError, _ = getLastError()
+	assert.Equal(t, "2000-01-01T00:00:00Z: configmap [kubevip] has no pools defined", lastError)
+
+	// the annotation is removed once the sync succeeds
+	cm.Data["cidr-global"] = "192.168.1.1/24"
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	mustSyncService(t, client, res)
+	_, ok = getLastError()
+	assert.False(t, ok)
+}
+
+func Test_recordLastErrorUnchanged(t *testing.T) {
+	syncErr := errors.New("no pool")
+	tests := []struct {
+		name    string
+		svc     *v1.Service
+		syncErr error
+	}{
+		{name: "successful sync without the annotation", svc: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "ok"}}},
+		{
+			name: "same failure",
+			svc: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "failed",
+				Annotations: map[string]string{LastErrorAnnotationKey: "2000-01-01T00:00:00Z: no pool"}}},
+			syncErr: syncErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.svc)
+			recordLastError(context.Background(), client, tt.svc, tt.syncErr)
+			assert.Empty(t, client.Actions(), "the service in hand is up to date, it isn't read again")
+		})
+	}
+}
+
+func TestEnsureLoadBalancerConcurrentWorkers(t *testing.T) {
+	const (
+		workers  = 8
+		services = 32
+	)
+
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "10.0.0.1-10.0.0.64",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := make(chan *v1.Service, services)
+	for i := 0; i < services; i++ {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: fmt.Sprintf("ns-%d", i%4), Name: fmt.Sprintf("svc-%d", i)}}
+		createService(t, client, svc)
+		queue <- svc
+	}
+	close(queue)
+
+	// the workers of the cloud-controller-manager service controller, --concurrent-service-syncs
+	lb := newLoadBalancer(client, KubeVipClientConfigNamespace, KubeVipClientConfig)
+	errs := make(chan error, services)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for svc := range queue {
+				if _, err := lb.EnsureLoadBalancer(context.Background(), "", svc, nil); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("EnsureLoadBalancer() error: %v", err)
+	}
+
+	svcs, err := client.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]string{}
+	for _, svc := range svcs.Items {
+		ip := svc.Annotations[LoadbalancerIPsAnnotation]
+		if len(ip) == 0 {
+			t.Errorf("service %s/%s got no address", svc.Namespace, svc.Name)
+			continue
+		}
+		if owner, ok := owners[ip]; ok {
+			t.Errorf("address %s given to both %s and %s/%s", ip, owner, svc.Namespace, svc.Name)
+		}
+		owners[ip] = svc.Namespace + "/" + svc.Name
+	}
+	assert.Len(t, owners, services)
+}
+
+func Test_syncLoadBalancerReadOnlyConfigMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap bool
+		expectIP  string
+		expectErr bool
+	}{
+		{
+			name:      "service gets an IP without writing the configmap",
+			configMap: true,
+			expectIP:  "10.0.0.1",
+		},
+		{
+			name:      "missing configmap isn't created",
+			expectErr: true,
+		},
+	}
+
+	configMapReadOnly = true
+	defer func() { configMapReadOnly = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if tt.configMap {
+				cm := &v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      KubeVipClientConfig,
+						Namespace: KubeVipClientConfigNamespace,
 					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
+					Data: map[string]string{"cidr-global": "10.0.0.0/24"},
+				}
+				if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}}
+			createService(t, client, svc)
+			client.ClearActions()
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// the configmaps are only read, the service is the only object written
+			for _, action := range client.Actions() {
+				if action.GetResource().Resource == "configmaps" {
+					assert.Contains(t, []string{"get", "list", "watch"}, action.GetVerb(), "unexpected configmap action %v", action)
+				}
+			}
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectIP, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_getConfigLogsFallbackOnce(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, restore := tu.CaptureKlog(t, "0")
+	for _, name := range []string{"first", "second", "third"} {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "global-only", Name: name}}
+		createService(t, client, svc)
+		if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatalf("syncLoadBalancer() error: %v", err)
+		}
+	}
+	restore()
+
+	assert.Equal(t, 1, strings.Count(buf.String(), "no cidr config for namespace [global-only]"))
+	assert.Equal(t, 1, strings.Count(buf.String(), "no allow-share config for namespace [global-only]"))
+}
+
+func Test_allocationStrategy(t *testing.T) {
+	tests := []struct {
+		name                   string
+		vips                   string
+		preferredIpv4ServiceIP string
+		kubevipLBConfig        *config.KubevipLBConfig
+		want                   string
+	}{
+		{
+			name: "no config allocates ascending",
+			vips: "10.0.0.1",
+			want: AllocationStrategyAsc,
+		},
+		{
+			name:            "descending search order",
+			vips:            "10.0.0.254",
+			kubevipLBConfig: &config.KubevipLBConfig{ReturnIPInDescOrder: true},
+			want:            AllocationStrategyDesc,
+		},
+		{
+			name:                   "shared ipv4 address",
+			vips:                   "10.0.0.1",
+			preferredIpv4ServiceIP: "10.0.0.1",
+			kubevipLBConfig:        &config.KubevipLBConfig{ReturnIPInDescOrder: true},
+			want:                   AllocationStrategyShared,
+		},
+		{
+			name:                   "dualstack with shared ipv4 address",
+			vips:                   "fe80::10,10.0.0.1",
+			preferredIpv4ServiceIP: "10.0.0.1",
+			want:                   AllocationStrategyShared,
+		},
+		{
+			name: "dhcp",
+			vips: "0.0.0.0",
+			want: AllocationStrategyDHCP,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, allocationStrategy(tt.vips, tt.preferredIpv4ServiceIP, tt.kubevipLBConfig))
+		})
+	}
+}
+
+func Test_migrateImplementationLabel(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	managed := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "managed",
+			Labels: map[string]string{
+				ImplementationLabelKey: ImplementationLabelValue,
+				"app":                  "test",
+			},
+			Annotations: map[string]string{
+				LoadbalancerIPsAnnotation: "192.168.1.1",
+			},
+		},
+	}
+	notManaged := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "not-managed",
+		},
+	}
+	for _, svc := range []*v1.Service{managed, notManaged} {
+		createService(t, client, svc)
+	}
+
+	newKey := "kube-vip.io/implementation"
+	implementationLabelKey = newKey
+	defer func() { implementationLabelKey = ImplementationLabelKey }()
+
+	if err := migrateImplementationLabel(ctx, client, ImplementationLabelKey, newKey); err != nil {
+		t.Fatalf("migrateImplementationLabel() error: %v", err)
+	}
+
+	res, err := client.CoreV1().Services("test").Get(ctx, "managed", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{newKey: ImplementationLabelValue, "app": "test"}, res.Labels)
+
+	// the relabeled service is still discovered as an implemented service
+	svcs, err := client.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUseSet, _, err := mapImplementedServices(svcs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, inUseSet.Contains(netip.MustParseAddr("192.168.1.1")))
+
+	res, err = client.CoreV1().Services("test").Get(ctx, "not-managed", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, res.Labels)
+}
+
+func Test_allocationWebhook(t *testing.T) {
+	received := make(chan webhook.Payload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var p webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	notifier, err := webhook.NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocationNotifier = notifier
+	defer func() { allocationNotifier = nil }()
+
+	ctx := context.Background()
+	mgr := &kubevipLoadBalancerManager{
+		kubeClient:     fake.NewSimpleClientset(),
+		namespace:      KubeVipClientConfigNamespace,
+		cloudConfigMap: KubeVipClientConfig,
+	}
+	poolConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "192.168.1.1/24",
+		},
+	}
+	if _, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, poolConfigMap, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "webhook",
+			Name:      "name",
+		},
+	}
+	createService(t, mgr.kubeClient, svc)
+
+	waitForPayload := func() webhook.Payload {
+		select {
+		case p := <-received:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook didn't receive the payload")
+		}
+		return webhook.Payload{}
+	}
+
+	if _, err := syncLoadBalancer(ctx, mgr.kubeClient, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, webhook.Payload{Service: "name", Namespace: "webhook", IP: "192.168.1.1", Action: webhook.ActionAllocate}, waitForPayload())
+
+	allocated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.EnsureLoadBalancerDeleted(ctx, "", allocated); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, webhook.Payload{Service: "name", Namespace: "webhook", IP: "192.168.1.1", Action: webhook.ActionRelease}, waitForPayload())
+}
+
+func Test_allocationWebhookSharedIP(t *testing.T) {
+	received := make(chan webhook.Payload, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var p webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		if p.Action == webhook.ActionRelease {
+			received <- p
+		}
+	}))
+	defer server.Close()
+
+	notifier, err := webhook.NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocationNotifier = notifier
+	defer func() { allocationNotifier = nil }()
+
+	ctx := context.Background()
+	mgr := &kubevipLoadBalancerManager{
+		kubeClient:     fake.NewSimpleClientset(),
+		namespace:      KubeVipClientConfigNamespace,
+		cloudConfigMap: KubeVipClientConfig,
+	}
+	poolConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-shared":       "192.168.1.1-192.168.1.10",
+			"allow-share-shared": "true",
+		},
+	}
+	if _, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, poolConfigMap, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(name string, port int32) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "shared", Name: name},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+		}
+		return createAndSyncService(t, mgr.kubeClient, svc)
+	}
+	deleteService := func(svc *v1.Service) {
+		if err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Delete(ctx, svc.Name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.EnsureLoadBalancerDeleted(ctx, "", svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	web := allocate("web", 80)
+	secure := allocate("secure", 443)
+	assert.Equal(t, "192.168.1.1", web.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, "192.168.1.1", secure.Annotations[LoadbalancerIPsAnnotation])
+
+	// The IP is still used by the other sharing service
+	deleteService(web)
+	select {
+	case p := <-received:
+		t.Fatalf("the shared IP was released: %v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, "192.168.1.2", allocate("other", 443).Annotations[LoadbalancerIPsAnnotation])
+
+	// The IP is freed with the last sharing service
+	deleteService(secure)
+	select {
+	case p := <-received:
+		assert.Equal(t, webhook.Payload{Service: "secure", Namespace: "shared", IP: "192.168.1.1", Action: webhook.ActionRelease}, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook didn't receive the release")
+	}
+	assert.Equal(t, "192.168.1.1", allocate("last", 443).Annotations[LoadbalancerIPsAnnotation])
+}
+
+func Test_syncLoadBalancerNoPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowShare string
+	}{
+		{
+			name:       "sharing disabled",
+			allowShare: "false",
+		},
+		{
+			name:       "sharing enabled",
+			allowShare: "true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global":       "10.0.0.1-10.0.0.3",
+					"allow-share-global": tt.allowShare,
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			existing := []*v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        "with-ports",
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
 					},
+					Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
 				},
-			},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        "no-ports",
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.2"},
+					},
+				},
+			}
+			for _, svc := range existing {
+				createService(t, client, svc)
+			}
+
+			svcs, err := client.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			inUse, servicePortMap, err := mapImplementedServices(svcs, tt.allowShare == "true")
+			if err != nil {
+				t.Fatalf("mapImplementedServices() error: %v", err)
+			}
+			assert.True(t, inUse.Contains(netip.MustParseAddr("10.0.0.2")), "the address of the service without ports is in use")
+
+			// a new service without ports neither shares an address nor panics
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "new-no-ports",
+				},
+			}
+			assert.Empty(t, discoverSharedVIPs(svc, servicePortMap, shareOptions{}))
+			res := createAndSyncService(t, client, svc)
+			assert.Equal(t, "10.0.0.3", res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerRejectPortless(t *testing.T) {
+	tests := []struct {
+		name      string
+		reject    string
+		expectIPs string
+		expectErr bool
+	}{
+		{
+			name:      "accept mode, the service gets a dedicated address",
+			reject:    "false",
+			expectIPs: "10.0.0.2",
 		},
 		{
-			name: "ipv6, add new annotation and loadbalancerIP to new service",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
-			},
-			poolConfigMap: &v1.ConfigMap{
+			name:      "reject mode, the service gets no address",
+			reject:    "true",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
 				Data: map[string]string{
-					"cidr-global": "fe80::10/126",
+					"range-global":              "10.0.0.1-10.0.0.3",
+					"allow-share-global":        "true",
+					"reject-portless-lb-global": tt.reject,
 				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			sync := func(svc *v1.Service) (*v1.Service, error) {
+				createService(t, client, svc)
+				res, syncErr := syncService(t, client, svc)
+				return res, syncErr
+			}
+
+			// the services with ports are allocated in both modes
+			res, err := sync(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "with-ports"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "10.0.0.1", res.Annotations[LoadbalancerIPsAnnotation])
+
+			res, err = sync(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "no-ports"}})
+			if tt.expectErr {
+				var portlessErr *PortlessLoadBalancerError
+				assert.ErrorAs(t, err, &portlessErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerDedicatedIP(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global":       "10.0.0.1-10.0.0.3",
+			"allow-share-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(name string, port int32, dedicated bool) string {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name, Annotations: map[string]string{}},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+		}
+		if dedicated {
+			svc.Annotations[DedicatedIPAnnotationKey] = "true"
+		}
+		res := createAndSyncService(t, client, svc)
+		return res.Annotations[LoadbalancerIPsAnnotation]
+	}
+
+	assert.Equal(t, "10.0.0.1", sync("http", 80, false))
+	// 10.0.0.1 is free on port 443, the dedicated service still gets a new IP
+	assert.Equal(t, "10.0.0.2", sync("dedicated", 443, true))
+	// the other services share 10.0.0.1 but not the dedicated IP
+	assert.Equal(t, "10.0.0.1", sync("https", 443, false))
+	assert.Equal(t, "10.0.0.3", sync("http-alt", 80, false))
+}
+
+func Test_syncLoadBalancerShareGroup(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global":       "10.0.0.1-10.0.0.4",
+			"allow-share-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(name string, port int32, shareGroup string) string {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name, Annotations: map[string]string{}},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+		}
+		if len(shareGroup) > 0 {
+			svc.Annotations[ShareGroupAnnotationKey] = shareGroup
+		}
+		res := createAndSyncService(t, client, svc)
+		return res.Annotations[LoadbalancerIPsAnnotation]
+	}
+
+	assert.Equal(t, "10.0.0.1", sync("a-http", 80, "group-a"))
+	// the ports are compatible, but the services are in different groups
+	assert.Equal(t, "10.0.0.2", sync("b-https", 443, "group-b"))
+	assert.Equal(t, "10.0.0.3", sync("ungrouped", 8080, ""))
+	// the services of the same group share
+	assert.Equal(t, "10.0.0.1", sync("a-https", 443, "group-a"))
+	assert.Equal(t, "10.0.0.2", sync("b-http", 80, "group-b"))
+	assert.Equal(t, "10.0.0.3", sync("ungrouped-http", 80, ""))
+}
+
+func Test_discoverSharedVIPsAffinity(t *testing.T) {
+	newSvc := func(name, ip string, port int32, affinity v1.ServiceAffinity) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ip},
 			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "fe80::10",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "fe80::10",
-				},
+			Spec: v1.ServiceSpec{
+				Ports:           []v1.ServicePort{{Port: port}},
+				SessionAffinity: affinity,
 			},
+		}
+	}
+	svcs := &v1.ServiceList{Items: []v1.Service{
+		newSvc("clientip", "10.0.0.1", 80, v1.ServiceAffinityClientIP),
+	}}
+	_, servicePortMap, err := mapImplementedServices(svcs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		service         v1.Service
+		respectAffinity bool
+		want            string
+	}{
+		{
+			name:    "differing affinity is shared when affinity isn't respected",
+			service: newSvc("none", "", 443, v1.ServiceAffinityNone),
+			want:    "10.0.0.1",
 		},
 		{
-			name: "create config map with different name and namespace",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
+			name:            "differing affinity isn't shared when affinity is respected",
+			service:         newSvc("none", "", 443, v1.ServiceAffinityNone),
+			respectAffinity: true,
+			want:            "",
+		},
+		{
+			name:            "unset affinity is treated as None and isn't shared",
+			service:         newSvc("unset", "", 443, ""),
+			respectAffinity: true,
+			want:            "",
+		},
+		{
+			name:            "same affinity is shared when affinity is respected",
+			service:         newSvc("clientip2", "", 443, v1.ServiceAffinityClientIP),
+			respectAffinity: true,
+			want:            "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serviceAffinityMap map[string]set.Set[v1.ServiceAffinity]
+			if tt.respectAffinity {
+				serviceAffinityMap = mapServiceAffinities(svcs)
+			}
+			assert.Equal(t, tt.want, discoverSharedVIPs(&tt.service, servicePortMap, shareOptions{affinities: serviceAffinityMap})) // #nosec G601
+		})
+	}
+}
+
+func Test_newShareOptions(t *testing.T) {
+	svcs := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "a", Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"}},
+		Spec:       v1.ServiceSpec{SessionAffinity: v1.ServiceAffinityClientIP},
+	}}}
+
+	opts := newShareOptions(&v1.ConfigMap{Data: map[string]string{}}, "test", KubeVipClientConfig, svcs)
+	assert.Nil(t, opts.affinities)
+	assert.Nil(t, opts.counts)
+	assert.NotNil(t, opts.shareGroups)
+
+	opts = newShareOptions(&v1.ConfigMap{Data: map[string]string{
+		"share-respect-affinity-global": "true",
+		"max-services-per-ip-global":    "3",
+	}}, "test", KubeVipClientConfig, svcs)
+	assert.Equal(t, set.New(v1.ServiceAffinityClientIP), opts.affinities["10.0.0.1"])
+	assert.Equal(t, map[string]int{"10.0.0.1": 1}, opts.counts)
+	assert.Equal(t, 3, opts.maxServicesPerIP)
+	assert.False(t, opts.aggressive)
+}
+
+func Test_discoverSharedVIPsMaxServicesPerIP(t *testing.T) {
+	newSvc := func(name, ip string, port int32) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ip},
 			},
-			poolConfigMap: &v1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      "load-balancer",
-					Namespace: "load-balancer-ns",
-				},
-				Data: map[string]string{
-					"cidr-global": "192.168.1.1/24",
-				},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: port}},
 			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
-				},
+		}
+	}
+	svcs := &v1.ServiceList{Items: []v1.Service{
+		newSvc("a", "10.0.0.1", 80),
+		newSvc("b", "10.0.0.1", 81),
+		newSvc("c", "10.0.0.1", 82),
+	}}
+	_, servicePortMap, err := mapImplementedServices(svcs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceCountMap := mapServiceCounts(svcs)
+	assert.Equal(t, map[string]int{"10.0.0.1": 3}, serviceCountMap)
+
+	tests := []struct {
+		name             string
+		maxServicesPerIP int
+		want             string
+	}{
+		{
+			name:             "no limit",
+			maxServicesPerIP: 0,
+			want:             "10.0.0.1",
+		},
+		{
+			name:             "below the limit",
+			maxServicesPerIP: 4,
+			want:             "10.0.0.1",
+		},
+		{
+			name:             "limit reached",
+			maxServicesPerIP: 3,
+			want:             "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newSvc("new", "", 443)
+			assert.Equal(t, tt.want, discoverSharedVIPs(&svc, servicePortMap, shareOptions{counts: serviceCountMap, maxServicesPerIP: tt.maxServicesPerIP}))
+		})
+	}
+}
+
+func Test_discoverSharedVIPsAggressive(t *testing.T) {
+	newSvc := func(name, ip string, port int32) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ip},
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: port}},
 			},
+		}
+	}
+	svcs := &v1.ServiceList{Items: []v1.Service{
+		newSvc("a", "10.0.0.1", 80),
+		newSvc("b", "10.0.0.3", 80),
+		newSvc("c", "10.0.0.3", 81),
+		newSvc("d", "10.0.0.2", 80),
+		newSvc("e", "10.0.0.2", 82),
+	}}
+	_, servicePortMap, err := mapImplementedServices(svcs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceCountMap := mapServiceCounts(svcs)
+
+	tests := []struct {
+		name             string
+		port             int32
+		maxServicesPerIP int
+		want             string
+	}{
+		{
+			name: "the address used by the most services, then the lowest",
+			port: 443,
+			want: "10.0.0.2",
 		},
 		{
-			name: "dualstack loadbalancer",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{
-					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
-					IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
-				},
+			name: "the densest address without a port conflict",
+			port: 82,
+			want: "10.0.0.3",
+		},
+		{
+			name:             "the densest address below the limit",
+			port:             443,
+			maxServicesPerIP: 2,
+			want:             "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newSvc("new", "", tt.port)
+			assert.Equal(t, tt.want, discoverSharedVIPs(&svc, servicePortMap, shareOptions{counts: serviceCountMap, maxServicesPerIP: tt.maxServicesPerIP, aggressive: true}))
+		})
+	}
+}
+
+func Test_syncLoadBalancerShareAggressive(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-tiny":              "192.168.1.1-192.168.1.3",
+			"allow-share-tiny":        "true",
+			"share-aggressive-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the services already spread over the pool, e.g. after some were deleted
+	for _, existing := range []struct {
+		name string
+		ip   string
+		port int32
+	}{
+		{name: "a", ip: "192.168.1.1", port: 80},
+		{name: "b", ip: "192.168.1.2", port: 80},
+		{name: "c", ip: "192.168.1.2", port: 81},
+	} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "tiny",
+				Name:        existing.name,
+				Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: existing.ip},
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: existing.port}},
 			},
+		}
+		createService(t, client, svc)
+	}
 
-			poolConfigMap: &v1.ConfigMap{
+	// the new services are packed on the densest address until its ports conflict
+	var got []string
+	for _, port := range []int32{443, 444, 80, 81} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "tiny",
+				Name:      fmt.Sprintf("svc-%d", port),
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: port}},
+			},
+		}
+		res := createAndSyncService(t, client, svc)
+		got = append(got, res.Annotations[LoadbalancerIPsAnnotation])
+	}
+
+	assert.Equal(t, []string{"192.168.1.2", "192.168.1.2", "192.168.1.3", "192.168.1.1"}, got)
+}
+
+func Test_syncLoadBalancerMaxServicesPerIP(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-max-share":            "192.168.1.1-192.168.1.10",
+			"allow-share-max-share":      "true",
+			"max-services-per-ip-global": "2",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for port := int32(80); port < 85; port++ {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "max-share",
+				Name:      fmt.Sprintf("svc-%d", port),
+			},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{{Port: port}},
+			},
+		}
+		res := createAndSyncService(t, client, svc)
+		got = append(got, res.Annotations[LoadbalancerIPsAnnotation])
+	}
+
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.1", "192.168.1.2", "192.168.1.2", "192.168.1.3"}, got)
+}
+
+func Test_syncLoadBalancerExcludeOwnService(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude string
+		wantIPs string
+	}{
+		{
+			name:    "own service IPs are allocated by default",
+			wantIPs: "192.168.1.1",
+		},
+		{
+			name:    "own service IPs are excluded",
+			exclude: "true",
+			wantIPs: "192.168.1.3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
 				Data: map[string]string{
-					"cidr-global": "10.120.120.1/24,fe80::10/126",
+					"range-own-service": "192.168.1.1-192.168.1.3",
 				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "fe80::10,10.120.120.1",
-					},
+			}
+			if len(tt.exclude) > 0 {
+				cm.Data["exclude-own-service-global"] = tt.exclude
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// services of the controller namespace that aren't implemented by kube-vip but use pool IPs
+			ownServices := []*v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: KubeVipClientConfigNamespace, Name: "metrics"},
+					Spec:       v1.ServiceSpec{ExternalIPs: []string{"192.168.1.1"}},
 				},
-				Spec: v1.ServiceSpec{
-					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
-					IPFamilies:     []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
-					LoadBalancerIP: "fe80::10",
+				{
+					ObjectMeta: metav1.ObjectMeta{Namespace: KubeVipClientConfigNamespace, Name: "self"},
+					Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{
+						Ingress: []v1.LoadBalancerIngress{{IP: "192.168.1.2"}},
+					}},
 				},
-			},
+			}
+			for _, svc := range ownServices {
+				createService(t, client, svc)
+			}
+
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "own-service", Name: "name"}}
+			res := createAndSyncService(t, client, svc)
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerPreferredIPs(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-preferred": "10.0.0.1-10.0.0.100",
+			// 10.0.1.1 isn't part of the pool and is never handed out
+			"preferred-global": "10.0.0.50,10.0.1.1,10.0.0.60, 10.0.0.70",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "preferred", Name: fmt.Sprintf("svc-%d", i)}}
+		res := createAndSyncService(t, client, svc)
+		got = append(got, res.Annotations[LoadbalancerIPsAnnotation])
+	}
+
+	// the preferred IPs are handed out in order, then the normal scan resumes
+	assert.Equal(t, []string{"10.0.0.50", "10.0.0.60", "10.0.0.70", "10.0.0.1", "10.0.0.2"}, got)
+}
+
+func Test_syncLoadBalancerLabelRemoved(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{"range-global": "10.0.0.1-10.0.0.10"},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(name string) *v1.Service {
+		svc, err := client.CoreV1().Services("unlabeled").Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			svc, err = client.CoreV1().Services("unlabeled").Create(ctx, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "unlabeled", Name: name}}, metav1.CreateOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mustSyncService(t, client, svc)
+	}
+
+	first := sync("first")
+	assert.Equal(t, "10.0.0.1", first.Annotations[LoadbalancerIPsAnnotation])
+
+	// The label is removed by accident, the IP of the service is still in use
+	delete(first.Labels, ImplementationLabelKey)
+	if _, err := client.CoreV1().Services(first.Namespace).Update(ctx, first, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	second := sync("second")
+	assert.Equal(t, "10.0.0.2", second.Annotations[LoadbalancerIPsAnnotation])
+
+	// The label is re-added and the service keeps its IP and strategy
+	first = sync("first")
+	assert.Equal(t, ImplementationLabelValue, first.Labels[ImplementationLabelKey])
+	assert.Equal(t, "10.0.0.1", first.Annotations[LoadbalancerIPsAnnotation])
+	assert.Equal(t, AllocationStrategyAsc, first.Annotations[AllocationStrategyAnnotationKey])
+}
+
+func Test_syncLoadBalancerDebugAnnotation(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{"range-debugged": "10.0.0.1-10.0.0.10"},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, restore := tu.CaptureKlog(t, "0")
+	for _, svc := range []*v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "debugged", Name: "investigated", Annotations: map[string]string{DebugAnnotationKey: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "debugged", Name: "other"}},
+	} {
+		createService(t, client, svc)
+		if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore()
+
+	// the trace of the debugged service is logged at the default verbosity, not the trace of the other one
+	assert.Contains(t, buf.String(), "chose address 10.0.0.1")
+	assert.Contains(t, buf.String(), "discovered VIPs [10.0.0.1] for namespace [debugged]")
+	assert.NotContains(t, buf.String(), "chose address 10.0.0.2")
+	assert.NotContains(t, buf.String(), "discovered VIPs [10.0.0.2]")
+}
+
+func Test_listInUseServices(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	t.Cleanup(func() {
+		implementedServices.Range(func(key, _ any) bool {
+			implementedServices.Delete(key)
+			return true
+		})
+	})
+
+	labels := map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+	for _, svc := range []*v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "labeled", Labels: labels, Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "unlabeled", Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "foreign", Labels: labels}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "other", Labels: labels, Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.3"}}},
+	} {
+		createService(t, client, svc)
+	}
+	names := func() []string {
+		svcs, err := listInUseServices(ctx, client, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for x := range svcs.Items {
+			names = append(names, svcs.Items[x].Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// only the labeled services are listed, an unlabeled service never seen with IPs isn't ours
+	assert.Equal(t, []string{"labeled", "other"}, names())
+
+	// the label of a listed service is removed, it is still in use
+	other, err := client.CoreV1().Services("test").Get(ctx, "other", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Labels = nil
+	if _, err := client.CoreV1().Services("test").Update(ctx, other, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"labeled", "other"}, names())
+
+	// the services are only listed with a selector
+	for _, action := range client.Actions() {
+		if list, ok := action.(clientgotesting.ListAction); ok {
+			assert.Equal(t, getKubevipImplementationLabel(), list.GetListRestrictions().Labels.String())
+		}
+	}
+
+	// it is forgotten once deleted
+	if err := client.CoreV1().Services("test").Delete(ctx, "other", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"labeled"}, names())
+	_, tracked := implementedServices.Load("test/other")
+	assert.False(t, tracked)
+}
+
+func Test_syncLoadBalancerAdvertisement(t *testing.T) {
+	tests := []struct {
+		name              string
+		data              map[string]string
+		annotations       map[string]string
+		wantAdvertisement string
+	}{
+		{
+			name:              "global advertisement",
+			data:              map[string]string{"cidr-global": "10.0.0.0/24", "advertisement-global": "bgp"},
+			wantAdvertisement: AdvertisementBGP,
 		},
 		{
-			name: "service interface defined in global, service gets the interface config",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
-			},
-			poolConfigMap: &v1.ConfigMap{
+			name:              "namespace advertisement takes precedence over global",
+			data:              map[string]string{"cidr-global": "10.0.0.0/24", "advertisement-global": "bgp", "advertisement-advertised": "ARP"},
+			wantAdvertisement: AdvertisementARP,
+		},
+		{
+			name:              "service annotation overrides the configmap",
+			data:              map[string]string{"cidr-global": "10.0.0.0/24", "advertisement-global": "bgp"},
+			annotations:       map[string]string{VipAdvertisementAnnotationKey: AdvertisementARP},
+			wantAdvertisement: AdvertisementARP,
+		},
+		{
+			name: "invalid advertisement is ignored",
+			data: map[string]string{"cidr-global": "10.0.0.0/24", "advertisement-global": "ospf"},
+		},
+		{
+			name: "no advertisement",
+			data: map[string]string{"cidr-global": "10.0.0.0/24"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
-				Data: map[string]string{
-					"cidr-global":      "192.168.1.1/24",
-					"interface-global": "eth0",
-				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation:                 "192.168.1.1",
-						LoadbalancerServiceInterfaceAnnotationKey: "eth0",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
-				},
-			},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "advertised", Name: "svc", Annotations: tt.annotations}}
+			res := createAndSyncService(t, client, svc)
+			assert.Equal(t, "10.0.0.1", res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.wantAdvertisement, res.Annotations[VipAdvertisementAnnotationKey])
+		})
+	}
+}
+
+func Test_discoverExcludedIPs(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		namespace string
+		want      string
+	}{
+		{
+			name:      "global addresses and ranges",
+			data:      map[string]string{"exclude-ips-global": "10.0.0.5, 10.0.0.10-10.0.0.12"},
+			namespace: "dev",
+			want:      "10.0.0.5-10.0.0.5,10.0.0.10-10.0.0.12",
 		},
 		{
-			name: "service interface defined in service's namespace, service gets the interface config",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
-			},
-			poolConfigMap: &v1.ConfigMap{
+			name:      "namespace takes precedence over global",
+			data:      map[string]string{"exclude-ips-global": "10.0.0.5", "exclude-ips-dev": "10.0.1.5"},
+			namespace: "dev",
+			want:      "10.0.1.5-10.0.1.5",
+		},
+		{
+			name:      "invalid list is ignored",
+			data:      map[string]string{"exclude-ips-global": "10.0.0.12-10.0.0.10"},
+			namespace: "dev",
+		},
+		{
+			name:      "exclude-own-service isn't an excluded list",
+			data:      map[string]string{"exclude-own-service-global": "true"},
+			namespace: "dev",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverExcludedIPs(&v1.ConfigMap{Data: tt.data}, tt.namespace))
+		})
+	}
+}
+
+func Test_discoverDefaultIPFamilyPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		namespace string
+		want      *v1.IPFamilyPolicy
+	}{
+		{
+			name:      "global default",
+			data:      map[string]string{"default-ip-family-policy-global": "PreferDualStack"},
+			namespace: "dev",
+			want:      ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+		},
+		{
+			name:      "namespace default overrides the global default",
+			data:      map[string]string{"default-ip-family-policy-global": "PreferDualStack", "default-ip-family-policy-dev": "SingleStack"},
+			namespace: "dev",
+			want:      ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack),
+		},
+		{
+			name:      "default of another namespace",
+			data:      map[string]string{"default-ip-family-policy-global": "SingleStack", "default-ip-family-policy-prod": "RequireDualStack"},
+			namespace: "dev",
+			want:      ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack),
+		},
+		{
+			name:      "invalid default is ignored",
+			data:      map[string]string{"default-ip-family-policy-dev": "DualStack"},
+			namespace: "dev",
+		},
+		{
+			name:      "no default",
+			namespace: "dev",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverDefaultIPFamilyPolicy(&v1.ConfigMap{Data: tt.data}, tt.namespace, KubeVipClientConfig))
+		})
+	}
+}
+
+func Test_syncLoadBalancerDefaultIPFamilyPolicy(t *testing.T) {
+	data := map[string]string{
+		"range-global":                    "10.0.0.1-10.0.0.10,fd00::1-fd00::10",
+		"default-ip-family-policy-global": "SingleStack",
+		"default-ip-family-policy-prod":   "PreferDualStack",
+	}
+	tests := []struct {
+		name           string
+		namespace      string
+		ipFamilyPolicy *v1.IPFamilyPolicy
+		wantIPs        string
+	}{
+		{
+			name:      "namespace default",
+			namespace: "prod",
+			wantIPs:   "10.0.0.1,fd00::1",
+		},
+		{
+			name:      "global default",
+			namespace: "dev",
+			wantIPs:   "10.0.0.1",
+		},
+		{
+			name:           "policy of the service overrides the default",
+			namespace:      "prod",
+			ipFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack),
+			wantIPs:        "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
-				Data: map[string]string{
-					"cidr-global":    "192.168.1.1/24",
-					"interface-test": "eth0",
-				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation:                 "192.168.1.1",
-						LoadbalancerServiceInterfaceAnnotationKey: "eth0",
-					},
-				},
-				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
-				},
-			},
+				Data: data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "svc"},
+				Spec:       v1.ServiceSpec{IPFamilyPolicy: tt.ipFamilyPolicy},
+			}
+			res := createAndSyncService(t, client, svc)
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
+
+func Test_preferredAddress(t *testing.T) {
+	builder := &netipx.IPSetBuilder{}
+	builder.Add(netip.MustParseAddr("10.0.0.50"))
+	inUse, err := builder.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.KubevipLBConfig{PreferredIPs: []string{"10.0.0.50", "10.0.0.60"}}
+	vip, ok := preferredAddress("10.0.0.0/24", inUse, cfg)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.60", vip)
+
+	// preferred IPs outside the usable range are skipped
+	cfg.UsableRange = "10.0.0.1-10.0.0.55"
+	_, ok = preferredAddress("10.0.0.0/24", inUse, cfg)
+	assert.False(t, ok)
+
+	// no preference for DHCP
+	_, ok = preferredAddress("0.0.0.0/32", inUse, &config.KubevipLBConfig{PreferredIPs: []string{"0.0.0.0"}})
+	assert.False(t, ok)
+}
+
+func Test_discoverMaxServicesPerIP(t *testing.T) {
+	assert.Equal(t, 0, discoverMaxServicesPerIP(&v1.ConfigMap{}))
+	assert.Equal(t, 10, discoverMaxServicesPerIP(&v1.ConfigMap{Data: map[string]string{"max-services-per-ip-global": "10"}}))
+	assert.Equal(t, 0, discoverMaxServicesPerIP(&v1.ConfigMap{Data: map[string]string{"max-services-per-ip-global": "ten"}}))
+	assert.Equal(t, 0, discoverMaxServicesPerIP(&v1.ConfigMap{Data: map[string]string{"max-services-per-ip-global": "-1"}}))
+}
+
+func Test_discoverShareRespectAffinity(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"share-respect-affinity-global": "true",
+			"share-respect-affinity-test":   "false",
+		},
+	}
+	assert.True(t, discoverShareRespectAffinity(cm, "other", ""))
+	assert.False(t, discoverShareRespectAffinity(cm, "test", ""))
+	assert.False(t, discoverShareRespectAffinity(&v1.ConfigMap{}, "test", ""))
+}
+
+func Test_discoverUsableRange(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"cidr-global":   "10.0.0.0/24",
+			"usable-global": "10.0.0.50-10.0.0.100",
+			"cidr-test":     "10.0.1.0/24",
+			"usable-test":   "10.0.1.10-10.0.1.20",
+			"cidr-other":    "10.0.2.0/24",
 		},
+	}
+	assert.Equal(t, "10.0.0.50-10.0.0.100", discoverUsableRange(cm, "unknown", true))
+	assert.Equal(t, "10.0.1.10-10.0.1.20", discoverUsableRange(cm, "test", false))
+	// the global usable range doesn't apply to a namespace cidr
+	assert.Equal(t, "", discoverUsableRange(cm, "other", false))
+}
+
+func Test_syncLoadBalancerLegacyIPv6(t *testing.T) {
+	tests := []struct {
+		name           string
+		loadBalancerIP string
+		ipFamilies     []v1.IPFamily
+		wantIPs        string
+		wantStrategy   string
+		wantEvent      string
+	}{
 		{
-			name: "service interface not defined in service's namespace, service doesn't get the interface config",
-			originalService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-				},
-				Spec: v1.ServiceSpec{},
-			},
-			poolConfigMap: &v1.ConfigMap{
+			name:           "IPv6 legacy IP migrates to the annotation",
+			loadBalancerIP: "fd00::10",
+			ipFamilies:     []v1.IPFamily{v1.IPv6Protocol},
+			wantIPs:        "fd00::10",
+			wantStrategy:   AllocationStrategyStatic,
+		},
+		{
+			name:           "IPv6 legacy IP of a service without IP families migrates to the annotation",
+			loadBalancerIP: "fd00::10",
+			wantIPs:        "fd00::10",
+			wantStrategy:   AllocationStrategyStatic,
+		},
+		{
+			name:           "IPv6 legacy IP of a dual-stack service migrates to the annotation",
+			loadBalancerIP: "fd00::10",
+			ipFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			wantIPs:        "fd00::10",
+			wantStrategy:   AllocationStrategyStatic,
+		},
+		{
+			name:           "IPv6 legacy IP of an IPv4 service is rejected",
+			loadBalancerIP: "fd00::10",
+			ipFamilies:     []v1.IPFamily{v1.IPv4Protocol},
+			wantIPs:        "192.168.1.1",
+			wantStrategy:   AllocationStrategyAsc,
+			wantEvent:      "Warning InvalidLoadBalancerIP invalid spec.loadBalancerIP [fd00::10]: IP family IPv6 isn't one of the service IP families [IPv4]",
+		},
+		{
+			name:           "IPv6 legacy IP with a zone is rejected",
+			loadBalancerIP: "fe80::10%eth0",
+			wantIPs:        "192.168.1.1",
+			wantStrategy:   AllocationStrategyAsc,
+			wantEvent:      "Warning InvalidLoadBalancerIP invalid spec.loadBalancerIP [fe80::10%eth0]: IPv6 zone eth0 isn't allowed",
+		},
+		{
+			name:           "IPv4-mapped IPv6 legacy IP is rejected",
+			loadBalancerIP: "::ffff:192.168.1.10",
+			wantIPs:        "192.168.1.1",
+			wantStrategy:   AllocationStrategyAsc,
+			wantEvent:      "Warning InvalidLoadBalancerIP invalid spec.loadBalancerIP [::ffff:192.168.1.10]: IPv4-mapped IPv6 address isn't allowed, use 192.168.1.10",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      KubeVipClientConfig,
 					Namespace: KubeVipClientConfigNamespace,
 				},
 				Data: map[string]string{
-					"cidr-global":    "192.168.1.1/24",
-					"interface-what": "eth0",
-				},
-			},
-			expectedService: v1.Service{
-				ObjectMeta: metav1.ObjectMeta{
-					Namespace: "test",
-					Name:      "name",
-					Labels: map[string]string{
-						"implementation": "kube-vip",
-					},
-					Annotations: map[string]string{
-						LoadbalancerIPsAnnotation: "192.168.1.1",
-					},
+					"cidr-global": "192.168.1.1/32",
 				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "legacy", Name: "web"},
 				Spec: v1.ServiceSpec{
-					LoadBalancerIP: "192.168.1.1",
+					LoadBalancerIP: tt.loadBalancerIP,
+					IPFamilies:     tt.ipFamilies,
 				},
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ns := KubeVipClientConfigNamespace
-			cm := KubeVipClientConfig
-			if tt.poolConfigMap != nil {
-				ns = tt.poolConfigMap.GetObjectMeta().GetNamespace()
-				cm = tt.poolConfigMap.GetObjectMeta().GetName()
 			}
+			createService(t, client, svc)
 
-			mgr := &kubevipLoadBalancerManager{
-				kubeClient:     fake.NewSimpleClientset(),
-				namespace:      ns,
-				cloudConfigMap: cm,
+			if _, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
 			}
 
-			// create dummy service
-			_, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), &tt.originalService, metav1.CreateOptions{}) // #nosec G601
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
 			if err != nil {
-				t.Error(err)
-			}
-
-			// create pool if needed
-			if tt.poolConfigMap != nil {
-				_, err := mgr.kubeClient.CoreV1().ConfigMaps(ns).Create(context.Background(), tt.poolConfigMap, metav1.CreateOptions{})
-				if err != nil {
-					t.Error(err)
-				}
+				t.Fatal(err)
 			}
-
-			_, err = syncLoadBalancer(context.Background(), mgr.kubeClient, &tt.originalService, cm, ns) // #nosec G601
-			if err != nil {
-				t.Error(err)
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.wantStrategy, res.Annotations[AllocationStrategyAnnotationKey])
+			assert.Equal(t, ImplementationLabelValue, res.Labels[implementationLabelKey])
+			if len(tt.wantEvent) > 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
 			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
 
-			if (err != nil) != tt.wantErr {
-				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
-				return
-			}
+func Test_syncLoadBalancerForeignImplementationLabel(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global": "192.168.1.1-192.168.1.3",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// another tool uses the same implementation label, without our annotation
+	foreign := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "foreign",
+			Labels:    map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+		},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.1.2"}}}},
+	}
+	ours := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "ours",
+			Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+			Annotations: map[string]string{LoadbalancerIPsAnnotation: "192.168.1.1"},
+		},
+	}
+	for _, svc := range []*v1.Service{foreign, ours} {
+		createService(t, client, svc)
+	}
 
-			resService, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "name", metav1.GetOptions{})
-			if err != nil {
-				t.Error(err)
-			}
+	assert.False(t, isImplemented(foreign))
+	assert.True(t, isImplemented(ours))
+	_, exists, err := (&kubevipLoadBalancerManager{}).GetLoadBalancer(context.Background(), "", foreign)
+	assert.NoError(t, err)
+	assert.False(t, exists)
 
-			assert.EqualValues(t, tt.expectedService, *resService)
-		})
+	svcs, err := listInUseServices(context.Background(), client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, svcs.Items, 1) {
+		assert.Equal(t, "ours", svcs.Items[0].Name)
 	}
+	inUseSet, _, err := mapImplementedServices(svcs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, inUseSet.Contains(netip.MustParseAddr("192.168.1.1")))
+	assert.False(t, inUseSet.Contains(netip.MustParseAddr("192.168.1.2")))
+
+	// the IP in the status of the foreign service isn't ours to track, the next free IP is handed out
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	res := createAndSyncService(t, client, svc)
+	assert.Equal(t, "192.168.1.2", res.Annotations[LoadbalancerIPsAnnotation])
 }
@@ -2,12 +2,17 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
@@ -19,12 +24,28 @@ import (
 	"k8s.io/client-go/util/workqueue"
 	servicehelper "k8s.io/cloud-provider/service/helpers"
 	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
 )
 
 const (
 	controllerName = "service-lbc-controller"
 )
 
+// loadbalancerClassName is the loadbalancerClass of the services served by the loadbalancerClass controller
+var loadbalancerClassName = LoadbalancerClass
+
+// acceptDefaultLoadbalancerClass also serves the services of LoadbalancerClass when loadbalancerClassName is a custom class
+var acceptDefaultLoadbalancerClass = true
+
+// isServedLoadbalancerClass returns true if the loadbalancerClass is served by the loadbalancerClass controller
+func isServedLoadbalancerClass(loadBalancerClass *string) bool {
+	if loadBalancerClass == nil {
+		return false
+	}
+	return *loadBalancerClass == loadbalancerClassName || (acceptDefaultLoadbalancerClass && *loadBalancerClass == LoadbalancerClass)
+}
+
 // loadbalancerClassServiceController starts a controller that reconcile type loadbalancer service with
 // loadbalancerclass set to kube-vip.io/kube-vip-class.
 // no need to add node controller since kube-vip-cp itself doesn't use node info to update loadbalancer
@@ -39,12 +60,32 @@ type loadbalancerClassServiceController struct {
 
 	cmName      string
 	cmNamespace string
+
+	// verboseEvents emits the EnsuringLoadBalancer / EnsuredLoadBalancer events on every reconcile
+	verboseEvents bool
+	// restoreStatus restores the status.loadBalancer.ingress of the services from their loadbalancerIPs annotation,
+	// which is authoritative, when they diverge, e.g. after the status was cleared outside the controller
+	restoreStatus bool
+	// allocationOrder syncs the queued services by name or creation time, so the IPs they get are reproducible
+	allocationOrder string
+	// maxRetries drops a failing service from the queue after that many retries, it is then only synced again on its
+	// next change, unlimited if 0
+	maxRetries int
+	// allocationFailedStatus sets the AllocationFailedHostname in the status.loadBalancer.ingress of the services
+	// failing allocation, it is cleared once they are allocated
+	allocationFailedStatus bool
 }
 
 func newLoadbalancerClassServiceController(
 	sharedInformer informers.SharedInformerFactory,
 	kubeClient kubernetes.Interface,
 	cmName, cmNamespace string,
+	verboseEvents bool,
+	priorityQueue bool,
+	restoreStatus bool,
+	allocationOrder string,
+	maxRetries int,
+	allocationFailedStatus bool,
 ) *loadbalancerClassServiceController {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(klog.Infof)
@@ -56,11 +97,30 @@ func newLoadbalancerClassServiceController(
 		serviceListerSynced: serviceInformer.HasSynced,
 		kubeClient:          kubeClient,
 
-		recorder:  recorder,
-		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Services"),
+		recorder: recorder,
 
 		cmName:      cmName,
 		cmNamespace: cmNamespace,
+
+		verboseEvents:   verboseEvents,
+		restoreStatus:   restoreStatus,
+		allocationOrder: allocationOrder,
+		maxRetries:      maxRetries,
+
+		allocationFailedStatus: allocationFailedStatus,
+	}
+	if priorityQueue || len(allocationOrder) > 0 {
+		var priority func(key string) int
+		if priorityQueue {
+			priority = c.servicePriority
+		}
+		var order func(key string) string
+		if len(allocationOrder) > 0 {
+			order = c.serviceOrder
+		}
+		c.workqueue = newPriorityQueue(workqueue.DefaultControllerRateLimiter(), priority, order)
+	} else {
+		c.workqueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Services")
 	}
 
 	_, _ = serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -75,6 +135,10 @@ func newLoadbalancerClassServiceController(
 			if ok1 && ok2 && wantsLoadBalancer(curSvc) && (c.needsUpdate(oldSvc, curSvc) || needsCleanup(curSvc)) {
 				c.enqueueService(curSvc)
 			}
+			// the service switched away from our class, it is handed off in syncService
+			if ok1 && ok2 && wantsLoadBalancer(oldSvc) && !wantsLoadBalancer(curSvc) {
+				c.enqueueService(curSvc)
+			}
 		},
 		// Delete is handled in the UpdateFunc
 	})
@@ -92,6 +156,50 @@ func (c *loadbalancerClassServiceController) enqueueService(obj interface{}) {
 	c.workqueue.Add(key)
 }
 
+// servicePriority returns the kube-vip.io/allocationPriority of the service with the key, 0 if it has none
+func (c *loadbalancerClassServiceController) servicePriority(key string) int {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return 0
+	}
+	return allocationPriority(svc)
+}
+
+// serviceOrder returns the order key of the service with the key: the key itself when sorting by name, prefixed with
+// the creation time of the service when sorting by creation
+func (c *loadbalancerClassServiceController) serviceOrder(key string) string {
+	if c.allocationOrder != AllocationOrderCreation {
+		return key
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return key
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return key
+	}
+	return fmt.Sprintf("%020d/%s", svc.CreationTimestamp.Unix(), key)
+}
+
+// allocationPriority parses the kube-vip.io/allocationPriority annotation of the service, 0 if it is missing or invalid
+func allocationPriority(service *corev1.Service) int {
+	value, ok := service.Annotations[AllocationPriorityAnnotationKey]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		klog.Warningf("service %s/%s has an invalid %s value %q, using 0", service.Namespace, service.Name, AllocationPriorityAnnotationKey, value)
+		return 0
+	}
+	return priority
+}
+
 // Run starts the worker to process service updates
 func (c *loadbalancerClassServiceController) Run(stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
@@ -140,6 +248,12 @@ func (c *loadbalancerClassServiceController) processNextWorkItem() bool {
 		// Run the syncHandler, passing it the key of the
 		// IPPool resource to be synced.
 		if err := c.syncService(key); err != nil {
+			// A service failing for good stops churning the queue once it exhausted its retries
+			if c.maxRetries > 0 && c.workqueue.NumRequeues(key) >= c.maxRetries {
+				c.workqueue.Forget(obj)
+				c.retriesExhausted(key, err)
+				return fmt.Errorf("error syncing '%s': %s, dropping it after %d retries", key, err.Error(), c.maxRetries)
+			}
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
@@ -158,6 +272,20 @@ func (c *loadbalancerClassServiceController) processNextWorkItem() bool {
 	return true
 }
 
+// retriesExhausted emits a SyncRetriesExhausted event on the service dropped from the queue
+func (c *loadbalancerClassServiceController) retriesExhausted(key string, err error) {
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(key)
+	if splitErr != nil {
+		return
+	}
+	svc, getErr := c.serviceLister.Services(namespace).Get(name)
+	if getErr != nil {
+		return
+	}
+	klog.Warningf("service %s/%s failed %d retries, it is synced again on its next change: %v", namespace, name, c.maxRetries, err)
+	c.recorder.Eventf(svc, corev1.EventTypeWarning, "SyncRetriesExhausted", "Stopped retrying after %d retries until the service changes: %v", c.maxRetries, err)
+}
+
 // syncService will sync the Service with the given key if it has had its expectations fulfilled,
 // meaning it did not expect to see any more of its pods created or deleted. This function is not meant to be
 // invoked concurrently with the same key.
@@ -176,6 +304,8 @@ func (c *loadbalancerClassServiceController) syncService(key string) error {
 	case err != nil:
 		utilruntime.HandleError(fmt.Errorf("unable to retrieve service %v from store: %v", key, err))
 		return err
+	case !wantsLoadBalancer(svc):
+		return c.processServiceHandoff(svc)
 	default:
 		klog.Infof("Reconcile service %s/%s, since loadbalancerClass match", svc.Namespace, svc.Name)
 		if err = c.processServiceCreateOrUpdate(svc); err != nil {
@@ -198,11 +328,14 @@ func (c *loadbalancerClassServiceController) processServiceCreateOrUpdate(svc *c
 			klog.Infof("Error removing finalizer from service %s/%s", svc.Namespace, svc.Name)
 			return err
 		}
+		notifyRelease(context.Background(), c.kubeClient, svc)
 		c.recorder.Event(svc, corev1.EventTypeNormal, "LoadBalancerDeleted", "Deleted load balancer")
 		return nil
 	}
 
-	c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuringLoadBalancer", "Ensuring load balancer")
+	if c.verboseEvents {
+		c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuringLoadBalancer", "Ensuring load balancer")
+	}
 
 	if err := c.addFinalizer(svc); err != nil {
 		klog.Infof("Error adding finalizer to service %s/%s", svc.Namespace, svc.Name)
@@ -210,17 +343,175 @@ func (c *loadbalancerClassServiceController) processServiceCreateOrUpdate(svc *c
 	}
 
 	if _, err := syncLoadBalancer(context.Background(), c.kubeClient, svc, c.cmName, c.cmNamespace); err != nil {
+		if c.allocationFailedStatus {
+			if statusErr := c.setAllocationFailedStatus(svc); statusErr != nil {
+				klog.Errorf("Error setting the allocation failed status of service %s/%s: %v", svc.Namespace, svc.Name, statusErr)
+			}
+		}
+		var noUsableIPs *ipam.NoUsableAddressesError
+		if errors.As(err, &noUsableIPs) {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "PoolHasNoUsableAddresses", "Error syncing load balancer: %v", err)
+			return err
+		}
+		var noFamilyPool *NoFamilyPoolError
+		if errors.As(err, &noFamilyPool) {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "NoPoolForIPFamily", "Error syncing load balancer: %v", err)
+			return err
+		}
+		var singleStackCluster *SingleStackClusterError
+		if errors.As(err, &singleStackCluster) {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "DualStackUnavailable", "Error syncing load balancer: %v", err)
+			return err
+		}
+		var familyMismatch *DualStackPoolMismatchError
+		if errors.As(err, &familyMismatch) {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "NoPoolForIPFamily", "Error syncing load balancer: %v", err)
+			return err
+		}
+		var poolExhausted *PoolExhaustedError
+		if errors.As(err, &poolExhausted) {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "PoolExhausted", "Error syncing load balancer: %v", err)
+			return err
+		}
 		c.recorder.Eventf(svc, corev1.EventTypeWarning, "syncLoadBalancer", "Error syncing load balancer: %v", err)
 		return err
 	}
 
-	c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuredLoadBalancer", "Ensured load balancer")
+	// the annotation is updated first, the status follows from it, so a failed status update converges on the retry
+	if err := c.updateLoadBalancerStatus(svc); err != nil {
+		klog.Infof("Error updating the load balancer status of service %s/%s", svc.Namespace, svc.Name)
+		return err
+	}
+
+	if c.verboseEvents {
+		c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuredLoadBalancer", "Ensured load balancer")
+	}
 
 	return nil
 }
 
-// addFinalizer patches the service to add finalizer.
+// processServiceHandoff releases a service that no longer uses our loadbalancerClass, its finalizer,
+// annotations and label are removed since kube-vip no longer owns it.
+func (c *loadbalancerClassServiceController) processServiceHandoff(svc *corev1.Service) error {
+	// a LoadBalancer service without class is owned by the cloud provider service controller
+	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer && svc.Spec.LoadBalancerClass == nil {
+		return nil
+	}
+	if !servicehelper.HasLBFinalizer(svc) && !isImplemented(svc) {
+		return nil
+	}
+
+	// Make a copy so we don't mutate the shared informer cache.
+	updated := svc.DeepCopy()
+	updated.ObjectMeta.Finalizers = removeString(updated.ObjectMeta.Finalizers, servicehelper.LoadBalancerCleanupFinalizer)
+	for _, key := range ownedAnnotations {
+		delete(updated.Annotations, key)
+	}
+	delete(updated.Labels, implementationLabelKey)
+
+	klog.Infof("Handing off service %s/%s, its loadbalancerClass is no longer %s", svc.Namespace, svc.Name, loadbalancerClassName)
+	if _, err := servicehelper.PatchService(c.kubeClient.CoreV1(), svc, updated); err != nil {
+		return err
+	}
+	notifyRelease(context.Background(), c.kubeClient, svc)
+	c.recorder.Eventf(svc, corev1.EventTypeNormal, "LoadBalancerHandedOff", "Released load balancer, loadBalancerClass is no longer %s", loadbalancerClassName)
+	return nil
+}
+
+// updateLoadBalancerStatus updates the status.loadBalancer.ingress of an allocated service in a single status update:
+// the AllocationFailedHostname is removed with allocationFailedStatus, and the ingress is restored to the IPs of the
+// loadbalancerIPs annotation if they diverge with restoreStatus, the annotation is authoritative. The status is derived
+// from the annotation every time, so a retry after a failed update converges without undoing the allocation.
+func (c *loadbalancerClassServiceController) updateLoadBalancerStatus(service *corev1.Service) error {
+	if !c.allocationFailedStatus && !c.restoreStatus {
+		return nil
+	}
+	return retryOnConflict(func() error {
+		recentService, err := c.kubeClient.CoreV1().Services(service.Namespace).Get(context.Background(), service.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		ingress := recentService.Status.LoadBalancer.Ingress
+		cleared := false
+		if c.allocationFailedStatus {
+			ingress = slices.DeleteFunc(slices.Clone(ingress), func(i corev1.LoadBalancerIngress) bool {
+				return i.Hostname == AllocationFailedHostname
+			})
+			cleared = len(ingress) != len(recentService.Status.LoadBalancer.Ingress)
+		}
+
+		ips := recentService.Annotations[LoadbalancerIPsAnnotation]
+		restored := c.restoreStatus && len(ips) > 0 && !ingressMatchesIPs(ingress, ips)
+		previous := ingressIPs(ingress)
+		if restored {
+			ingress = []corev1.LoadBalancerIngress{}
+			for _, ip := range strings.Split(ips, ",") {
+				ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip})
+			}
+			klog.Infof("Restoring the load balancer status of service %s/%s from [%s] to [%s]", service.Namespace, service.Name, strings.Join(previous, ","), ips)
+		}
+		if !cleared && !restored {
+			return nil
+		}
+
+		recentService.Status.LoadBalancer.Ingress = ingress
+		if _, err = c.kubeClient.CoreV1().Services(recentService.Namespace).UpdateStatus(context.Background(), recentService, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		if restored {
+			c.recorder.Eventf(service, corev1.EventTypeNormal, "LoadBalancerStatusRestored", "Restored load balancer status [%s] -> [%s]", strings.Join(previous, ","), ips)
+		}
+		return nil
+	})
+}
+
+// setAllocationFailedStatus sets the AllocationFailedHostname as the only status.loadBalancer.ingress of a service
+// failing allocation. A service whose ingress is already set, e.g. keeping its IPs on a failed resync, is left as is.
+func (c *loadbalancerClassServiceController) setAllocationFailedStatus(service *corev1.Service) error {
+	return retryOnConflict(func() error {
+		recentService, err := c.kubeClient.CoreV1().Services(service.Namespace).Get(context.Background(), service.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if len(recentService.Status.LoadBalancer.Ingress) > 0 {
+			return nil
+		}
+		recentService.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: AllocationFailedHostname}}
+		_, err = c.kubeClient.CoreV1().Services(recentService.Namespace).UpdateStatus(context.Background(), recentService, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// ingressIPs returns the IPs of the load balancer ingress
+func ingressIPs(ingress []corev1.LoadBalancerIngress) []string {
+	var ips []string
+	for _, i := range ingress {
+		if len(i.IP) > 0 {
+			ips = append(ips, i.IP)
+		}
+	}
+	return ips
+}
+
+// ingressMatchesIPs returns true if the IPs of the load balancer ingress are the comma separated IPs, in any order
+func ingressMatchesIPs(ingress []corev1.LoadBalancerIngress, ips string) bool {
+	current := ingressIPs(ingress)
+	expected := strings.Split(ips, ",")
+	if len(current) != len(expected) {
+		return false
+	}
+	slices.Sort(current)
+	slices.Sort(expected)
+	return slices.Equal(current, expected)
+}
+
+// addFinalizer patches the service to add finalizer, unless the service skips it with the
+// skipFinalizer annotation, in which case the finalizer is removed.
 func (c *loadbalancerClassServiceController) addFinalizer(service *corev1.Service) error {
+	if skip, _ := strconv.ParseBool(service.Annotations[SkipFinalizerAnnotationKey]); skip {
+		return c.removeFinalizer(service)
+	}
 	if servicehelper.HasLBFinalizer(service) {
 		return nil
 	}
@@ -281,7 +572,20 @@ func (c *loadbalancerClassServiceController) needsUpdate(oldService *corev1.Serv
 			return true
 		}
 	}
-	if !reflect.DeepEqual(oldService.Annotations, newService.Annotations) {
+	if oldService.Annotations[LoadbalancerIPsAnnotation] != newService.Annotations[LoadbalancerIPsAnnotation] {
+		c.recorder.Eventf(newService, corev1.EventTypeNormal, "LoadbalancerIPs", "%v -> %v",
+			oldService.Annotations[LoadbalancerIPsAnnotation], newService.Annotations[LoadbalancerIPsAnnotation])
+		return true
+	}
+	if c.restoreStatus && !reflect.DeepEqual(oldService.Status.LoadBalancer.Ingress, newService.Status.LoadBalancer.Ingress) {
+		return true
+	}
+	if oldService.Annotations[ReconcileAnnotationKey] != newService.Annotations[ReconcileAnnotationKey] {
+		c.recorder.Eventf(newService, corev1.EventTypeNormal, "Reconcile", "%v -> %v",
+			oldService.Annotations[ReconcileAnnotationKey], newService.Annotations[ReconcileAnnotationKey])
+		return true
+	}
+	if !reflect.DeepEqual(kubeVipAnnotations(oldService), kubeVipAnnotations(newService)) {
 		return true
 	}
 	if oldService.UID != newService.UID {
@@ -301,20 +605,39 @@ func (c *loadbalancerClassServiceController) needsUpdate(oldService *corev1.Serv
 	}
 
 	// User can upgrade (add another clusterIP or ipFamily) or can downgrade (remove secondary clusterIP or ipFamily),
-	// but CAN NOT change primary/secondary clusterIP || ipFamily UNLESS they are changing from/to/ON ExternalName
-	// so not care about order, only need check the length.
+	// the order of the families is also checked as the IPs of a dual-stack service follow it.
 	if len(oldService.Spec.IPFamilies) != len(newService.Spec.IPFamilies) {
 		c.recorder.Eventf(newService, corev1.EventTypeNormal, "IPFamilies", "Count: %v -> %v",
 			len(oldService.Spec.IPFamilies), len(newService.Spec.IPFamilies))
 		return true
 	}
+	if !reflect.DeepEqual(oldService.Spec.IPFamilies, newService.Spec.IPFamilies) {
+		c.recorder.Eventf(newService, corev1.EventTypeNormal, "IPFamilies", "Order: %v -> %v",
+			oldService.Spec.IPFamilies, newService.Spec.IPFamilies)
+		return true
+	}
 
 	return false
 }
 
-// only return service that's service type loadbalancer and loadbalancerclass match
+// kubeVipAnnotations returns the annotations of the service with the kube-vip prefix,
+// changes to annotations owned by other tools don't need a reconcile.
+// The last error annotation is written by the sync itself, and the endpoint nodes annotation by the endpoint nodes
+// controller, so they don't need a reconcile either.
+func kubeVipAnnotations(svc *corev1.Service) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range svc.Annotations {
+		if strings.HasPrefix(k, AnnotationPrefix) && k != LastErrorAnnotationKey && k != EndpointNodesAnnotationKey {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// only return service that's service type loadbalancer and loadbalancerclass match, and that isn't denylisted
 func wantsLoadBalancer(svc *corev1.Service) bool {
-	return svc != nil && svc.Spec.Type == corev1.ServiceTypeLoadBalancer && svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass == LoadbalancerClass
+	return svc != nil && svc.Spec.Type == corev1.ServiceTypeLoadBalancer && isServedLoadbalancerClass(svc.Spec.LoadBalancerClass) &&
+		!isDenylisted(svc) && isNamespaceAllowed(svc)
 }
 
 // removeString returns a newly created []string that contains all items from slice that
@@ -402,3 +725,24 @@ func portEqualForLB(x, y *corev1.ServicePort) bool {
 
 	return true
 }
+
+// warnOrphanedClassServices warns about the services using our loadbalancerClass while the loadbalancerClass controller
+// isn't running: the default service controller ignores them, so they would stay pending without any hint. A warning is
+// logged and a LoadBalancerClassDisabled event is emitted for each of them, they are returned as namespace/name.
+func warnOrphanedClassServices(ctx context.Context, kubeClient kubernetes.Interface) ([]string, error) {
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []string
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if !wantsLoadBalancer(svc) {
+			continue
+		}
+		orphaned = append(orphaned, svc.Namespace+"/"+svc.Name)
+		klog.Warningf("service '%s/%s' uses loadbalancerClass %s but %s isn't set, it won't get an address", svc.Namespace, svc.Name, *svc.Spec.LoadBalancerClass, EnableLoadbalancerClassEnvKey)
+		recordEventf(svc, corev1.EventTypeWarning, "LoadBalancerClassDisabled", "loadBalancerClass %s is not served, set %s to true on kube-vip-cloud-provider", *svc.Spec.LoadBalancerClass, EnableLoadbalancerClassEnvKey)
+	}
+	return orphaned, nil
+}
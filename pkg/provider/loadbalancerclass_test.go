@@ -2,16 +2,24 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	clientgotesting "k8s.io/client-go/testing"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 	servicehelper "k8s.io/cloud-provider/service/helpers"
 	klog "k8s.io/klog/v2"
@@ -90,6 +98,11 @@ func TestSyncLoadBalancerIfNeeded(t *testing.T) {
 			service:           tu.NewService("basic-service3", tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
 			expectNumOfUpdate: 1,
 		},
+		{
+			desc:              "service that wants LB without finalizer",
+			service:           tu.NewService("basic-service4", tu.TweakAddAnnotation(SkipFinalizerAnnotationKey, "true"), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expectNumOfUpdate: 1,
+		},
 	}
 
 	// create ip pool for service to use
@@ -206,10 +219,11 @@ func TestSyncLoadBalancerIfNeededWithMultipleIpUse(t *testing.T) {
 			expectError:       true,
 		},
 		{
-			desc:             "another service who wants same port, no ip left, get no ip",
-			service:          tu.NewService("basic-service6", tu.TweakAddPorts(corev1.ProtocolTCP, 80, 80), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
-			expectNumOfPatch: 1,
-			expectError:      true,
+			desc:              "another service who wants same port, no ip left, get no ip but the last error",
+			service:           tu.NewService("basic-service6", tu.TweakAddPorts(corev1.ProtocolTCP, 80, 80), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expectNumOfUpdate: 1,
+			expectNumOfPatch:  1,
+			expectError:       true,
 		},
 	}
 
@@ -311,6 +325,14 @@ func TestNeedsUpdate(t *testing.T) {
 			},
 			expect: true,
 		},
+		{
+			desc: "service with the ipfamilies reordered",
+			service: []*corev1.Service{
+				tu.NewService("basic-etp", tu.TweakSetIPFamilies(corev1.IPv4Protocol, corev1.IPv6Protocol)),
+				tu.NewService("basic-etp", tu.TweakSetIPFamilies(corev1.IPv6Protocol, corev1.IPv4Protocol)),
+			},
+			expect: true,
+		},
 		{
 			desc: "service with update on loadbalancerip",
 			service: []*corev1.Service{
@@ -319,6 +341,54 @@ func TestNeedsUpdate(t *testing.T) {
 			},
 			expect: true,
 		},
+		{
+			desc: "service with update on a foreign annotation",
+			service: []*corev1.Service{
+				tu.NewService("foreign-annotation", tu.TweakAddAnnotation("example.com/owner", "a")),
+				tu.NewService("foreign-annotation", tu.TweakAddAnnotation("example.com/owner", "b")),
+			},
+			expect: false,
+		},
+		{
+			desc: "service with a foreign annotation added",
+			service: []*corev1.Service{
+				tu.NewService("foreign-annotation"),
+				tu.NewService("foreign-annotation", tu.TweakAddAnnotation("example.com/owner", "a")),
+			},
+			expect: false,
+		},
+		{
+			desc: "service with update on a kube-vip annotation",
+			service: []*corev1.Service{
+				tu.NewService("kube-vip-annotation", tu.TweakAddAnnotation(LoadbalancerServiceInterfaceAnnotationKey, "eth0")),
+				tu.NewService("kube-vip-annotation", tu.TweakAddAnnotation(LoadbalancerServiceInterfaceAnnotationKey, "eth1")),
+			},
+			expect: true,
+		},
+		{
+			desc: "service with the reconcile annotation bumped",
+			service: []*corev1.Service{
+				tu.NewService("reconcile-annotation", tu.TweakAddAnnotation(ReconcileAnnotationKey, "1")),
+				tu.NewService("reconcile-annotation", tu.TweakAddAnnotation(ReconcileAnnotationKey, "2")),
+			},
+			expect: true,
+		},
+		{
+			desc: "service with update on the last error annotation",
+			service: []*corev1.Service{
+				tu.NewService("last-error", tu.TweakAddAnnotation(LastErrorAnnotationKey, "2000-01-01T00:00:00Z: a")),
+				tu.NewService("last-error", tu.TweakAddAnnotation(LastErrorAnnotationKey, "2000-01-01T00:00:01Z: b")),
+			},
+			expect: false,
+		},
+		{
+			desc: "service with a kube-vip annotation added",
+			service: []*corev1.Service{
+				tu.NewService("kube-vip-annotation", tu.TweakAddAnnotation("example.com/owner", "a")),
+				tu.NewService("kube-vip-annotation", tu.TweakAddAnnotation("example.com/owner", "a"), tu.TweakAddAnnotation(AllocationStrategyAnnotationKey, AllocationStrategyAsc)),
+			},
+			expect: true,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -368,3 +438,888 @@ func TestNeedsCleanup(t *testing.T) {
 		})
 	}
 }
+
+func TestPriorityQueueServiceOrder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newController(client)
+	c.workqueue = newPriorityQueue(workqueue.DefaultControllerRateLimiter(), c.servicePriority, nil)
+	defer c.workqueue.ShutDown()
+
+	services := []*corev1.Service{
+		tu.NewService("app", tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+		tu.NewService("invalid", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddAnnotation(AllocationPriorityAnnotationKey, "high")),
+		tu.NewService("gateway", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddAnnotation(AllocationPriorityAnnotationKey, "10")),
+		tu.NewService("ingress", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddAnnotation(AllocationPriorityAnnotationKey, "100")),
+		tu.NewService("batch", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddAnnotation(AllocationPriorityAnnotationKey, "-1")),
+	}
+	for _, svc := range services {
+		if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+			t.Fatal(err)
+		}
+		c.enqueueService(svc)
+	}
+
+	var got []string
+	for c.workqueue.Len() > 0 {
+		key, _ := c.workqueue.Get()
+		got = append(got, key.(string))
+		c.workqueue.Done(key)
+	}
+	ns := services[0].Namespace
+	want := []string{ns + "/ingress", ns + "/gateway", ns + "/app", ns + "/invalid", ns + "/batch"}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expect services to be processed in order %v, got %v", want, got)
+	}
+}
+
+func TestAllocationOrderDeterministic(t *testing.T) {
+	// the services are created in the reverse order of their names
+	names := []string{"web", "queue", "db", "cache", "api"}
+	created := time.Now().Add(-time.Hour)
+	enqueueOrders := [][]string{
+		{"web", "queue", "db", "cache", "api"},
+		{"api", "cache", "db", "queue", "web"},
+		{"db", "api", "web", "cache", "queue"},
+	}
+
+	testCases := []struct {
+		desc            string
+		allocationOrder string
+		expectOrder     []string
+	}{
+		{
+			desc:            "by name",
+			allocationOrder: AllocationOrderName,
+			expectOrder:     []string{"api", "cache", "db", "queue", "web"},
+		},
+		{
+			desc:            "by creation",
+			allocationOrder: AllocationOrderCreation,
+			expectOrder:     names,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var first map[string]string
+			for _, enqueueOrder := range enqueueOrders {
+				client := fake.NewSimpleClientset()
+				if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), newIPPoolConfigMap(), metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				c := newController(client)
+				c.allocationOrder = tc.allocationOrder
+				c.workqueue = newPriorityQueue(workqueue.DefaultControllerRateLimiter(), nil, c.serviceOrder)
+
+				services := map[string]*corev1.Service{}
+				for i, name := range names {
+					svc := tu.NewService(name, tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+					svc.CreationTimestamp = metav1.NewTime(created.Add(time.Duration(i) * time.Minute))
+					createService(t, client, svc)
+					if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+						t.Fatal(err)
+					}
+					services[name] = svc
+				}
+				for _, name := range enqueueOrder {
+					c.enqueueService(services[name])
+				}
+				for c.workqueue.Len() > 0 {
+					c.processNextWorkItem()
+				}
+
+				mapping := map[string]string{}
+				for _, name := range names {
+					svc, err := client.CoreV1().Services(services[name].Namespace).Get(context.Background(), name, metav1.GetOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					mapping[name] = svc.Annotations[LoadbalancerIPsAnnotation]
+				}
+				if first == nil {
+					first = mapping
+				} else if !reflect.DeepEqual(first, mapping) {
+					t.Errorf("expect the same IPs whatever the queue order, got %v then %v with queue order %v", first, mapping, enqueueOrder)
+				}
+			}
+
+			// the services get ascending IPs in the allocation order
+			for i := 1; i < len(tc.expectOrder); i++ {
+				prev, cur := netip.MustParseAddr(first[tc.expectOrder[i-1]]), netip.MustParseAddr(first[tc.expectOrder[i]])
+				if !prev.Less(cur) {
+					t.Errorf("expect %s to get an IP before %s, got %v", tc.expectOrder[i-1], tc.expectOrder[i], first)
+				}
+			}
+		})
+	}
+}
+
+func TestVerboseEvents(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		verboseEvents bool
+		expectEvents  int
+	}{
+		{
+			desc:          "redundant reconciles don't emit events by default",
+			verboseEvents: false,
+			expectEvents:  0,
+		},
+		{
+			desc:          "redundant reconciles emit events when verbose",
+			verboseEvents: true,
+			expectEvents:  4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			c := newController(client)
+			c.verboseEvents = tc.verboseEvents
+			recorder := record.NewFakeRecorder(100)
+			c.recorder = recorder
+
+			svc := tu.NewService("allocated", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer))
+			svc.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+			svc.Annotations = map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"}
+			createService(t, client, svc)
+
+			for i := 0; i < 2; i++ {
+				if err := c.processServiceCreateOrUpdate(svc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(recorder.Events) != tc.expectEvents {
+				t.Errorf("expect %d events, got %d events.", tc.expectEvents, len(recorder.Events))
+			}
+		})
+	}
+}
+
+func TestNeedsUpdateIPChangeEvent(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newController(client)
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+
+	oldSvc := tu.NewService("ip-change")
+	newSvc := oldSvc.DeepCopy()
+	newSvc.Annotations = map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"}
+
+	if !c.needsUpdate(oldSvc, newSvc) {
+		t.Errorf("expect update when the IPs change")
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expect 1 event, got %d events.", len(recorder.Events))
+	}
+	if e := <-recorder.Events; e != "Normal LoadbalancerIPs  -> 10.0.0.1" {
+		t.Errorf("unexpected event %q", e)
+	}
+}
+
+func TestReconcileAnnotation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newController(client)
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), newIPPoolConfigMap(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := tu.NewService("reconcile", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer))
+	svc.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+	svc.Annotations = map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1", ReconcileAnnotationKey: "1"}
+	createService(t, client, svc)
+
+	same := svc.DeepCopy()
+	if c.needsUpdate(svc, same) {
+		t.Errorf("expect no update when the reconcile annotation is unchanged")
+	}
+
+	bumped := svc.DeepCopy()
+	bumped.Annotations[ReconcileAnnotationKey] = "2"
+	if !c.needsUpdate(svc, bumped) {
+		t.Fatalf("expect update when the reconcile annotation is bumped")
+	}
+	if e := <-recorder.Events; e != "Normal Reconcile 1 -> 2" {
+		t.Errorf("unexpected event %q", e)
+	}
+
+	// the bumped service is synced again
+	client.ClearActions()
+	if err := c.processServiceCreateOrUpdate(bumped); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Actions()) == 0 {
+		t.Errorf("expect the bumped service to be synced")
+	}
+}
+
+func TestConflictBackoff(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		backoff       wait.Backoff
+		expectRequeue bool
+	}{
+		{
+			desc:          "conflicts are retried inline",
+			backoff:       wait.Backoff{Steps: 5, Duration: time.Millisecond, Factor: 1},
+			expectRequeue: false,
+		},
+		{
+			desc:          "conflicts are requeued with fail-fast",
+			backoff:       wait.Backoff{Steps: 1, Duration: time.Millisecond, Factor: 1},
+			expectRequeue: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			conflictBackoff = tc.backoff
+			defer func() { conflictBackoff = retry.DefaultRetry }()
+
+			client := fake.NewSimpleClientset()
+			c := newController(client)
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), newIPPoolConfigMap(), metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := tu.NewService("conflict", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer))
+			createService(t, client, svc)
+			if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+				t.Fatal(err)
+			}
+
+			// the first update of the service conflicts
+			updates := 0
+			client.PrependReactor("update", "services", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+				updates++
+				if updates > 1 {
+					return false, nil, nil
+				}
+				return true, nil, apierrors.NewConflict(corev1.Resource("services"), svc.Name, errors.New("the object has been modified"))
+			})
+
+			key := svc.Namespace + "/" + svc.Name
+			c.workqueue.Add(key)
+			c.processNextWorkItem()
+
+			if requeued := c.workqueue.NumRequeues(key) > 0; requeued != tc.expectRequeue {
+				t.Errorf("expect requeue to be %t, got %t", tc.expectRequeue, requeued)
+			}
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allocated := len(res.Annotations[LoadbalancerIPsAnnotation]) > 0; allocated == tc.expectRequeue {
+				t.Errorf("expect the service to be allocated %t, got annotations %v", !tc.expectRequeue, res.Annotations)
+			}
+		})
+	}
+}
+
+func TestServiceHandoff(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		tweak         func(s *corev1.Service)
+		expectHandoff bool
+	}{
+		{
+			desc: "switching to another class hands off the service",
+			tweak: func(s *corev1.Service) {
+				s.Spec.LoadBalancerClass = ptr.To("other-class")
+			},
+			expectHandoff: true,
+		},
+		{
+			desc: "switching to ClusterIP hands off the service",
+			tweak: func(s *corev1.Service) {
+				s.Spec.Type = corev1.ServiceTypeClusterIP
+				s.Spec.LoadBalancerClass = nil
+			},
+			expectHandoff: true,
+		},
+		{
+			desc: "LoadBalancer without class is left to the cloud provider service controller",
+			tweak: func(s *corev1.Service) {
+				s.Spec.LoadBalancerClass = nil
+			},
+			expectHandoff: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			c := newController(client)
+			recorder := record.NewFakeRecorder(100)
+			c.recorder = recorder
+
+			svc := tu.NewService("handoff", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer))
+			svc.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+			svc.Annotations = map[string]string{"foo": "bar"}
+			for _, key := range ownedAnnotations {
+				svc.Annotations[key] = "set"
+			}
+			svc.Annotations[LoadbalancerIPsAnnotation] = "10.0.0.1"
+			tc.tweak(svc)
+			createService(t, client, svc)
+			if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.syncService(svc.Namespace + "/" + svc.Name); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if servicehelper.HasLBFinalizer(res) == tc.expectHandoff {
+				t.Errorf("expect finalizer removed %t, got finalizers %v", tc.expectHandoff, res.Finalizers)
+			}
+			for _, key := range ownedAnnotations {
+				if _, ok := res.Annotations[key]; ok == tc.expectHandoff {
+					t.Errorf("expect %s annotation removed %t, got annotations %v", key, tc.expectHandoff, res.Annotations)
+				}
+			}
+			if _, ok := res.Labels[ImplementationLabelKey]; ok == tc.expectHandoff {
+				t.Errorf("expect implementation label removed %t, got labels %v", tc.expectHandoff, res.Labels)
+			}
+			if res.Annotations["foo"] != "bar" {
+				t.Errorf("expect foreign annotations to be kept, got annotations %v", res.Annotations)
+			}
+
+			expectEvents := 0
+			if tc.expectHandoff {
+				expectEvents = 1
+			}
+			if len(recorder.Events) != expectEvents {
+				t.Fatalf("expect %d events, got %d events.", expectEvents, len(recorder.Events))
+			}
+			if tc.expectHandoff {
+				if e := <-recorder.Events; e != "Normal LoadBalancerHandedOff Released load balancer, loadBalancerClass is no longer "+LoadbalancerClass {
+					t.Errorf("unexpected event %q", e)
+				}
+			}
+		})
+	}
+}
+
+func TestWantsLoadBalancer(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		svc    *corev1.Service
+		expect bool
+	}{
+		{
+			desc:   "service with kube-vip class",
+			svc:    tu.NewService("app", tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expect: true,
+		},
+		{
+			desc:   "service with another class",
+			svc:    tu.NewService("app", tu.TweakAddLBClass(ptr.To("other-class"))),
+			expect: false,
+		},
+		{
+			desc:   "denylisted service with kube-vip class",
+			svc:    tu.NewService("kube-dns", tu.TweakNamespace("kube-system"), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expect: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := wantsLoadBalancer(tc.svc); got != tc.expect {
+				t.Errorf("expect wantsLoadBalancer %t, got %t", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestCustomLoadbalancerClass(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		acceptDefault   bool
+		expectReconcile map[string]bool
+	}{
+		{
+			desc:          "default class services are reconciled alongside custom class ones during migration",
+			acceptDefault: true,
+			expectReconcile: map[string]bool{
+				"custom":  true,
+				"default": true,
+				"other":   false,
+			},
+		},
+		{
+			desc:          "default class services are ignored once disabled",
+			acceptDefault: false,
+			expectReconcile: map[string]bool{
+				"custom":  true,
+				"default": false,
+				"other":   false,
+			},
+		},
+	}
+	defer func() {
+		loadbalancerClassName = LoadbalancerClass
+		acceptDefaultLoadbalancerClass = true
+	}()
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			loadbalancerClassName = "kube-vip.io/custom"
+			acceptDefaultLoadbalancerClass = tc.acceptDefault
+
+			client := fake.NewSimpleClientset()
+			cm := newIPPoolConfigMap()
+			if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			c := newController(client)
+			for name, class := range map[string]string{
+				"custom":  "kube-vip.io/custom",
+				"default": LoadbalancerClass,
+				"other":   "other-class",
+			} {
+				svc := tu.NewService(name, tu.TweakAddLBClass(ptr.To(class)))
+				createService(t, client, svc)
+				if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.syncService(svc.Namespace + "/" + svc.Name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for name, expect := range tc.expectReconcile {
+				res, err := client.CoreV1().Services("default").Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := res.Annotations[LoadbalancerIPsAnnotation]; ok != expect {
+					t.Errorf("expect service %s reconciled %t, got annotations %v", name, expect, res.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestWarnOrphanedClassServices(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	defer func() { eventRecorder = nil }()
+
+	client := fake.NewSimpleClientset(
+		tu.NewService("orphaned", tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+		tu.NewService("other-class", tu.TweakAddLBClass(ptr.To("other-class"))),
+		tu.NewService("no-class"),
+	)
+	orphaned, err := warnOrphanedClassServices(context.Background(), client)
+	if err != nil {
+		t.Fatalf("warnOrphanedClassServices() error: %v", err)
+	}
+	if !reflect.DeepEqual(orphaned, []string{"default/orphaned"}) {
+		t.Errorf("expect orphaned services [default/orphaned], got %v", orphaned)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(recorder.Events))
+	}
+	expectEvent := "Warning LoadBalancerClassDisabled loadBalancerClass " + LoadbalancerClass + " is not served, set " + EnableLoadbalancerClassEnvKey + " to true on kube-vip-cloud-provider"
+	if event := <-recorder.Events; event != expectEvent {
+		t.Errorf("expect event %q, got %q", expectEvent, event)
+	}
+}
+
+func TestSkipFinalizer(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		service         *corev1.Service
+		expectFinalizer bool
+	}{
+		{
+			desc:            "service gets the finalizer",
+			service:         tu.NewService("keep", tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expectFinalizer: true,
+		},
+		{
+			desc:            "annotated service gets no finalizer",
+			service:         tu.NewService("skip", tu.TweakAddAnnotation(SkipFinalizerAnnotationKey, "true"), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expectFinalizer: false,
+		},
+		{
+			desc: "annotated service with finalizer loses it",
+			service: tu.NewService("skip-existing", tu.TweakAddAnnotation(SkipFinalizerAnnotationKey, "true"),
+				tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer), tu.TweakAddLBClass(ptr.To(LoadbalancerClass))),
+			expectFinalizer: false,
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	cm := newIPPoolConfigMap()
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := newController(client)
+			if _, err := client.CoreV1().Services(tc.service.Namespace).Create(ctx, tc.service, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.processServiceCreateOrUpdate(tc.service); err != nil {
+				t.Fatalf("failed to update service %s: %v", tc.service.Name, err)
+			}
+
+			res, err := client.CoreV1().Services(tc.service.Namespace).Get(ctx, tc.service.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if servicehelper.HasLBFinalizer(res) != tc.expectFinalizer {
+				t.Errorf("expect finalizer %t, got finalizers %v", tc.expectFinalizer, res.Finalizers)
+			}
+			if len(res.Annotations[LoadbalancerIPsAnnotation]) == 0 {
+				t.Errorf("expect service %s to get an IP", tc.service.Name)
+			}
+		})
+	}
+}
+
+func TestStaticLoadBalancerIPClassService(t *testing.T) {
+	ctx := context.Background()
+	newService := func(opts ...tu.ServiceTweak) *corev1.Service {
+		return tu.NewService("static", append(opts, tu.TweakSetLoadbalancerIP("10.0.0.5"))...)
+	}
+
+	// class-based service through the loadbalancerClass controller
+	client := fake.NewSimpleClientset()
+	cm := newIPPoolConfigMap()
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := newService(tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	createService(t, client, svc)
+	c := newController(client)
+	if err := c.processServiceCreateOrUpdate(svc); err != nil {
+		t.Fatalf("failed to update service %s: %v", svc.Name, err)
+	}
+	classService, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if classService.Annotations[LoadbalancerIPsAnnotation] != "10.0.0.5" {
+		t.Errorf("expect IPs annotation 10.0.0.5, got %q", classService.Annotations[LoadbalancerIPsAnnotation])
+	}
+	if classService.Labels[ImplementationLabelKey] != ImplementationLabelValue {
+		t.Errorf("expect the implementation label, got labels %v", classService.Labels)
+	}
+	if classService.Annotations[AllocationStrategyAnnotationKey] != AllocationStrategyStatic {
+		t.Errorf("expect allocation strategy %s, got %q", AllocationStrategyStatic, classService.Annotations[AllocationStrategyAnnotationKey])
+	}
+	if !servicehelper.HasLBFinalizer(classService) {
+		t.Errorf("expect the finalizer, got finalizers %v", classService.Finalizers)
+	}
+
+	// the same service through the in-tree service controller
+	inTreeClient := fake.NewSimpleClientset()
+	if _, err := inTreeClient.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, newIPPoolConfigMap(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	inTreeSvc := newService()
+	createService(t, inTreeClient, inTreeSvc)
+	mgr := newLoadBalancer(inTreeClient, KubeVipClientConfigNamespace, KubeVipClientConfig)
+	if _, err := mgr.EnsureLoadBalancer(ctx, "", inTreeSvc, nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error: %v", err)
+	}
+	inTreeService, err := inTreeClient.CoreV1().Services(inTreeSvc.Namespace).Get(ctx, inTreeSvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both paths leave the same kube-vip annotations and labels, the assignment time aside
+	classAnnotations, inTreeAnnotations := kubeVipAnnotations(classService), kubeVipAnnotations(inTreeService)
+	delete(classAnnotations, IPAssignedAtAnnotationKey)
+	delete(inTreeAnnotations, IPAssignedAtAnnotationKey)
+	if !reflect.DeepEqual(classAnnotations, inTreeAnnotations) {
+		t.Errorf("expect the same annotations on both paths, got %v and %v", classAnnotations, inTreeAnnotations)
+	}
+	if !reflect.DeepEqual(classService.Labels, inTreeService.Labels) {
+		t.Errorf("expect the same labels on both paths, got %v and %v", classService.Labels, inTreeService.Labels)
+	}
+}
+
+func TestRestoreStatus(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		restoreStatus bool
+		ingress       []corev1.LoadBalancerIngress
+		expectIngress []corev1.LoadBalancerIngress
+	}{
+		{
+			desc:          "cleared status is restored from the annotation",
+			restoreStatus: true,
+			expectIngress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}, {IP: "fd00::1"}},
+		},
+		{
+			desc:          "changed status is restored from the annotation",
+			restoreStatus: true,
+			ingress:       []corev1.LoadBalancerIngress{{IP: "10.0.0.9"}},
+			expectIngress: []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}, {IP: "fd00::1"}},
+		},
+		{
+			desc:          "matching status is kept",
+			restoreStatus: true,
+			ingress:       []corev1.LoadBalancerIngress{{IP: "fd00::1"}, {IP: "10.0.0.1", IPMode: ptr.To(corev1.LoadBalancerIPModeProxy)}},
+			expectIngress: []corev1.LoadBalancerIngress{{IP: "fd00::1"}, {IP: "10.0.0.1", IPMode: ptr.To(corev1.LoadBalancerIPModeProxy)}},
+		},
+		{
+			desc:          "cleared status is kept when restoring is disabled",
+			restoreStatus: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			c := newController(client)
+			c.restoreStatus = tc.restoreStatus
+
+			svc := tu.NewService("restore", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)), tu.TweakAddFinalizers(servicehelper.LoadBalancerCleanupFinalizer))
+			svc.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+			svc.Annotations = map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1,fd00::1"}
+			svc.Status.LoadBalancer.Ingress = tc.ingress
+			createService(t, client, svc)
+
+			if err := c.processServiceCreateOrUpdate(svc); err != nil {
+				t.Fatal(err)
+			}
+			updated, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(updated.Status.LoadBalancer.Ingress, tc.expectIngress) {
+				t.Errorf("expect ingress %v, got %v", tc.expectIngress, updated.Status.LoadBalancer.Ingress)
+			}
+		})
+	}
+}
+
+func TestNeedsUpdateRestoreStatus(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newController(client)
+
+	oldSvc := tu.NewService("status-cleared", tu.TweakAddLBIngress("10.0.0.1"))
+	newSvc := oldSvc.DeepCopy()
+	newSvc.Status.LoadBalancer.Ingress = nil
+
+	if c.needsUpdate(oldSvc, newSvc) {
+		t.Errorf("expect no update when the status is cleared and restoring is disabled")
+	}
+	c.restoreStatus = true
+	if !c.needsUpdate(oldSvc, newSvc) {
+		t.Errorf("expect update when the status is cleared and restoring is enabled")
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := newIPPoolConfigMap()
+	cm.Data = map[string]string{}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := newController(client)
+	c.maxRetries = 3
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+
+	svc := tu.NewService("failing", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	createService(t, client, svc)
+	if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	key := svc.Namespace + "/" + svc.Name
+	c.workqueue.Add(key)
+	// the first sync and its 3 retries fail
+	for i := 0; i <= c.maxRetries; i++ {
+		c.processNextWorkItem()
+	}
+
+	// the service is dropped instead of being requeued
+	if requeues := c.workqueue.NumRequeues(key); requeues != 0 {
+		t.Errorf("expect the service to be forgotten, got %d requeues", requeues)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if queued := c.workqueue.Len(); queued != 0 {
+		t.Errorf("expect the service to be dropped from the queue, got %d queued", queued)
+	}
+
+	var exhausted []string
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, "SyncRetriesExhausted") {
+			exhausted = append(exhausted, event)
+		}
+	}
+	if len(exhausted) != 1 || !strings.HasPrefix(exhausted[0], "Warning SyncRetriesExhausted Stopped retrying after 3 retries until the service changes") {
+		t.Errorf("expect a single SyncRetriesExhausted event, got %v", exhausted)
+	}
+
+	// a change of the service syncs it again
+	c.enqueueService(svc)
+	if queued := c.workqueue.Len(); queued != 1 {
+		t.Errorf("expect the changed service to be queued, got %d queued", queued)
+	}
+}
+
+func TestAllocationFailedStatus(t *testing.T) {
+	testCases := []struct {
+		desc                   string
+		allocationFailedStatus bool
+		expectFailedIngress    []corev1.LoadBalancerIngress
+	}{
+		{
+			desc:                   "sentinel hostname is set on failure and cleared on success",
+			allocationFailedStatus: true,
+			expectFailedIngress:    []corev1.LoadBalancerIngress{{Hostname: AllocationFailedHostname}},
+		},
+		{
+			desc: "status is left empty when disabled",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := newIPPoolConfigMap()
+			cm.Data = map[string]string{}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			c := newController(client)
+			c.allocationFailedStatus = tc.allocationFailedStatus
+
+			svc := tu.NewService("failing", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+			createService(t, client, svc)
+
+			// no pool, the allocation fails
+			if err := c.processServiceCreateOrUpdate(svc); err == nil {
+				t.Fatal("expect the allocation to fail")
+			}
+			failed, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(failed.Status.LoadBalancer.Ingress, tc.expectFailedIngress) {
+				t.Errorf("expect ingress %v after the failure, got %v", tc.expectFailedIngress, failed.Status.LoadBalancer.Ingress)
+			}
+
+			// a pool is added, the allocation succeeds
+			cm.Data = map[string]string{"cidr-global": "10.0.0.1/24"}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.processServiceCreateOrUpdate(failed); err != nil {
+				t.Fatal(err)
+			}
+			allocated, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(allocated.Status.LoadBalancer.Ingress) != 0 {
+				t.Errorf("expect the ingress to be cleared after the allocation, got %v", allocated.Status.LoadBalancer.Ingress)
+			}
+			if ips := allocated.Annotations[LoadbalancerIPsAnnotation]; ips != "10.0.0.1" {
+				t.Errorf("expect IP 10.0.0.1, got %s", ips)
+			}
+		})
+	}
+}
+
+func TestAllocationFailedStatusKeepsIngress(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newController(client)
+	c.allocationFailedStatus = true
+
+	svc := tu.NewService("allocated", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	createService(t, client, svc)
+	if err := c.setAllocationFailedStatus(svc); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}; !reflect.DeepEqual(updated.Status.LoadBalancer.Ingress, expect) {
+		t.Errorf("expect ingress %v to be kept, got %v", expect, updated.Status.LoadBalancer.Ingress)
+	}
+}
+
+func TestStatusUpdateFailureConverges(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := newIPPoolConfigMap()
+	cm.Data = map[string]string{"cidr-global": "10.0.0.1/24"}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := newController(client)
+	c.allocationFailedStatus = true
+	c.restoreStatus = true
+
+	svc := tu.NewService("partial", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: AllocationFailedHostname}}
+	createService(t, client, svc)
+
+	// the annotation is updated, the following status update fails once
+	statusUpdates := 0
+	client.PrependReactor("update", "services", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		statusUpdates++
+		if statusUpdates == 1 {
+			return true, nil, errors.New("status update failed")
+		}
+		return false, nil, nil
+	})
+
+	if err := c.processServiceCreateOrUpdate(svc); err == nil {
+		t.Fatal("expect the status update to fail")
+	}
+	partial, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := partial.Annotations[LoadbalancerIPsAnnotation]; ips != "10.0.0.1" {
+		t.Fatalf("expect IP 10.0.0.1 in the annotation, got %s", ips)
+	}
+	if expect := []corev1.LoadBalancerIngress{{Hostname: AllocationFailedHostname}}; !reflect.DeepEqual(partial.Status.LoadBalancer.Ingress, expect) {
+		t.Fatalf("expect ingress %v after the failed status update, got %v", expect, partial.Status.LoadBalancer.Ingress)
+	}
+
+	// the retry keeps the allocated IP and updates the status once
+	if err := c.processServiceCreateOrUpdate(partial); err != nil {
+		t.Fatal(err)
+	}
+	converged, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := converged.Annotations[LoadbalancerIPsAnnotation]; ips != "10.0.0.1" {
+		t.Errorf("expect IP 10.0.0.1 to be kept, got %s", ips)
+	}
+	if expect := []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}; !reflect.DeepEqual(converged.Status.LoadBalancer.Ingress, expect) {
+		t.Errorf("expect ingress %v, got %v", expect, converged.Status.LoadBalancer.Ingress)
+	}
+	if statusUpdates != 2 {
+		t.Errorf("expect 2 status updates, got %d", statusUpdates)
+	}
+
+	// a further sync is a no-op
+	if err := c.processServiceCreateOrUpdate(converged); err != nil {
+		t.Fatal(err)
+	}
+	if statusUpdates != 2 {
+		t.Errorf("expect no further status update, got %d", statusUpdates)
+	}
+}
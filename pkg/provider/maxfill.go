@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// maxFillHostBits bounds the size of the cidrs with a max fill, the addresses of larger IPv6 cidrs aren't counted
+const maxFillHostBits = 32
+
+// prefixMaxFill is the share of the addresses of a cidr, in percent, from which no address is allocated from it anymore
+type prefixMaxFill struct {
+	prefix  netip.Prefix
+	percent uint64
+}
+
+// discoverMaxFill parses the max-fill-<namespace> or max-fill-global key, a comma separated list of <cidr>=<percent>,
+// e.g. 10.0.0.0/28=90. The invalid entries are ignored with a warning.
+func discoverMaxFill(cm *v1.ConfigMap, namespace, configMapName string, global bool) []prefixMaxFill {
+	var value string
+	var err error
+	if global {
+		value, _, err = getGlobalConfig(cm, "max-fill")
+	} else {
+		value, _, err = getConfig(cm, namespace, configMapName, "max-fill", "config")
+	}
+	if err != nil || len(value) == 0 {
+		return nil
+	}
+
+	var limits []prefixMaxFill
+	for _, entry := range strings.Split(value, ",") {
+		cidr, percentStr, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			klog.Warningf("invalid max-fill entry [%s], expected <cidr>=<percent>, ignoring it: %v", entry, err)
+			continue
+		}
+		percent, err := strconv.ParseUint(strings.TrimSuffix(percentStr, "%"), 10, 8)
+		if err != nil || percent == 0 || percent > 100 {
+			klog.Warningf("invalid max-fill entry [%s], expected a percent between 1 and 100, ignoring it", entry)
+			continue
+		}
+		if prefix.Addr().BitLen()-prefix.Bits() > maxFillHostBits {
+			klog.Warningf("max-fill entry [%s] is larger than %d host bits, ignoring it", entry, maxFillHostBits)
+			continue
+		}
+		limits = append(limits, prefixMaxFill{prefix: prefix.Masked(), percent: percent})
+	}
+	return limits
+}
+
+// reserveFilledPrefixes adds the addresses of the cidrs filled up to their max fill to the in use addresses, so the
+// allocation moves to the next cidr of the pool and the rest of the cidr is kept as headroom
+func reserveFilledPrefixes(cm *v1.ConfigMap, service *v1.Service, configMapName string, global bool, inUseSet *netipx.IPSet) (*netipx.IPSet, error) {
+	limits := discoverMaxFill(cm, service.Namespace, configMapName, global)
+	if len(limits) == 0 {
+		return inUseSet, nil
+	}
+
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for _, limit := range limits {
+		inPrefix := &netipx.IPSetBuilder{}
+		inPrefix.AddPrefix(limit.prefix)
+		inPrefix.Intersect(inUseSet)
+		inPrefixSet, err := inPrefix.IPSet()
+		if err != nil {
+			return nil, err
+		}
+
+		capacity := uint64(1) << (limit.prefix.Addr().BitLen() - limit.prefix.Bits())
+		inUse := addressCount(inPrefixSet)
+		if inUse*100 < capacity*limit.percent {
+			continue
+		}
+		klog.V(ipam.TraceLevel).Infof("reserving cidr %s, %d of its %d addresses are in use which reaches its max fill of %d%%",
+			limit.prefix, inUse, capacity, limit.percent)
+		builder.AddPrefix(limit.prefix)
+	}
+	return builder.IPSet()
+}
+
+// addressCount returns the number of addresses of the set, which must fit in a cidr of at most maxFillHostBits
+func addressCount(set *netipx.IPSet) uint64 {
+	var count uint64
+	for _, r := range set.Ranges() {
+		from, to := r.From().As16(), r.To().As16()
+		count += uint64(binary.BigEndian.Uint32(to[12:])-binary.BigEndian.Uint32(from[12:])) + 1
+	}
+	return count
+}
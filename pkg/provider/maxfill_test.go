@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiscoverMaxFill(t *testing.T) {
+	cm := &v1.ConfigMap{Data: map[string]string{
+		"max-fill-global": "10.0.0.0/28=90, 10.0.1.0/28=50%,10.0.2.0/28=0,10.0.3.0/28=101,invalid=10,fd00::/64=90,fd01::/120=80",
+		"max-fill-team-a": "10.1.0.5/24=75",
+	}}
+
+	assert.Equal(t, []prefixMaxFill{
+		{prefix: netip.MustParsePrefix("10.0.0.0/28"), percent: 90},
+		{prefix: netip.MustParsePrefix("10.0.1.0/28"), percent: 50},
+		{prefix: netip.MustParsePrefix("fd01::/120"), percent: 80},
+	}, discoverMaxFill(cm, "", KubeVipClientConfig, true))
+	// the cidr is masked
+	assert.Equal(t, []prefixMaxFill{{prefix: netip.MustParsePrefix("10.1.0.0/24"), percent: 75}}, discoverMaxFill(cm, "team-a", KubeVipClientConfig, false))
+	// the namespaces without a max fill of their own use the global one
+	assert.Len(t, discoverMaxFill(cm, "team-b", KubeVipClientConfig, false), 3)
+	assert.Empty(t, discoverMaxFill(&v1.ConfigMap{}, "team-b", KubeVipClientConfig, false))
+}
+
+func TestSyncLoadBalancerMaxFill(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":     "10.0.0.0/29,10.0.1.0/29",
+			"max-fill-global": "10.0.0.0/29=50",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(name string) string {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		createService(t, client, svc)
+		if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Annotations[LoadbalancerIPsAnnotation]
+	}
+
+	// the first cidr is used until 4 of its 8 addresses are in use
+	assert.Equal(t, "10.0.0.1", allocate("svc-1"))
+	assert.Equal(t, "10.0.0.2", allocate("svc-2"))
+	assert.Equal(t, "10.0.0.3", allocate("svc-3"))
+	assert.Equal(t, "10.0.0.4", allocate("svc-4"))
+	// then the allocation moves to the second cidr, the rest of the first one is kept as headroom
+	assert.Equal(t, "10.0.1.1", allocate("svc-5"))
+	assert.Equal(t, "10.0.1.2", allocate("svc-6"))
+}
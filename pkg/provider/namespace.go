@@ -0,0 +1,237 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+const (
+	// EnableNamespaceSelectorsEnvKey environment key for watching namespace labels, services are re-evaluated
+	// when the labels of their namespace change the pool selected by namespace-selector-<pool>
+	EnableNamespaceSelectorsEnvKey = "KUBEVIP_ENABLE_NAMESPACE_SELECTORS"
+
+	// SelectorChangeBehaviorDetect only emits an event when a service is no longer in the pool of its namespace, this is the default
+	SelectorChangeBehaviorDetect = "detect"
+
+	// SelectorChangeBehaviorReallocate releases the IPs of a service that is no longer in the pool of its namespace,
+	// the service then gets new IPs from the selected pool
+	SelectorChangeBehaviorReallocate = "reallocate"
+)
+
+// namespaceController re-evaluates the services of a namespace when its labels change
+type namespaceController struct {
+	kubeClient            kubernetes.Interface
+	serviceLister         corelisters.ServiceLister
+	serviceListerSynced   cache.InformerSynced
+	namespaceLister       corelisters.NamespaceLister
+	namespaceListerSynced cache.InformerSynced
+
+	workqueue workqueue.RateLimitingInterface
+
+	cmName      string
+	cmNamespace string
+}
+
+func newNamespaceController(
+	sharedInformer informers.SharedInformerFactory,
+	kubeClient kubernetes.Interface,
+	cmName, cmNamespace string,
+) *namespaceController {
+	serviceInformer := sharedInformer.Core().V1().Services().Informer()
+	namespaceInformer := sharedInformer.Core().V1().Namespaces().Informer()
+	c := &namespaceController{
+		kubeClient:            kubeClient,
+		serviceLister:         sharedInformer.Core().V1().Services().Lister(),
+		serviceListerSynced:   serviceInformer.HasSynced,
+		namespaceLister:       sharedInformer.Core().V1().Namespaces().Lister(),
+		namespaceListerSynced: namespaceInformer.HasSynced,
+
+		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Namespaces"),
+
+		cmName:      cmName,
+		cmNamespace: cmNamespace,
+	}
+
+	_, _ = namespaceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.namespaceUpdated,
+	})
+
+	return c
+}
+
+// namespaceUpdated enqueues the namespace if its labels changed
+func (c *namespaceController) namespaceUpdated(old, cur interface{}) {
+	oldNs, ok1 := old.(*corev1.Namespace)
+	curNs, ok2 := cur.(*corev1.Namespace)
+	if !ok1 || !ok2 || reflect.DeepEqual(oldNs.Labels, curNs.Labels) {
+		return
+	}
+	c.workqueue.Add(curNs.Name)
+}
+
+// Run starts the worker to process namespace updates
+func (c *namespaceController) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	if !cache.WaitForNamedCacheSync("namespace", stopCh, c.serviceListerSynced, c.namespaceListerSynced) {
+		return
+	}
+
+	klog.V(4).Info("Starting namespace worker.")
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	<-stopCh
+}
+
+func (c *namespaceController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *namespaceController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.workqueue.Done(obj)
+
+	name, ok := obj.(string)
+	if !ok {
+		c.workqueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+		return true
+	}
+
+	if err := c.syncNamespace(context.Background(), name); err != nil {
+		c.workqueue.AddRateLimited(obj)
+		utilruntime.HandleError(fmt.Errorf("error syncing namespace '%s': %s, requeuing", name, err.Error()))
+		return true
+	}
+
+	c.workqueue.Forget(obj)
+	return true
+}
+
+// syncNamespace checks the services of the namespace against the pool selected by the namespace labels
+func (c *namespaceController) syncNamespace(ctx context.Context, name string) error {
+	cm, err := getConfigMap(ctx, c.kubeClient, c.cmName, c.cmNamespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(namespaceSelectorPools(cm)) == 0 {
+		return nil
+	}
+
+	ns, err := c.namespaceLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pool, _, _, err := discoverPoolForNamespace(cm, name, ns.Labels, c.cmName)
+	if err != nil {
+		klog.Infof("no pool for namespace [%s] after its labels changed: %v", name, err)
+		return nil
+	}
+
+	svcs, err := c.serviceLister.Services(name).List(labels.SelectorFromSet(labels.Set{implementationLabelKey: ImplementationLabelValue}))
+	if err != nil {
+		return err
+	}
+
+	reallocate := discoverSelectorChangeReallocate(cm)
+	for _, svc := range svcs {
+		ips := svc.Annotations[LoadbalancerIPsAnnotation]
+		if len(ips) == 0 || !svc.DeletionTimestamp.IsZero() {
+			continue
+		}
+		// a regional pool doesn't depend on the namespace labels
+		if region := svc.Annotations[RegionAnnotationKey]; len(region) > 0 {
+			regionalPool, _, _, err := discoverRegionalPool(cm, name, region, ns.Labels, c.cmName)
+			if err != nil || regionalPool != pool {
+				continue
+			}
+		}
+		if ipsInPool(ips, pool) {
+			continue
+		}
+
+		klog.Infof("service '%s/%s' IPs [%s] are not in the pool [%s] selected for its namespace", svc.Namespace, svc.Name, ips, pool)
+		if !reallocate || isFrozen(svc) {
+			recordEventf(svc, corev1.EventTypeWarning, "PoolSelectorChanged", "IPs [%s] are not in the pool [%s] selected for namespace %s", ips, pool, name)
+			continue
+		}
+
+		recordEventf(svc, corev1.EventTypeNormal, "PoolSelectorChanged", "Releasing IPs [%s] to reallocate from the pool [%s] selected for namespace %s", ips, pool, name)
+		if err := releaseForReallocation(ctx, c.kubeClient, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipsInPool returns true if all the IPs are part of the pool, DHCP IPs are only part of the DHCP pool
+func ipsInPool(ips, pool string) bool {
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		contained, err := ipam.PoolContains(pool, addr)
+		if err != nil || !contained {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseForReallocation removes the IPs of the service so it gets new IPs on its next sync
+func releaseForReallocation(ctx context.Context, kubeClient kubernetes.Interface, svc *corev1.Service) error {
+	err := retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		delete(recentService.Annotations, LoadbalancerIPsAnnotation)
+		delete(recentService.Annotations, AllocationStrategyAnnotationKey)
+		delete(recentService.Annotations, SourcePoolAnnotationKey)
+		delete(recentService.Annotations, AllocationInfoAnnotationKey)
+		recentService.Spec.LoadBalancerIP = ""
+
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("error releasing IPs of Service [%s] : %v", svc.Name, err)
+	}
+	notifyRelease(ctx, kubeClient, svc)
+	return nil
+}
+
+// discoverSelectorChangeReallocate returns true if selector-change-behavior-global is reallocate
+func discoverSelectorChangeReallocate(cm *corev1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "selector-change-behavior", SelectorChangeBehaviorDetect, SelectorChangeBehaviorReallocate) == SelectorChangeBehaviorReallocate
+}
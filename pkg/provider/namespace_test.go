@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newTestNamespaceController(t *testing.T, behavior string) (*namespaceController, *fake.Clientset, informers.SharedInformerFactory) {
+	client := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-pool-a":               "10.0.1.1/32",
+			"cidr-pool-b":               "10.0.2.1/32",
+			"namespace-selector-pool-a": "team=a",
+			"namespace-selector-pool-b": "team=b",
+		},
+	}
+	if len(behavior) > 0 {
+		cm.Data["selector-change-behavior-global"] = behavior
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &namespaceController{
+		kubeClient:            client,
+		serviceLister:         informerFactory.Core().V1().Services().Lister(),
+		serviceListerSynced:   alwaysReady,
+		namespaceLister:       informerFactory.Core().V1().Namespaces().Lister(),
+		namespaceListerSynced: alwaysReady,
+		workqueue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Namespaces"),
+		cmName:                KubeVipClientConfig,
+		cmNamespace:           KubeVipClientConfigNamespace,
+	}
+	return c, client, informerFactory
+}
+
+func TestNamespaceUpdated(t *testing.T) {
+	c, _, _ := newTestNamespaceController(t, "")
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Labels: map[string]string{"team": "a"}}}
+	annotated := ns.DeepCopy()
+	annotated.Annotations = map[string]string{"foo": "bar"}
+	c.namespaceUpdated(ns, annotated)
+	assert.Equal(t, 0, c.workqueue.Len(), "namespace enqueued without label change")
+
+	relabeled := ns.DeepCopy()
+	relabeled.Labels["team"] = "b"
+	c.namespaceUpdated(ns, relabeled)
+	assert.Equal(t, 1, c.workqueue.Len(), "namespace not enqueued on label change")
+}
+
+func TestSyncNamespace(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		behavior    string
+		frozen      bool
+		expectIPs   string
+		expectEvent string
+	}{
+		{
+			desc:        "label change is only detected by default",
+			behavior:    "",
+			expectIPs:   "10.0.1.1",
+			expectEvent: "Warning PoolSelectorChanged IPs [10.0.1.1] are not in the pool [10.0.2.1/32] selected for namespace ns",
+		},
+		{
+			desc:        "label change reallocates from the selected pool",
+			behavior:    SelectorChangeBehaviorReallocate,
+			expectIPs:   "10.0.2.1",
+			expectEvent: "Normal PoolSelectorChanged Releasing IPs [10.0.1.1] to reallocate from the pool [10.0.2.1/32] selected for namespace ns",
+		},
+		{
+			desc:        "label change keeps the IPs of a frozen service",
+			behavior:    SelectorChangeBehaviorReallocate,
+			frozen:      true,
+			expectIPs:   "10.0.1.1",
+			expectEvent: "Warning PoolSelectorChanged IPs [10.0.1.1] are not in the pool [10.0.2.1/32] selected for namespace ns",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			c, client, informerFactory := newTestNamespaceController(t, tc.behavior)
+
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Labels: map[string]string{"team": "a"}}}
+			if _, err := client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc"}}
+			if tc.frozen {
+				svc.Annotations = map[string]string{FreezeAnnotationKey: "true"}
+			}
+			createService(t, client, svc)
+
+			// the service gets an address from the pool selected by team=a
+			allocated := mustSyncService(t, client, svc)
+			assert.Equal(t, "10.0.1.1", allocated.Annotations[LoadbalancerIPsAnnotation])
+
+			// the namespace now selects the pool of team=b
+			ns.Labels["team"] = "b"
+			if _, err := client.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := informerFactory.Core().V1().Namespaces().Informer().GetIndexer().Add(ns); err != nil {
+				t.Fatal(err)
+			}
+			if err := informerFactory.Core().V1().Services().Informer().GetIndexer().Add(allocated); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.syncNamespace(ctx, ns.Name); err != nil {
+				t.Fatal(err)
+			}
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Equal(t, tc.expectEvent, <-recorder.Events)
+
+			// resync the service as the service controllers do on update
+			updated, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := syncLoadBalancer(ctx, client, updated, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+		})
+	}
+}
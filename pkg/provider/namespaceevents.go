@@ -0,0 +1,25 @@
+package provider
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+// discoverNamespaceEvents returns true if namespace-events-global is set, the allocation failures and utilization
+// alerts of a namespace are then summarized as events on the Namespace object too, so a tenant finds them without
+// going through the events of every service or of the controller configmap
+func discoverNamespaceEvents(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "namespace-events")
+}
+
+// recordNamespaceEventf emits an event on the Namespace object of the namespace if namespace-events-global is set,
+// nothing is emitted for the global pool
+func recordNamespaceEventf(cm *v1.ConfigMap, namespace, eventType, reason, messageFmt string, args ...interface{}) {
+	if eventRecorder == nil || len(namespace) == 0 || namespace == config.GlobalKeyword || !discoverNamespaceEvents(cm) {
+		return
+	}
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	eventRecorder.Eventf(ns, eventType, reason, messageFmt, args...)
+}
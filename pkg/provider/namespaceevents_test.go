@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/utils/ptr"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+// objectRecorder records the events with the kind, namespace and name of their object
+type objectRecorder struct {
+	events []string
+}
+
+func (r *objectRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	kind := "Service"
+	if _, ok := object.(*v1.Namespace); ok {
+		kind = "Namespace"
+	}
+	accessor, _ := meta.Accessor(object)
+	r.events = append(r.events, fmt.Sprintf("%s %s/%s %s %s %s", kind, accessor.GetNamespace(), accessor.GetName(), eventtype, reason, message))
+}
+
+func (r *objectRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *objectRecorder) AnnotatedEventf(object runtime.Object, _ map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// poolExhaustedCount returns the value of kubevip_pool_exhausted_total for the namespace
+func poolExhaustedCount(t *testing.T, namespace string) float64 {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "kubevip_pool_exhausted_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "namespace" && label.GetValue() == namespace {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func Test_discoverNamespaceEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want bool
+	}{
+		{name: "unset"},
+		{name: "enabled", data: map[string]string{"namespace-events-global": "true"}, want: true},
+		{name: "disabled", data: map[string]string{"namespace-events-global": "false"}},
+		{name: "invalid", data: map[string]string{"namespace-events-global": "yes please"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverNamespaceEvents(&v1.ConfigMap{Data: tt.data}))
+		})
+	}
+}
+
+func TestNamespaceScopedAllocationFailures(t *testing.T) {
+	tests := []struct {
+		name            string
+		namespaceEvents bool
+	}{
+		{name: "service events only"},
+		{name: "with namespace summary events", namespaceEvents: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &objectRecorder{}
+			eventRecorder = recorder
+			defer func() { eventRecorder = nil }()
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := newIPPoolConfigMap()
+			cm.Data = map[string]string{
+				"range-tenant-a": "10.0.1.1-10.0.1.1",
+				"range-tenant-b": "10.0.2.1-10.0.2.1",
+			}
+			if tt.namespaceEvents {
+				cm.Data["namespace-events-global"] = "true"
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			c := newController(client)
+			c.recorder = recorder
+
+			before := map[string]float64{}
+			for _, namespace := range []string{"tenant-a", "tenant-b"} {
+				before[namespace] = poolExhaustedCount(t, namespace)
+				for _, name := range []string{"first", "second"} {
+					svc := tu.NewService(name, tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+					svc.Namespace = namespace
+					if _, err := client.CoreV1().Services(namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+						t.Fatal(err)
+					}
+					err := c.processServiceCreateOrUpdate(svc)
+					if name == "first" && err != nil {
+						t.Fatal(err)
+					}
+					if name == "second" && err == nil {
+						t.Fatalf("expect the pool of %s to be exhausted", namespace)
+					}
+				}
+			}
+
+			for _, namespace := range []string{"tenant-a", "tenant-b"} {
+				assert.Equal(t, before[namespace]+1, poolExhaustedCount(t, namespace), namespace)
+
+				var serviceEvents, namespaceEvents []string
+				for _, event := range recorder.events {
+					switch {
+					case strings.HasPrefix(event, "Service "+namespace+"/second Warning PoolExhausted "):
+						serviceEvents = append(serviceEvents, event)
+					case strings.HasPrefix(event, "Namespace /"+namespace+" "):
+						namespaceEvents = append(namespaceEvents, event)
+					}
+				}
+				assert.Len(t, serviceEvents, 1, namespace)
+				if !tt.namespaceEvents {
+					assert.Empty(t, namespaceEvents, namespace)
+					continue
+				}
+				if assert.Len(t, namespaceEvents, 1, namespace) {
+					assert.Contains(t, namespaceEvents[0], "Warning AllocationFailed Service second failed to get IPs")
+				}
+			}
+		})
+	}
+}
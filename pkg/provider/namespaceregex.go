@@ -0,0 +1,27 @@
+package provider
+
+import (
+	"regexp"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// NamespaceRegexEnvKey environment key for a regular expression the namespace of a service must match to be allocated
+// an address, e.g. ^tenant-.*, unset allocates in every namespace
+const NamespaceRegexEnvKey = "KUBEVIP_NAMESPACE_REGEX"
+
+// namespaceRegex restricts the namespaces of the services allocated an address, nil if NamespaceRegexEnvKey isn't set
+var namespaceRegex *regexp.Regexp
+
+// isNamespaceAllowed returns true if the namespace of the service matches the namespace regex, or if none is set
+func isNamespaceAllowed(service *v1.Service) bool {
+	return namespaceRegex == nil || namespaceRegex.MatchString(service.Namespace)
+}
+
+// namespaceRegexString returns the namespace regex, empty if none is set
+func namespaceRegexString() string {
+	if namespaceRegex == nil {
+		return ""
+	}
+	return namespaceRegex.String()
+}
@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func TestNamespaceRegex(t *testing.T) {
+	tests := []struct {
+		name      string
+		regex     string
+		namespace string
+		wantIPs   string
+	}{
+		{
+			name:      "no regex allocates in every namespace",
+			namespace: "default",
+			wantIPs:   "192.168.1.1",
+		},
+		{
+			name:      "matching namespace",
+			regex:     "^tenant-.*",
+			namespace: "tenant-a",
+			wantIPs:   "192.168.1.1",
+		},
+		{
+			name:      "non-matching namespace",
+			regex:     "^tenant-.*",
+			namespace: "default",
+		},
+		{
+			name:      "regex isn't anchored unless asked to",
+			regex:     "tenant",
+			namespace: "shared-tenant",
+			wantIPs:   "192.168.1.1",
+		},
+	}
+
+	defer func() { namespaceRegex = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespaceRegex = nil
+			if len(tt.regex) > 0 {
+				namespaceRegex = regexp.MustCompile(tt.regex)
+			}
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "192.168.1.1/24",
+				},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "web"}}
+			res := createAndSyncService(t, client, svc)
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+
+			classSvc := tu.NewService("web", tu.TweakNamespace(tt.namespace), tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+			assert.Equal(t, len(tt.wantIPs) > 0, wantsLoadBalancer(classSvc))
+		})
+	}
+}
+
+func TestNamespaceRegexInvalid(t *testing.T) {
+	defer func() { namespaceRegex = nil }()
+	t.Setenv(NamespaceRegexEnvKey, "^tenant-(")
+
+	_, err := newKubeVipCloudProvider(nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error parsing value of "+NamespaceRegexEnvKey)
+	}
+}
@@ -0,0 +1,153 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// AllocationStrategyPinned means the IP is pinned to the service by the pinned-services-global entry of the configmap
+const AllocationStrategyPinned = "pinned"
+
+// PinnedIPConflictError is returned when the pinned IP of a service is used by another service
+type PinnedIPConflictError struct {
+	IP      string
+	Service string
+}
+
+func (e *PinnedIPConflictError) Error() string {
+	return fmt.Sprintf("pinned IP [%s] is used by service [%s]", e.IP, e.Service)
+}
+
+// discoverPinnedServices returns the IPs pinned to the services by pinned-services-global, a comma or newline separated
+// list of <namespace>/<name>=<ip> entries. Invalid entries are ignored.
+func discoverPinnedServices(cm *v1.ConfigMap) map[string]netip.Addr {
+	pinnedStr, key, err := getGlobalConfig(cm, "pinned-services")
+	if err != nil {
+		return nil
+	}
+
+	pins := map[string]netip.Addr{}
+	for _, entry := range strings.FieldsFunc(pinnedStr, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		service, ip, found := strings.Cut(entry, "=")
+		namespace, name, _ := strings.Cut(strings.TrimSpace(service), "/")
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if !found || len(namespace) == 0 || len(name) == 0 || err != nil {
+			klog.Warningf("invalid entry [%s] in [%s], expected <namespace>/<name>=<ip>, ignoring it", entry, key)
+			continue
+		}
+		pins[namespace+"/"+name] = addr
+	}
+	return pins
+}
+
+// reservePinnedIPs adds the IPs pinned to the other services to the in use addresses, so they are never
+// allocated from the pool
+func reservePinnedIPs(cm *v1.ConfigMap, service *v1.Service, inUseSet *netipx.IPSet) (*netipx.IPSet, error) {
+	pins := discoverPinnedServices(cm)
+	if len(pins) == 0 {
+		return inUseSet, nil
+	}
+
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for key, addr := range pins {
+		if key == service.Namespace+"/"+service.Name {
+			continue
+		}
+		klog.V(ipam.TraceLevel).Infof("reserving address %s pinned to service '%s'", addr, key)
+		builder.Add(addr)
+	}
+	return builder.IPSet()
+}
+
+// syncPinnedService assigns the service the IP pinned to it in the configmap, whatever IPs it had before.
+// It returns false if the service isn't pinned.
+func syncPinnedService(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) (*v1.LoadBalancerStatus, bool, error) {
+	if controllerCM == nil {
+		return nil, false, nil
+	}
+	addr, pinned := discoverPinnedServices(controllerCM)[service.Namespace+"/"+service.Name]
+	if !pinned {
+		return nil, false, nil
+	}
+	ip := addr.String()
+
+	if service.Labels[implementationLabelKey] == ImplementationLabelValue &&
+		service.Annotations[LoadbalancerIPsAnnotation] == ip &&
+		service.Annotations[AllocationStrategyAnnotationKey] == AllocationStrategyPinned {
+		return &service.Status.LoadBalancer, true, nil
+	}
+
+	// The pinned IP is exclusive to the service
+	svcs, err := listInUseServices(ctx, kubeClient, "")
+	if err != nil {
+		return nil, true, err
+	}
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if svc.Namespace == service.Namespace && svc.Name == service.Name {
+			continue
+		}
+		addrs, err := parseAddrList(svc.Annotations[LoadbalancerIPsAnnotation])
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a == addr {
+				conflictErr := &PinnedIPConflictError{IP: ip, Service: svc.Namespace + "/" + svc.Name}
+				klog.Warningf("service '%s/%s': %v", service.Namespace, service.Name, conflictErr)
+				recordEventf(service, v1.EventTypeWarning, "PinnedIPConflict", "%v", conflictErr)
+				ipam.RecordAllocation(service.Namespace, service.Name, ipam.AllocationOutcomeFailed, allocationExemplars)
+				return nil, true, conflictErr
+			}
+		}
+	}
+
+	if previous := service.Annotations[LoadbalancerIPsAnnotation]; len(previous) > 0 && previous != ip {
+		klog.Infof("service '%s/%s' is pinned to [%s], replacing IPs [%s]", service.Namespace, service.Name, ip, previous)
+	}
+	err = retryOnConflict(func() error {
+		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if recentService.Labels == nil {
+			recentService.Labels = make(map[string]string)
+		}
+		recentService.Labels[implementationLabelKey] = ImplementationLabelValue
+		if recentService.Annotations == nil {
+			recentService.Annotations = make(map[string]string)
+		}
+		setLoadBalancerIPs(recentService, ip)
+		recentService.Annotations[AllocationStrategyAnnotationKey] = AllocationStrategyPinned
+		delete(recentService.Annotations, SourcePoolAnnotationKey)
+		refreshAllocationInfo(recentService)
+		recentService.Spec.LoadBalancerIP = ip
+
+		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		ipam.RecordAllocation(service.Namespace, service.Name, ipam.AllocationOutcomeFailed, allocationExemplars)
+		return nil, true, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
+	}
+	klog.Infof("service '%s/%s' is pinned to [%s]", service.Namespace, service.Name, ip)
+	ipam.RecordAllocation(service.Namespace, service.Name, ipam.AllocationOutcomeAllocated, allocationExemplars)
+	notifyAllocation(service, ip, "")
+
+	return &service.Status.LoadBalancer, true, nil
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDiscoverPinnedServices(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"pinned-services-global": "prod/web=10.0.0.42, prod/db=fd00::42\ninvalid,prod=10.0.0.1,prod/api=not-an-ip\n",
+		},
+	}
+	assert.Equal(t, map[string]netip.Addr{
+		"prod/web": netip.MustParseAddr("10.0.0.42"),
+		"prod/db":  netip.MustParseAddr("fd00::42"),
+	}, discoverPinnedServices(cm))
+	assert.Empty(t, discoverPinnedServices(&v1.ConfigMap{}))
+}
+
+func TestSyncPinnedService(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		serviceName    string
+		serviceIPs     string
+		existingIP     string
+		expectIPs      string
+		expectStrategy string
+		expectEvent    string
+	}{
+		{
+			name:           "pinned service gets its IP",
+			data:           map[string]string{"cidr-global": "10.0.0.0/24", "pinned-services-global": "test/pinned=10.0.0.42"},
+			serviceName:    "pinned",
+			expectIPs:      "10.0.0.42",
+			expectStrategy: AllocationStrategyPinned,
+		},
+		{
+			name:           "pinned IP replaces the IPs of the service",
+			data:           map[string]string{"cidr-global": "10.0.0.0/24", "pinned-services-global": "test/pinned=10.0.0.42"},
+			serviceName:    "pinned",
+			serviceIPs:     "10.0.0.7",
+			expectIPs:      "10.0.0.42",
+			expectStrategy: AllocationStrategyPinned,
+		},
+		{
+			name:        "pinned IP used by another service is a conflict",
+			data:        map[string]string{"cidr-global": "10.0.0.0/24", "pinned-services-global": "test/pinned=10.0.0.42"},
+			serviceName: "pinned",
+			existingIP:  "10.0.0.42",
+			expectEvent: "Warning PinnedIPConflict pinned IP [10.0.0.42] is used by service [test/existing]",
+		},
+		{
+			name:           "pinned IP of another service isn't allocated from the pool",
+			data:           map[string]string{"cidr-global": "10.0.0.1/30", "pinned-services-global": "test/pinned=10.0.0.1"},
+			serviceName:    "other",
+			expectIPs:      "10.0.0.2",
+			expectStrategy: AllocationStrategyAsc,
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.existingIP) > 0 {
+				existing := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        "existing",
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: tt.existingIP},
+					},
+				}
+				createService(t, client, existing)
+			}
+
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: tt.serviceName}}
+			if len(tt.serviceIPs) > 0 {
+				svc.Labels = map[string]string{ImplementationLabelKey: ImplementationLabelValue}
+				svc.Annotations = map[string]string{LoadbalancerIPsAnnotation: tt.serviceIPs}
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(context.Background(), client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if len(tt.expectEvent) > 0 {
+				var conflictErr *PinnedIPConflictError
+				assert.ErrorAs(t, err, &conflictErr)
+				assert.Len(t, recorder.Events, 1)
+				assert.Equal(t, tt.expectEvent, <-recorder.Events)
+			} else if err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			assert.Equal(t, tt.expectStrategy, res.Annotations[AllocationStrategyAnnotationKey])
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// PoolStatusConfigMap is the name of the ConfigMap that reflects the exhaustion of the pools, it is created in the
+	// same namespace as the pool ConfigMap. Each key is a cidr, range or allowlist key of the pool ConfigMap and the value
+	// is its Exhausted condition in JSON.
+	PoolStatusConfigMap = "kubevip-pool-status"
+
+	// PoolConditionExhausted is True while every address of the pool is in use
+	PoolConditionExhausted = "Exhausted"
+)
+
+// syncPoolStatus sets the Exhausted condition of every pool of the pool ConfigMap from the addresses of the services,
+// the condition only transitions when a pool fills up or frees an address
+func (c *allocationsStatusController) syncPoolStatus(ctx context.Context, svcs []*corev1.Service) error {
+	poolCM, err := getConfigMap(ctx, c.kubeClient, c.cmName, c.cmNamespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	list := &corev1.ServiceList{}
+	for _, svc := range svcs {
+		if svc.DeletionTimestamp.IsZero() {
+			list.Items = append(list.Items, *svc)
+		}
+	}
+	inUse := inUseAddresses(list)
+
+	cm, err := getConfigMap(ctx, c.kubeClient, PoolStatusConfigMap, c.cmNamespace)
+	if apierrors.IsNotFound(err) {
+		cm, err = createConfigMap(ctx, c.kubeClient, PoolStatusConfigMap, c.cmNamespace)
+	}
+	if err != nil {
+		return err
+	}
+
+	status := map[string]string{}
+	for _, key := range poolKeys(poolCM) {
+		pool := poolOfKey(poolCM, key)
+		size, used, free, err := poolUsage(pool, inUse)
+		if err != nil {
+			continue
+		}
+
+		condition := metav1.Condition{
+			Type:    PoolConditionExhausted,
+			Status:  metav1.ConditionFalse,
+			Reason:  "FreeAddresses",
+			Message: fmt.Sprintf("%s of %s addresses of pool [%s] are free", free, size, pool),
+		}
+		if free.Sign() == 0 {
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "NoFreeAddresses"
+			condition.Message = fmt.Sprintf("all %d addresses of pool [%s] are in use", used, pool)
+		}
+
+		// Keep the transition time of the previous condition if its status is unchanged
+		var conditions []metav1.Condition
+		var previous metav1.Condition
+		if err := json.Unmarshal([]byte(cm.Data[key]), &previous); err == nil {
+			conditions = append(conditions, previous)
+		}
+		if meta.SetStatusCondition(&conditions, condition) && previous.Status != condition.Status {
+			if condition.Status == metav1.ConditionTrue {
+				klog.Warningf("pool [%s] in [%s] is exhausted", key, c.cmName)
+			} else if len(previous.Status) > 0 {
+				klog.Infof("pool [%s] in [%s] has free addresses again", key, c.cmName)
+			}
+		}
+		value, err := json.Marshal(conditions[0])
+		if err != nil {
+			return err
+		}
+		status[key] = string(value)
+	}
+
+	if (len(cm.Data) == 0 && len(status) == 0) || reflect.DeepEqual(cm.Data, status) {
+		return nil
+	}
+	updated := cm.DeepCopy()
+	updated.Data = status
+	_, err = c.kubeClient.CoreV1().ConfigMaps(c.cmNamespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
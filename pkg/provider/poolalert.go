@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// poolAlerts holds the pools above the utilization alert threshold, keyed by <namespace>/<pool>, so the alert fires
+// once when a pool crosses the threshold and again only after it went back below it
+var poolAlerts sync.Map
+
+// resetPoolAlerts forgets the pools above the threshold
+func resetPoolAlerts() {
+	poolAlerts.Range(func(key, _ any) bool {
+		poolAlerts.Delete(key)
+		return true
+	})
+}
+
+// discoverAlertAtPercent returns the value of alert-at-percent-global, the utilization of a pool in percent above which
+// an alert is raised. It returns 0 if the alert is disabled.
+func discoverAlertAtPercent(cm *v1.ConfigMap) float64 {
+	percentStr, key, err := getGlobalConfig(cm, "alert-at-percent")
+	if err != nil {
+		return 0
+	}
+	percent, err := strconv.Atoi(percentStr)
+	if err != nil || percent < 1 || percent > 100 {
+		klog.Warningf("invalid value [%s] in [%s], expected a percentage between 1 and 100, ignoring the alert", percentStr, key)
+		return 0
+	}
+	return float64(percent)
+}
+
+// checkPoolUtilization raises an alert when the services in use hold at least alert-at-percent-global of the addresses
+// of the pool. The alert is a warning event on the configmap of the controller and the
+// kubevip_pool_utilization_alerts_total metric, it fires once per crossing of the threshold. With namespace-events-global
+// the event of a namespace pool is emitted on the Namespace object too.
+func checkPoolUtilization(ctx context.Context, kubeClient kubernetes.Interface, cm *v1.ConfigMap, pool, serviceNamespace string) {
+	if len(pool) == 0 || pool == DHCPPool {
+		return
+	}
+	threshold := discoverAlertAtPercent(cm)
+	if threshold == 0 {
+		return
+	}
+
+	svcs, err := listInUseServices(ctx, kubeClient, serviceNamespace)
+	if err != nil {
+		return
+	}
+	inUseSet, _, err := mapImplementedServices(svcs, false)
+	if err != nil {
+		return
+	}
+	size, inUse, err := ipam.PoolUtilization(pool, inUseSet)
+	if err != nil || size == 0 {
+		return
+	}
+
+	namespace := serviceNamespace
+	if len(namespace) == 0 {
+		namespace = config.GlobalKeyword
+	}
+	key := namespace + "/" + pool
+	percent := inUse / size * 100
+	if percent < threshold {
+		poolAlerts.Delete(key)
+		return
+	}
+	if _, alerted := poolAlerts.LoadOrStore(key, struct{}{}); alerted {
+		return
+	}
+
+	klog.Warningf("pool [%s] of namespace [%s] is %.0f%% used (%.0f of %.0f addresses), above the alert threshold of %.0f%%",
+		pool, namespace, percent, inUse, size, threshold)
+	ipam.RecordPoolUtilizationAlert(namespace, pool)
+	if eventRecorder != nil {
+		eventRecorder.Eventf(cm, v1.EventTypeWarning, "PoolUtilizationHigh", "Pool [%s] of namespace %s is %.0f%% used (%.0f of %.0f addresses), above the alert threshold of %.0f%%",
+			pool, namespace, percent, inUse, size, threshold)
+	}
+	recordNamespaceEventf(cm, serviceNamespace, v1.EventTypeWarning, "PoolUtilizationHigh", "Pool [%s] is %.0f%% used (%.0f of %.0f addresses), above the alert threshold of %.0f%%",
+		pool, percent, inUse, size, threshold)
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDiscoverAlertAtPercent(t *testing.T) {
+	assert.Equal(t, float64(80), discoverAlertAtPercent(&v1.ConfigMap{Data: map[string]string{"alert-at-percent-global": "80"}}))
+	assert.Equal(t, float64(0), discoverAlertAtPercent(&v1.ConfigMap{Data: map[string]string{"alert-at-percent-global": "0"}}))
+	assert.Equal(t, float64(0), discoverAlertAtPercent(&v1.ConfigMap{Data: map[string]string{"alert-at-percent-global": "101"}}))
+	assert.Equal(t, float64(0), discoverAlertAtPercent(&v1.ConfigMap{Data: map[string]string{"alert-at-percent-global": "high"}}))
+	assert.Equal(t, float64(0), discoverAlertAtPercent(&v1.ConfigMap{}))
+}
+
+func TestSyncLoadBalancerPoolUtilizationAlert(t *testing.T) {
+	resetPoolAlerts()
+	defer resetPoolAlerts()
+	recorder := record.NewFakeRecorder(10)
+	eventRecorder = recorder
+	defer func() { eventRecorder = nil }()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"range-global":            "10.0.0.1-10.0.0.5",
+			"alert-at-percent-global": "60",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	allocate := func(name string) {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}}
+		createService(t, client, svc)
+		if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2 of 5 addresses are below the threshold
+	allocate("first")
+	allocate("second")
+	assert.Empty(t, recorder.Events)
+
+	// 3 of 5 addresses cross the threshold
+	allocate("third")
+	assert.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning PoolUtilizationHigh Pool [10.0.0.1-10.0.0.5] of namespace global is 60% used (3 of 5 addresses), above the alert threshold of 60%",
+		<-recorder.Events)
+
+	// the pool staying above the threshold doesn't raise the alert again
+	allocate("fourth")
+	assert.Empty(t, recorder.Events)
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// StaticIPOutsidePoolError is returned when a static IP of a service isn't part of the pool of the service while
+// enforce-pool-boundaries-global is set
+type StaticIPOutsidePoolError struct {
+	IP        string
+	Pool      string
+	Namespace string
+}
+
+func (e *StaticIPOutsidePoolError) Error() string {
+	return fmt.Sprintf("static IP [%s] isn't in the pool [%s] of namespace %s", e.IP, e.Pool, e.Namespace)
+}
+
+// discoverEnforcePoolBoundaries returns true if enforce-pool-boundaries-global is set, the static IPs of a service
+// must then be part of its own pool, so a tenant can't take the IPs of the pool of another namespace
+func discoverEnforcePoolBoundaries(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "enforce-pool-boundaries")
+}
+
+// checkStaticIPPool returns a StaticIPOutsidePoolError if a static IP of the service isn't part of the pool it would be
+// allocated from while enforce-pool-boundaries-global is set. A service without a pool can't hold static IPs then,
+// the IPs of a DHCP namespace aren't checked.
+func checkStaticIPPool(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	addrs, err := parseAddrList(service.Annotations[LoadbalancerIPsAnnotation])
+	if err != nil {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	if !discoverEnforcePoolBoundaries(controllerCM) {
+		return nil
+	}
+
+	namespaceLabels, err := getNamespaceLabels(ctx, kubeClient, controllerCM, service.Namespace)
+	if err != nil {
+		return err
+	}
+	pool, _, _, err := discoverServicePool(controllerCM, service, namespaceLabels, controllerCM.Name)
+	if err != nil {
+		return err
+	}
+	if pool == DHCPPool {
+		return nil
+	}
+	for _, addr := range addrs {
+		contained, err := ipam.PoolContains(pool, addr)
+		if err != nil {
+			return err
+		}
+		if !contained {
+			return &StaticIPOutsidePoolError{IP: addr.String(), Pool: pool, Namespace: service.Namespace}
+		}
+	}
+	return nil
+}
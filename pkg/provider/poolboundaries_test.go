@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_discoverEnforcePoolBoundaries(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want bool
+	}{
+		{name: "unset"},
+		{name: "enabled", data: map[string]string{"enforce-pool-boundaries-global": "true"}, want: true},
+		{name: "disabled", data: map[string]string{"enforce-pool-boundaries-global": "false"}},
+		{name: "invalid", data: map[string]string{"enforce-pool-boundaries-global": "tenants"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverEnforcePoolBoundaries(&v1.ConfigMap{Data: tt.data}))
+		})
+	}
+}
+
+func TestCheckStaticIPPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		ips         string
+		expectErr   bool
+		expectEvent string
+	}{
+		{
+			name: "static IP of the namespace pool is accepted",
+			data: map[string]string{"cidr-tenant-a": "10.0.1.0/24", "cidr-tenant-b": "10.0.2.0/24", "enforce-pool-boundaries-global": "true"},
+			ips:  "10.0.1.10",
+		},
+		{
+			name:        "static IP of the pool of another namespace is rejected",
+			data:        map[string]string{"cidr-tenant-a": "10.0.1.0/24", "cidr-tenant-b": "10.0.2.0/24", "enforce-pool-boundaries-global": "true"},
+			ips:         "10.0.2.10",
+			expectErr:   true,
+			expectEvent: "Warning StaticIPOutsidePool static IP [10.0.2.10] isn't in the pool [10.0.1.0/24] of namespace tenant-a",
+		},
+		{
+			name:        "static IP outside of any pool is rejected",
+			data:        map[string]string{"cidr-tenant-a": "10.0.1.0/24", "cidr-tenant-b": "10.0.2.0/24", "enforce-pool-boundaries-global": "true"},
+			ips:         "192.168.0.10",
+			expectErr:   true,
+			expectEvent: "Warning StaticIPOutsidePool static IP [192.168.0.10] isn't in the pool [10.0.1.0/24] of namespace tenant-a",
+		},
+		{
+			name: "static IP of the pool of another namespace is accepted by default",
+			data: map[string]string{"cidr-tenant-a": "10.0.1.0/24", "cidr-tenant-b": "10.0.2.0/24"},
+			ips:  "10.0.2.10",
+		},
+		{
+			name: "static IP of a DHCP namespace isn't checked",
+			data: map[string]string{"dhcp-tenant-a": "true", "cidr-tenant-b": "10.0.2.0/24", "enforce-pool-boundaries-global": "true"},
+			ips:  "10.0.2.10",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "tenant-a",
+					Name:        "static",
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: tt.ips},
+				},
+			}
+			createService(t, client, svc)
+
+			res, err := syncService(t, client, svc)
+			if tt.expectErr {
+				var outsideErr *StaticIPOutsidePoolError
+				assert.ErrorAs(t, err, &outsideErr)
+				assert.Empty(t, res.Labels[ImplementationLabelKey])
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, ImplementationLabelValue, res.Labels[ImplementationLabelKey])
+				assert.Equal(t, tt.ips, res.Annotations[LoadbalancerIPsAnnotation])
+			}
+
+			if len(tt.expectEvent) == 0 {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Equal(t, tt.expectEvent, <-recorder.Events)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// poolOverlapWarnings holds the pools whose overlapping entries were logged, so a pool is only warned about once
+// instead of on every reconcile
+var poolOverlapWarnings sync.Map
+
+// discoverStrictPoolParsing returns true if strict-pool-parsing-global is true, the duplicate or overlapping entries
+// of a pool are then logged as they often come from a copy-paste error
+func discoverStrictPoolParsing(cm *v1.ConfigMap) bool {
+	return discoverGlobalBool(cm, "strict-pool-parsing")
+}
+
+// warnPoolOverlaps logs the duplicate or overlapping entries of the pool with strict-pool-parsing-global, the entries
+// are still merged into one pool so the allocation goes on
+func warnPoolOverlaps(cm *v1.ConfigMap, pool string) {
+	if len(pool) == 0 || pool == DHCPPool || !discoverStrictPoolParsing(cm) {
+		return
+	}
+	if _, warned := poolOverlapWarnings.Load(pool); warned {
+		return
+	}
+	overlaps, err := ipam.PoolOverlaps(pool)
+	if err != nil {
+		return
+	}
+	poolOverlapWarnings.Store(pool, struct{}{})
+	for _, overlap := range overlaps {
+		klog.Warningf("pool [%s] has overlapping entries, %s", pool, overlap)
+	}
+}
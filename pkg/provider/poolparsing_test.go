@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func TestStrictPoolParsing(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      string
+		wantWarning bool
+	}{
+		{name: "overlaps are ignored by default"},
+		{name: "overlaps are warned about in strict mode", strict: "true", wantWarning: true},
+		{name: "invalid strict value", strict: "always"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poolOverlapWarnings = sync.Map{}
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "10.0.0.1-10.0.0.3,10.0.0.2-10.0.0.5,10.0.0.1-10.0.0.3",
+				},
+			}
+			if len(tt.strict) > 0 {
+				cm.Data["strict-pool-parsing-global"] = tt.strict
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			buf, restore := tu.CaptureKlog(t, "0")
+			var ips []string
+			for _, name := range []string{"first", "second"} {
+				svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+				res := createAndSyncService(t, client, svc)
+				ips = append(ips, res.Annotations[LoadbalancerIPsAnnotation])
+			}
+			restore()
+
+			// the entries are still merged into one pool
+			assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, ips)
+			_, warned := poolOverlapWarnings.Load(cm.Data["range-global"])
+			assert.Equal(t, tt.wantWarning, warned)
+			if !tt.wantWarning {
+				assert.NotContains(t, buf.String(), "has overlapping entries")
+				return
+			}
+			// the pool is only warned about once, each overlap is logged on a single line
+			assert.Equal(t, 1, strings.Count(buf.String(), "[10.0.0.2-10.0.0.5] overlaps [10.0.0.1-10.0.0.3]"))
+			assert.Equal(t, 1, strings.Count(buf.String(), "[10.0.0.1-10.0.0.3] duplicates [10.0.0.1-10.0.0.3]"))
+			assert.Equal(t, 1, strings.Count(buf.String(), "[10.0.0.1-10.0.0.3] overlaps [10.0.0.2-10.0.0.5]"))
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// priorityQueue is a workqueue.RateLimitingInterface handing out the queued keys with the highest priority first,
+// keys of the same priority are handed out by their order key, then in FIFO order. Like the client-go workqueue, a key is never processed
+// concurrently: a key added while it is processed is queued again once it is Done.
+type priorityQueue struct {
+	priority    func(key string) int
+	order       func(key string) string
+	rateLimiter workqueue.RateLimiter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the keys waiting to be processed
+	queue priorityItems
+	// dirty holds every key waiting to be processed, including the keys that are queued again while processed
+	dirty map[interface{}]*priorityItem
+	// processing holds the keys handed out by Get and not Done yet
+	processing   map[interface{}]struct{}
+	seq          uint64
+	shuttingDown bool
+}
+
+var _ workqueue.RateLimitingInterface = &priorityQueue{}
+
+type priorityItem struct {
+	key      interface{}
+	priority int
+	order    string
+	seq      uint64
+	// index is the position of the item in the heap, -1 while the key is processed
+	index int
+}
+
+func newPriorityQueue(rateLimiter workqueue.RateLimiter, priority func(key string) int, order func(key string) string) *priorityQueue {
+	q := &priorityQueue{
+		priority:    priority,
+		order:       order,
+		rateLimiter: rateLimiter,
+		dirty:       map[interface{}]*priorityItem{},
+		processing:  map[interface{}]struct{}{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *priorityQueue) priorityOf(item interface{}) int {
+	if key, ok := item.(string); ok && q.priority != nil {
+		return q.priority(key)
+	}
+	return 0
+}
+
+func (q *priorityQueue) orderOf(item interface{}) string {
+	if key, ok := item.(string); ok && q.order != nil {
+		return q.order(key)
+	}
+	return ""
+}
+
+// Add queues the item with its current priority and order key, those of an item already waiting are refreshed
+func (q *priorityQueue) Add(item interface{}) {
+	priority, order := q.priorityOf(item), q.orderOf(item)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if existing, ok := q.dirty[item]; ok {
+		existing.priority, existing.order = priority, order
+		if existing.index >= 0 {
+			heap.Fix(&q.queue, existing.index)
+		}
+		return
+	}
+
+	q.seq++
+	pi := &priorityItem{key: item, priority: priority, order: order, seq: q.seq, index: -1}
+	q.dirty[item] = pi
+	if _, ok := q.processing[item]; ok {
+		return
+	}
+	heap.Push(&q.queue, pi)
+	q.cond.Signal()
+}
+
+func (q *priorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queue.Len()
+}
+
+func (q *priorityQueue) Get() (interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.queue.Len() == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if q.queue.Len() == 0 {
+		return nil, true
+	}
+
+	pi := heap.Pop(&q.queue).(*priorityItem)
+	delete(q.dirty, pi.key)
+	q.processing[pi.key] = struct{}{}
+	return pi.key, false
+}
+
+func (q *priorityQueue) Done(item interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, item)
+	if pi, ok := q.dirty[item]; ok {
+		heap.Push(&q.queue, pi)
+		q.cond.Signal()
+	} else if len(q.processing) == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *priorityQueue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain shuts the queue down and waits for the keys being processed to be Done
+func (q *priorityQueue) ShutDownWithDrain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+	for len(q.processing) > 0 {
+		q.cond.Wait()
+	}
+}
+
+func (q *priorityQueue) ShuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.shuttingDown
+}
+
+func (q *priorityQueue) AddAfter(item interface{}, duration time.Duration) {
+	if q.ShuttingDown() {
+		return
+	}
+	if duration <= 0 {
+		q.Add(item)
+		return
+	}
+	time.AfterFunc(duration, func() { q.Add(item) })
+}
+
+func (q *priorityQueue) AddRateLimited(item interface{}) {
+	q.AddAfter(item, q.rateLimiter.When(item))
+}
+
+func (q *priorityQueue) Forget(item interface{}) {
+	q.rateLimiter.Forget(item)
+}
+
+func (q *priorityQueue) NumRequeues(item interface{}) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+// priorityItems is a heap of the queued items, the highest priority first, then the lowest order key, then the oldest
+type priorityItems []*priorityItem
+
+func (p priorityItems) Len() int { return len(p) }
+
+func (p priorityItems) Less(i, j int) bool {
+	if p[i].priority != p[j].priority {
+		return p[i].priority > p[j].priority
+	}
+	if p[i].order != p[j].order {
+		return p[i].order < p[j].order
+	}
+	return p[i].seq < p[j].seq
+}
+
+func (p priorityItems) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+	p[i].index = i
+	p[j].index = j
+}
+
+func (p *priorityItems) Push(x interface{}) {
+	pi := x.(*priorityItem)
+	pi.index = len(*p)
+	*p = append(*p, pi)
+}
+
+func (p *priorityItems) Pop() interface{} {
+	old := *p
+	n := len(old)
+	pi := old[n-1]
+	old[n-1] = nil
+	pi.index = -1
+	*p = old[:n-1]
+	return pi
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	priorities := map[string]int{"default/ingress": 100, "default/gateway": 10, "default/high": 100}
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), func(key string) int { return priorities[key] }, nil)
+	defer q.ShutDown()
+
+	for _, key := range []string{"default/app-1", "default/ingress", "default/app-2", "default/gateway", "default/high"} {
+		q.Add(key)
+	}
+	// a key queued twice keeps its place
+	q.Add("default/app-1")
+	assert.Equal(t, 5, q.Len())
+
+	var got []interface{}
+	for q.Len() > 0 {
+		key, shutdown := q.Get()
+		assert.False(t, shutdown)
+		got = append(got, key)
+		q.Done(key)
+	}
+	assert.Equal(t, []interface{}{"default/ingress", "default/high", "default/gateway", "default/app-1", "default/app-2"}, got)
+}
+
+func TestPriorityQueueRequeueWhileProcessing(t *testing.T) {
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), func(string) int { return 0 }, nil)
+	defer q.ShutDown()
+
+	q.Add("default/app")
+	key, _ := q.Get()
+
+	// the key is not handed out again before it is Done
+	q.Add("default/app")
+	assert.Equal(t, 0, q.Len())
+
+	q.Done(key)
+	assert.Equal(t, 1, q.Len())
+	key, _ = q.Get()
+	assert.Equal(t, "default/app", key)
+	q.Done(key)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestPriorityQueueShutDown(t *testing.T) {
+	q := newPriorityQueue(workqueue.DefaultControllerRateLimiter(), nil, nil)
+	q.ShutDown()
+	q.Add("default/app")
+
+	key, shutdown := q.Get()
+	assert.Nil(t, key)
+	assert.True(t, shutdown)
+}
@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go4.org/netipx"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+const (
+	// maxProbedAddresses bounds the number of live addresses skipped for a single allocation, it fails past that
+	maxProbedAddresses = 5
+
+	// probeTimeout bounds the time spent probing a single port of an address
+	probeTimeout = 200 * time.Millisecond
+)
+
+// prober checks whether an address is already used on the network
+type prober interface {
+	IsLive(addr netip.Addr) bool
+}
+
+// addressProber is the prober used when probe-before-assign is enabled
+var addressProber prober = &tcpProber{ports: []int{22, 80, 443}, timeout: probeTimeout}
+
+// tcpProber considers an address live if any of the ports accepts or actively refuses a connection,
+// it doesn't need the privileges that ARP or ICMP would require
+type tcpProber struct {
+	ports   []int
+	timeout time.Duration
+}
+
+func (p *tcpProber) IsLive(addr netip.Addr) bool {
+	for _, port := range p.ports {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr.String(), strconv.Itoa(port)), p.timeout)
+		if err == nil {
+			_ = conn.Close()
+			return true
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeAddress returns a copy of the IPSet with the address added
+func excludeAddress(inUseIPSet *netipx.IPSet, addr netip.Addr) (*netipx.IPSet, error) {
+	builder := &netipx.IPSetBuilder{}
+	if inUseIPSet != nil {
+		builder.AddSet(inUseIPSet)
+	}
+	builder.Add(addr)
+	return builder.IPSet()
+}
+
+// unprobedAddressError is returned by the allocation when the address it picks wasn't probed yet, the address is
+// probed with the pools unlocked and the allocation runs again
+type unprobedAddressError struct {
+	addr netip.Addr
+}
+
+func (e *unprobedAddressError) Error() string {
+	return fmt.Sprintf("address [%s] isn't probed yet", e.addr)
+}
+
+// ProbeLimitError is returned when maxProbedAddresses addresses of the pool answer on the network, no address is
+// assigned rather than one that may be used by another host
+type ProbeLimitError struct {
+	Live int
+}
+
+func (e *ProbeLimitError) Error() string {
+	return fmt.Sprintf("%d free addresses of the pool answer on the network, no address is assigned", e.Live)
+}
+
+// probeAddress returns the address returned by find, skipping the live addresses. An address not probed yet fails with
+// an unprobedAddressError, see allocateProbed.
+func probeAddress(inUseIPSet *netipx.IPSet, probed map[netip.Addr]bool, find func(*netipx.IPSet) (string, error)) (string, error) {
+	for live := 0; ; live++ {
+		if live >= maxProbedAddresses {
+			return "", &ProbeLimitError{Live: live}
+		}
+		vip, err := find(inUseIPSet)
+		if err != nil {
+			return "", err
+		}
+		addr, err := netip.ParseAddr(vip)
+		if err != nil || addr.IsUnspecified() {
+			return vip, nil
+		}
+		isLive, ok := probed[addr]
+		if !ok {
+			return "", &unprobedAddressError{addr: addr}
+		}
+		if !isLive {
+			return vip, nil
+		}
+		if inUseIPSet, err = excludeAddress(inUseIPSet, addr); err != nil {
+			return "", err
+		}
+	}
+}
+
+// allocateProbed runs allocate with the pools locked by lock. Probing an address takes up to a second, so it is done
+// with the pools unlocked: an allocation picking an address not probed yet fails, the address is probed and the
+// allocation runs again.
+func allocateProbed(kubevipLBConfig *config.KubevipLBConfig, lock func() func(), allocate func() error) error {
+	for {
+		unlock := lock()
+		err := allocate()
+		unlock()
+
+		var unprobed *unprobedAddressError
+		if !errors.As(err, &unprobed) {
+			return err
+		}
+		if kubevipLBConfig.ProbedAddresses == nil {
+			kubevipLBConfig.ProbedAddresses = map[netip.Addr]bool{}
+		}
+		live := addressProber.IsLive(unprobed.addr)
+		if live {
+			klog.Warningf("address [%s] answers on the network, excluding it from allocation", unprobed.addr)
+		}
+		kubevipLBConfig.ProbedAddresses[unprobed.addr] = live
+	}
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+)
+
+type fakeProber struct {
+	live   map[netip.Addr]bool
+	probed []string
+	// locked is set while the pools are locked, no address is probed then
+	locked         bool
+	probedInLocked bool
+}
+
+func (p *fakeProber) IsLive(addr netip.Addr) bool {
+	p.probed = append(p.probed, addr.String())
+	p.probedInLocked = p.probedInLocked || p.locked
+	return p.live[addr]
+}
+
+func Test_discoverAddressWithProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		live       []string
+		probe      bool
+		want       string
+		wantErr    bool
+		wantProbed []string
+	}{
+		{
+			name:       "probe disabled, live address is assigned",
+			pool:       "10.0.0.1/29",
+			live:       []string{"10.0.0.1"},
+			want:       "10.0.0.1",
+			wantProbed: nil,
+		},
+		{
+			name:       "live addresses are skipped",
+			pool:       "10.0.0.1/29",
+			live:       []string{"10.0.0.1", "10.0.0.2"},
+			probe:      true,
+			want:       "10.0.0.3",
+			wantProbed: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:       "live addresses are skipped in a range",
+			pool:       "10.0.0.10-10.0.0.12",
+			live:       []string{"10.0.0.10"},
+			probe:      true,
+			want:       "10.0.0.11",
+			wantProbed: []string{"10.0.0.10", "10.0.0.11"},
+		},
+		{
+			name:       "probing is bounded, no live address is assigned",
+			pool:       "10.0.0.1/28",
+			live:       []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"},
+			probe:      true,
+			wantErr:    true,
+			wantProbed: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+		},
+		{
+			name:       "dhcp address isn't probed",
+			pool:       "0.0.0.0/32",
+			probe:      true,
+			want:       "0.0.0.0",
+			wantProbed: nil,
+		},
+	}
+
+	defer func(p prober) { addressProber = p }(addressProber)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProber{live: map[netip.Addr]bool{}}
+			for _, ip := range tt.live {
+				p.live[netip.MustParseAddr(ip)] = true
+			}
+			addressProber = p
+
+			inUse, err := (&netipx.IPSetBuilder{}).IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kubevipLBConfig := &config.KubevipLBConfig{ProbeBeforeAssign: tt.probe}
+			lock := func() func() {
+				p.locked = true
+				return func() { p.locked = false }
+			}
+			var got string
+			err = allocateProbed(kubevipLBConfig, lock, func() error {
+				var err error
+				got, err = discoverAddress("probe", tt.pool, inUse, kubevipLBConfig)
+				return err
+			})
+			if tt.wantErr {
+				var limitErr *ProbeLimitError
+				assert.ErrorAs(t, err, &limitErr)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantProbed, p.probed)
+			assert.False(t, p.probedInLocked, "an address was probed with the pools locked")
+		})
+	}
+}
@@ -6,15 +6,30 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
 	cloudprovider "k8s.io/cloud-provider"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/admin"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/config"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/webhook"
 )
 
 // OutSideCluster allows the controller to be started using a local kubeConfig for testing
@@ -39,12 +54,70 @@ const (
 
 	// EnableLoadbalancerClassEnvKey environment key for enabling loadbalancerclass.
 	EnableLoadbalancerClassEnvKey = "KUBEVIP_ENABLE_LOADBALANCERCLASS"
+
+	// CustomLoadbalancerClassNameEnvKey environment key for the loadbalancerclass served instead of LoadbalancerClass,
+	// e.g. kube-vip.io/custom.
+	CustomLoadbalancerClassNameEnvKey = "CUSTOM_LOADBALANCERCLASS_NAME"
+
+	// AcceptDefaultLoadbalancerClassEnvKey environment key for also serving the services of LoadbalancerClass when
+	// CustomLoadbalancerClassNameEnvKey is set, true by default so the services can be migrated to the custom class.
+	AcceptDefaultLoadbalancerClassEnvKey = "KUBEVIP_ACCEPT_DEFAULT_LOADBALANCERCLASS"
+
+	// VerboseEventsEnvKey environment key for emitting an event on every reconcile of the loadbalancerclass controller,
+	// by default only IP changes and failures emit events.
+	VerboseEventsEnvKey = "KUBEVIP_VERBOSE_EVENTS"
+
+	// PriorityQueueEnvKey environment key for syncing the services of the loadbalancerclass controller by their
+	// kube-vip.io/allocationPriority annotation instead of in FIFO order.
+	PriorityQueueEnvKey = "KUBEVIP_PRIORITY_QUEUE"
+
+	// RestoreStatusEnvKey environment key for restoring the status.loadBalancer.ingress of the services of the
+	// loadbalancerclass controller from their kube-vip.io/loadbalancerIPs annotation when they diverge.
+	RestoreStatusEnvKey = "KUBEVIP_RESTORE_STATUS"
+
+	// AllocationOrderEnvKey environment key for syncing the services of the loadbalancerclass controller in a
+	// deterministic order, AllocationOrderName or AllocationOrderCreation, instead of in FIFO order.
+	AllocationOrderEnvKey = "KUBEVIP_ALLOCATION_ORDER"
+	// AllocationOrderName syncs the services by namespace and name
+	AllocationOrderName = "name"
+	// AllocationOrderCreation syncs the oldest services first, then by namespace and name
+	AllocationOrderCreation = "creation"
+
+	// MaxSyncRetriesEnvKey environment key for the number of retries of a failing service of the loadbalancerclass
+	// controller, it is then only synced again on its next change. Unlimited by default.
+	MaxSyncRetriesEnvKey = "KUBEVIP_MAX_SYNC_RETRIES"
+
+	// AllocationFailedStatusEnvKey environment key for setting the AllocationFailedHostname in the
+	// status.loadBalancer.ingress of the services of the loadbalancerclass controller failing allocation, so the
+	// dashboards show the failure instead of an empty external IP.
+	AllocationFailedStatusEnvKey = "KUBEVIP_ALLOCATION_FAILED_STATUS"
+	// AllocationFailedHostname is the ingress hostname of the services failing allocation with AllocationFailedStatusEnvKey
+	AllocationFailedHostname = "allocation-failed.kube-vip.io"
 )
 
 func init() {
 	cloudprovider.RegisterCloudProvider(ProviderName, newKubeVipCloudProvider)
 }
 
+// NewRestConfig returns the config of the cluster the controller runs in, or of the current context of the local
+// kubeConfig when started with OutSideCluster
+func NewRestConfig() (*rest.Config, error) {
+	if !OutSideCluster {
+		// This will attempt to load the configuration when running within a POD
+		cfg, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+		}
+		return cfg, nil
+	}
+	// use the current context in kubeconfig
+	cfg, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubeconfig: %s", err.Error())
+	}
+	return cfg, nil
+}
+
 // KubeVipCloudProvider - contains all of the interfaces for the cloud provider
 type KubeVipCloudProvider struct {
 	lb            cloudprovider.LoadBalancer
@@ -52,6 +125,24 @@ type KubeVipCloudProvider struct {
 	namespace     string
 	configMapName string
 	enableLBClass bool
+
+	enableAllocationsStatus bool
+	adminAddress            string
+	adminToken              string
+	textfilePath            string
+	poolReportInterval      time.Duration
+	verboseEvents           bool
+	priorityQueue           bool
+	restoreStatus           bool
+	allocationOrder         string
+	maxSyncRetries          int
+	allocationFailedStatus  bool
+
+	enableNamespaceSelectors bool
+	enableEndpointNodes      bool
+
+	dynamicClient  dynamic.Interface
+	gatewayClasses []string
 }
 
 var _ cloudprovider.Interface = &KubeVipCloudProvider{}
@@ -60,6 +151,13 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 	ns := os.Getenv("KUBEVIP_NAMESPACE")
 	cm := os.Getenv("KUBEVIP_CONFIG_MAP")
 	lbc := os.Getenv(EnableLoadbalancerClassEnvKey)
+	allocStatus := os.Getenv(EnableAllocationsStatusEnvKey)
+	verbose := os.Getenv(VerboseEventsEnvKey)
+	priority := os.Getenv(PriorityQueueEnvKey)
+	restore := os.Getenv(RestoreStatusEnvKey)
+	failedStatus := os.Getenv(AllocationFailedStatusEnvKey)
+	nsSelectors := os.Getenv(EnableNamespaceSelectorsEnvKey)
+	epNodes := os.Getenv(EnableEndpointNodesEnvKey)
 
 	if cm == "" {
 		cm = KubeVipClientConfig
@@ -70,8 +168,15 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 	}
 
 	var (
-		enableLBClass bool
-		err           error
+		enableLBClass           bool
+		enableAllocationsStatus bool
+		verboseEvents           bool
+		priorityQueue           bool
+		restoreStatus           bool
+		allocationFailedStatus  bool
+		enableNsSelectors       bool
+		enableEndpointNodes     bool
+		err                     error
 	)
 
 	if len(lbc) > 0 {
@@ -83,36 +188,258 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 	}
 	klog.Infof("staring with loadbalancerClass set to: %t", enableLBClass)
 
-	klog.Infof("Watching configMap for pool config with name: '%s', namespace: '%s'", cm, ns)
+	if customClass := os.Getenv(CustomLoadbalancerClassNameEnvKey); len(customClass) > 0 {
+		if errs := validation.IsQualifiedName(customClass); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value of %s '%s': %s", CustomLoadbalancerClassNameEnvKey, customClass, strings.Join(errs, ", "))
+		}
+		loadbalancerClassName = customClass
+		klog.Infof("serving loadbalancerClass '%s'", customClass)
+	}
 
-	var cl *kubernetes.Clientset
-	if !OutSideCluster {
-		// This will attempt to load the configuration when running within a POD
-		cfg, err := rest.InClusterConfig()
+	if acceptDefault := os.Getenv(AcceptDefaultLoadbalancerClassEnvKey); len(acceptDefault) > 0 {
+		acceptDefaultLoadbalancerClass, err = strconv.ParseBool(acceptDefault)
 		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+			return nil, fmt.Errorf("error parsing value of %s: %s", AcceptDefaultLoadbalancerClassEnvKey, err.Error())
+		}
+	}
+	if loadbalancerClassName != LoadbalancerClass && acceptDefaultLoadbalancerClass {
+		klog.Infof("also serving loadbalancerClass '%s' until the services are migrated to '%s'", LoadbalancerClass, loadbalancerClassName)
+	}
+
+	if len(allocStatus) > 0 {
+		enableAllocationsStatus, err = strconv.ParseBool(allocStatus)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", EnableAllocationsStatusEnvKey, err.Error())
+		}
+	}
+
+	if readOnly := os.Getenv(ConfigMapReadOnlyEnvKey); len(readOnly) > 0 {
+		configMapReadOnly, err = strconv.ParseBool(readOnly)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", ConfigMapReadOnlyEnvKey, err.Error())
 		}
-		cl, err = kubernetes.NewForConfig(cfg)
+	}
+	if configMapReadOnly && enableAllocationsStatus {
+		return nil, fmt.Errorf("%s writes the allocations to a configMap, it can't be set with %s", EnableAllocationsStatusEnvKey, ConfigMapReadOnlyEnvKey)
+	}
+
+	if records := os.Getenv(AllocationRecordsEnvKey); len(records) > 0 {
+		allocationRecords, err = strconv.ParseBool(records)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", AllocationRecordsEnvKey, err.Error())
+		}
+	}
+
+	configSecret = os.Getenv(ConfigSecretEnvKey)
+
+	if pause := os.Getenv(PauseOnConfigMapDeletionEnvKey); len(pause) > 0 {
+		pauseOnConfigMapDeletion, err = strconv.ParseBool(pause)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", PauseOnConfigMapDeletionEnvKey, err.Error())
+		}
+	}
+
+	if exemplars := os.Getenv(AllocationExemplarsEnvKey); len(exemplars) > 0 {
+		allocationExemplars, err = strconv.ParseBool(exemplars)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", AllocationExemplarsEnvKey, err.Error())
+		}
+	}
+
+	if len(verbose) > 0 {
+		verboseEvents, err = strconv.ParseBool(verbose)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", VerboseEventsEnvKey, err.Error())
+		}
+	}
+
+	if len(priority) > 0 {
+		priorityQueue, err = strconv.ParseBool(priority)
 		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			return nil, fmt.Errorf("error parsing value of %s: %s", PriorityQueueEnvKey, err.Error())
 		}
-		// use the current context in kubeconfig
-	} else {
-		config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+	}
+
+	if len(restore) > 0 {
+		restoreStatus, err = strconv.ParseBool(restore)
 		if err != nil {
-			panic(err.Error())
+			return nil, fmt.Errorf("error parsing value of %s: %s", RestoreStatusEnvKey, err.Error())
 		}
-		cl, err = kubernetes.NewForConfig(config)
+	}
+
+	if len(failedStatus) > 0 {
+		allocationFailedStatus, err = strconv.ParseBool(failedStatus)
 		if err != nil {
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			return nil, fmt.Errorf("error parsing value of %s: %s", AllocationFailedStatusEnvKey, err.Error())
 		}
 	}
+
+	allocationOrder := os.Getenv(AllocationOrderEnvKey)
+	switch allocationOrder {
+	case "", AllocationOrderName, AllocationOrderCreation:
+	default:
+		return nil, fmt.Errorf("error parsing value of %s: expected %s or %s, got %q", AllocationOrderEnvKey, AllocationOrderName, AllocationOrderCreation, allocationOrder)
+	}
+
+	var maxSyncRetries int
+	if retries := os.Getenv(MaxSyncRetriesEnvKey); len(retries) > 0 {
+		maxSyncRetries, err = strconv.Atoi(retries)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", MaxSyncRetriesEnvKey, err.Error())
+		}
+		if maxSyncRetries < 0 {
+			return nil, fmt.Errorf("error parsing value of %s: %s is negative", MaxSyncRetriesEnvKey, retries)
+		}
+	}
+
+	if len(nsSelectors) > 0 {
+		enableNsSelectors, err = strconv.ParseBool(nsSelectors)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", EnableNamespaceSelectorsEnvKey, err.Error())
+		}
+	}
+
+	if len(epNodes) > 0 {
+		enableEndpointNodes, err = strconv.ParseBool(epNodes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", EnableEndpointNodesEnvKey, err.Error())
+		}
+	}
+
+	if delimiter := os.Getenv(config.ConfigMapKeyDelimiterEnvKey); len(delimiter) > 0 {
+		if err = config.SetNamespaceKeyDelimiter(delimiter); err != nil {
+			return nil, err
+		}
+		klog.Infof("using '%s' as ConfigMap key delimiter for namespaces", delimiter)
+	}
+
+	if keyword := os.Getenv(config.GlobalKeywordEnvKey); len(keyword) > 0 {
+		if err = config.SetGlobalKeyword(keyword); err != nil {
+			return nil, err
+		}
+		klog.Infof("using '%s' as ConfigMap keyword for the global keys", keyword)
+	}
+
+	if clusterName := os.Getenv(config.ClusterNameEnvKey); len(clusterName) > 0 {
+		if err = config.SetClusterName(clusterName); err != nil {
+			return nil, err
+		}
+		klog.Infof("preferring the ConfigMap keys scoped to cluster '%s'", clusterName)
+	}
+
+	if labelKey := os.Getenv(ImplementationLabelKeyEnvKey); len(labelKey) > 0 {
+		if errs := validation.IsQualifiedName(labelKey); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value of %s '%s': %s", ImplementationLabelKeyEnvKey, labelKey, strings.Join(errs, ", "))
+		}
+		implementationLabelKey = labelKey
+		klog.Infof("using '%s' as implementation label key", labelKey)
+	}
+
+	if denylist, ok := os.LookupEnv(ServiceDenylistEnvKey); ok {
+		serviceDenylist, err = parseServiceDenylist(denylist)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", ServiceDenylistEnvKey, err.Error())
+		}
+	}
+	klog.Infof("never allocating addresses to the services matching %v", serviceDenylist)
+
+	if nsRegex := os.Getenv(NamespaceRegexEnvKey); len(nsRegex) > 0 {
+		namespaceRegex, err = regexp.Compile(nsRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", NamespaceRegexEnvKey, err.Error())
+		}
+		klog.Infof("only allocating addresses to the services of the namespaces matching %s", nsRegex)
+	}
+
+	conflictBackoff, err = parseConflictBackoff(os.Getenv(ConflictRetryStepsEnvKey), os.Getenv(ConflictRetryDurationEnvKey), os.Getenv(ConflictFailFastEnvKey))
+	if err != nil {
+		return nil, err
+	}
+	if conflictBackoff.Steps == 1 {
+		klog.Info("requeuing services whose update conflicts instead of retrying")
+	}
+
+	var poolReportInterval time.Duration
+	if interval := os.Getenv(PoolReportIntervalEnvKey); len(interval) > 0 {
+		poolReportInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", PoolReportIntervalEnvKey, err.Error())
+		}
+		if poolReportInterval <= 0 {
+			return nil, fmt.Errorf("error parsing value of %s: %s is not positive", PoolReportIntervalEnvKey, interval)
+		}
+	}
+
+	if interfaceCM := os.Getenv(InterfaceConfigMapEnvKey); len(interfaceCM) > 0 {
+		interfaceConfigMap = interfaceCM
+		klog.Infof("looking up service interfaces in configMap [%s] before configMap [%s]", interfaceCM, cm)
+	}
+
+	if iface := os.Getenv(DefaultInterfaceEnvKey); len(iface) > 0 {
+		if err = validateInterfaceList(iface); err != nil {
+			return nil, fmt.Errorf("error parsing value of %s: %s", DefaultInterfaceEnvKey, err.Error())
+		}
+		defaultInterface = iface
+		klog.Infof("using service interface [%s] when no interface is configured for a namespace", iface)
+	}
+
+	if webhookURL := os.Getenv(webhook.AllocationWebhookURLEnvKey); len(webhookURL) > 0 {
+		allocationNotifier, err = webhook.NewNotifier(webhookURL)
+		if err != nil {
+			return nil, err
+		}
+		klog.Infof("sending allocation changes to webhook [%s]", webhookURL)
+	}
+
+	klog.Infof("Watching configMap for pool config with name: '%s', namespace: '%s'", cm, ns)
+
+	restConfig, err := NewRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+	}
+
+	var gatewayClasses []string
+	var dynamicClient dynamic.Interface
+	if classes := os.Getenv(GatewayClassesEnvKey); len(classes) > 0 {
+		for _, class := range strings.Split(classes, ",") {
+			if class = strings.TrimSpace(class); len(class) > 0 {
+				gatewayClasses = append(gatewayClasses, class)
+			}
+		}
+		dynamicClient, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kubernetes dynamic client: %s", err.Error())
+		}
+		klog.Infof("allocating addresses to the Gateways of classes %v", gatewayClasses)
+	}
 	return &KubeVipCloudProvider{
 		lb:            newLoadBalancer(cl, ns, cm),
 		kubeClient:    cl,
 		namespace:     ns,
 		configMapName: cm,
 		enableLBClass: enableLBClass,
+
+		enableAllocationsStatus: enableAllocationsStatus,
+		adminAddress:            os.Getenv(admin.AddressEnvKey),
+		adminToken:              os.Getenv(admin.TokenEnvKey),
+		textfilePath:            os.Getenv(ipam.TextfilePathEnvKey),
+		poolReportInterval:      poolReportInterval,
+		verboseEvents:           verboseEvents,
+		priorityQueue:           priorityQueue,
+		restoreStatus:           restoreStatus,
+		allocationOrder:         allocationOrder,
+		maxSyncRetries:          maxSyncRetries,
+		allocationFailedStatus:  allocationFailedStatus,
+
+		enableNamespaceSelectors: enableNsSelectors,
+		enableEndpointNodes:      enableEndpointNodes,
+
+		dynamicClient:  dynamicClient,
+		gatewayClasses: gatewayClasses,
 	}, nil
 }
 
@@ -120,16 +447,72 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 func (p *KubeVipCloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, _ <-chan struct{}) {
 	klog.Info("Initing Kube-vip Cloud Provider")
 
+	if err := migrateImplementationLabel(context.Background(), p.kubeClient, ImplementationLabelKey, implementationLabelKey); err != nil {
+		klog.Errorf("unable to relabel services from '%s' to '%s': %v", ImplementationLabelKey, implementationLabelKey, err)
+	}
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: p.kubeClient.CoreV1().Events("")})
+	eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: ProviderName})
+
 	clientset := clientBuilder.ClientOrDie("do-shared-informers")
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
 
 	if p.enableLBClass {
 		klog.Info("staring a separate service controller that only monitors service with loadbalancerClass")
 		klog.Info("default cloud-provider service controller will ignore service with loadbalancerClass")
-		controller := newLoadbalancerClassServiceController(sharedInformer, p.kubeClient, p.configMapName, p.namespace)
+		controller := newLoadbalancerClassServiceController(sharedInformer, p.kubeClient, p.configMapName, p.namespace, p.verboseEvents, p.priorityQueue, p.restoreStatus, p.allocationOrder, p.maxSyncRetries, p.allocationFailedStatus)
+		go controller.Run(context.Background().Done())
+	} else if _, err := warnOrphanedClassServices(context.Background(), p.kubeClient); err != nil {
+		klog.Errorf("unable to check for services using loadbalancerClass %s: %v", loadbalancerClassName, err)
+	}
+
+	if p.enableAllocationsStatus {
+		klog.Infof("reflecting allocations in configMap [%s] in %s", AllocationsStatusConfigMap, p.namespace)
+		controller := newAllocationsStatusController(sharedInformer, p.kubeClient, p.configMapName, p.namespace)
 		go controller.Run(context.Background().Done())
 	}
 
+	if p.enableNamespaceSelectors {
+		klog.Info("re-evaluating services when the labels of their namespace change")
+		controller := newNamespaceController(sharedInformer, p.kubeClient, p.configMapName, p.namespace)
+		go controller.Run(context.Background().Done())
+	}
+
+	if p.enableEndpointNodes {
+		klog.Info("reflecting the endpoint nodes of ExternalTrafficPolicy Local services")
+		controller := newEndpointNodesController(sharedInformer, p.kubeClient)
+		go controller.Run(context.Background().Done())
+	}
+
+	watcher := newConfigMapWatcher(p.kubeClient, p.configMapName, p.namespace)
+	watcher.Run(context.Background().Done())
+
+	if len(configSecret) > 0 {
+		watcher := newConfigSecretWatcher(p.kubeClient, configSecret, p.namespace)
+		watcher.Run(context.Background().Done())
+	}
+
+	if len(p.gatewayClasses) > 0 {
+		dynamicInformer := dynamicinformer.NewDynamicSharedInformerFactory(p.dynamicClient, 0)
+		controller := newGatewayController(dynamicInformer, p.kubeClient, p.dynamicClient, p.gatewayClasses, p.configMapName, p.namespace)
+		go controller.Run(context.Background().Done())
+		dynamicInformer.Start(nil)
+	}
+
+	if len(p.adminAddress) > 0 {
+		admin.Start(p.adminAddress, p.adminToken, p.effectiveConfig, p.status)
+	}
+
+	if len(p.textfilePath) > 0 {
+		ipam.StartTextfileWriter(p.textfilePath)
+	}
+
+	if p.poolReportInterval > 0 {
+		startPoolReport(p.kubeClient, p.configMapName, p.namespace, p.poolReportInterval)
+	}
+
 	sharedInformer.Start(nil)
 	sharedInformer.WaitForCacheSync(nil)
 }
@@ -0,0 +1,179 @@
+package provider
+
+import (
+	"context"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/admin"
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+)
+
+// PoolReportIntervalEnvKey environment key for the interval the utilization of the pools is logged at, e.g. 10m.
+// Nothing is logged unless it's set.
+const PoolReportIntervalEnvKey = "KUBEVIP_POOL_REPORT_INTERVAL"
+
+// reportPools logs the size, the used and the free addresses of every pool of the configmap
+func reportPools(ctx context.Context, kubeClient kubernetes.Interface, cmName, cmNamespace string) error {
+	cm, err := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
+	if err != nil {
+		return err
+	}
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		return err
+	}
+	inUse := inUseAddresses(svcs)
+
+	for _, key := range poolKeys(cm) {
+		pool := poolOfKey(cm, key)
+		size, used, free, err := poolUsage(pool, inUse)
+		if err != nil {
+			klog.Warningf("pool [%s] in [%s]: unable to parse [%s]: %v", key, cmName, pool, err)
+			continue
+		}
+		klog.Infof("pool [%s] in [%s]: %s addresses, %d used, %s free", key, cmName, size, used, free)
+	}
+	return nil
+}
+
+// status returns the status of the pools rendered on the /status path of the admin endpoint
+func (p *KubeVipCloudProvider) status(ctx context.Context) (*admin.Status, error) {
+	return poolStatus(ctx, p.kubeClient, p.configMapName, p.namespace)
+}
+
+// poolStatus returns the capacity and the usage of every pool of the configmap, with the services holding its addresses
+func poolStatus(ctx context.Context, kubeClient kubernetes.Interface, cmName, cmNamespace string) (*admin.Status, error) {
+	cm, err := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
+	if err != nil {
+		return nil, err
+	}
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		return nil, err
+	}
+	inUse := inUseAddresses(svcs)
+
+	status := &admin.Status{
+		ConfigMap: cmNamespace + "/" + cmName,
+		Services:  len(svcs.Items),
+	}
+	for _, key := range poolKeys(cm) {
+		pool := poolOfKey(cm, key)
+		size, used, free, err := poolUsage(pool, inUse)
+		if err != nil {
+			klog.Warningf("pool [%s] in [%s]: unable to parse [%s]: %v", key, cmName, pool, err)
+			continue
+		}
+		status.Pools = append(status.Pools, admin.PoolStatus{
+			Key:      key,
+			Pool:     pool,
+			Size:     size.String(),
+			Used:     used,
+			Free:     free.String(),
+			Services: poolServices(pool, svcs),
+		})
+	}
+	return status, nil
+}
+
+// poolServices returns the sorted services with an address of the pool, as <namespace>/<name> <IPs>
+func poolServices(pool string, svcs *v1.ServiceList) []string {
+	var services []string
+	for x := range svcs.Items {
+		ips := svcs.Items[x].Annotations[LoadbalancerIPsAnnotation]
+		addrs, err := parseAddrList(ips)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if inPool, _ := ipam.PoolContains(pool, addr); inPool {
+				services = append(services, svcs.Items[x].Namespace+"/"+svcs.Items[x].Name+" "+ips)
+				break
+			}
+		}
+	}
+	slices.Sort(services)
+	return services
+}
+
+// poolOfKey returns the pool of the cidr, range or allowlist key of the configmap
+func poolOfKey(cm *v1.ConfigMap, key string) string {
+	if strings.HasPrefix(key, "allow-") {
+		return allowlistRanges(cm.Data[key])
+	}
+	return cm.Data[key]
+}
+
+// poolUsage returns the size of the pool, and the number of its addresses in use and free
+func poolUsage(pool string, inUse []netip.Addr) (size *big.Int, used int, free *big.Int, err error) {
+	size, err = ipam.PoolSize(pool)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	for _, addr := range inUse {
+		if inPool, _ := ipam.PoolContains(pool, addr); inPool {
+			used++
+		}
+	}
+	free = new(big.Int).Sub(size, big.NewInt(int64(used)))
+	if free.Sign() < 0 {
+		free.SetInt64(0)
+	}
+	return size, used, free, nil
+}
+
+// poolKeys returns the sorted cidr, range and allowlist keys of the configmap
+func poolKeys(cm *v1.ConfigMap) []string {
+	var keys []string
+	for key := range cm.Data {
+		allowlist := strings.HasPrefix(key, "allow-") && !strings.HasPrefix(key, "allow-share-")
+		if strings.HasPrefix(key, "cidr-") || strings.HasPrefix(key, "range-") || allowlist {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// inUseAddresses returns the distinct addresses of the services, the DHCP address isn't counted
+func inUseAddresses(svcs *v1.ServiceList) []netip.Addr {
+	seen := map[netip.Addr]struct{}{}
+	var addrs []netip.Addr
+	for x := range svcs.Items {
+		svcAddrs, err := parseAddrList(svcs.Items[x].Annotations[LoadbalancerIPsAnnotation])
+		if err != nil {
+			continue
+		}
+		for _, addr := range svcAddrs {
+			if _, ok := seen[addr]; ok || addr.IsUnspecified() {
+				continue
+			}
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// startPoolReport logs the utilization of the pools every interval in the background
+func startPoolReport(kubeClient kubernetes.Interface, cmName, cmNamespace string, interval time.Duration) {
+	go func() {
+		klog.Infof("logging the utilization of the pools of configMap [%s] every %s", cmName, interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			if err := reportPools(context.Background(), kubeClient, cmName, cmNamespace); err != nil {
+				klog.Errorf("unable to report the utilization of the pools of configMap [%s]: %v", cmName, err)
+			}
+		}
+	}()
+}
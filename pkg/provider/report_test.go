@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/admin"
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func TestReportPools(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global":        "10.0.0.0/30",
+			"range-team":         "10.1.0.1-10.1.0.10",
+			"allow-share-global": "true",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, ips := range map[string]string{
+		"a":      "10.0.0.1",
+		"b":      "10.0.0.1",
+		"c":      "10.0.0.2,fd00::1",
+		"d":      "10.1.0.5",
+		"dhcp":   "0.0.0.0",
+		"absent": "192.168.0.1",
+	} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ips},
+			},
+		}
+		createService(t, client, svc)
+	}
+
+	buf, restore := tu.CaptureKlog(t, "0")
+	err := reportPools(context.Background(), client, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	restore()
+	if err != nil {
+		t.Fatalf("reportPools() error: %v", err)
+	}
+
+	assert.Contains(t, buf.String(), "pool [cidr-global] in [kubevip]: 4 addresses, 2 used, 2 free")
+	assert.Contains(t, buf.String(), "pool [range-team] in [kubevip]: 10 addresses, 1 used, 9 free")
+	assert.NotContains(t, buf.String(), "allow-share-global")
+}
+
+func TestPoolStatus(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: map[string]string{
+			"cidr-global": "10.0.0.0/30",
+			"range-team":  "10.1.0.1-10.1.0.10",
+		},
+	}
+	if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, ips := range map[string]string{
+		"b": "10.0.0.2,fd00::1",
+		"a": "10.0.0.1",
+	} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+				Annotations: map[string]string{LoadbalancerIPsAnnotation: ips},
+			},
+		}
+		createService(t, client, svc)
+	}
+
+	status, err := poolStatus(context.Background(), client, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	if err != nil {
+		t.Fatalf("poolStatus() error: %v", err)
+	}
+	assert.Equal(t, &admin.Status{
+		ConfigMap: "kube-system/kubevip",
+		Services:  2,
+		Pools: []admin.PoolStatus{
+			{Key: "cidr-global", Pool: "10.0.0.0/30", Size: "4", Used: 2, Free: "2", Services: []string{"test/a 10.0.0.1", "test/b 10.0.0.2,fd00::1"}},
+			{Key: "range-team", Pool: "10.1.0.1-10.1.0.10", Size: "10", Used: 0, Free: "10"},
+		},
+	}, status)
+}
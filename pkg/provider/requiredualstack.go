@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// RequireDualStackBehaviorFail fails the allocation of a RequireDualStack service that can't be dual-stack, this is
+	// the default
+	RequireDualStackBehaviorFail = "fail"
+
+	// RequireDualStackBehaviorDowngrade allocates a single IP to a RequireDualStack service that can't be dual-stack,
+	// with a DualStackDowngraded warning event
+	RequireDualStackBehaviorDowngrade = "downgrade"
+)
+
+// SingleStackClusterError is returned when a RequireDualStack service only lists one IP family in spec.ipFamilies,
+// the cluster is then single-stack and no pool can make the service dual-stack
+type SingleStackClusterError struct {
+	Family v1.IPFamily
+}
+
+func (e *SingleStackClusterError) Error() string {
+	return fmt.Sprintf("dual-stack required but the cluster is single-stack, service only has IP family %s", e.Family)
+}
+
+// discoverRequireDualStackDowngrade returns true if require-dual-stack-behavior-global is downgrade
+func discoverRequireDualStackDowngrade(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "require-dual-stack-behavior", RequireDualStackBehaviorFail, RequireDualStackBehaviorDowngrade) == RequireDualStackBehaviorDowngrade
+}
+
+// recordDualStackDowngrade emits a DualStackDowngraded event on a RequireDualStack service that got a single IP
+func recordDualStackDowngrade(service *v1.Service, ipFamilyPolicy *v1.IPFamilyPolicy, ips string) {
+	if ipFamilyPolicy == nil || *ipFamilyPolicy != v1.IPFamilyPolicyRequireDualStack || len(ips) == 0 {
+		return
+	}
+	if addrs, err := parseAddrList(ips); err != nil || len(addrs) != 1 || addrs[0].IsUnspecified() {
+		return
+	}
+	recordEventf(service, v1.EventTypeWarning, "DualStackDowngraded", "RequireDualStack service can't be dual-stack, downgraded to single-stack IP %s", ips)
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func Test_discoverRequireDualStackDowngrade(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "fail",
+			data: map[string]string{"require-dual-stack-behavior-global": "fail"},
+		},
+		{
+			name: "downgrade",
+			data: map[string]string{"require-dual-stack-behavior-global": "downgrade"},
+			want: true,
+		},
+		{
+			name: "unknown value",
+			data: map[string]string{"require-dual-stack-behavior-global": "single"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, discoverRequireDualStackDowngrade(&v1.ConfigMap{Data: tt.data}))
+		})
+	}
+}
+
+func TestSyncLoadBalancerRequireDualStack(t *testing.T) {
+	tests := []struct {
+		name                 string
+		pool                 string
+		families             []v1.IPFamily
+		behavior             string
+		wantIPs              string
+		wantErr              string
+		wantSingleStackError bool
+		wantMismatchError    bool
+		wantEvent            string
+	}{
+		{
+			name:                 "single-stack cluster fails",
+			pool:                 "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+			families:             []v1.IPFamily{v1.IPv4Protocol},
+			wantErr:              "dual-stack required but the cluster is single-stack, service only has IP family IPv4",
+			wantSingleStackError: true,
+		},
+		{
+			name:      "single-stack cluster is downgraded",
+			pool:      "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+			families:  []v1.IPFamily{v1.IPv6Protocol},
+			behavior:  RequireDualStackBehaviorDowngrade,
+			wantIPs:   "fd00::1",
+			wantEvent: "Warning DualStackDowngraded RequireDualStack service can't be dual-stack, downgraded to single-stack IP fd00::1",
+		},
+		{
+			name:              "single-stack pool fails",
+			pool:              "10.0.0.1-10.0.0.3",
+			families:          []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			behavior:          RequireDualStackBehaviorFail,
+			wantErr:           "dual-stack requested but pool has no IPv6 range",
+			wantMismatchError: true,
+		},
+		{
+			name:      "single-stack pool is downgraded to its family",
+			pool:      "fd00::1-fd00::3",
+			families:  []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			behavior:  RequireDualStackBehaviorDowngrade,
+			wantIPs:   "fd00::1",
+			wantEvent: "Warning DualStackDowngraded RequireDualStack service can't be dual-stack, downgraded to single-stack IP fd00::1",
+		},
+		{
+			name:     "dual-stack pool is not downgraded",
+			pool:     "10.0.0.1-10.0.0.3,fd00::1-fd00::3",
+			families: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			behavior: RequireDualStackBehaviorDowngrade,
+			wantIPs:  "10.0.0.1,fd00::1",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			data := map[string]string{"range-global": tt.pool}
+			if len(tt.behavior) > 0 {
+				data["require-dual-stack-behavior-global"] = tt.behavior
+			}
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     tt.families,
+				},
+			}
+			createService(t, client, svc)
+
+			_, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				assert.Contains(t, err.Error(), tt.wantErr)
+				var singleStack *SingleStackClusterError
+				assert.Equal(t, tt.wantSingleStackError, errors.As(err, &singleStack))
+				var mismatch *DualStackPoolMismatchError
+				assert.Equal(t, tt.wantMismatchError, errors.As(err, &mismatch))
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, res.Annotations[LoadbalancerIPsAnnotation])
+			if len(tt.wantEvent) > 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			}
+			assert.Empty(t, recorder.Events)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/utils/set"
+)
+
+const (
+	// SharingDisabledBehaviorDetect only emits an event when a service shares an IP while sharing is disabled, this is the default
+	SharingDisabledBehaviorDetect = "detect"
+
+	// SharingDisabledBehaviorReallocate releases the IPs of a service sharing an IP while sharing is disabled, unless it
+	// is the oldest of the services sharing the IP, the service then gets new IPs from its pool
+	SharingDisabledBehaviorReallocate = "reallocate"
+)
+
+// checkSharedIPs emits a SharingDisabledButSharedIP event if the service shares an IP with other services while
+// allow-share is set to false for its namespace, e.g. after allow-share-global was turned off. The services aren't
+// listed unless allow-share is explicitly false. The IPs requested by a service are never released.
+func checkSharedIPs(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	allowShareStr, _, err := getConfig(controllerCM, service.Namespace, controllerCM.Name, "allow-share", "config")
+	if err != nil {
+		return nil
+	}
+	if allowShare, err := strconv.ParseBool(allowShareStr); err != nil || allowShare {
+		return nil
+	}
+
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		return err
+	}
+
+	var peers []string
+	oldest := true
+	for x := range svcs.Items {
+		peer := &svcs.Items[x]
+		if peer.Namespace == service.Namespace && peer.Name == service.Name {
+			continue
+		}
+		if !sharesAddress(addrs, peer.Annotations[LoadbalancerIPsAnnotation]) {
+			continue
+		}
+		peers = append(peers, peer.Namespace+"/"+peer.Name)
+		if olderService(peer, service) {
+			oldest = false
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	klog.Warningf("service '%s/%s' IPs [%s] are shared with %v while sharing is disabled", service.Namespace, service.Name, ips, peers)
+	if oldest || !discoverSharingDisabledReallocate(controllerCM) || !poolAllocatedStrategies.Has(service.Annotations[AllocationStrategyAnnotationKey]) {
+		recordEventf(service, v1.EventTypeWarning, "SharingDisabledButSharedIP", "IPs [%s] are shared with [%s] while sharing is disabled", ips, strings.Join(peers, ","))
+		return nil
+	}
+
+	recordEventf(service, v1.EventTypeNormal, "SharingDisabledButSharedIP", "Releasing IPs [%s] shared with [%s] to reallocate, sharing is disabled", ips, strings.Join(peers, ","))
+	return releaseForReallocation(ctx, kubeClient, service)
+}
+
+// checkSharedIPPorts releases the IPs of a service sharing an IP with services using the same ports, e.g. after its
+// ports changed, unless it is the oldest of them. The service then gets new IPs from its pool. Static IPs are never
+// released, their conflicts are reported by checkStaticIPPorts.
+func checkSharedIPPorts(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	switch service.Annotations[AllocationStrategyAnnotationKey] {
+	case AllocationStrategyAsc, AllocationStrategyDesc, AllocationStrategyShared:
+	default:
+		return nil
+	}
+	ips := service.Annotations[LoadbalancerIPsAnnotation]
+	addrs, err := parseAddrList(ips)
+	if err != nil {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	allowShareStr, _, err := getConfig(controllerCM, service.Namespace, controllerCM.Name, "allow-share", "config")
+	if err != nil {
+		return nil
+	}
+	if allowShare, _ := strconv.ParseBool(allowShareStr); !allowShare {
+		return nil
+	}
+
+	svcs, err := listInUseServices(ctx, kubeClient, "")
+	if err != nil {
+		return err
+	}
+
+	servicePorts := servicePortSet(service)
+	var peers []string
+	oldest := true
+	for x := range svcs.Items {
+		peer := &svcs.Items[x]
+		if peer.Namespace == service.Namespace && peer.Name == service.Name {
+			continue
+		}
+		if !sharesAddress(addrs, peer.Annotations[LoadbalancerIPsAnnotation]) {
+			continue
+		}
+		if peerPorts := servicePortSet(peer); !portsConflict(servicePorts, peerPorts) && peerPorts.Len() > 0 {
+			continue
+		}
+		peers = append(peers, peer.Namespace+"/"+peer.Name)
+		if olderService(peer, service) {
+			oldest = false
+		}
+	}
+	if len(peers) == 0 || oldest {
+		return nil
+	}
+
+	klog.Warningf("service '%s/%s' IPs [%s] are shared with %v on conflicting ports", service.Namespace, service.Name, ips, peers)
+	recordEventf(service, v1.EventTypeNormal, "SharedIPPortConflict", "Releasing IPs [%s] shared with [%s] on conflicting ports to reallocate", ips, strings.Join(peers, ","))
+	return releaseForReallocation(ctx, kubeClient, service)
+}
+
+// servicePortSet returns the ports of the service
+func servicePortSet(service *v1.Service) set.Set[int32] {
+	ports := set.New[int32]()
+	for p := range service.Spec.Ports {
+		ports.Insert(service.Spec.Ports[p].Port)
+	}
+	return ports
+}
+
+// StaticIPPortConflictError is returned when the static IP of a service is shared by other services on the same ports
+type StaticIPPortConflictError struct {
+	IP    string
+	Ports []int32
+}
+
+func (e *StaticIPPortConflictError) Error() string {
+	if len(e.Ports) == 0 {
+		return fmt.Sprintf("static IP [%s] is used by other services and can't be shared, the service or the services using it define no ports", e.IP)
+	}
+	return fmt.Sprintf("static IP [%s] is used by other services on ports %v", e.IP, e.Ports)
+}
+
+// checkStaticIPPorts returns a StaticIPPortConflictError if a static IP of the service is used by other services on one of
+// its ports while sharing is enabled. With sharing disabled, shared IPs are reported by checkSharedIPs instead.
+func checkStaticIPPorts(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, controllerCM *v1.ConfigMap) error {
+	addrs, err := parseAddrList(service.Annotations[LoadbalancerIPsAnnotation])
+	if err != nil {
+		return nil
+	}
+
+	if controllerCM == nil {
+		return nil
+	}
+	allowShareStr, _, err := getConfig(controllerCM, service.Namespace, controllerCM.Name, "allow-share", "config")
+	if err != nil {
+		return nil
+	}
+	if allowShare, _ := strconv.ParseBool(allowShareStr); !allowShare {
+		return nil
+	}
+
+	svcs, err := kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+	if err != nil {
+		return err
+	}
+	peers := &v1.ServiceList{}
+	for x := range svcs.Items {
+		if svcs.Items[x].Namespace != service.Namespace || svcs.Items[x].Name != service.Name {
+			peers.Items = append(peers.Items, svcs.Items[x])
+		}
+	}
+	_, servicePortMap, err := mapImplementedServices(peers, true)
+	if err != nil {
+		return err
+	}
+
+	servicePorts := servicePortSet(service)
+	for _, addr := range addrs {
+		portSet, ok := servicePortMap[addr.String()]
+		if !ok || !portsConflict(servicePorts, *portSet) {
+			continue
+		}
+		return &StaticIPPortConflictError{IP: addr.String(), Ports: servicePorts.Intersection(*portSet).SortedList()}
+	}
+	return nil
+}
+
+// portsConflict returns true if the ports of a service can't share an address used on portSet, a service without ports
+// accounts for the whole address
+func portsConflict(servicePorts, portSet set.Set[int32]) bool {
+	return servicePorts.Len() == 0 || portSet.Has(0) || servicePorts.Intersection(portSet).Len() > 0
+}
+
+// sharesAddress returns true if the IPs contain one of the addresses, the DHCP address isn't shared
+func sharesAddress(addrs []netip.Addr, ips string) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	peerAddrs, err := parseAddrList(ips)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IsUnspecified() {
+			continue
+		}
+		for _, peerAddr := range peerAddrs {
+			if addr == peerAddr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// olderService returns true if a was created before b, services created at the same time are ordered by namespace/name
+func olderService(a, b *v1.Service) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+}
+
+// discoverSharingDisabledReallocate returns true if sharing-disabled-behavior-global is reallocate
+func discoverSharingDisabledReallocate(cm *v1.ConfigMap) bool {
+	return discoverGlobalEnum(cm, "sharing-disabled-behavior", SharingDisabledBehaviorDetect, SharingDisabledBehaviorReallocate) == SharingDisabledBehaviorReallocate
+}
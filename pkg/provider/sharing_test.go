@@ -0,0 +1,337 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckSharedIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		ips         string
+		strategy    string
+		syncService string
+		expectIPs   map[string]string
+		expectEvent string
+	}{
+		{
+			name:        "shared IP is detected once sharing is disabled",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "false"},
+			ips:         "10.0.0.1",
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.1"},
+			expectEvent: "Warning SharingDisabledButSharedIP IPs [10.0.0.1] are shared with [test/a] while sharing is disabled",
+		},
+		{
+			name:        "shared IP is allowed while sharing is enabled",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "true"},
+			ips:         "10.0.0.1",
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.1"},
+		},
+		{
+			name:        "shared IP is ignored while sharing isn't configured",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "sharing-disabled-behavior-global": SharingDisabledBehaviorReallocate},
+			ips:         "10.0.0.1",
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.1"},
+		},
+		{
+			name:        "DHCP address isn't shared",
+			data:        map[string]string{"cidr-global": "0.0.0.0/32", "allow-share-global": "false"},
+			ips:         "0.0.0.0",
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "0.0.0.0", "b": "0.0.0.0"},
+		},
+		{
+			name:        "newer service sharing the IP is reallocated",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "false", "sharing-disabled-behavior-global": SharingDisabledBehaviorReallocate},
+			ips:         "10.0.0.1",
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": ""},
+			expectEvent: "Normal SharingDisabledButSharedIP Releasing IPs [10.0.0.1] shared with [test/a] to reallocate, sharing is disabled",
+		},
+		{
+			name:        "oldest service sharing the IP keeps it",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "false", "sharing-disabled-behavior-global": SharingDisabledBehaviorReallocate},
+			ips:         "10.0.0.1",
+			syncService: "a",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.1"},
+			expectEvent: "Warning SharingDisabledButSharedIP IPs [10.0.0.1] are shared with [test/b] while sharing is disabled",
+		},
+		{
+			name:        "static IP sharing the IP is kept",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "false", "sharing-disabled-behavior-global": SharingDisabledBehaviorReallocate},
+			ips:         "10.0.0.1",
+			strategy:    AllocationStrategyStatic,
+			syncService: "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.1"},
+			expectEvent: "Warning SharingDisabledButSharedIP IPs [10.0.0.1] are shared with [test/a] while sharing is disabled",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			strategy := tt.strategy
+			if len(strategy) == 0 {
+				strategy = AllocationStrategyShared
+			}
+			// both services were packed on the same IP on different ports while sharing was enabled
+			svcs := map[string]*v1.Service{}
+			for name, port := range map[string]int32{"a": 80, "b": 8080} {
+				svc := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test",
+						Name:      name,
+						Labels:    map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{
+							LoadbalancerIPsAnnotation:       tt.ips,
+							AllocationStrategyAnnotationKey: strategy,
+						},
+					},
+					Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+				}
+				createService(t, client, svc)
+				svcs[name] = svc
+			}
+
+			if _, err := syncLoadBalancer(context.Background(), client, svcs[tt.syncService], KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+				t.Fatalf("syncLoadBalancer() error: %v", err)
+			}
+
+			for name, ips := range tt.expectIPs {
+				res, err := client.CoreV1().Services("test").Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, ips, res.Annotations[LoadbalancerIPsAnnotation], "IPs of service %s", name)
+			}
+
+			if len(tt.expectEvent) == 0 {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Equal(t, tt.expectEvent, <-recorder.Events)
+		})
+	}
+}
+
+func TestCheckStaticIPPorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		ports       []int32
+		expectErr   bool
+		expectEvent string
+	}{
+		{
+			name:  "static IP on a shared address with free ports is accepted",
+			data:  map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "true"},
+			ports: []int32{443},
+		},
+		{
+			name:        "static IP on a shared address with a used port is rejected",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "true"},
+			ports:       []int32{80, 443},
+			expectErr:   true,
+			expectEvent: "Warning StaticIPPortConflict static IP [10.0.0.1] is used by other services on ports [80]",
+		},
+		{
+			name:        "static IP without ports on a shared address is rejected",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "true"},
+			expectErr:   true,
+			expectEvent: "Warning StaticIPPortConflict static IP [10.0.0.1] is used by other services and can't be shared, the service or the services using it define no ports",
+		},
+		{
+			name:        "static IP is only checked for sharing while sharing is disabled",
+			data:        map[string]string{"cidr-global": "10.0.0.1/24", "allow-share-global": "false"},
+			ports:       []int32{80},
+			expectEvent: "Warning SharingDisabledButSharedIP IPs [10.0.0.1] are shared with",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: tt.data,
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// two services already share the address on ports 80 and 8080
+			for name, port := range map[string]int32{"a": 80, "b": 8080} {
+				svc := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "test",
+						Name:        name,
+						Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+						Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
+					},
+					Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+				}
+				createService(t, client, svc)
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "static",
+					Annotations: map[string]string{LoadbalancerIPsAnnotation: "10.0.0.1"},
+				},
+			}
+			for _, port := range tt.ports {
+				svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: port})
+			}
+			createService(t, client, svc)
+
+			res, err := syncService(t, client, svc)
+			if tt.expectErr {
+				var conflictErr *StaticIPPortConflictError
+				assert.ErrorAs(t, err, &conflictErr)
+				assert.Empty(t, res.Labels[ImplementationLabelKey])
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, ImplementationLabelValue, res.Labels[ImplementationLabelKey])
+			}
+
+			if len(tt.expectEvent) == 0 {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Contains(t, <-recorder.Events, tt.expectEvent)
+		})
+	}
+}
+
+func TestCheckSharedIPPorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		changed     string
+		expectIPs   map[string]string
+		expectEvent string
+	}{
+		{
+			name:        "newer service changing to a conflicting port is reallocated",
+			changed:     "b",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.2"},
+			expectEvent: "Normal SharedIPPortConflict Releasing IPs [10.0.0.1] shared with [test/a] on conflicting ports to reallocate",
+		},
+		{
+			name:        "oldest service changing to a conflicting port keeps its IP",
+			changed:     "a",
+			expectIPs:   map[string]string{"a": "10.0.0.1", "b": "10.0.0.2"},
+			expectEvent: "Normal SharedIPPortConflict Releasing IPs [10.0.0.1] shared with [test/a] on conflicting ports to reallocate",
+		},
+	}
+
+	defer func() { eventRecorder = nil }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			cm := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{"range-global": "10.0.0.1-10.0.0.10", "allow-share-global": "true"},
+			}
+			if _, err := client.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			sync := func(name string) {
+				svc, err := client.CoreV1().Services("test").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := syncLoadBalancer(ctx, client, svc, KubeVipClientConfig, KubeVipClientConfigNamespace); err != nil {
+					t.Fatalf("syncLoadBalancer() error: %v", err)
+				}
+			}
+
+			// both services share the IP on different ports
+			for name, port := range map[string]int32{"a": 80, "b": 443} {
+				svc := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name},
+					Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: port}}},
+				}
+				createService(t, client, svc)
+			}
+			sync("a")
+			sync("b")
+
+			// the ports of a service change to conflict with the other one
+			changed, err := client.CoreV1().Services("test").Get(ctx, tt.changed, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed.Spec.Ports = []v1.ServicePort{{Port: 8080}, {Port: map[string]int32{"a": 443, "b": 80}[tt.changed]}}
+			if _, err := client.CoreV1().Services("test").Update(ctx, changed, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			sync("a")
+			sync("b")
+			// the released service gets new IPs on its next sync
+			sync("b")
+
+			for name, ips := range tt.expectIPs {
+				res, err := client.CoreV1().Services("test").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, ips, res.Annotations[LoadbalancerIPsAnnotation], "IPs of service %s", name)
+			}
+
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(recorder.Events))
+			}
+			assert.Equal(t, tt.expectEvent, <-recorder.Events)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	servicehelper "k8s.io/cloud-provider/service/helpers"
+	"k8s.io/klog"
+)
+
+// UninstallCleanup removes the load balancer cleanup finalizer from the services implemented by kube-vip, so they can
+// still be deleted once the controller is uninstalled. The services of other load balancer implementations keep their
+// finalizer. It returns the <namespace>/<name> of the services it cleaned up.
+func UninstallCleanup(ctx context.Context, kubeClient kubernetes.Interface, labelKey string) ([]string, error) {
+	svcs, err := kubeClient.CoreV1().Services(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services: %v", err)
+	}
+
+	var cleaned []string
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if !servicehelper.HasLBFinalizer(svc) || !implementedByKubeVip(svc, labelKey) {
+			continue
+		}
+
+		updated := svc.DeepCopy()
+		updated.ObjectMeta.Finalizers = removeString(updated.ObjectMeta.Finalizers, servicehelper.LoadBalancerCleanupFinalizer)
+		if _, err := servicehelper.PatchService(kubeClient.CoreV1(), svc, updated); err != nil {
+			return cleaned, fmt.Errorf("error removing finalizer from service %s/%s: %v", svc.Namespace, svc.Name, err)
+		}
+		klog.Infof("Removed finalizer from service %s/%s", svc.Namespace, svc.Name)
+		cleaned = append(cleaned, svc.Namespace+"/"+svc.Name)
+	}
+	return cleaned, nil
+}
+
+// implementedByKubeVip returns true if the service has the implementation label or a loadBalancerClass of kube-vip,
+// the default or the custom one
+func implementedByKubeVip(svc *v1.Service, labelKey string) bool {
+	if svc.Labels[labelKey] == ImplementationLabelValue {
+		return true
+	}
+	return svc.Spec.LoadBalancerClass != nil &&
+		(*svc.Spec.LoadBalancerClass == LoadbalancerClass || *svc.Spec.LoadBalancerClass == loadbalancerClassName)
+}
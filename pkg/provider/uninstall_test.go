@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	servicehelper "k8s.io/cloud-provider/service/helpers"
+	"k8s.io/utils/ptr"
+)
+
+func TestUninstallCleanup(t *testing.T) {
+	otherFinalizer := "example.com/protect"
+	services := []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "labeled",
+				Labels:     map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+				Finalizers: []string{servicehelper.LoadBalancerCleanupFinalizer, otherFinalizer}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "class",
+				Finalizers: []string{servicehelper.LoadBalancerCleanupFinalizer}},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerClass: ptr.To(LoadbalancerClass)},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "foreign",
+				Finalizers: []string{servicehelper.LoadBalancerCleanupFinalizer}},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerClass: ptr.To("example.com/other")},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "no-finalizer",
+				Labels: map[string]string{ImplementationLabelKey: ImplementationLabelValue}},
+		},
+	}
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	for _, svc := range services {
+		createService(t, client, svc)
+	}
+
+	cleaned, err := UninstallCleanup(ctx, client, ImplementationLabelKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"team-a/labeled", "team-b/class"}, cleaned)
+
+	finalizers := map[string][]string{}
+	for _, svc := range services {
+		res, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		finalizers[svc.Namespace+"/"+svc.Name] = res.Finalizers
+	}
+	assert.Equal(t, []string{otherFinalizer}, finalizers["team-a/labeled"])
+	assert.Empty(t, finalizers["team-b/class"])
+	assert.Equal(t, []string{servicehelper.LoadBalancerCleanupFinalizer}, finalizers["team-a/foreign"])
+	assert.Empty(t, finalizers["team-a/no-finalizer"])
+
+	// a second run has nothing left to clean up
+	cleaned, err = UninstallCleanup(ctx, client, ImplementationLabelKey)
+	assert.NoError(t, err)
+	assert.Empty(t, cleaned)
+}
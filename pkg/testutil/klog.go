@@ -0,0 +1,30 @@
+package testutil
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"testing"
+
+	"k8s.io/klog"
+)
+
+// CaptureKlog redirects klog to a buffer at the given verbosity until the returned func is called. klog writes the
+// warnings and errors to the INFO output too, only that output is captured so every line shows once.
+func CaptureKlog(t *testing.T, verbosity string) (*bytes.Buffer, func()) {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	for name, value := range map[string]string{"v": verbosity, "logtostderr": "false", "alsologtostderr": "false"} {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatalf("failed to set klog flag %s: %v", name, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	klog.SetOutput(io.Discard)
+	klog.SetOutputBySeverity("INFO", buf)
+	return buf, func() {
+		klog.Flush()
+		_ = fs.Set("v", "0")
+		_ = fs.Set("logtostderr", "true")
+	}
+}
@@ -107,6 +107,16 @@ func TweakSetLoadbalancerIP(ip string) ServiceTweak {
 	}
 }
 
+// TweakAddAnnotation returns a func that adds an annotation to a service
+func TweakAddAnnotation(key, value string) ServiceTweak {
+	return func(s *corev1.Service) {
+		if s.Annotations == nil {
+			s.Annotations = map[string]string{}
+		}
+		s.Annotations[key] = value
+	}
+}
+
 func ipFamilyPolicyPtr(p corev1.IPFamilyPolicy) *corev1.IPFamilyPolicy {
 	return &p
 }
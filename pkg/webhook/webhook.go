@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// AllocationWebhookURLEnvKey environment key for the URL allocation changes are posted to
+	AllocationWebhookURLEnvKey = "KUBEVIP_ALLOCATION_WEBHOOK_URL"
+
+	// ActionAllocate is the action sent when IPs are assigned to a service
+	ActionAllocate = "allocate"
+
+	// ActionRelease is the action sent when the IPs of a deleted service are released
+	ActionRelease = "release"
+
+	// QueueSize is the number of payloads waiting to be sent above which the new ones are dropped
+	QueueSize = 1000
+)
+
+// Payload is the JSON body posted to the webhook
+type Payload struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	IP        string `json:"ip"`
+	Action    string `json:"action"`
+}
+
+// Notifier posts allocation changes to an external webhook
+type Notifier struct {
+	url     string
+	client  *http.Client
+	backoff wait.Backoff
+	// queue holds the payloads waiting to be sent, a single worker sends them in order so the release of an IP never
+	// lands after its next allocation
+	queue chan Payload
+	start sync.Once
+}
+
+// NewNotifier returns a Notifier posting to the given URL
+func NewNotifier(webhookURL string) (*Notifier, error) {
+	u, err := url.ParseRequestURI(webhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url [%s]: %v", webhookURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook url [%s]: scheme must be http or https", webhookURL)
+	}
+	return &Notifier{
+		url:    webhookURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		backoff: wait.Backoff{
+			Duration: 500 * time.Millisecond,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    5,
+		},
+		queue: make(chan Payload, QueueSize),
+	}, nil
+}
+
+// Notify queues the payload to be posted in the background so it never blocks reconciliation, the payloads are posted
+// in order and failed posts are retried with backoff. The payload is dropped if QueueSize payloads are already waiting.
+// It's a no-op on a nil Notifier.
+func (n *Notifier) Notify(p Payload) {
+	if n == nil {
+		return
+	}
+	n.start.Do(func() { go n.run() })
+	select {
+	case n.queue <- p:
+	default:
+		klog.Errorf("webhook queue is full, dropping %s of [%s] for service [%s/%s]", p.Action, p.IP, p.Namespace, p.Service)
+	}
+}
+
+// run sends the queued payloads one at a time
+func (n *Notifier) run() {
+	for p := range n.queue {
+		if err := n.send(p); err != nil {
+			klog.Errorf("unable to send %s of [%s] for service [%s/%s] to webhook: %v", p.Action, p.IP, p.Namespace, p.Service, err)
+		}
+	}
+}
+
+func (n *Notifier) send(p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	err = wait.ExponentialBackoff(n.backoff, func() (bool, error) {
+		resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			lastErr = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			return false, nil
+		}
+		return true, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
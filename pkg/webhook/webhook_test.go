@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{name: "http url", url: "http://ipam.example.com/allocations"},
+		{name: "https url", url: "https://ipam.example.com/allocations"},
+		{name: "missing scheme", url: "ipam.example.com/allocations", wantErr: true},
+		{name: "unsupported scheme", url: "ftp://ipam.example.com/allocations", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewNotifier(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewNotifier() error: %v, expected: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	var calls int32
+	received := make(chan Payload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first two attempts
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 5}
+
+	want := Payload{Service: "svc", Namespace: "default", IP: "10.0.0.1", Action: ActionAllocate}
+	n.Notify(want)
+
+	select {
+	case got := <-received:
+		assert.Equal(t, want, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook didn't receive the payload")
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestNotifyKeepsOrder(t *testing.T) {
+	var calls int32
+	received := make(chan Payload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the release fails twice, the allocation queued after it must wait for its retries
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1, Steps: 5}
+
+	release := Payload{Service: "old", Namespace: "default", IP: "10.0.0.1", Action: ActionRelease}
+	allocate := Payload{Service: "new", Namespace: "default", IP: "10.0.0.1", Action: ActionAllocate}
+	n.Notify(release)
+	n.Notify(allocate)
+
+	for _, want := range []Payload{release, allocate} {
+		select {
+		case got := <-received:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook didn't receive the payload")
+		}
+	}
+}
+
+func TestNotifyDropsWhenQueueIsFull(t *testing.T) {
+	sending := make(chan struct{})
+	unblock := make(chan struct{})
+	received := make(chan Payload, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		if p.IP == "10.0.0.1" {
+			close(sending)
+			<-unblock
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.queue = make(chan Payload, 1)
+
+	n.Notify(Payload{IP: "10.0.0.1", Action: ActionAllocate})
+	<-sending
+	// one payload waits while the first is sent, the next one is dropped
+	n.Notify(Payload{IP: "10.0.0.2", Action: ActionAllocate})
+	n.Notify(Payload{IP: "10.0.0.3", Action: ActionAllocate})
+	close(unblock)
+
+	var got []string
+	for range 2 {
+		select {
+		case p := <-received:
+			got = append(got, p.IP)
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook didn't receive the payload")
+		}
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, got)
+	select {
+	case p := <-received:
+		t.Errorf("dropped payload %v was sent", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 2}
+
+	assert.Error(t, n.send(Payload{Service: "svc", Namespace: "default", IP: "10.0.0.1", Action: ActionRelease}))
+}
+
+func TestNotifyNilNotifier(_ *testing.T) {
+	var n *Notifier
+	n.Notify(Payload{})
+}